@@ -12,6 +12,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/botherder/go-savetime/hashes"
@@ -23,6 +24,55 @@ import (
 	"github.com/mvt-project/androidqf/utils"
 )
 
+// BuildInfo contains the build properties of forensic interest.
+type BuildInfo struct {
+	Fingerprint string `json:"fingerprint"`
+	Release     string `json:"release"`
+	Debuggable  string `json:"debuggable"`
+	Secure      string `json:"secure"`
+	USBConfig   string `json:"usb_config"`
+}
+
+// DeviceInfo is a summary of the device properties.
+type DeviceInfo struct {
+	AndroidVersion string `json:"android_version"`
+	SecurityPatch  string `json:"security_patch"`
+	Fingerprint    string `json:"fingerprint"`
+	Manufacturer   string `json:"manufacturer"`
+	Model          string `json:"model"`
+	Serial         string `json:"serial"`
+}
+
+// KernelVersion contains the details of the kernel parsed from /proc/version.
+type KernelVersion struct {
+	Version    string `json:"version"`
+	GCCVersion string `json:"gcc_version"`
+	BuildDate  string `json:"build_date"`
+}
+
+// SELinuxStatus contains the SELinux state of the device.
+type SELinuxStatus struct {
+	Mode          string `json:"mode"`
+	Context       string `json:"context"`
+	PolicyVersion string `json:"policy_version"`
+	PolicyHash    string `json:"policy_hash"`
+	// Enforce and KernelPolicyVersion are read from /sys/fs/selinux.
+	Enforce             string `json:"enforce"`
+	KernelPolicyVersion string `json:"kernel_policy_version"`
+	// LoadedPolicySHA256 is the hash of the loaded policy, only readable as
+	// root.
+	LoadedPolicySHA256 string            `json:"loaded_policy_sha256"`
+	VerifiedBoot       map[string]string `json:"verified_boot"`
+}
+
+// Policies for the download of copies of the installed packages.
+const (
+	DownloadAll        = "all"
+	DownloadThirdParty = "third-party"
+	DownloadNotSystem  = "non-system"
+	DownloadNone       = "none"
+)
+
 // Acquisition is the main object containing all phone information
 type Acquisition struct {
 	UUID             string         `json:"uuid"`
@@ -34,6 +84,92 @@ type Acquisition struct {
 	TmpDir           string         `json:"tmp_dir"`
 	SdCard           string         `json:"sdcard"`
 	Cpu              string         `json:"cpu"`
+	PullAPKs         bool           `json:"pull_apks"`
+	// ParseManifests decodes the manifests of the downloaded packages.
+	ParseManifests bool `json:"parse_manifests"`
+	// DownloadPolicy selects the packages whose files are downloaded, one
+	// of the Download* values. When empty, the user is prompted.
+	DownloadPolicy string `json:"download_policy"`
+	// MaxAPKSize is the size in bytes above which the files of a package
+	// are not downloaded, 0 for no limit.
+	MaxAPKSize int64 `json:"max_apk_size"`
+	// MaxCrashDumpsSize is the total size in bytes of the tombstones and
+	// ANR traces pulled, 0 for no limit.
+	MaxCrashDumpsSize int64    `json:"max_crash_dumps_size"`
+	CompletedModules  []string `json:"completed_modules"`
+	// OperatorNotes are free-text notes of the operator, recorded in the
+	// acquisition metadata.
+	OperatorNotes string `json:"operator_notes"`
+	// MetadataSHA256 is the hash of acquisition_start.json, recorded
+	// along with the output of every module and in the manifest.
+	MetadataSHA256 string `json:"metadata_sha256"`
+	// SkippedModules were not selected to run.
+	SkippedModules []string `json:"skipped_modules"`
+	// BaselinePath is the apex_modules.json of a reference acquisition of
+	// the factory image, to compare the APEX modules against.
+	BaselinePath string `json:"baseline_path"`
+	// Resumed is set when the acquisition reused the folder of a previous
+	// one.
+	Resumed bool `json:"resumed"`
+	// LogcatLines limits the lines collected from the individual logcat
+	// buffers, 0 for no limit. The capture of all the buffers is complete.
+	LogcatLines int `json:"logcat_lines"`
+	// DropboxDays is how many days back dropbox entries are saved, 0 for all
+	// of them.
+	DropboxDays int `json:"dropbox_days"`
+	// MaxDropboxSize is the total size in bytes of the dropbox entries
+	// saved, 0 for no limit.
+	MaxDropboxSize int64 `json:"max_dropbox_size"`
+	// RedactContent replaces the content of messages with its SHA-256.
+	RedactContent bool `json:"redact_content"`
+	// RedactEmails replaces the local part of account email addresses with
+	// its SHA-256.
+	RedactEmails bool `json:"redact_emails"`
+	// RedactIdentifiers replaces the IMEI, IMSI and ICCID with their
+	// SHA-256.
+	RedactIdentifiers bool `json:"redact_identifiers"`
+	// EncryptionKeyPath is the public key the acquisition is encrypted with
+	// once completed. When empty, the key.txt next to the executable is used
+	// if present.
+	EncryptionKeyPath string `json:"encryption_key_path"`
+	// SignKeyPath is the private key the manifest of the files is signed
+	// with.
+	SignKeyPath string `json:"sign_key_path"`
+	// ZipOutput replaces the acquisition folder with a zip archive once
+	// completed.
+	ZipOutput bool `json:"zip_output"`
+	// IncludeCredentials disables the redaction of stored credentials.
+	IncludeCredentials bool           `json:"include_credentials"`
+	RootUsed           bool           `json:"root_used"`
+	RootMethod         string         `json:"root_method"`
+	BuildInfo          *BuildInfo     `json:"build_info,omitempty"`
+	Device             *DeviceInfo    `json:"device,omitempty"`
+	KernelVersion      *KernelVersion `json:"kernel_version,omitempty"`
+	SELinux            *SELinuxStatus `json:"selinux,omitempty"`
+	// RootIndicators is the number of traces of rooting found.
+	RootIndicators int `json:"root_indicators"`
+	// Warnings are the high-severity findings to report in the summary.
+	Warnings []string `json:"warnings"`
+	// Findings are the values in the output of the modules matching the
+	// indicators loaded.
+	Findings []Finding `json:"-"`
+	// Progress reports the advancement of the running module.
+	Progress Progress `json:"-"`
+	// Packages collected during this acquisition, shared between modules.
+	Packages []adb.Package `json:"-"`
+	// ProcNet caches the content of the /proc/net socket tables read by the
+	// modules, keyed by protocol.
+	ProcNet map[string]string `json:"-"`
+	// Properties are the system properties parsed by the getprop module.
+	Properties map[string]string `json:"-"`
+
+	serial        string
+	files         map[string]fileState
+	checkpoint    Checkpoint
+	noCheckpoints bool
+	// mutex protects the warnings and the checkpoint from modules running
+	// concurrently.
+	mutex sync.Mutex
 }
 
 // New returns a new Acquisition instance.
@@ -42,6 +178,7 @@ func New(path string) (*Acquisition, error) {
 		UUID:             uuid.New().String(),
 		Started:          time.Now().UTC(),
 		AndroidQFVersion: utils.Version,
+		Progress:         NoopProgress{},
 	}
 
 	if path == "" {
@@ -68,6 +205,9 @@ func New(path string) (*Acquisition, error) {
 		return nil, err
 	}
 
+	// Continue from the checkpoint of a previous run in the same folder.
+	acq.loadCheckpoint()
+
 	coll, err := adb.Client.GetCollector(acq.TmpDir, acq.Cpu)
 	if err != nil {
 		// Collector install failed, will use find instead
@@ -82,9 +222,73 @@ func New(path string) (*Acquisition, error) {
 	return &acq, nil
 }
 
+// LatestPath returns the most recent acquisition folder created next to the
+// executable, recognized by its UUID name and its command.log.
+func LatestPath() (string, error) {
+	dir := rt.GetExecutableDirectory()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to list acquisition folders: %v", err)
+	}
+
+	latest := ""
+	var latestTime time.Time
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := uuid.Parse(entry.Name()); err != nil {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(dir, entry.Name(), "command.log"))
+		if err != nil {
+			continue
+		}
+		if latest == "" || info.ModTime().After(latestTime) {
+			latest = filepath.Join(dir, entry.Name())
+			latestTime = info.ModTime()
+		}
+	}
+	if latest == "" {
+		return "", fmt.Errorf("no previous acquisition found in %s", dir)
+	}
+
+	return latest, nil
+}
+
+// Resume returns a new Acquisition storing its data in the folder of a
+// previous one, by default the most recent. Its UUID is kept.
+func Resume(path string) (*Acquisition, error) {
+	if path == "" {
+		var err error
+		path, err = LatestPath()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	acq, err := New(path)
+	if err != nil {
+		return nil, err
+	}
+	acq.Resumed = true
+	if _, err := uuid.Parse(filepath.Base(path)); err == nil {
+		acq.UUID = filepath.Base(path)
+	}
+	log.Infof("Resuming acquisition in %s", acq.StoragePath)
+
+	return acq, nil
+}
+
 func (a *Acquisition) Complete() {
 	a.Completed = time.Now().UTC()
 
+	// Record whether any data was collected with root privileges.
+	a.RootUsed = adb.Client.RootUsed()
+	if a.RootUsed {
+		a.RootMethod = adb.Client.RootMethod()
+	}
+
 	if a.Collector != nil {
 		a.Collector.Clean()
 	}
@@ -94,6 +298,52 @@ func (a *Acquisition) Complete() {
 	assets.CleanAssets()
 }
 
+// AddWarning logs a high-severity finding and records it so it is reported
+// in the acquisition summary.
+func (a *Acquisition) AddWarning(format string, v ...any) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.addWarning(format, v...)
+}
+
+// addWarning is AddWarning for callers already holding the mutex.
+func (a *Acquisition) addWarning(format string, v ...any) {
+	msg := fmt.Sprintf(format, v...)
+	log.Warning(msg)
+	a.Warnings = append(a.Warnings, msg)
+}
+
+// ModuleCompleted records that the module ran successfully, saves it in the
+// acquisition checkpoint, and checks its output against the indicators. The
+// files of the module are those written since the previous module
+// completed. With checkpoints disabled, they are only checked once all the
+// modules are done.
+func (a *Acquisition) ModuleCompleted(name string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.CompletedModules = append(a.CompletedModules, name)
+	if a.noCheckpoints {
+		return
+	}
+	module := a.moduleFiles(name)
+	if err := a.saveCheckpoint(module); err != nil {
+		log.Warningf("Failed to save the acquisition checkpoint: %v", err)
+	}
+	if err := a.checkIOCs(module); err != nil {
+		log.Warningf("Failed to check the output of module %s against the indicators: %v", name, err)
+	}
+}
+
+// IsModuleCompleted checks whether the module already ran successfully.
+func (a *Acquisition) IsModuleCompleted(name string) bool {
+	for _, completed := range a.CompletedModules {
+		if completed == name {
+			return true
+		}
+	}
+	return false
+}
+
 func (a *Acquisition) GetSystemInformation() error {
 	// Get architecture information
 	out, err := adb.Client.Shell("getprop ro.product.cpu.abi")
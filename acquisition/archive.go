@@ -0,0 +1,169 @@
+// androidqf - Android Quick Forensics
+// Copyright (c) 2021-2022 Claudio Guarnieri.
+// Use of this software is governed by the MVT License 1.1 that can be found at
+//   https://license.mvt.re/1.1/
+
+package acquisition
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/mvt-project/androidqf/log"
+)
+
+// ManifestEntry describes a file stored in the acquisition archive.
+type ManifestEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// hashWriter wraps the writer of an archive entry to compute the size and
+// the SHA-256 of the data written to it.
+type hashWriter struct {
+	w    io.Writer
+	hash hash.Hash
+	size int64
+}
+
+func newHashWriter(w io.Writer) *hashWriter {
+	return &hashWriter{w: w, hash: sha256.New()}
+}
+
+func (h *hashWriter) Write(p []byte) (int, error) {
+	n, err := h.w.Write(p)
+	h.hash.Write(p[:n])
+	h.size += int64(n)
+	return n, err
+}
+
+func (h *hashWriter) Sum() string {
+	return hex.EncodeToString(h.hash.Sum(nil))
+}
+
+// writeArchive compresses the acquisition folder to a zip file at zipPath.
+// The files are stored in a folder named after the acquisition folder, next
+// to a manifest.json listing them with their size and SHA-256.
+func (a *Acquisition) writeArchive(zipPath string) error {
+	zipFile, err := os.Create(zipPath)
+	if err != nil {
+		return err
+	}
+	defer zipFile.Close()
+
+	archive := zip.NewWriter(zipFile)
+	baseDir := filepath.Base(a.StoragePath)
+
+	manifest := []ManifestEntry{}
+	err = filepath.Walk(a.StoragePath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(a.StoragePath, filePath)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = path.Join(baseDir, relPath)
+		header.Method = zip.Deflate
+
+		entry, err := archive.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+
+		file, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		w := newHashWriter(entry)
+		if _, err := io.Copy(w, file); err != nil {
+			return err
+		}
+
+		manifest = append(manifest, ManifestEntry{
+			Path:   relPath,
+			Size:   w.size,
+			SHA256: w.Sum(),
+		})
+		return nil
+	})
+	if err != nil {
+		archive.Close()
+		return fmt.Errorf("failed to compress the acquisition folder: %v", err)
+	}
+
+	manifestData, err := json.MarshalIndent(manifest, "", " ")
+	if err != nil {
+		archive.Close()
+		return fmt.Errorf("failed to json marshal the archive manifest: %v", err)
+	}
+	entry, err := archive.CreateHeader(&zip.FileHeader{
+		Name:     "manifest.json",
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		archive.Close()
+		return err
+	}
+	if _, err := entry.Write(manifestData); err != nil {
+		archive.Close()
+		return err
+	}
+
+	if err := archive.Close(); err != nil {
+		return fmt.Errorf("failed to finalize the archive: %v", err)
+	}
+	return zipFile.Close()
+}
+
+// StoreArchive replaces the acquisition folder with a zip archive of it,
+// when ZipOutput is enabled and the folder was not already encrypted.
+func (a *Acquisition) StoreArchive() error {
+	if !a.ZipOutput {
+		return nil
+	}
+	if _, err := os.Stat(a.StoragePath); os.IsNotExist(err) {
+		return nil
+	}
+
+	zipFilePath := a.StoragePath + ".zip"
+	log.Infof("Compressing the acquisition folder to %s. This might take a while...", zipFilePath)
+
+	err := a.writeArchive(zipFilePath)
+	if err != nil {
+		return err
+	}
+
+	// The log file is still open and would prevent the deletion on Windows.
+	log.DisableFileLog()
+	err = os.RemoveAll(a.StoragePath)
+	if err != nil {
+		return fmt.Errorf("failed to delete the acquisition folder: %v", err)
+	}
+
+	log.Infof("Acquisition successfully stored at %s", zipFilePath)
+	return nil
+}
@@ -0,0 +1,207 @@
+// androidqf - Android Quick Forensics
+// Copyright (c) 2021-2022 Claudio Guarnieri.
+// Use of this software is governed by the MVT License 1.1 that can be found at
+//   https://license.mvt.re/1.1/
+
+package acquisition
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/botherder/go-savetime/hashes"
+	"github.com/mvt-project/androidqf/adb"
+	"github.com/mvt-project/androidqf/log"
+)
+
+const checkpointFileName = "acquisition.checkpoint.json"
+
+// CheckpointFile is a file written by a module.
+type CheckpointFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// CheckpointModule is a module which completed successfully, with the files
+// it wrote.
+type CheckpointModule struct {
+	Name string `json:"name"`
+	// MetadataSHA256 chains the output of the module to the acquisition
+	// metadata.
+	MetadataSHA256 string           `json:"metadata_sha256"`
+	Files          []CheckpointFile `json:"files"`
+}
+
+// Checkpoint records the progress of an acquisition, so that it can be
+// continued after an interruption.
+type Checkpoint struct {
+	UUID    string             `json:"uuid"`
+	Serial  string             `json:"serial"`
+	Updated time.Time          `json:"updated"`
+	Modules []CheckpointModule `json:"modules"`
+}
+
+// fileState is the size and modification time of a file, to find the files
+// written by a module.
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// deviceSerial returns the serial number of the device, which unlike the
+// adb serial does not change when connected over wireless debugging.
+func deviceSerial() string {
+	out, err := adb.Client.Shell("getprop", "ro.serialno")
+	if err != nil {
+		log.Debugf("Failed to get the serial number of the device: %v", err)
+		return ""
+	}
+	return out
+}
+
+// scanFiles returns the state of the files in the acquisition folder.
+func (a *Acquisition) scanFiles() map[string]fileState {
+	files := make(map[string]fileState)
+	_ = filepath.Walk(a.StoragePath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(a.StoragePath, filePath)
+		if err != nil || relPath == checkpointFileName || relPath == metadataFileName || relPath == startFileName ||
+			relPath == findingsFileName || relPath == "command.log" {
+			return nil
+		}
+		files[relPath] = fileState{size: info.Size(), modTime: info.ModTime()}
+		return nil
+	})
+	return files
+}
+
+// loadCheckpoint restores the completed modules from the checkpoint of a
+// previous run in the acquisition folder. The checkpoint is ignored if it
+// was made on another device, and a module is run again if its files were
+// modified.
+func (a *Acquisition) loadCheckpoint() {
+	a.serial = deviceSerial()
+	a.files = a.scanFiles()
+
+	data, err := os.ReadFile(filepath.Join(a.StoragePath, checkpointFileName))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warningf("Failed to read the acquisition checkpoint: %v", err)
+		}
+		return
+	}
+
+	var checkpoint Checkpoint
+	err = json.Unmarshal(data, &checkpoint)
+	if err != nil {
+		log.Warningf("Ignoring invalid acquisition checkpoint: %v", err)
+		return
+	}
+	if checkpoint.Serial != a.serial {
+		log.Warningf("Ignoring the acquisition checkpoint made on the device with serial %q", checkpoint.Serial)
+		return
+	}
+
+	for _, module := range checkpoint.Modules {
+		valid := true
+		for _, file := range module.Files {
+			state, ok := a.files[filepath.FromSlash(file.Path)]
+			if ok && state.size == file.Size {
+				sha256, err := hashes.FileSHA256(filepath.Join(a.StoragePath, filepath.FromSlash(file.Path)))
+				ok = err == nil && sha256 == file.SHA256
+			}
+			if !ok {
+				log.Infof("File %s of module %s is missing or was modified, running it again", file.Path, module.Name)
+				valid = false
+				break
+			}
+		}
+		if !valid {
+			continue
+		}
+		a.checkpoint.Modules = append(a.checkpoint.Modules, module)
+		a.CompletedModules = append(a.CompletedModules, module.Name)
+	}
+	if len(a.CompletedModules) > 0 {
+		a.UUID = checkpoint.UUID
+		a.Resumed = true
+		log.Infof("Resuming acquisition, skipping %d modules already completed", len(a.CompletedModules))
+	}
+}
+
+// moduleFiles returns the module along with the files written since the
+// previous module completed.
+func (a *Acquisition) moduleFiles(name string) CheckpointModule {
+	module := CheckpointModule{
+		Name:           name,
+		MetadataSHA256: a.MetadataSHA256,
+		Files:          []CheckpointFile{},
+	}
+	files := a.scanFiles()
+	for path, state := range files {
+		if previous, ok := a.files[path]; ok && previous == state {
+			continue
+		}
+		sha256, err := hashes.FileSHA256(filepath.Join(a.StoragePath, path))
+		if err != nil {
+			log.Debugf("Failed to hash %s: %v", path, err)
+		}
+		module.Files = append(module.Files, CheckpointFile{
+			Path:   filepath.ToSlash(path),
+			Size:   state.size,
+			SHA256: sha256,
+		})
+	}
+	a.files = files
+
+	return module
+}
+
+// DisableCheckpoints stops recording the completed modules. The files can
+// only be attributed to the module which wrote them when modules run one
+// after the other, so this is needed when they run concurrently.
+func (a *Acquisition) DisableCheckpoints() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.noCheckpoints = true
+}
+
+// ForgetModule removes the module from the completed ones, so that it is
+// run again.
+func (a *Acquisition) ForgetModule(name string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for i, completed := range a.CompletedModules {
+		if completed == name {
+			a.CompletedModules = append(a.CompletedModules[:i], a.CompletedModules[i+1:]...)
+			break
+		}
+	}
+	for i, module := range a.checkpoint.Modules {
+		if module.Name == name {
+			a.checkpoint.Modules = append(a.checkpoint.Modules[:i], a.checkpoint.Modules[i+1:]...)
+			break
+		}
+	}
+}
+
+// saveCheckpoint records the module as completed, and writes the checkpoint
+// to the acquisition folder.
+func (a *Acquisition) saveCheckpoint(module CheckpointModule) error {
+	a.checkpoint.UUID = a.UUID
+	a.checkpoint.Serial = a.serial
+	a.checkpoint.Updated = time.Now().UTC()
+	a.checkpoint.Modules = append(a.checkpoint.Modules, module)
+
+	data, err := json.MarshalIndent(&a.checkpoint, "", " ")
+	if err != nil {
+		return fmt.Errorf("failed to json marshal the acquisition checkpoint: %v", err)
+	}
+	return os.WriteFile(filepath.Join(a.StoragePath, checkpointFileName), data, 0o644)
+}
@@ -0,0 +1,155 @@
+// androidqf - Android Quick Forensics
+// Copyright (c) 2021-2022 Claudio Guarnieri.
+// Use of this software is governed by the MVT License 1.1 that can be found at
+//   https://license.mvt.re/1.1/
+
+package acquisition
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mvt-project/androidqf/utils"
+)
+
+const findingsFileName = "findings.json"
+
+var (
+	sha256Regexp = regexp.MustCompile(`^[a-fA-F0-9]{64}$`)
+	ipv4Regexp   = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+	urlRegexp    = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^\s"'<>]+`)
+	domainRegexp = regexp.MustCompile(`^(?i)[a-z0-9-]+(?:\.[a-z0-9-]+)+$`)
+)
+
+// Finding is a value in the output of a module matching an indicator.
+type Finding struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+	// Name is the name of the malware the indicator is related to.
+	Name    string `json:"name"`
+	IOCFile string `json:"ioc_file"`
+	Module  string `json:"module"`
+	File    string `json:"file"`
+	// Artifact is the path of the value in the JSON file, as in
+	// "[3].name".
+	Artifact string `json:"artifact"`
+}
+
+// matchValue returns the indicators matching the value, which might be a
+// package name, a SHA-256 hash, or contain domains and IPv4 addresses.
+func matchValue(value string) []utils.IOC {
+	matches := []utils.IOC{}
+	add := func(iocType, value string) {
+		if ioc, ok := utils.MatchIOC(iocType, value); ok {
+			matches = append(matches, ioc)
+		}
+	}
+
+	add(utils.IOCAppID, value)
+	if sha256Regexp.MatchString(value) {
+		add(utils.IOCSHA256, value)
+	}
+	if domainRegexp.MatchString(value) {
+		add(utils.IOCDomain, value)
+	}
+	for _, rawURL := range urlRegexp.FindAllString(value, -1) {
+		if domain := utils.URLDomain(rawURL); domain != "" {
+			add(utils.IOCDomain, domain)
+		}
+	}
+	for _, ip := range ipv4Regexp.FindAllString(value, -1) {
+		add(utils.IOCIPv4, ip)
+	}
+
+	return matches
+}
+
+// walkJSON calls fn with every string in the decoded JSON value, along with
+// its path.
+func walkJSON(value any, jsonPath string, fn func(jsonPath, value string)) {
+	switch v := value.(type) {
+	case string:
+		fn(jsonPath, v)
+	case []any:
+		for i, item := range v {
+			walkJSON(item, fmt.Sprintf("%s[%d]", jsonPath, i), fn)
+		}
+	case map[string]any:
+		for key, item := range v {
+			// Keys are package names in some outputs.
+			fn(jsonPath, key)
+			walkJSON(item, strings.TrimPrefix(jsonPath+"."+key, "."), fn)
+		}
+	}
+}
+
+// checkIOCs scans the JSON files written by the module for values matching
+// the indicators loaded, and adds them to findings.json. The caller holds
+// the mutex.
+func (a *Acquisition) checkIOCs(module CheckpointModule) error {
+	if !utils.HasIOCs() {
+		return nil
+	}
+
+	added := 0
+	for _, file := range module.Files {
+		if path.Ext(file.Path) != ".json" {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(a.StoragePath, filepath.FromSlash(file.Path)))
+		if err != nil {
+			return err
+		}
+		var decoded any
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			continue
+		}
+
+		seen := make(map[string]bool)
+		walkJSON(decoded, "", func(jsonPath, value string) {
+			for _, ioc := range matchValue(value) {
+				key := ioc.Type + ":" + ioc.Value + ":" + jsonPath
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+
+				description := ioc.Value
+				if ioc.Name != "" {
+					description = fmt.Sprintf("%s (%s)", ioc.Value, ioc.Name)
+				}
+				if module.Name == "" {
+					a.addWarning("Output %s matches the %s indicator %s", file.Path, ioc.Type, description)
+				} else {
+					a.addWarning("Output %s of module %s matches the %s indicator %s",
+						file.Path, module.Name, ioc.Type, description)
+				}
+				a.Findings = append(a.Findings, Finding{
+					Type:     ioc.Type,
+					Value:    ioc.Value,
+					Name:     ioc.Name,
+					IOCFile:  ioc.File,
+					Module:   module.Name,
+					File:     file.Path,
+					Artifact: jsonPath,
+				})
+				added++
+			}
+		})
+	}
+	if added == 0 {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(a.Findings, "", " ")
+	if err != nil {
+		return fmt.Errorf("failed to json marshal the findings: %v", err)
+	}
+	return os.WriteFile(filepath.Join(a.StoragePath, findingsFileName), data, 0o644)
+}
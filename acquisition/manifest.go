@@ -0,0 +1,168 @@
+// androidqf - Android Quick Forensics
+// Copyright (c) 2021-2022 Claudio Guarnieri.
+// Use of this software is governed by the MVT License 1.1 that can be found at
+//   https://license.mvt.re/1.1/
+
+package acquisition
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/botherder/go-savetime/hashes"
+	"github.com/mvt-project/androidqf/log"
+)
+
+const (
+	manifestFileName  = "manifest.sha256"
+	signatureFileName = "manifest.sha256.sig"
+)
+
+// LoadSigningKey reads a PEM encoded RSA, ECDSA or Ed25519 private key.
+func LoadSigningKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+
+	var key any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %v", err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+// StoreManifest writes manifest.sha256, listing the hash and the relative
+// path of every file in the acquisition folder in the format of sha256sum,
+// so that it can be verified with `sha256sum -c manifest.sha256`. If a
+// signing key was provided, the manifest is signed to manifest.sha256.sig.
+func (a *Acquisition) StoreManifest() error {
+	log.Info("Generating the manifest of the acquisition files...")
+
+	paths := []string{}
+	sums := make(map[string]string)
+	err := filepath.Walk(a.StoragePath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(a.StoragePath, filePath)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		if relPath == manifestFileName || relPath == signatureFileName {
+			return nil
+		}
+
+		sha256, err := hashes.FileSHA256(filePath)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, relPath)
+		sums[relPath] = sha256
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to hash the acquisition files: %v", err)
+	}
+	sort.Strings(paths)
+
+	var manifest []byte
+	for _, path := range paths {
+		manifest = append(manifest, fmt.Sprintf("%s  %s\n", sums[path], path)...)
+	}
+	err = os.WriteFile(filepath.Join(a.StoragePath, manifestFileName), manifest, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to write the manifest: %v", err)
+	}
+
+	if a.SignKeyPath == "" {
+		return nil
+	}
+
+	signer, err := LoadSigningKey(a.SignKeyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load the signing key: %v", err)
+	}
+
+	// Ed25519 signs the message itself, the other algorithms its digest.
+	var signature []byte
+	if _, ok := signer.(ed25519.PrivateKey); ok {
+		signature, err = signer.Sign(rand.Reader, manifest, crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256(manifest)
+		signature, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to sign the manifest: %v", err)
+	}
+
+	return os.WriteFile(filepath.Join(a.StoragePath, signatureFileName), signature, 0o644)
+}
+
+// Finalize completes the acquisition once the modules ran: it records the
+// end of the acquisition, stores its details, and hashes all the files.
+func (a *Acquisition) Finalize() error {
+	// The files of modules run concurrently weren't attributed to any of
+	// them.
+	if a.noCheckpoints {
+		a.mutex.Lock()
+		err := a.checkIOCs(a.moduleFiles(""))
+		a.mutex.Unlock()
+		if err != nil {
+			log.Warningf("Failed to check the output of the modules against the indicators: %v", err)
+		}
+	}
+
+	err := a.CompleteMetadata()
+	if err != nil {
+		log.ErrorExc("Failed to update the acquisition metadata", err)
+	}
+
+	a.Complete()
+
+	err = a.StoreInfo()
+	if err != nil {
+		log.ErrorExc("Failed to store the acquisition details", err)
+	}
+
+	err = a.HashFiles()
+	if err != nil {
+		return fmt.Errorf("failed to generate list of file hashes: %v", err)
+	}
+
+	// The log file would no longer match the manifest if written to.
+	log.DisableFileLog()
+
+	return a.StoreManifest()
+}
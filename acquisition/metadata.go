@@ -0,0 +1,142 @@
+// androidqf - Android Quick Forensics
+// Copyright (c) 2021-2022 Claudio Guarnieri.
+// Use of this software is governed by the MVT License 1.1 that can be found at
+//   https://license.mvt.re/1.1/
+
+package acquisition
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/botherder/go-savetime/hashes"
+	"github.com/mvt-project/androidqf/adb"
+	"github.com/mvt-project/androidqf/log"
+)
+
+const (
+	metadataFileName = "acquisition_metadata.json"
+	// startFileName is the metadata as written before the modules ran. It
+	// is never rewritten, so that its hash, to which the output of every
+	// module is chained, can still be verified afterwards.
+	startFileName = "acquisition_start.json"
+)
+
+// Metadata describes the acquisition and the device. It is written before
+// any module runs, so that it is present even if the acquisition is
+// interrupted.
+type Metadata struct {
+	UUID             string     `json:"uuid"`
+	AndroidQFVersion string     `json:"androidqf_version"`
+	HostOS           string     `json:"host_os"`
+	Started          time.Time  `json:"started"`
+	Ended            *time.Time `json:"ended"`
+	OperatorNotes    string     `json:"operator_notes"`
+	Device           DeviceInfo `json:"device"`
+	// StartSHA256 is the hash of acquisition_start.json.
+	StartSHA256 string `json:"start_sha256,omitempty"`
+}
+
+func (a *Acquisition) writeMetadata(fileName string, metadata *Metadata) error {
+	data, err := json.MarshalIndent(metadata, "", " ")
+	if err != nil {
+		return fmt.Errorf("failed to json marshal the acquisition metadata: %v", err)
+	}
+	return os.WriteFile(filepath.Join(a.StoragePath, fileName), data, 0o644)
+}
+
+// readStartMetadata reads acquisition_start.json.
+func (a *Acquisition) readStartMetadata() (*Metadata, error) {
+	data, err := os.ReadFile(filepath.Join(a.StoragePath, startFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	var metadata Metadata
+	err = json.Unmarshal(data, &metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the acquisition metadata: %v", err)
+	}
+	return &metadata, nil
+}
+
+// StoreMetadata writes acquisition_start.json and records its hash in
+// MetadataSHA256, to which the output of every module is chained. The same
+// metadata is written to acquisition_metadata.json, completed at the end of
+// the acquisition. When resuming, the metadata of the first run is kept.
+func (a *Acquisition) StoreMetadata() error {
+	startPath := filepath.Join(a.StoragePath, startFileName)
+	if _, err := os.Stat(startPath); err != nil || !a.Resumed {
+		metadata := Metadata{
+			UUID:             a.UUID,
+			AndroidQFVersion: a.AndroidQFVersion,
+			HostOS:           fmt.Sprintf("%s/%s", runtime.GOOS, runtime.GOARCH),
+			Started:          a.Started,
+			OperatorNotes:    a.OperatorNotes,
+		}
+
+		props := map[string]*string{
+			"ro.product.model":                &metadata.Device.Model,
+			"ro.product.manufacturer":         &metadata.Device.Manufacturer,
+			"ro.build.fingerprint":            &metadata.Device.Fingerprint,
+			"ro.serialno":                     &metadata.Device.Serial,
+			"ro.build.version.release":        &metadata.Device.AndroidVersion,
+			"ro.build.version.security_patch": &metadata.Device.SecurityPatch,
+		}
+		for prop, value := range props {
+			out, err := adb.Client.Shell("getprop", prop)
+			if err != nil {
+				log.Debugf("Failed to get property %s: %v", prop, err)
+				continue
+			}
+			*value = out
+		}
+
+		err := a.writeMetadata(startFileName, &metadata)
+		if err != nil {
+			return err
+		}
+	}
+
+	sha256, err := hashes.FileSHA256(startPath)
+	if err != nil {
+		return fmt.Errorf("failed to hash the acquisition metadata: %v", err)
+	}
+	a.MetadataSHA256 = sha256
+	log.Debugf("Acquisition metadata hash: %s", sha256)
+
+	metadata, err := a.readStartMetadata()
+	if err != nil {
+		return err
+	}
+	metadata.StartSHA256 = sha256
+	return a.writeMetadata(metadataFileName, metadata)
+}
+
+// CompleteMetadata records the end time in acquisition_metadata.json.
+// acquisition_start.json is left untouched, and its hash is checked against
+// MetadataSHA256.
+func (a *Acquisition) CompleteMetadata() error {
+	sha256, err := hashes.FileSHA256(filepath.Join(a.StoragePath, startFileName))
+	if err != nil {
+		return fmt.Errorf("failed to hash the acquisition metadata: %v", err)
+	}
+	if sha256 != a.MetadataSHA256 {
+		log.Warningf("The acquisition metadata was modified during the acquisition, its hash is %s instead of %s",
+			sha256, a.MetadataSHA256)
+	}
+
+	metadata, err := a.readStartMetadata()
+	if err != nil {
+		return err
+	}
+	ended := time.Now().UTC()
+	metadata.Ended = &ended
+	metadata.StartSHA256 = sha256
+
+	return a.writeMetadata(metadataFileName, metadata)
+}
@@ -0,0 +1,94 @@
+// androidqf - Android Quick Forensics
+// Copyright (c) 2021-2022 Claudio Guarnieri.
+// Use of this software is governed by the MVT License 1.1 that can be found at
+//   https://license.mvt.re/1.1/
+
+package acquisition
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/mvt-project/androidqf/adb"
+)
+
+// Progress reports how far along a module is.
+type Progress interface {
+	adb.Progress
+	SetStatus(msg string)
+}
+
+// NoopProgress discards the progress, for non-interactive use.
+type NoopProgress struct{}
+
+func (NoopProgress) SetTotal(n int)       {}
+func (NoopProgress) Increment()           {}
+func (NoopProgress) SetStatus(msg string) {}
+
+// ConsoleProgress renders the progress as a percentage bar on stderr. It is
+// safe for concurrent use.
+type ConsoleProgress struct {
+	mutex   sync.Mutex
+	total   int
+	current int
+	status  string
+}
+
+func NewConsoleProgress() *ConsoleProgress {
+	return &ConsoleProgress{}
+}
+
+// NewProgress returns a ConsoleProgress when stderr is a terminal, and a
+// NoopProgress otherwise.
+func NewProgress() Progress {
+	info, err := os.Stderr.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return NoopProgress{}
+	}
+	return NewConsoleProgress()
+}
+
+func (c *ConsoleProgress) SetTotal(n int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.total = n
+	c.current = 0
+	c.render()
+}
+
+func (c *ConsoleProgress) Increment() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.current++
+	c.render()
+}
+
+func (c *ConsoleProgress) SetStatus(msg string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.status = msg
+	c.render()
+}
+
+// render redraws the bar in place, and ends the line once completed.
+func (c *ConsoleProgress) render() {
+	if c.total <= 0 {
+		return
+	}
+
+	const width = 30
+	current := c.current
+	if current > c.total {
+		current = c.total
+	}
+	percent := current * 100 / c.total
+	filled := width * percent / 100
+	fmt.Fprintf(os.Stderr, "\r\033[K[%s%s] %3d%% (%d/%d) %s",
+		strings.Repeat("#", filled), strings.Repeat(" ", width-filled),
+		percent, current, c.total, c.status)
+	if current == c.total {
+		fmt.Fprintln(os.Stderr)
+	}
+}
@@ -6,51 +6,140 @@
 package acquisition
 
 import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"filippo.io/age"
-	"github.com/botherder/go-savetime/files"
+	"filippo.io/age/agessh"
 	saveRuntime "github.com/botherder/go-savetime/runtime"
 	"github.com/mvt-project/androidqf/log"
+	"golang.org/x/crypto/ssh"
 )
 
+// EncryptionKey is a public key the acquisitions are encrypted with.
+type EncryptionKey struct {
+	Recipient age.Recipient
+	// Type is either "age", "ssh-rsa" or "ssh-ed25519".
+	Type string
+	// ID identifies the private key needed for the decryption: the age
+	// recipient itself, or the SHA-256 fingerprint of SSH and RSA keys.
+	ID string
+}
+
+// EncryptionHeader is stored next to an encrypted acquisition to describe
+// how to decrypt it.
+type EncryptionHeader struct {
+	UUID      string    `json:"uuid"`
+	Archive   string    `json:"archive"`
+	Format    string    `json:"format"`
+	KeyType   string    `json:"key_type"`
+	KeyID     string    `json:"key_id"`
+	Encrypted time.Time `json:"encrypted"`
+}
+
+// LoadEncryptionKey reads a public key from the file at path. It accepts an
+// age recipient, an SSH public key in the authorized_keys format, or a PEM
+// encoded RSA public key.
+func LoadEncryptionKey(path string) (*EncryptionKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keyStr := strings.TrimSpace(string(data))
+
+	if strings.HasPrefix(keyStr, "age1") {
+		recipient, err := age.ParseX25519Recipient(keyStr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key %q: %v", keyStr, err)
+		}
+		return &EncryptionKey{Recipient: recipient, Type: "age", ID: keyStr}, nil
+	}
+
+	var pub ssh.PublicKey
+	if block, _ := pem.Decode(data); block != nil {
+		var key any
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		default:
+			return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse PEM public key: %v", err)
+		}
+		pub, err = ssh.NewPublicKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported PEM public key: %v", err)
+		}
+	} else {
+		pub, _, _, _, err = ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key %q: %v", keyStr, err)
+		}
+	}
+
+	var recipient age.Recipient
+	switch pub.Type() {
+	case ssh.KeyAlgoRSA:
+		recipient, err = agessh.NewRSARecipient(pub)
+	case ssh.KeyAlgoED25519:
+		recipient, err = agessh.NewEd25519Recipient(pub)
+	default:
+		return nil, fmt.Errorf("unsupported public key type %s", pub.Type())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &EncryptionKey{
+		Recipient: recipient,
+		Type:      pub.Type(),
+		ID:        ssh.FingerprintSHA256(pub),
+	}, nil
+}
+
+// StoreSecurely compresses and encrypts the acquisition folder with the key
+// at EncryptionKeyPath, or with the key.txt next to the executable, and then
+// deletes the unencrypted copy.
 func (a *Acquisition) StoreSecurely() error {
 	cwd := saveRuntime.GetExecutableDirectory()
 
-	keyFilePath := filepath.Join(cwd, "key.txt")
-	if _, err := os.Stat(keyFilePath); os.IsNotExist(err) {
-		return nil
+	keyFilePath := a.EncryptionKeyPath
+	if keyFilePath == "" {
+		keyFilePath = filepath.Join(cwd, "key.txt")
+		if _, err := os.Stat(keyFilePath); os.IsNotExist(err) {
+			return nil
+		}
 	}
 
-	log.Info("You provided an age public key, storing the acquisition securely.")
+	key, err := LoadEncryptionKey(keyFilePath)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("You provided an %s public key, storing the acquisition securely.", key.Type)
 
 	zipFileName := fmt.Sprintf("%s.zip", a.UUID)
 	zipFilePath := filepath.Join(cwd, zipFileName)
 
 	log.Info("Compressing the acquisition folder. This might take a while...")
 
-	err := files.Zip(a.StoragePath, zipFilePath)
+	err = a.writeArchive(zipFilePath)
 	if err != nil {
 		return err
 	}
 
 	log.Info("Encrypting the compressed archive. This might take a while...")
 
-	publicKey, err := os.ReadFile(keyFilePath)
-	if err != nil {
-		return err
-	}
-	publicKeyStr := strings.TrimSpace(string(publicKey))
-
-	recipient, err := age.ParseX25519Recipient(publicKeyStr)
-	if err != nil {
-		return fmt.Errorf("failed to parse public key %q: %v", publicKeyStr, err)
-	}
-
 	zipFile, err := os.Open(zipFilePath)
 	if err != nil {
 		return err
@@ -65,7 +154,7 @@ func (a *Acquisition) StoreSecurely() error {
 	}
 	defer encFile.Close()
 
-	w, err := age.Encrypt(encFile, recipient)
+	w, err := age.Encrypt(encFile, key.Recipient)
 	if err != nil {
 		return fmt.Errorf("failed to create encrypted file: %v", err)
 	}
@@ -79,6 +168,24 @@ func (a *Acquisition) StoreSecurely() error {
 		return fmt.Errorf("failed to close encrypted file: %v", err)
 	}
 
+	header := EncryptionHeader{
+		UUID:      a.UUID,
+		Archive:   encFileName,
+		Format:    "age",
+		KeyType:   key.Type,
+		KeyID:     key.ID,
+		Encrypted: time.Now().UTC(),
+	}
+	headerData, err := json.MarshalIndent(header, "", " ")
+	if err != nil {
+		return fmt.Errorf("failed to json marshal the encryption header: %v", err)
+	}
+	headerPath := filepath.Join(cwd, fmt.Sprintf("%s.json", encFileName))
+	err = os.WriteFile(headerPath, headerData, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to write the encryption header: %v", err)
+	}
+
 	log.Infof("Acquisition successfully encrypted at %s", encFilePath)
 
 	// TODO: we should securely wipe the files.
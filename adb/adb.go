@@ -6,28 +6,102 @@
 package adb
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"os"
 	"os/exec"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	// Embed the timezone database, as it is not available on Windows.
+	_ "time/tzdata"
 
-	saveSlice "github.com/botherder/go-savetime/slice"
+	"github.com/manifoldco/promptui"
 	"github.com/mvt-project/androidqf/log"
 )
 
+// DefaultMaxHashWorkers is the default number of hash commands run
+// concurrently on the device for each package file.
+const DefaultMaxHashWorkers = 4
+
+// DefaultPackageWorkers is the default number of packages processed
+// concurrently.
+const DefaultPackageWorkers = 2
+
 type ADB struct {
 	ExePath string
 	Serial  string
+	// MaxHashWorkers caps the number of concurrent hash commands run for
+	// each package file.
+	MaxHashWorkers int
+	// PackageWorkers is the number of packages hashed, downloaded and
+	// verified concurrently.
+	PackageWorkers int
+	// MaxRetries is the number of times a command is retried after the
+	// device disconnected and came back.
+	MaxRetries int
+	// RetryBackoff is how long to wait before the first retry, multiplied
+	// by the attempt number for the following ones.
+	RetryBackoff time.Duration
+	// ReconnectTimeout is how long to wait for a disconnected device to
+	// come back before giving up.
+	ReconnectTimeout time.Duration
+	// VerifyPulls enables checking pulled files against the hash
+	// computed on the device.
+	VerifyPulls bool
+	// ResumePulls reuses the local copies of files left by a previous
+	// acquisition, and completes the partial ones.
+	ResumePulls bool
+	// TCPAddress is the host:port of the device when it is acquired over
+	// wireless debugging, empty when connected over USB.
+	TCPAddress string
+	// AdbRoot allows restarting adbd as root with `adb root` when su is
+	// not available. The restart breaks the commands in progress, so it
+	// must only be enabled while no other command runs.
+	AdbRoot bool
+
+	ctx           context.Context
+	procSubstOnce sync.Once
+	procSubst     bool
+
+	dumpCache      map[string]string
+	dumpCacheMutex sync.Mutex
+	dumpAllOnce    sync.Once
+
+	// localNames maps the lowercase local paths of the pulled files to their
+	// on-device path.
+	localNames      map[string]string
+	localNamesMutex sync.Mutex
+
+	locationOnce sync.Once
+	location     *time.Location
+
+	rootOnce   sync.Once
+	rootMethod string
+	rootUsed   atomic.Bool
+
+	// hashTime is the time spent hashing package files, in nanoseconds.
+	hashTime atomic.Int64
 }
 
 var Client *ADB
 
-// New returns a new ADB instance.
-func New(serial string) (*ADB, error) {
-	adb := ADB{}
+// newADB finds the adb executable and restarts the adb server.
+func newADB() (*ADB, error) {
+	adb := ADB{
+		MaxHashWorkers:   DefaultMaxHashWorkers,
+		PackageWorkers:   DefaultPackageWorkers,
+		MaxRetries:       DefaultMaxRetries,
+		RetryBackoff:     DefaultRetryBackoff,
+		ReconnectTimeout: DefaultReconnectTimeout,
+		VerifyPulls:      true,
+	}
 	err := adb.findExe()
 	if err != nil {
-		return nil, fmt.Errorf("failed to find a usable adb executable: %v",
+		return nil, fmt.Errorf("failed to find a usable adb executable: %w",
 			err)
 	}
 	log.Debugf("ADB found at path: %s", adb.ExePath)
@@ -35,66 +109,260 @@ func New(serial string) (*ADB, error) {
 	log.Debug("Killing existing ADB server if running")
 	adb.KillServer()
 
+	return &adb, nil
+}
+
+// New returns a new ADB instance.
+func New(serial string) (*ADB, error) {
+	adb, err := newADB()
+	if err != nil {
+		return nil, err
+	}
+
 	// Managing devices
-	devices, err := adb.Devices()
+	devices, err := adb.ListDevices()
 	if err != nil {
 		return nil, err
 	}
 
 	serial = strings.TrimSpace(serial)
 	if len(devices) == 0 {
-		return nil, fmt.Errorf("no devices connected to adb")
+		return nil, fmt.Errorf("no devices connected to adb: %w", ErrNoDevice)
 	}
 	if serial != "" {
 		// Check that the serial match one of the devices
-		// Can be replace with the go package slices in 1.21
-		if !saveSlice.ContainsNoCase(devices, serial) {
+		found := false
+		for _, device := range devices {
+			if strings.EqualFold(device.Serial, serial) {
+				found = true
+				break
+			}
+		}
+		if !found {
 			// Serial is not an existing device
-			return nil, fmt.Errorf("serial %s not found in the device list", serial)
+			return nil, fmt.Errorf("serial %s not found in the device list: %w", serial, ErrNoDevice)
 		}
 		adb.Serial = serial
-	} else {
-		// Problem if multiple devices
-		if len(devices) > 1 {
-			return nil, fmt.Errorf("multiple devices connected, please provide a serial number")
+	} else if len(devices) > 1 {
+		// Multiple devices, ask which one to acquire
+		adb.Serial, err = selectDevice(devices)
+		if err != nil {
+			return nil, err
 		}
+	} else {
 		adb.Serial = ""
 	}
 
-	return &adb, nil
+	return adb, nil
 }
 
-// List existing devices
-func (a *ADB) Devices() ([]string, error) {
-	var devices []string
-	out, err := exec.Command(a.ExePath, "devices").Output()
+// Device describes a device attached to adb.
+type Device struct {
+	Serial string `json:"serial"`
+	State  string `json:"state"`
+	Model  string `json:"model"`
+}
+
+// ListDevices returns the serial, state and model of each attached device.
+func (a *ADB) ListDevices() ([]Device, error) {
+	var devices []Device
+	out, err := exec.Command(a.ExePath, "devices", "-l").Output()
 	if err != nil {
-		return devices, fmt.Errorf("failed to use the adb executable: %v",
-			err)
+		return devices, fmt.Errorf("failed to use the adb executable: %w",
+			parseError(err))
 	}
 
 	lines := strings.Split(string(out), "\n")
-	for _, s := range lines[1:] {
-		dev := strings.Split(s, "\t")
-		if len(dev) == 2 {
-			devices = append(devices, strings.TrimSpace(dev[0]))
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		device := Device{
+			Serial: fields[0],
+			State:  fields[1],
+		}
+		for _, field := range fields[2:] {
+			if strings.HasPrefix(field, "model:") {
+				device.Model = strings.TrimPrefix(field, "model:")
+			}
 		}
+		devices = append(devices, device)
 	}
 
 	return devices, nil
 }
 
+// ListAllDevices returns the devices attached to adb, without selecting
+// one of them.
+func ListAllDevices() ([]Device, error) {
+	adb, err := newADB()
+	if err != nil {
+		return nil, err
+	}
+	return adb.ListDevices()
+}
+
+// List existing devices
+func (a *ADB) Devices() ([]string, error) {
+	var serials []string
+	devices, err := a.ListDevices()
+	if err != nil {
+		return serials, err
+	}
+
+	for _, device := range devices {
+		serials = append(serials, device.Serial)
+	}
+
+	return serials, nil
+}
+
+// selectDevice prompts the user to choose one of the attached devices and
+// returns its serial.
+func selectDevice(devices []Device) (string, error) {
+	items := []string{}
+	for _, device := range devices {
+		model := device.Model
+		if model == "" {
+			model = "unknown model"
+		}
+		items = append(items, fmt.Sprintf("%s (%s, %s)", device.Serial, model, device.State))
+	}
+
+	fmt.Println("Multiple devices are connected. Which one would you like to acquire?")
+	devicePrompt := promptui.Select{
+		Label: "Device",
+		Items: items,
+	}
+	index, _, err := devicePrompt.Run()
+	if err != nil {
+		return "", fmt.Errorf("failed to make selection for device: %v", err)
+	}
+
+	return devices[index].Serial, nil
+}
+
 // Run a command to the given phone using exec
 // Returns string and/or error
 func (a *ADB) Exec(args ...string) ([]byte, error) {
-	if a.Serial == "" {
-		return exec.Command(a.ExePath, args...).Output()
-	} else {
-		var params []string
+	return a.ExecContext(a.context(), args...)
+}
+
+// ExecTimeout runs a command like Exec, but kills adb and returns ErrTimeout
+// if it does not complete within the given duration. A zero timeout means no
+// timeout.
+func (a *ADB) ExecTimeout(timeout time.Duration, args ...string) ([]byte, error) {
+	if timeout <= 0 {
+		return a.Exec(args...)
+	}
+
+	ctx, cancel := context.WithTimeout(a.context(), timeout)
+	defer cancel()
+	return a.ExecContext(ctx, args...)
+}
+
+// ExecContext runs a command like Exec, killing the adb process when the
+// context is done. If the device disconnects, it waits for it to come back
+// and retries the command, up to MaxRetries times.
+func (a *ADB) ExecContext(ctx context.Context, args ...string) ([]byte, error) {
+	return a.execRetry(ctx, a.MaxRetries, a.RetryBackoff, args...)
+}
+
+// execRetry runs a command, retrying it up to maxRetries times if the
+// device disconnects.
+func (a *ADB) execRetry(ctx context.Context, maxRetries int, backoff time.Duration, args ...string) ([]byte, error) {
+	out, err := a.execOnce(ctx, args...)
+	for attempt := 1; attempt <= maxRetries && isDisconnected(err); attempt++ {
+		if !a.waitForDevice(ctx, backoff*time.Duration(attempt)) {
+			break
+		}
+		log.Infof("Retrying `adb %s` (attempt %d of %d)", strings.Join(args, " "), attempt, maxRetries)
+		out, err = a.execOnce(ctx, args...)
+	}
+
+	return out, err
+}
+
+// execOnce runs a command on the device exactly once.
+func (a *ADB) execOnce(ctx context.Context, args ...string) ([]byte, error) {
+	var params []string
+	if a.Serial != "" {
+		params = append(params, "-s", a.Serial)
+	}
+	params = append(params, args...)
+
+	out, err := exec.CommandContext(ctx, a.ExePath, params...).Output()
+	if err != nil && ctx.Err() != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return out, fmt.Errorf("%w: adb %s", ErrTimeout, strings.Join(args, " "))
+		}
+		return out, fmt.Errorf("adb %s: %w", strings.Join(args, " "), ctx.Err())
+	}
+	return out, parseError(err)
+}
+
+// ShellToFile executes a shell command through adb like Shell, streaming its
+// output to the local file instead of keeping it in memory. The file is
+// written again from the start if the command is retried after the device
+// disconnected.
+func (a *ADB) ShellToFile(localPath string, cmd ...string) error {
+	ctx := a.context()
+	err := a.shellToFileOnce(ctx, localPath, cmd...)
+	for attempt := 1; attempt <= a.MaxRetries && isDisconnected(err); attempt++ {
+		if !a.waitForDevice(ctx, a.RetryBackoff*time.Duration(attempt)) {
+			break
+		}
+		log.Infof("Retrying `adb shell %s` (attempt %d of %d)", strings.Join(cmd, " "), attempt, a.MaxRetries)
+		err = a.shellToFileOnce(ctx, localPath, cmd...)
+	}
+
+	return err
+}
+
+func (a *ADB) shellToFileOnce(ctx context.Context, localPath string, cmd ...string) error {
+	file, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var params []string
+	if a.Serial != "" {
 		params = append(params, "-s", a.Serial)
-		params = append(params, args...)
-		return exec.Command(a.ExePath, params...).Output()
 	}
+	params = append(params, "shell")
+	params = append(params, cmd...)
+
+	var stderr bytes.Buffer
+	command := exec.CommandContext(ctx, a.ExePath, params...)
+	command.Stdout = file
+	command.Stderr = &stderr
+	err = command.Run()
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("adb shell %s: %w", strings.Join(cmd, " "), ctx.Err())
+	}
+
+	// Output() only fills Stderr of the error itself.
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitErr.Stderr = stderr.Bytes()
+	}
+	return parseError(err)
+}
+
+// SetContext sets the parent context of every command run by this client.
+// Cancelling it kills any in-flight adb process.
+func (a *ADB) SetContext(ctx context.Context) {
+	a.ctx = ctx
+}
+
+func (a *ADB) context() context.Context {
+	if a.ctx == nil {
+		return context.Background()
+	}
+	return a.ctx
 }
 
 // GetState returns the output of `adb get-state`.
@@ -102,7 +370,9 @@ func (a *ADB) Exec(args ...string) ([]byte, error) {
 // will exit with status 1.
 func (a *ADB) GetState() (string, error) {
 	log.Debug("Starting get-state")
-	out, err := a.Exec("get-state")
+	// Do not wait for the device to reconnect, get-state is how we check
+	// whether it is connected at all.
+	out, err := a.execOnce(a.context(), "get-state")
 	if err != nil {
 		log.Debug("get-state failed")
 		return "", err
@@ -114,8 +384,41 @@ func (a *ADB) GetState() (string, error) {
 
 // Shell executes a shell command through adb.
 func (a *ADB) Shell(cmd ...string) (string, error) {
+	return a.ShellContext(a.context(), cmd...)
+}
+
+// ShellTimeout executes a shell command through adb, returning ErrTimeout if
+// it does not complete within the given duration. A zero timeout means no
+// timeout.
+func (a *ADB) ShellTimeout(timeout time.Duration, cmd ...string) (string, error) {
+	if timeout <= 0 {
+		return a.Shell(cmd...)
+	}
+
+	ctx, cancel := context.WithTimeout(a.context(), timeout)
+	defer cancel()
+	return a.ShellContext(ctx, cmd...)
+}
+
+// RetryShell executes a shell command through adb, running it at most
+// maxAttempts times if the device disconnects, and waiting backoff times the
+// attempt number before each retry.
+func (a *ADB) RetryShell(maxAttempts int, backoff time.Duration, cmd ...string) (string, error) {
+	fullCmd := append([]string{"shell"}, cmd...)
+	out, err := a.execRetry(a.context(), maxAttempts-1, backoff, fullCmd...)
+	return shellOutput(out, err)
+}
+
+// ShellContext executes a shell command through adb, killing it when the
+// context is done.
+func (a *ADB) ShellContext(ctx context.Context, cmd ...string) (string, error) {
 	fullCmd := append([]string{"shell"}, cmd...)
-	out, err := a.Exec(fullCmd...)
+	out, err := a.ExecContext(ctx, fullCmd...)
+	return shellOutput(out, err)
+}
+
+// shellOutput returns the trimmed output of a shell command.
+func shellOutput(out []byte, err error) (string, error) {
 	if err != nil {
 		if out == nil {
 			return "", err
@@ -127,6 +430,42 @@ func (a *ADB) Shell(cmd ...string) (string, error) {
 	return strings.TrimSpace(string(out)), nil
 }
 
+// DeviceLocation returns the timezone configured on the device, falling back
+// to its current UTC offset, and then to UTC.
+func (a *ADB) DeviceLocation() *time.Location {
+	a.locationOnce.Do(func() {
+		a.location = time.UTC
+
+		out, err := a.Shell("getprop", "persist.sys.timezone")
+		if err == nil && out != "" {
+			location, err := time.LoadLocation(out)
+			if err == nil {
+				a.location = location
+				return
+			}
+			log.Debugf("Failed to load device timezone %s: %v", out, err)
+		}
+
+		out, err = a.Shell("date", "+%z")
+		if err == nil {
+			offset, err := time.Parse("-0700", out)
+			if err == nil {
+				_, seconds := offset.Zone()
+				a.location = time.FixedZone(out, seconds)
+			}
+		}
+	})
+
+	return a.location
+}
+
+// ExecOut runs a command on the device through `adb exec-out` and returns its
+// raw output. Contrary to Shell, no newline translation is done, so it is safe
+// to use for binary data.
+func (a *ADB) ExecOut(cmd string) ([]byte, error) {
+	return a.Exec("exec-out", cmd)
+}
+
 // Pull downloads a file from the device to a local path.
 func (a *ADB) Pull(remotePath, localPath string) (string, error) {
 	out, err := a.Exec("pull", remotePath, localPath)
@@ -149,14 +488,14 @@ func (a *ADB) Push(localPath, remotePath string) (string, error) {
 
 // Backup generates a backup of the specified app, or of all.
 func (a *ADB) Backup(arg string) error {
-	cmd := exec.Command(a.ExePath, "backup", "-nocompress", arg)
-	return cmd.Run()
+	_, err := a.Exec("backup", "-nocompress", arg)
+	return err
 }
 
-// Bugreport generates a bugreport of the the device
-func (a *ADB) Bugreport() error {
-	cmd := exec.Command(a.ExePath, "bugreport", "bugreport.zip")
-	err := cmd.Run()
+// Bugreport generates a bugreport of the the device, giving up after the
+// provided timeout.
+func (a *ADB) Bugreport(timeout time.Duration) error {
+	_, err := a.ExecTimeout(timeout, "bugreport", "bugreport.zip")
 	return err
 }
 
@@ -0,0 +1,118 @@
+// androidqf - Android Quick Forensics
+// Copyright (c) 2021-2022 Claudio Guarnieri.
+// Use of this software is governed by the MVT License 1.1 that can be found at
+//   https://license.mvt.re/1.1/
+
+package adb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fakeShell is a fake adb executable running the shell and exec-out commands
+// on the host with bash, as the device shell would.
+const fakeShell = `#!/bin/bash
+while [ $# -gt 0 ] && [ "$1" != "shell" ] && [ "$1" != "exec-out" ]; do
+	shift
+done
+shift
+exec bash -c "$*"
+`
+
+// newFakeADB returns an ADB using a fake adb executable with the given
+// script.
+func newFakeADB(tb testing.TB, script string) *ADB {
+	tb.Helper()
+	if runtime.GOOS == "windows" {
+		tb.Skip("the fake adb executable is a shell script")
+	}
+	if _, err := exec.LookPath("bash"); err != nil {
+		tb.Skip("bash is needed by the fake adb executable")
+	}
+
+	exePath := filepath.Join(tb.TempDir(), "adb")
+	if err := os.WriteFile(exePath, []byte(script), 0o755); err != nil {
+		tb.Fatal(err)
+	}
+	return &ADB{ExePath: exePath, MaxHashWorkers: DefaultMaxHashWorkers}
+}
+
+// fakeCommand is the answer of a fake device to the shell commands matching
+// pattern, a bash case pattern.
+type fakeCommand struct {
+	pattern string
+	out     string
+	status  int
+}
+
+// newFakeDevice returns an ADB whose fake adb executable answers the shell
+// commands with the first matching fakeCommand, and runs the others with
+// bash. Files are pulled from the host. The returned function lists the
+// shell commands run so far.
+func newFakeDevice(tb testing.TB, commands []fakeCommand) (*ADB, func() []string) {
+	tb.Helper()
+	dir := tb.TempDir()
+	logPath := filepath.Join(dir, "commands.log")
+
+	var script strings.Builder
+	script.WriteString("#!/bin/bash\n")
+	script.WriteString(`while [ $# -gt 0 ] && [ "$1" != "shell" ] && [ "$1" != "exec-out" ] && [ "$1" != "pull" ]; do shift; done` + "\n")
+	script.WriteString(`if [ "$1" = "pull" ]; then exec cp "$2" "$3"; fi` + "\n")
+	script.WriteString("shift\n")
+	fmt.Fprintf(&script, "echo \"$*\" >> %s\n", shellQuote(logPath))
+	script.WriteString("case \"$*\" in\n")
+	for i, command := range commands {
+		outPath := filepath.Join(dir, fmt.Sprintf("out%d", i))
+		if err := os.WriteFile(outPath, []byte(command.out), 0o644); err != nil {
+			tb.Fatal(err)
+		}
+		fmt.Fprintf(&script, "%s) cat %s; exit %d;;\n", command.pattern, shellQuote(outPath), command.status)
+	}
+	script.WriteString("*) exec bash -c \"$*\";;\n")
+	script.WriteString("esac\n")
+
+	calls := func() []string {
+		data, err := os.ReadFile(logPath)
+		if err != nil {
+			return nil
+		}
+		return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+	return newFakeADB(tb, script.String()), calls
+}
+
+// noopProgress ignores the advancement of the collection of packages.
+type noopProgress struct{}
+
+func (noopProgress) SetTotal(n int) {}
+func (noopProgress) Increment()     {}
+
+func TestExecOut(t *testing.T) {
+	a := newFakeADB(t, fakeShell)
+	a.Serial = "emulator-5554"
+
+	// Every byte value, along with the line endings adb shell translates.
+	blob := []byte("\r\n\n\r\x00\x1a")
+	for i := 0; i < 256; i++ {
+		blob = append(blob, byte(i))
+	}
+	blobPath := filepath.Join(t.TempDir(), "blob.bin")
+	if err := os.WriteFile(blobPath, blob, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := a.ExecOut("cat " + shellQuote(blobPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, blob) {
+		t.Errorf("got %d bytes %x, want %d bytes %x", len(out), out, len(blob), blob)
+	}
+}
@@ -6,7 +6,6 @@
 package adb
 
 import (
-	"errors"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -36,7 +35,7 @@ func (a *ADB) findExe() error {
 		_, err = os.Stat(a.ExePath)
 		if err != nil {
 			log.Debugf("ADB doesn't exist at %s", a.ExePath)
-			return errors.New("Impossible to find ADB")
+			return ErrAdbNotFound
 		}
 	}
 	return nil
@@ -0,0 +1,72 @@
+// androidqf - Android Quick Forensics
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this software is governed by the MVT License 1.1 that can be found at
+//   https://license.mvt.re/1.1/
+
+package adb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+var (
+	// ErrAdbNotFound is returned when no usable adb executable is found.
+	ErrAdbNotFound = errors.New("adb executable not found")
+	// ErrNoDevice is returned when the device is not connected.
+	ErrNoDevice = errors.New("device not found")
+	// ErrDeviceOffline is returned when the device is connected but not
+	// responding.
+	ErrDeviceOffline = errors.New("device offline")
+	// ErrDeviceUnauthorized is returned when the host was not authorized
+	// on the device.
+	ErrDeviceUnauthorized = errors.New("device unauthorized")
+	// ErrCommandNotFound is returned when the shell command does not exist
+	// on the device.
+	ErrCommandNotFound = errors.New("command not found on device")
+	// ErrTimeout is returned when an adb command does not complete in time.
+	ErrTimeout = errors.New("adb command timed out")
+	// ErrHashMismatch is returned when a pulled file does not match the
+	// hash computed on the device.
+	ErrHashMismatch = errors.New("local copy does not match the on-device hash")
+)
+
+// parseError converts the error of an adb execution into one of the typed
+// errors above, based on what adb printed on stderr. The original error is
+// still wrapped.
+func parseError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %w", ErrAdbNotFound, err)
+	}
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+
+	stderr := strings.TrimSpace(string(exitErr.Stderr))
+	lower := strings.ToLower(stderr)
+	switch {
+	case strings.Contains(lower, "unauthorized"):
+		return fmt.Errorf("%w: %w", ErrDeviceUnauthorized, err)
+	case strings.Contains(lower, "device offline"):
+		return fmt.Errorf("%w: %w", ErrDeviceOffline, err)
+	case strings.Contains(lower, "no devices/emulators found"),
+		strings.Contains(lower, "device not found"),
+		strings.HasPrefix(lower, "error: device '") && strings.Contains(lower, "' not found"):
+		return fmt.Errorf("%w: %w", ErrNoDevice, err)
+	case strings.Contains(lower, "inaccessible or not found"),
+		strings.HasSuffix(lower, ": not found"):
+		return fmt.Errorf("%w: %w", ErrCommandNotFound, err)
+	case stderr != "":
+		return fmt.Errorf("%w: %s", err, stderr)
+	}
+
+	return err
+}
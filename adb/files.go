@@ -7,10 +7,26 @@ package adb
 
 import (
 	"fmt"
+	"os"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/botherder/go-savetime/hashes"
+	"github.com/mvt-project/androidqf/log"
+)
+
+// Verification status of a pulled file.
+const (
+	VerificationVerified   = "verified"
+	VerificationMismatch   = "mismatch"
+	VerificationUnverified = "unverified"
 )
 
+// pullProgressInterval is how often the size of a file being pulled is
+// checked to report progress.
+const pullProgressInterval = 250 * time.Millisecond
+
 func (a *ADB) FindFullCommand(path string) ([]FileInfo, error) {
 	var results []FileInfo
 	out, err := a.Shell("find", fmt.Sprintf("'%s'", path), "-type", "f", "-printf", "'%T@ %m %s %u %g %p\n'", "2>", "/dev/null")
@@ -59,3 +75,157 @@ func (a *ADB) FindLimitedCommand(path string) ([]FileInfo, error) {
 
 	return results, nil
 }
+
+// RemoteFileSize returns the size in bytes of a file on the device.
+func (a *ADB) RemoteFileSize(remotePath string) (int64, error) {
+	out, err := a.Shell("stat", "-c", "%s", fmt.Sprintf("'%s'", remotePath))
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+}
+
+// PullWithProgress downloads a file from the device like Pull, and calls cb
+// periodically with the number of bytes downloaded so far. If the size of the
+// remote file can't be determined, total is -1.
+func (a *ADB) PullWithProgress(remotePath, localPath string, cb func(done, total int64)) (string, error) {
+	if cb == nil {
+		return a.Pull(remotePath, localPath)
+	}
+
+	total, err := a.RemoteFileSize(remotePath)
+	if err != nil {
+		total = -1
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(pullProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if info, err := os.Stat(localPath); err == nil {
+					cb(info.Size(), total)
+				}
+			}
+		}
+	}()
+
+	out, err := a.Pull(remotePath, localPath)
+	close(stop)
+	<-stopped
+
+	if err == nil {
+		if info, statErr := os.Stat(localPath); statErr == nil {
+			cb(info.Size(), total)
+		}
+	}
+
+	return out, err
+}
+
+// PullAndVerify downloads a file like PullWithProgress and, if VerifyPulls is
+// enabled, checks the SHA256 of the local copy against the on-device hash.
+// On mismatch the file is downloaded once more. It returns the adb output and
+// the verification status, which is empty if verification is disabled.
+func (a *ADB) PullAndVerify(remotePath, localPath, expectedSHA256 string, cb func(done, total int64)) (string, string, error) {
+	out, err := a.PullWithProgress(remotePath, localPath, cb)
+	if err != nil || !a.VerifyPulls {
+		return out, "", err
+	}
+	if expectedSHA256 == "" {
+		return out, VerificationUnverified, nil
+	}
+
+	for attempt := 0; ; attempt++ {
+		localSHA256, err := hashes.FileSHA256(localPath)
+		if err != nil {
+			return out, VerificationUnverified, fmt.Errorf("failed to hash local copy: %v", err)
+		}
+		if strings.EqualFold(localSHA256, expectedSHA256) {
+			return out, VerificationVerified, nil
+		}
+		if attempt > 0 {
+			return out, VerificationMismatch, fmt.Errorf("%w: device %s, local %s",
+				ErrHashMismatch, expectedSHA256, localSHA256)
+		}
+
+		log.Warningf("Local copy of %s does not match the device, downloading it again", remotePath)
+		out, err = a.PullWithProgress(remotePath, localPath, cb)
+		if err != nil {
+			return out, VerificationMismatch, err
+		}
+	}
+}
+
+// ResumePull completes a partial local copy of the remote file by appending
+// the bytes it is missing.
+func (a *ADB) ResumePull(remotePath, localPath string) error {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+
+	out, err := a.ExecOut(fmt.Sprintf("tail -c +%d '%s'", info.Size()+1, remotePath))
+	if err != nil {
+		return fmt.Errorf("failed to read the end of %s: %v", remotePath, err)
+	}
+
+	file, err := os.OpenFile(localPath, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(out)
+	return err
+}
+
+// ReuseLocalCopy checks whether a local copy of the remote file left by a
+// previous acquisition can be kept instead of pulling the file again. Partial
+// copies are completed first. A copy is reused when it matches the on-device
+// hash or, when the hash is unknown, the size of the remote file. It returns
+// whether the copy was reused and its verification status.
+func (a *ADB) ReuseLocalCopy(remotePath, localPath, expectedSHA256 string) (bool, string) {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return false, ""
+	}
+
+	size, err := a.RemoteFileSize(remotePath)
+	if err != nil {
+		log.Debugf("Failed to get size of %s: %v", remotePath, err)
+		return false, ""
+	}
+	if info.Size() < size {
+		log.Infof("Resuming download of %s from byte %d", remotePath, info.Size())
+		err = a.ResumePull(remotePath, localPath)
+		if err != nil {
+			log.Debugf("Failed to resume download of %s: %v", remotePath, err)
+			return false, ""
+		}
+	}
+
+	if expectedSHA256 == "" {
+		info, err = os.Stat(localPath)
+		if err != nil || info.Size() != size {
+			return false, ""
+		}
+		log.Infof("Reusing existing copy of %s, its hash is unknown", remotePath)
+		return true, VerificationUnverified
+	}
+
+	localSHA256, err := hashes.FileSHA256(localPath)
+	if err != nil || !strings.EqualFold(localSHA256, expectedSHA256) {
+		return false, ""
+	}
+
+	log.Infof("Reusing existing copy of %s", remotePath)
+	return true, VerificationVerified
+}
@@ -6,17 +6,28 @@
 package adb
 
 import (
+	"errors"
 	"fmt"
-	"reflect"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/avast/apkverifier"
 	"github.com/mvt-project/androidqf/log"
+	"github.com/mvt-project/androidqf/utils"
 )
 
 type PackageFile struct {
-	Path                string               `json:"path"`
+	Path string `json:"path"`
+	// LocalName is the path of the local copy, relative to the folder of
+	// the acquisition and with forward slashes, so that it remains valid
+	// when the folder is moved.
 	LocalName           string               `json:"local_name"`
 	MD5                 string               `json:"md5"`
 	SHA1                string               `json:"sha1"`
@@ -27,20 +38,701 @@ type PackageFile struct {
 	Certificate         apkverifier.CertInfo `json:"certificate"`
 	CertificateError    string               `json:"certificate_error"`
 	TrustedCertificate  bool                 `json:"trusted_certificate"`
+	MatchedTrustAnchor  string               `json:"matched_trust_anchor"`
+	Verification        string               `json:"verification"`
+	Signatures          []utils.Signature    `json:"signatures"`
+	// SignatureSchemeVersions are the signature schemes the file is signed
+	// with, 31 standing for v3.1.
+	SignatureSchemeVersions []int `json:"signature_scheme_versions"`
+	// Type is one of PackageFileBase, PackageFileSplit or PackageFileApex.
+	Type string `json:"type"`
+	// SplitName is the name of the split, as in config.arm64_v8a, empty
+	// for the base APK.
+	SplitName string `json:"split_name"`
+	// YaraMatches are the YARA rules matching the downloaded file.
+	YaraMatches []string `json:"yara_matches,omitempty"`
+}
+
+// Types of package files.
+const (
+	PackageFileBase  = "base"
+	PackageFileSplit = "split"
+	PackageFileApex  = "apex"
+)
+
+// newPackageFile returns the package file at the given path, with its type
+// and split name derived from the file name. Splits are installed as
+// split_<name>.apk.
+func newPackageFile(filePath string) PackageFile {
+	packageFile := PackageFile{
+		Path: filePath,
+		Type: PackageFileBase,
+	}
+
+	name := path.Base(filePath)
+	switch {
+	case strings.HasSuffix(name, ".apex") || strings.HasPrefix(filePath, "/apex/"):
+		packageFile.Type = PackageFileApex
+	case strings.HasPrefix(name, "split_") && strings.HasSuffix(name, ".apk"):
+		packageFile.Type = PackageFileSplit
+		packageFile.SplitName = strings.TrimSuffix(strings.TrimPrefix(name, "split_"), ".apk")
+	}
+
+	return packageFile
 }
 
 type Package struct {
-	Name       string        `json:"name"`
-	Files      []PackageFile `json:"files"`
-	Installer  string        `json:"installer"`
-	UID        int           `json:"uid"`
-	Disabled   bool          `json:"disabled"`
-	System     bool          `json:"system"`
-	ThirdParty bool          `json:"third_party"`
+	Name      string        `json:"name"`
+	Files     []PackageFile `json:"files"`
+	Installer string        `json:"installer"`
+	UID       int           `json:"uid"`
+	// User is the ID of the Android user the package is installed for.
+	User           int       `json:"user"`
+	Disabled       bool      `json:"disabled"`
+	System         bool      `json:"system"`
+	ThirdParty     bool      `json:"third_party"`
+	VersionCode    int64     `json:"version_code"`
+	VersionName    string    `json:"version_name"`
+	InstallTime    time.Time `json:"install_time"`
+	LastUpdateTime time.Time `json:"last_update_time"`
+	// InstallingPackage is the package which requested the installation.
+	InstallingPackage string `json:"installing_package"`
+	// OriginatingPackage is the package the APK was downloaded from, if
+	// different.
+	OriginatingPackage string `json:"originating_package"`
+	// Permissions requested by the package.
+	Permissions []string `json:"permissions"`
+	// GrantedPermissions lists the install and runtime permissions which
+	// were granted to the package for its user.
+	GrantedPermissions []string `json:"granted_permissions"`
+	// RuntimePermissions lists the runtime permissions granted for the user
+	// of the package, along with their grant flags.
+	RuntimePermissions []string `json:"runtime_permissions"`
+	// DeclaredPermissions lists the permissions defined by the package.
+	DeclaredPermissions []string `json:"declared_permissions"`
+	// DumpError is set when the details of the package couldn't be dumped.
+	DumpError string `json:"dump_error,omitempty"`
+	// TestKeySigned is set when a file of the package is signed with an
+	// AOSP test key or an SDK debug key.
+	TestKeySigned bool `json:"test_key_signed"`
+	// SplitSignatureMismatch is set when the files of the package are not
+	// all signed with the same certificates.
+	SplitSignatureMismatch bool `json:"split_signature_mismatch"`
+	// V1SignatureOnly is set when the files of the package are only signed
+	// with the JAR signature scheme.
+	V1SignatureOnly bool `json:"v1_signature_only"`
+	// Sideloaded is set when a non-system package was not installed from
+	// one of the StoreInstallers, for example with a browser, a file
+	// manager or `adb install`.
+	Sideloaded bool `json:"sideloaded"`
+	// Downloaded is set when copies of the files of the package were
+	// pulled, and is false when they were skipped by the download policy.
+	Downloaded bool `json:"downloaded"`
+	// UninstalledWithData is set for packages which were uninstalled while
+	// keeping their data, and are only listed by `pm list packages -u`.
+	UninstalledWithData bool `json:"uninstalled_with_data"`
+	// FilesError explains why the files of the package are missing.
+	FilesError string `json:"files_error,omitempty"`
+	// Debuggable and TestOnly are set from the flags of the package, which
+	// are only checked when not in fast mode.
+	Debuggable bool `json:"debuggable"`
+	TestOnly   bool `json:"test_only"`
 }
 
-func (a *ADB) getPackageFiles(packageName string, fast bool) []PackageFile {
-	out, err := a.Shell("pm", "path", packageName)
+// StoreInstallers are the packages of the app stores, installations from
+// which are not considered sideloaded.
+var StoreInstallers = []string{
+	"com.android.vending",             // Google Play Store
+	"com.sec.android.app.samsungapps", // Galaxy Store
+	"com.amazon.venezia",              // Amazon Appstore
+	"org.fdroid.fdroid",               // F-Droid
+}
+
+// isStoreInstaller checks whether the installer is one of the StoreInstallers.
+func isStoreInstaller(installer string) bool {
+	for _, store := range StoreInstallers {
+		if installer == store {
+			return true
+		}
+	}
+	return false
+}
+
+// isSideloaded checks whether the package was installed from outside of an
+// app store. Empty and "null" installers, the package itself, browsers, file
+// managers and the shell are all not stores.
+func isSideloaded(pkg *Package) bool {
+	if pkg.System {
+		return false
+	}
+
+	installer := pkg.Installer
+	if installer == "" || installer == "null" {
+		installer = pkg.InstallingPackage
+	}
+	return !isStoreInstaller(installer)
+}
+
+// pmDumpTimeout is how long `pm dump` is given for a single package, and
+// dumpsysPackageTimeout how long `dumpsys package` is given for all of them.
+const (
+	pmDumpTimeout         = 30 * time.Second
+	dumpsysPackageTimeout = 2 * time.Minute
+)
+
+// getPackageDump returns the output of `pm dump` for the package. The output
+// is cached, as the command is slow and several details are parsed from it.
+func (a *ADB) getPackageDump(packageName string) (string, error) {
+	a.dumpCacheMutex.Lock()
+	out, ok := a.dumpCache[packageName]
+	a.dumpCacheMutex.Unlock()
+	if ok {
+		return out, nil
+	}
+
+	out, err := a.ShellTimeout(pmDumpTimeout, "pm", "dump", packageName)
+	if err != nil && out == "" {
+		return "", fmt.Errorf("failed to run `pm dump %s`: %v", packageName, err)
+	}
+
+	a.dumpCacheMutex.Lock()
+	if a.dumpCache == nil {
+		a.dumpCache = make(map[string]string)
+	}
+	a.dumpCache[packageName] = out
+	a.dumpCacheMutex.Unlock()
+
+	return out, nil
+}
+
+// dumpValue returns the value of the first `key=value` entry found in the
+// `pm dump` output. The value ends at the next space, unless toEOL is set.
+func dumpValue(dump, key string, toEOL bool) string {
+	for _, line := range strings.Split(dump, "\n") {
+		index := strings.Index(line, key+"=")
+		if index == -1 {
+			continue
+		}
+		// Make sure we didn't match the end of a longer key.
+		if index > 0 && line[index-1] != ' ' && line[index-1] != '\t' {
+			continue
+		}
+
+		value := strings.TrimSpace(line[index+len(key)+1:])
+		if !toEOL {
+			value = strings.SplitN(value, " ", 2)[0]
+		}
+		return value
+	}
+
+	return ""
+}
+
+// getPackageVersion returns the version code and version name of the package.
+func (a *ADB) getPackageVersion(packageName string) (int64, string) {
+	dump, err := a.getPackageDump(packageName)
+	if err != nil {
+		log.Debugf("Failed to get version of package %s: %v", packageName, err)
+		return 0, ""
+	}
+
+	versionCode, _ := strconv.ParseInt(dumpValue(dump, "versionCode", false), 10, 64)
+	return versionCode, dumpValue(dump, "versionName", true)
+}
+
+// userSectionRegexp matches the header of the state of a package for a
+// user, as in "User 0: ceDataInode=123 installed=true hidden=false".
+var userSectionRegexp = regexp.MustCompile(`^User (\d+):`)
+
+// indentation returns the number of leading whitespace characters of line.
+func indentation(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " \t"))
+}
+
+// dumpSection returns the trimmed lines nested under every occurrence of the
+// section header in the `pm dump` output.
+func dumpSection(dump, header string) []string {
+	var items []string
+	lines := strings.Split(dump, "\n")
+	for i := 0; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) != header {
+			continue
+		}
+
+		indent := indentation(lines[i])
+		for i+1 < len(lines) {
+			next := lines[i+1]
+			if strings.TrimSpace(next) == "" || indentation(next) <= indent {
+				break
+			}
+			items = append(items, strings.TrimSpace(next))
+			i++
+		}
+	}
+
+	return items
+}
+
+// appendUnique appends value to values unless it is already present.
+func appendUnique(values []string, value string) []string {
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
+
+// splitUserSections splits the `pm dump` output into the lines shared by all
+// users and the lines nested under each "User <id>:" header, which hold the
+// runtime permissions of that user since Android 6.
+func splitUserSections(dump string) (string, map[int]string) {
+	var shared []string
+	users := make(map[int][]string)
+	lines := strings.Split(dump, "\n")
+	for i := 0; i < len(lines); i++ {
+		match := userSectionRegexp.FindStringSubmatch(strings.TrimSpace(lines[i]))
+		if match == nil {
+			shared = append(shared, lines[i])
+			continue
+		}
+
+		user, _ := strconv.Atoi(match[1])
+		indent := indentation(lines[i])
+		for i+1 < len(lines) {
+			next := lines[i+1]
+			if strings.TrimSpace(next) != "" && indentation(next) <= indent {
+				break
+			}
+			users[user] = append(users[user], next)
+			i++
+		}
+	}
+
+	sections := make(map[int]string, len(users))
+	for user, section := range users {
+		sections[user] = strings.Join(section, "\n")
+	}
+	return strings.Join(shared, "\n"), sections
+}
+
+// parsePackagePermissions returns the permissions requested by the package,
+// those granted to the user, and the runtime permissions granted to the user
+// along with their flags. Before Android 6 all the permissions were granted
+// at install time and listed under "grantedPermissions:".
+func parsePackagePermissions(dump string, user int) ([]string, []string, []string) {
+	requested := []string{}
+	granted := []string{}
+	runtime := []string{}
+
+	shared, users := splitUserSections(dump)
+	userDump, ok := users[user]
+	if !ok && len(users) == 0 {
+		userDump = shared
+	}
+
+	for _, item := range dumpSection(shared, "requested permissions:") {
+		requested = appendUnique(requested, strings.SplitN(item, ":", 2)[0])
+	}
+	for _, item := range dumpSection(shared, "grantedPermissions:") {
+		granted = appendUnique(granted, item)
+	}
+	for _, item := range dumpSection(shared, "install permissions:") {
+		if strings.Contains(item, "granted=true") {
+			granted = appendUnique(granted, strings.SplitN(item, ":", 2)[0])
+		}
+	}
+	for _, item := range dumpSection(userDump, "runtime permissions:") {
+		if strings.Contains(item, "granted=true") {
+			granted = appendUnique(granted, strings.SplitN(item, ":", 2)[0])
+			runtime = appendUnique(runtime, item)
+		}
+	}
+
+	return requested, granted, runtime
+}
+
+// getPackagePermissions returns the permissions requested by the package,
+// those which have been granted to it for the user, and the granted runtime
+// permissions along with their grant flags, as in
+// "android.permission.CAMERA: granted=true, flags=[ USER_SET ]".
+func (a *ADB) getPackagePermissions(packageName string, user int) ([]string, []string, []string) {
+	dump, err := a.getPackageDump(packageName)
+	if err != nil {
+		log.Debugf("Failed to get permissions of package %s: %v", packageName, err)
+		return []string{}, []string{}, []string{}
+	}
+
+	return parsePackagePermissions(dump, user)
+}
+
+// getPackageFlags returns whether the package is debuggable and whether it
+// is test only, from the pkgFlags entry of the `pm dump` output.
+func (a *ADB) getPackageFlags(packageName string) (bool, bool) {
+	dump, err := a.getPackageDump(packageName)
+	if err != nil {
+		log.Debugf("Failed to get flags of package %s: %v", packageName, err)
+		return false, false
+	}
+
+	// pkgFlags=[ SYSTEM HAS_CODE DEBUGGABLE ALLOW_CLEAR_USER_DATA ]
+	debuggable, testOnly := false, false
+	flags := strings.Trim(dumpValue(dump, "pkgFlags", true), "[]")
+	for _, flag := range strings.Fields(flags) {
+		switch flag {
+		case "DEBUGGABLE":
+			debuggable = true
+		case "TEST_ONLY":
+			testOnly = true
+		}
+	}
+	return debuggable, testOnly
+}
+
+// getPackageInstallSource returns the package which requested the
+// installation and the one the APK was originally downloaded from. The keys
+// were renamed in Android 11 and again in Android 13, and either might be
+// missing.
+func (a *ADB) getPackageInstallSource(packageName string) (string, string) {
+	dump, err := a.getPackageDump(packageName)
+	if err != nil {
+		log.Debugf("Failed to get install source of package %s: %v", packageName, err)
+		return "", ""
+	}
+
+	installing := dumpValue(dump, "installInitiatingPackageName", false)
+	if installing == "" {
+		installing = dumpValue(dump, "initiatingPackageName", false)
+	}
+	if installing == "" {
+		installing = dumpValue(dump, "installerPackageName", false)
+	}
+	originating := dumpValue(dump, "installOriginatingPackageName", false)
+	if originating == "" {
+		originating = dumpValue(dump, "originatingPackageName", false)
+	}
+
+	// Missing values are printed as "null".
+	if installing == "null" {
+		installing = ""
+	}
+	if originating == "null" {
+		originating = ""
+	}
+
+	return installing, originating
+}
+
+// getPackageDeclaredPermissions returns the permissions defined by the
+// package.
+func (a *ADB) getPackageDeclaredPermissions(packageName string) []string {
+	declared := []string{}
+
+	dump, err := a.getPackageDump(packageName)
+	if err != nil {
+		log.Debugf("Failed to get declared permissions of package %s: %v", packageName, err)
+		return declared
+	}
+
+	for _, item := range dumpSection(dump, "declared permissions:") {
+		declared = appendUnique(declared, strings.SplitN(item, ":", 2)[0])
+	}
+
+	return declared
+}
+
+// splitPackagesDump splits the output of `dumpsys package` into the section
+// of each package, starting with "Package [name] (id):". Only the first
+// section of each package is kept, as hidden system packages are listed
+// again later on.
+func splitPackagesDump(out string) map[string]string {
+	sections := make(map[string]string)
+
+	var name string
+	var section strings.Builder
+	indent := 0
+	flush := func() {
+		if _, ok := sections[name]; name != "" && !ok {
+			sections[name] = section.String()
+		}
+		name = ""
+		section.Reset()
+	}
+
+	for _, line := range strings.Split(out, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "Package [") {
+			flush()
+			end := strings.Index(trimmed, "]")
+			if end == -1 {
+				continue
+			}
+			name = trimmed[len("Package ["):end]
+			indent = indentation(line)
+			section.WriteString(line + "\n")
+			continue
+		}
+		if name == "" {
+			continue
+		}
+		if trimmed != "" && indentation(line) <= indent {
+			flush()
+			continue
+		}
+		section.WriteString(line + "\n")
+	}
+	flush()
+
+	return sections
+}
+
+// loadPackageDumps fills the `pm dump` cache with the sections of a single
+// `dumpsys package` run. It is much faster than dumping every package, but
+// only contains the package details.
+func (a *ADB) loadPackageDumps() error {
+	out, err := a.ShellTimeout(dumpsysPackageTimeout, "dumpsys", "package")
+	if err != nil && out == "" {
+		return fmt.Errorf("failed to run `dumpsys package`: %v", err)
+	}
+
+	sections := splitPackagesDump(out)
+	a.dumpCacheMutex.Lock()
+	if a.dumpCache == nil {
+		a.dumpCache = make(map[string]string)
+	}
+	for name, section := range sections {
+		if _, ok := a.dumpCache[name]; !ok {
+			a.dumpCache[name] = section
+		}
+	}
+	a.dumpCacheMutex.Unlock()
+
+	return nil
+}
+
+// hasPackageDump checks whether the dump of the package is already cached.
+func (a *ADB) hasPackageDump(packageName string) bool {
+	a.dumpCacheMutex.Lock()
+	defer a.dumpCacheMutex.Unlock()
+	_, ok := a.dumpCache[packageName]
+	return ok
+}
+
+// dumpTimeLayout is the format used by `pm dump` for timestamps.
+const dumpTimeLayout = "2006-01-02 15:04:05"
+
+// getPackageTimes returns the time the package was first installed and last
+// updated, in UTC. Zero values are returned if they can't be determined.
+func (a *ADB) getPackageTimes(packageName string) (time.Time, time.Time) {
+	var installTime, lastUpdateTime time.Time
+
+	dump, err := a.getPackageDump(packageName)
+	if err != nil {
+		log.Debugf("Failed to get install times of package %s: %v", packageName, err)
+		return installTime, lastUpdateTime
+	}
+
+	location := a.DeviceLocation()
+	parsed, err := time.ParseInLocation(dumpTimeLayout, dumpValue(dump, "firstInstallTime", true), location)
+	if err == nil {
+		installTime = parsed.UTC()
+	}
+	parsed, err = time.ParseInLocation(dumpTimeLayout, dumpValue(dump, "lastUpdateTime", true), location)
+	if err == nil {
+		lastUpdateTime = parsed.UTC()
+	}
+
+	return installTime, lastUpdateTime
+}
+
+// hashCommands are the commands computing the hashes of a file on the
+// device, along with the label of their hash.
+var hashCommands = []struct {
+	label string
+	cmd   string
+}{
+	{"md5", "md5sum"},
+	{"sha1", "sha1sum"},
+	{"sha256", "sha256sum"},
+	{"sha512", "sha512sum"},
+}
+
+// hashFileScript returns the shell commands printing the hashes of the file,
+// each on a line as in "<id> md5 <hash>". With singlePass the file is only
+// read once, using process substitution. The substituted processes print
+// asynchronously, possibly after the commands that follow, so every line
+// carries the id of the file and the label of its hash.
+func hashFileScript(id int, path string, singlePass bool) string {
+	label := func(hashLabel string) string {
+		return fmt.Sprintf("sed 's/^/%d %s /'", id, hashLabel)
+	}
+
+	if singlePass {
+		// The output of tee is discarded rather than piped, as the
+		// substituted processes would then write to the pipe too.
+		var substitutions []string
+		for _, hashCmd := range hashCommands {
+			substitutions = append(substitutions, fmt.Sprintf(">(%s | %s)", hashCmd.cmd, label(hashCmd.label)))
+		}
+		return fmt.Sprintf("tee %s < %s > /dev/null; wait", strings.Join(substitutions, " "), shellQuote(path))
+	}
+
+	var script []string
+	for _, hashCmd := range hashCommands {
+		script = append(script, fmt.Sprintf("%s %s 2>/dev/null | %s", hashCmd.cmd, shellQuote(path), label(hashCmd.label)))
+	}
+	return strings.Join(script, "; ")
+}
+
+// parseHashLines stores the hashes printed by the hashFileScript of each
+// package file, whose id is its index, and returns which files got at least
+// one hash.
+func parseHashLines(out string, packageFiles []PackageFile) []bool {
+	hashed := make([]bool, len(packageFiles))
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		id, err := strconv.Atoi(fields[0])
+		if err != nil || id < 0 || id >= len(packageFiles) {
+			continue
+		}
+		if setHash(&packageFiles[id], fields[1], fields[2]) {
+			hashed[id] = true
+		}
+	}
+	return hashed
+}
+
+// supportsProcessSubstitution checks once whether the device shell supports
+// process substitution, which is needed for single-pass hashing.
+func (a *ADB) supportsProcessSubstitution() bool {
+	a.procSubstOnce.Do(func() {
+		out, _ := a.Shell("cat /dev/null > >(cat) && echo supported")
+		a.procSubst = strings.TrimSpace(out) == "supported"
+		log.Debugf("Device shell supports process substitution: %t", a.procSubst)
+	})
+	return a.procSubst
+}
+
+// hashPackageFileSinglePass computes all hashes of the package file in one
+// shell invocation.
+func (a *ADB) hashPackageFileSinglePass(packageFile *PackageFile) {
+	out, err := a.Shell(hashFileScript(0, packageFile.Path, true))
+	if err != nil && out == "" {
+		log.Debugf("Failed to hash %s in a single pass: %v", packageFile.Path, err)
+		return
+	}
+
+	packageFiles := []PackageFile{*packageFile}
+	parseHashLines(out, packageFiles)
+	*packageFile = packageFiles[0]
+}
+
+// setHash stores the hash in the field of the package file matching its
+// label, and returns whether the label is known.
+func setHash(packageFile *PackageFile, label, hash string) bool {
+	switch label {
+	case "md5":
+		packageFile.MD5 = hash
+	case "sha1":
+		packageFile.SHA1 = hash
+	case "sha256":
+		packageFile.SHA256 = hash
+	case "sha512":
+		packageFile.SHA512 = hash
+	default:
+		return false
+	}
+	return true
+}
+
+// listMarker precedes the path of each folder in the output of a batched
+// listing.
+const listMarker = "==> "
+
+// hashPackageFiles computes the hashes of all the files of a package in a
+// single shell invocation. Hash utilities missing on the device leave their
+// field empty. Files for which the batch produced no output at all are hashed
+// one by one instead.
+func (a *ADB) hashPackageFiles(packageFiles []PackageFile) {
+	start := time.Now()
+	defer func() {
+		a.hashTime.Add(int64(time.Since(start)))
+	}()
+
+	singlePass := a.supportsProcessSubstitution()
+	var script []string
+	for i, packageFile := range packageFiles {
+		script = append(script, hashFileScript(i, packageFile.Path, singlePass))
+	}
+
+	out, err := a.Shell(strings.Join(script, "; "))
+	if err != nil && out == "" {
+		log.Debugf("Failed to hash package files in a single command: %v", err)
+	}
+
+	hashed := parseHashLines(out, packageFiles)
+	for i := range packageFiles {
+		if !hashed[i] {
+			a.hashPackageFile(&packageFiles[i])
+		}
+	}
+}
+
+// hashPackageFile computes the MD5, SHA1, SHA256 and SHA512 hashes of the
+// package file on the device. If the device shell allows it, all hashes are
+// computed in a single pass. Any hash still missing is then computed with its
+// own command, run concurrently and bounded by MaxHashWorkers. A failed hash
+// command only leaves its own field empty.
+func (a *ADB) hashPackageFile(packageFile *PackageFile) {
+	if a.supportsProcessSubstitution() {
+		a.hashPackageFileSinglePass(packageFile)
+	}
+
+	hashCmds := []struct {
+		cmd   string
+		field *string
+	}{
+		{"md5sum", &packageFile.MD5},
+		{"sha1sum", &packageFile.SHA1},
+		{"sha256sum", &packageFile.SHA256},
+		{"sha512sum", &packageFile.SHA512},
+	}
+
+	workers := a.MaxHashWorkers
+	if workers <= 0 || workers > len(hashCmds) {
+		workers = len(hashCmds)
+	}
+	sem := make(chan struct{}, workers)
+
+	var wg sync.WaitGroup
+	for _, hashCmd := range hashCmds {
+		if *hashCmd.field != "" {
+			continue
+		}
+
+		wg.Add(1)
+		go func(cmd string, field *string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			out, err := a.Shell(cmd, shellQuote(packageFile.Path))
+			if err != nil {
+				log.Debugf("Failed to run %s on %s: %v", cmd, packageFile.Path, err)
+				return
+			}
+			*field = strings.SplitN(out, " ", 2)[0]
+		}(hashCmd.cmd, hashCmd.field)
+	}
+	wg.Wait()
+}
+
+// getPackageFiles returns the files of the package as listed by `pm path`.
+func (a *ADB) getPackageFiles(packageName string, user int) []PackageFile {
+	out, err := a.Shell("pm", "path", "--user", strconv.Itoa(user), packageName)
 	if err != nil {
 		log.Errorf("Failed to get file paths for package %s: %v: %s", packageName, err, out)
 		return []PackageFile{}
@@ -53,44 +745,220 @@ func (a *ADB) getPackageFiles(packageName string, fast bool) []PackageFile {
 			continue
 		}
 
-		packageFile := PackageFile{
-			Path: packagePath,
+		packageFiles = append(packageFiles, newPackageFile(packagePath))
+	}
+
+	return packageFiles
+}
+
+// listDirsBatchSize is the number of folders listed by a single shell
+// command, to stay below the command length limit of older adbd.
+const listDirsBatchSize = 20
+
+// listAPKs lists the APK files found in each of the folders, in as few shell
+// invocations as possible. Folders which could not be listed are missing
+// from the result.
+func (a *ADB) listAPKs(dirs []string) map[string][]string {
+	apks := make(map[string][]string)
+	for start := 0; start < len(dirs); start += listDirsBatchSize {
+		end := start + listDirsBatchSize
+		if end > len(dirs) {
+			end = len(dirs)
+		}
+
+		var script []string
+		for _, dir := range dirs[start:end] {
+			script = append(script, fmt.Sprintf("echo %s; ls %s 2>/dev/null", shellQuote(listMarker+dir), shellQuote(dir)))
+		}
+		out, err := a.Shell(strings.Join(script, "; "))
+		if err != nil && out == "" {
+			log.Debugf("Failed to list package folders: %v", err)
+			continue
 		}
 
-		if !fast {
-			// Not sure if this is useful or not considering packages may
-			// be downloaded later on
-			md5Out, err := a.Shell("md5sum", packagePath)
-			if err == nil {
-				packageFile.MD5 = strings.SplitN(md5Out, " ", 2)[0]
+		current := ""
+		for _, line := range strings.Split(out, "\n") {
+			line = strings.TrimSpace(line)
+			if strings.HasPrefix(line, listMarker) {
+				current = strings.TrimPrefix(line, listMarker)
+				apks[current] = []string{}
+				continue
 			}
-			sha1Out, err := a.Shell("sha1sum", packagePath)
-			if err == nil {
-				packageFile.SHA1 = strings.SplitN(sha1Out, " ", 2)[0]
+			if current != "" && strings.HasSuffix(line, ".apk") {
+				apks[current] = append(apks[current], path.Join(current, line))
 			}
-			sha256Out, err := a.Shell("sha256sum", packagePath)
-			if err == nil {
-				packageFile.SHA256 = strings.SplitN(sha256Out, " ", 2)[0]
+		}
+	}
+
+	return apks
+}
+
+// resolvePackageFiles returns the files of each package from the base APK
+// path printed by `pm list packages -f`. Split APKs can only be found next to
+// a base.apk installed in its own folder, so those folders are listed in a
+// batch. Packages with no usable base path fall back to `pm path`.
+func (a *ADB) resolvePackageFiles(user int, basePaths map[string]string, uninstalled map[string]bool) map[string][]PackageFile {
+	files := make(map[string][]PackageFile, len(basePaths))
+
+	var dirs []string
+	for _, basePath := range basePaths {
+		if path.Base(basePath) == "base.apk" {
+			dirs = append(dirs, path.Dir(basePath))
+		}
+	}
+	dirAPKs := a.listAPKs(dirs)
+
+	for packageName, basePath := range basePaths {
+		if !strings.HasSuffix(basePath, ".apk") {
+			// The files of uninstalled packages are usually gone, and
+			// `pm path` fails for them.
+			if uninstalled[packageName] {
+				files[packageName] = []PackageFile{}
+				continue
 			}
-			sha512Out, err := a.Shell("sha512sum", packagePath)
-			if err == nil {
-				packageFile.SHA512 = strings.SplitN(sha512Out, " ", 2)[0]
+			// The -f output is missing or truncated.
+			files[packageName] = a.getPackageFiles(packageName, user)
+			continue
+		}
+		if path.Base(basePath) != "base.apk" {
+			files[packageName] = []PackageFile{newPackageFile(basePath)}
+			continue
+		}
+
+		apks, ok := dirAPKs[path.Dir(basePath)]
+		if !ok || len(apks) == 0 || apks[0] != basePath {
+			files[packageName] = a.getPackageFiles(packageName, user)
+			continue
+		}
+		packageFiles := []PackageFile{}
+		for _, apk := range apks {
+			packageFiles = append(packageFiles, newPackageFile(apk))
+		}
+		files[packageName] = packageFiles
+	}
+
+	return files
+}
+
+// parsePackageLine parses a line of `pm list packages -f -U -u [-i]`, such
+// as "package:/data/app/com.example-1/base.apk=com.example
+// installer=com.android.vending uid:10123", and returns the package name,
+// base APK path, installer and UID. Fields are matched by their prefix
+// wherever they appear in the line. The path is empty if -f was not used,
+// and the UID is -1 if it is missing.
+func parsePackageLine(line string) (string, string, string, int, bool) {
+	var packageName, packagePath, installer string
+	uid := -1
+	for _, field := range strings.Fields(line) {
+		switch {
+		case strings.HasPrefix(field, "package:"):
+			packageName = strings.TrimPrefix(field, "package:")
+			// The path can contain "=", the package name can't.
+			if index := strings.LastIndex(packageName, "="); index != -1 {
+				packagePath = packageName[:index]
+				packageName = packageName[index+1:]
+			}
+		case strings.HasPrefix(field, "installer="):
+			installer = strings.TrimPrefix(field, "installer=")
+		case strings.HasPrefix(field, "uid:"):
+			value, err := strconv.Atoi(strings.TrimPrefix(field, "uid:"))
+			if err != nil {
+				return "", "", "", -1, false
 			}
+			uid = value
 		}
+	}
 
-		packageFiles = append(packageFiles, packageFile)
+	if packageName == "" {
+		return "", "", "", -1, false
 	}
 
-	return packageFiles
+	return packageName, packagePath, installer, uid, true
 }
 
-// GetPackages returns the list of installed package names.
-func (a *ADB) GetPackages(fast bool) ([]Package, error) {
+// forEachPackage calls fn with every index up to count, running up to
+// PackageWorkers calls concurrently. It returns once all calls are done.
+func (a *ADB) forEachPackage(count int, fn func(i int)) {
+	workers := a.PackageWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				fn(i)
+			}
+		}()
+	}
+
+	for i := 0; i < count; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// Progress receives the advancement of the collection of the packages.
+type Progress interface {
+	SetTotal(n int)
+	Increment()
+}
+
+// GetPackages returns the list of packages installed for every user on the
+// device, sorted by name. A package installed for several users is listed
+// once per user. The progress is incremented once per package processed.
+func (a *ADB) GetPackages(fast bool, progress Progress) ([]Package, error) {
+	users, err := a.GetUsers()
+	if err != nil {
+		log.Debugf("Failed to list users, only looking at the primary one: %v", err)
+	}
+
+	a.hashTime.Store(0)
+	packages := []Package{}
+	// Package files are the same for every user, no need to hash them
+	// again.
+	files := make(map[string][]PackageFile)
+	for _, user := range users {
+		userPackages, err := a.GetUserPackages(user.ID, fast, files, progress)
+		if err != nil {
+			if user.ID == 0 {
+				return packages, err
+			}
+			log.Errorf("Failed to get packages of user %d: %v", user.ID, err)
+			continue
+		}
+		packages = append(packages, userPackages...)
+	}
+
+	sort.SliceStable(packages, func(i, j int) bool {
+		if packages[i].Name != packages[j].Name {
+			return packages[i].Name < packages[j].Name
+		}
+		return packages[i].User < packages[j].User
+	})
+
+	if !fast {
+		log.Infof("Spent %s hashing the files of %d packages", time.Duration(a.hashTime.Load()).Round(time.Millisecond), len(files))
+	}
+
+	return packages, nil
+}
+
+// GetUserPackages returns the list of packages installed for the given user.
+// Files already found for a package name in files are reused instead of being
+// looked up again, and newly found ones are added to it.
+func (a *ADB) GetUserPackages(user int, fast bool, files map[string][]PackageFile, progress Progress) ([]Package, error) {
+	userArg := strconv.Itoa(user)
 	withInstaller := true
-	out, err := a.Shell("pm", "list", "packages", "-U", "-u", "-i")
+	out, err := a.Shell("pm", "list", "packages", "--user", userArg, "-f", "-U", "-u", "-i")
 	if err != nil {
 		// Some phones do not support -i option
-		out, err = a.Shell("pm", "list", "packages", "-U", "-u")
+		out, err = a.Shell("pm", "list", "packages", "--user", userArg, "-f", "-U", "-u")
 		if err != nil {
 			return []Package{}, fmt.Errorf("failed to launch `pm list packages` command: %v",
 				err)
@@ -98,72 +966,151 @@ func (a *ADB) GetPackages(fast bool) ([]Package, error) {
 		withInstaller = false
 	}
 
+	// Packages uninstalled while keeping their data are only listed with -u.
+	var installed map[string]bool
+	installedOut, err := a.Shell("pm", "list", "packages", "--user", userArg)
+	if err != nil {
+		log.Debugf("Failed to list installed packages of user %d: %v", user, err)
+	} else {
+		installed = make(map[string]bool)
+		for _, line := range strings.Split(installedOut, "\n") {
+			if packageName := strings.TrimPrefix(strings.TrimSpace(line), "package:"); packageName != "" {
+				installed[packageName] = true
+			}
+		}
+	}
+
 	packages := []Package{}
-	var installer string
-	var uid int
+	basePaths := make(map[string]string)
+	uninstalled := make(map[string]bool)
 	for _, line := range strings.Split(out, "\n") {
-		fields := strings.Fields(line)
-		packageName := strings.TrimPrefix(strings.TrimSpace(fields[0]), "package:")
-		if withInstaller {
-			installer = strings.TrimPrefix(strings.TrimSpace(fields[1]), "installer=")
-			uid, _ = strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(fields[2]), "uid:"))
-		} else {
-			uid, _ = strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(fields[1]), "uid:"))
-			installer = ""
+		if strings.TrimSpace(line) == "" {
+			continue
 		}
 
-		if packageName == "" {
+		packageName, packagePath, installer, uid, ok := parsePackageLine(line)
+		if !ok {
+			log.Warningf("Skipping malformed line in `pm list packages` output: %q", line)
 			continue
 		}
+		if !withInstaller {
+			installer = ""
+		}
+		if _, ok := files[packageName]; !ok {
+			basePaths[packageName] = packagePath
+		}
+		if installed != nil && !installed[packageName] {
+			uninstalled[packageName] = true
+		}
 
-		newPackage := Package{
-			Name:       packageName,
-			Installer:  installer,
-			UID:        uid,
-			Disabled:   false,
-			System:     false,
-			ThirdParty: false,
-			Files:      a.getPackageFiles(packageName, fast),
+		packages = append(packages, Package{
+			Name:                packageName,
+			Installer:           installer,
+			UID:                 uid,
+			User:                user,
+			Disabled:            false,
+			System:              false,
+			ThirdParty:          false,
+			UninstalledWithData: uninstalled[packageName],
+		})
+	}
+
+	newFiles := a.resolvePackageFiles(user, basePaths, uninstalled)
+	if !fast {
+		// Not sure if this is useful or not considering packages may
+		// be downloaded later on
+		a.forEachPackage(len(packages), func(i int) {
+			packageFiles := newFiles[packages[i].Name]
+			if len(packageFiles) > 0 {
+				a.hashPackageFiles(packageFiles)
+			}
+		})
+	}
+
+	if fast {
+		// A single dumpsys instead of one per package.
+		a.dumpAllOnce.Do(func() {
+			err := a.loadPackageDumps()
+			if err != nil {
+				log.Debugf("Failed to dump packages: %v", err)
+			}
+		})
+	}
+
+	progress.SetTotal(len(packages))
+	a.forEachPackage(len(packages), func(i int) {
+		defer progress.Increment()
+
+		packageName := packages[i].Name
+		if fast && !a.hasPackageDump(packageName) {
+			packages[i].DumpError = "package not found in `dumpsys package` output"
+			return
+		}
+		if _, err := a.getPackageDump(packageName); err != nil {
+			packages[i].DumpError = err.Error()
+			return
 		}
 
-		packages = append(packages, newPackage)
+		packages[i].VersionCode, packages[i].VersionName = a.getPackageVersion(packageName)
+		packages[i].InstallTime, packages[i].LastUpdateTime = a.getPackageTimes(packageName)
+		packages[i].InstallingPackage, packages[i].OriginatingPackage = a.getPackageInstallSource(packageName)
+		packages[i].Permissions, packages[i].GrantedPermissions, packages[i].RuntimePermissions =
+			a.getPackagePermissions(packageName, packages[i].User)
+		packages[i].DeclaredPermissions = a.getPackageDeclaredPermissions(packageName)
+		// Only the output of `pm dump` is reliable enough for the flags.
+		if !fast {
+			packages[i].Debuggable, packages[i].TestOnly = a.getPackageFlags(packageName)
+		}
+	})
+
+	for i := range packages {
+		packageName := packages[i].Name
+		packageFiles, ok := files[packageName]
+		if !ok {
+			packageFiles = newFiles[packageName]
+			if files != nil {
+				files[packageName] = packageFiles
+			}
+		}
+		packages[i].Files = append([]PackageFile{}, packageFiles...)
+		if len(packageFiles) == 0 && packages[i].UninstalledWithData {
+			packages[i].FilesError = "package is uninstalled, only its data was kept"
+		}
 	}
 
-	cmds := []map[string]string{
-		{"field": "Disabled", "arg": "-d"},
-		{"field": "System", "arg": "-s"},
-		{"field": "ThirdParty", "arg": "-3"},
+	index := make(map[string]*Package, len(packages))
+	for i := range packages {
+		index[packages[i].Name] = &packages[i]
 	}
-	for _, cmd := range cmds {
-		out, err = a.Shell("pm", "list", "packages", cmd["arg"])
+
+	filters := []struct {
+		arg string
+		set func(p *Package)
+	}{
+		{"-d", func(p *Package) { p.Disabled = true }},
+		{"-s", func(p *Package) { p.System = true }},
+		{"-3", func(p *Package) { p.ThirdParty = true }},
+	}
+	for _, filter := range filters {
+		out, err = a.Shell("pm", "list", "packages", "--user", userArg, filter.arg)
 		if err != nil && out == "" {
 			log.Infof("Failed to get packages filtered by `%s`: %v: %s\n",
-				cmd["arg"], err, out)
+				filter.arg, err, out)
 			continue
 		}
 
 		for _, line := range strings.Split(out, "\n") {
 			packageName := strings.TrimPrefix(strings.TrimSpace(line), "package:")
-			if packageName == "" {
-				continue
-			}
-
-			for pIndex, p := range packages {
-				if p.Name != packageName {
-					continue
-				}
-
-				elems := reflect.ValueOf(&p).Elem()
-				for i := 0; i < elems.NumField(); i++ {
-					fieldName := elems.Type().Field(i).Name
-					if fieldName == cmd["field"] {
-						reflect.ValueOf(&packages[pIndex]).Elem().FieldByName(fieldName).SetBool(true)
-					}
-				}
+			if pkg, ok := index[packageName]; ok {
+				filter.set(pkg)
 			}
 		}
 	}
 
+	for i := range packages {
+		packages[i].Sideloaded = isSideloaded(&packages[i])
+	}
+
 	return packages, nil
 }
 
@@ -188,3 +1135,132 @@ func (a *ADB) GetPackagePaths(packageName string) ([]string, error) {
 
 	return packagePaths, nil
 }
+
+// invalidFileNameChars are the characters not allowed in file names on
+// NTFS and FAT.
+const invalidFileNameChars = `<>:"/\|?*`
+
+// reservedFileNames are the device names which can't be used as file names
+// on Windows, with or without an extension.
+var reservedFileNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitizeFileName replaces the characters which are invalid on NTFS and FAT
+// with underscores, so that the file can be saved on any platform.
+func sanitizeFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(invalidFileNameChars, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	// Trailing dots and spaces are dropped by Windows.
+	name = strings.TrimRight(name, ". ")
+
+	base := strings.ToUpper(strings.SplitN(name, ".", 2)[0])
+	if name == "" || reservedFileNames[base] {
+		name = "_" + name
+	}
+
+	return name
+}
+
+// localFileName returns the path, relative to the download folder, under
+// which the file of the package is saved, as in "<package>/<basename>".
+// Paths already given during this acquisition get a numeric suffix, so that
+// no file is overwritten.
+func (a *ADB) localFileName(packageName string, remotePath string) string {
+	dir := sanitizeFileName(packageName)
+	name := sanitizeFileName(path.Base(remotePath))
+
+	a.localNamesMutex.Lock()
+	defer a.localNamesMutex.Unlock()
+	if a.localNames == nil {
+		a.localNames = make(map[string]string)
+	}
+
+	ext := filepath.Ext(name)
+	unique := filepath.Join(dir, name)
+	for suffix := 1; ; suffix++ {
+		// Names are compared case-insensitively, like on Windows.
+		owner, ok := a.localNames[strings.ToLower(unique)]
+		if !ok || owner == remotePath {
+			break
+		}
+		unique = filepath.Join(dir, fmt.Sprintf("%s_%d%s", strings.TrimSuffix(name, ext), suffix, ext))
+	}
+	a.localNames[strings.ToLower(unique)] = remotePath
+
+	return unique
+}
+
+// PullPackageAPK downloads all the files of the package into destDir and
+// records their local path, relative to rootDir, in LocalName. rootDir is the
+// folder of the acquisition, which contains destDir. Files are stored in a
+// subdirectory
+// named after the package, so that splits with the same file name in
+// different packages don't collide. When VerifyPulls is enabled, the local
+// copy is checked against the on-device SHA256 and the outcome recorded in
+// Verification.
+func (a *ADB) PullPackageAPK(pkg Package, rootDir, destDir string) error {
+	return a.PullPackageAPKWithProgress(pkg, rootDir, destDir, nil)
+}
+
+// PullPackageAPKWithProgress downloads the package like PullPackageAPK, and
+// reports the progress of each file download to cb.
+func (a *ADB) PullPackageAPKWithProgress(pkg Package, rootDir, destDir string, cb func(file PackageFile, done, total int64)) error {
+	err := os.MkdirAll(filepath.Join(destDir, sanitizeFileName(pkg.Name)), 0o755)
+	if err != nil {
+		return fmt.Errorf("failed to create folder for package %s: %v", pkg.Name, err)
+	}
+
+	var errs []error
+	for i := range pkg.Files {
+		packageFile := &pkg.Files[i]
+		localPath := filepath.Join(destDir, a.localFileName(pkg.Name, packageFile.Path))
+		localName, err := filepath.Rel(rootDir, localPath)
+		if err != nil {
+			return fmt.Errorf("failed to store package %s outside of %s: %v", pkg.Name, rootDir, err)
+		}
+		localName = filepath.ToSlash(localName)
+
+		var fileCb func(done, total int64)
+		if cb != nil {
+			fileCb = func(done, total int64) {
+				cb(*packageFile, done, total)
+			}
+		}
+
+		if a.ResumePulls {
+			if reused, verification := a.ReuseLocalCopy(packageFile.Path, localPath, packageFile.SHA256); reused {
+				packageFile.Verification = verification
+				packageFile.LocalName = localName
+				continue
+			}
+		}
+
+		out, verification, err := a.PullAndVerify(packageFile.Path, localPath, packageFile.SHA256, fileCb)
+		packageFile.Verification = verification
+		if errors.Is(err, ErrHashMismatch) {
+			packageFile.LocalName = localName
+			packageFile.Error = err.Error()
+			errs = append(errs, fmt.Errorf("local copy of %s does not match the device", packageFile.Path))
+			continue
+		} else if err != nil {
+			packageFile.Error = strings.TrimSpace(out)
+			if packageFile.Error == "" {
+				packageFile.Error = err.Error()
+			}
+			errs = append(errs, fmt.Errorf("failed to download %s: %v", packageFile.Path, err))
+			continue
+		}
+		packageFile.LocalName = localName
+	}
+
+	return errors.Join(errs...)
+}
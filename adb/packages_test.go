@@ -0,0 +1,681 @@
+// androidqf - Android Quick Forensics
+// Copyright (c) 2021-2022 Claudio Guarnieri.
+// Use of this software is governed by the MVT License 1.1 that can be found at
+//   https://license.mvt.re/1.1/
+
+package adb
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"base.apk", "base.apk"},
+		{"split_config.ar.apk", "split_config.ar.apk"},
+		{"приложение.apk", "приложение.apk"},
+		{"a:b*c?.apk", "a_b_c_.apk"},
+		{"tab\there.apk", "tab_here.apk"},
+		{"trailing. ", "trailing"},
+		{"CON", "_CON"},
+		{"nul.apk", "_nul.apk"},
+		{"com1.txt", "_com1.txt"},
+		{"console.apk", "console.apk"},
+		{"", "_"},
+	}
+
+	for _, test := range tests {
+		if got := sanitizeFileName(test.name); got != test.want {
+			t.Errorf("sanitizeFileName(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLocalFileName(t *testing.T) {
+	tests := []struct {
+		packageName string
+		remotePath  string
+		want        string
+	}{
+		// Two packages shipping base.apk get their own folder.
+		{"com.example.one", "/data/app/com.example.one-1/base.apk", filepath.Join("com.example.one", "base.apk")},
+		{"com.example.two", "/data/app/com.example.two-1/base.apk", filepath.Join("com.example.two", "base.apk")},
+		// The same file asked for again keeps its name.
+		{"com.example.one", "/data/app/com.example.one-1/base.apk", filepath.Join("com.example.one", "base.apk")},
+		// Names differing only by case collide on case-insensitive filesystems.
+		{"com.example.one", "/data/app/com.example.one-1/BASE.apk", filepath.Join("com.example.one", "BASE_1.apk")},
+		{"com.example.one", "/data/app/com.example.one-2/base.apk", filepath.Join("com.example.one", "base_2.apk")},
+		{"com.example.one", "/data/app/com.example.one-1/split_config.ar.apk", filepath.Join("com.example.one", "split_config.ar.apk")},
+		{"com.example.ünï", "/data/app/com.example.ünï-1/分割.apk", filepath.Join("com.example.ünï", "分割.apk")},
+		{"com.example.bad", "/data/app/com.example.bad-1/a:b?.apk", filepath.Join("com.example.bad", "a_b_.apk")},
+	}
+
+	a := &ADB{}
+	for _, test := range tests {
+		if got := a.localFileName(test.packageName, test.remotePath); got != test.want {
+			t.Errorf("localFileName(%q, %q) = %q, want %q", test.packageName, test.remotePath, got, test.want)
+		}
+	}
+}
+
+// TestPackageDump parses `pm dump` samples of several Android versions, each
+// with a package installed for the primary user and a secondary one.
+func TestPackageDump(t *testing.T) {
+	tests := []struct {
+		fixture     string
+		versionCode int64
+		versionName string
+		installing  string
+		originating string
+		debuggable  bool
+		requested   []string
+		// granted and runtime are indexed by user.
+		granted map[int][]string
+		runtime map[int][]string
+	}{
+		{
+			fixture:     "pm_dump_api22.txt",
+			versionCode: 42,
+			versionName: "1.4.2",
+			installing:  "com.android.vending",
+			requested:   []string{},
+			granted: map[int][]string{
+				0:  {"android.permission.INTERNET", "android.permission.RECORD_AUDIO", "android.permission.READ_SMS"},
+				10: {"android.permission.INTERNET", "android.permission.RECORD_AUDIO", "android.permission.READ_SMS"},
+			},
+			runtime: map[int][]string{0: {}, 10: {}},
+		},
+		{
+			fixture:     "pm_dump_api23.txt",
+			versionCode: 105,
+			versionName: "2.0.5",
+			installing:  "com.android.vending",
+			requested:   []string{"android.permission.INTERNET", "android.permission.CAMERA", "android.permission.READ_CONTACTS"},
+			granted: map[int][]string{
+				0:  {"android.permission.INTERNET", "android.permission.CAMERA"},
+				10: {"android.permission.INTERNET", "android.permission.READ_CONTACTS"},
+			},
+			runtime: map[int][]string{
+				0:  {"android.permission.CAMERA: granted=true, flags=[ USER_SET ]"},
+				10: {"android.permission.READ_CONTACTS: granted=true, flags=[ USER_SET ]"},
+			},
+		},
+		{
+			fixture:     "pm_dump_api28.txt",
+			versionCode: 30100,
+			versionName: "3.1.0 (beta)",
+			installing:  "com.android.vending",
+			debuggable:  true,
+			requested: []string{
+				"android.permission.INTERNET", "android.permission.ACCESS_FINE_LOCATION",
+				"android.permission.RECORD_AUDIO", "com.example.app.permission.C2D_MESSAGE",
+			},
+			granted: map[int][]string{
+				0: {
+					"com.example.app.permission.C2D_MESSAGE", "android.permission.INTERNET",
+					"android.permission.ACCESS_FINE_LOCATION", "android.permission.RECORD_AUDIO",
+				},
+				10: {"com.example.app.permission.C2D_MESSAGE", "android.permission.INTERNET"},
+			},
+			runtime: map[int][]string{
+				0: {
+					"android.permission.ACCESS_FINE_LOCATION: granted=true, flags=[ USER_SET ]",
+					"android.permission.RECORD_AUDIO: granted=true, flags=[ USER_SET ]",
+				},
+				10: {},
+			},
+		},
+		{
+			fixture:     "pm_dump_api30.txt",
+			versionCode: 4020001,
+			versionName: "4.2.0",
+			installing:  "com.android.chrome",
+			requested: []string{
+				"android.permission.INTERNET", "android.permission.READ_SMS",
+				"android.permission.RECEIVE_SMS", "android.permission.BIND_ACCESSIBILITY_SERVICE",
+			},
+			granted: map[int][]string{
+				0:  {"android.permission.INTERNET", "android.permission.READ_SMS", "android.permission.RECEIVE_SMS"},
+				10: {"android.permission.INTERNET"},
+			},
+			runtime: map[int][]string{
+				0: {
+					"android.permission.READ_SMS: granted=true, flags=[ USER_SET|RESTRICTION_INSTALLER_EXEMPT ]",
+					"android.permission.RECEIVE_SMS: granted=true, flags=[ USER_SET|RESTRICTION_INSTALLER_EXEMPT ]",
+				},
+				10: {},
+			},
+		},
+		{
+			fixture:     "pm_dump_api34.txt",
+			versionCode: 7310042,
+			versionName: "7.31.0",
+			installing:  "com.android.chrome",
+			requested: []string{
+				"android.permission.INTERNET", "android.permission.POST_NOTIFICATIONS",
+				"android.permission.CAMERA", "android.permission.RECORD_AUDIO",
+				"android.permission.FOREGROUND_SERVICE", "com.example.app.permission.PUSH",
+			},
+			granted: map[int][]string{
+				0: {
+					"android.permission.FOREGROUND_SERVICE", "android.permission.INTERNET",
+					"com.example.app.permission.PUSH", "android.permission.POST_NOTIFICATIONS",
+				},
+				10: {
+					"android.permission.FOREGROUND_SERVICE", "android.permission.INTERNET",
+					"com.example.app.permission.PUSH", "android.permission.CAMERA", "android.permission.RECORD_AUDIO",
+				},
+			},
+			runtime: map[int][]string{
+				0: {"android.permission.POST_NOTIFICATIONS: granted=true, flags=[ USER_SET|USER_SENSITIVE_WHEN_GRANTED|USER_SENSITIVE_WHEN_DENIED ]"},
+				10: {
+					"android.permission.CAMERA: granted=true, flags=[ USER_SET|USER_SENSITIVE_WHEN_GRANTED|USER_SENSITIVE_WHEN_DENIED ]",
+					"android.permission.RECORD_AUDIO: granted=true, flags=[ USER_SET|USER_SENSITIVE_WHEN_GRANTED|USER_SENSITIVE_WHEN_DENIED ]",
+				},
+			},
+		},
+	}
+
+	const packageName = "com.example.app"
+	for _, test := range tests {
+		t.Run(test.fixture, func(t *testing.T) {
+			dump, err := os.ReadFile(filepath.Join("testdata", test.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := &ADB{dumpCache: map[string]string{packageName: string(dump)}}
+
+			versionCode, versionName := a.getPackageVersion(packageName)
+			if versionCode != test.versionCode || versionName != test.versionName {
+				t.Errorf("got version %d %q, want %d %q", versionCode, versionName, test.versionCode, test.versionName)
+			}
+			installing, originating := a.getPackageInstallSource(packageName)
+			if installing != test.installing || originating != test.originating {
+				t.Errorf("got install source %q %q, want %q %q", installing, originating, test.installing, test.originating)
+			}
+			if debuggable, testOnly := a.getPackageFlags(packageName); debuggable != test.debuggable || testOnly {
+				t.Errorf("got debuggable %v and test only %v", debuggable, testOnly)
+			}
+
+			for user := range test.granted {
+				requested, granted, runtime := a.getPackagePermissions(packageName, user)
+				if !reflect.DeepEqual(requested, test.requested) {
+					t.Errorf("user %d: got requested %v, want %v", user, requested, test.requested)
+				}
+				if !reflect.DeepEqual(granted, test.granted[user]) {
+					t.Errorf("user %d: got granted %v, want %v", user, granted, test.granted[user])
+				}
+				if !reflect.DeepEqual(runtime, test.runtime[user]) {
+					t.Errorf("user %d: got runtime %v, want %v", user, runtime, test.runtime[user])
+				}
+			}
+		})
+	}
+}
+
+func TestSplitUserSections(t *testing.T) {
+	dump := "    pkgFlags=[ HAS_CODE ]\n" +
+		"    User 0: installed=true\n" +
+		"      runtime permissions:\n" +
+		"        android.permission.CAMERA: granted=true\n" +
+		"    User 10: installed=true\n" +
+		"      gids=[3003]\n" +
+		"  Queries:\n"
+
+	shared, users := splitUserSections(dump)
+	if shared != "    pkgFlags=[ HAS_CODE ]\n  Queries:\n" {
+		t.Errorf("got shared lines %q", shared)
+	}
+	if len(users) != 2 || users[10] != "      gids=[3003]" {
+		t.Errorf("got users %q", users)
+	}
+}
+
+// writeHashFixtures writes count files of size bytes, with names needing to
+// be quoted, and returns them as package files.
+func writeHashFixtures(tb testing.TB, count, size int) []PackageFile {
+	tb.Helper()
+	dir := tb.TempDir()
+	packageFiles := []PackageFile{}
+	for i := 0; i < count; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, size)
+		filePath := filepath.Join(dir, fmt.Sprintf("split's $config %d.apk", i))
+		if err := os.WriteFile(filePath, data, 0o644); err != nil {
+			tb.Fatal(err)
+		}
+		packageFiles = append(packageFiles, PackageFile{Path: filePath})
+	}
+	return packageFiles
+}
+
+// withProcessSubstitution forces whether the device shell is considered to
+// support process substitution.
+func withProcessSubstitution(a *ADB, supported bool) *ADB {
+	a.procSubstOnce.Do(func() {
+		a.procSubst = supported
+	})
+	return a
+}
+
+func TestHashPackageFiles(t *testing.T) {
+	for _, singlePass := range []bool{true, false} {
+		t.Run(fmt.Sprintf("single pass %t", singlePass), func(t *testing.T) {
+			a := withProcessSubstitution(newFakeADB(t, fakeShell), singlePass)
+			packageFiles := writeHashFixtures(t, 5, 64*1024)
+			a.hashPackageFiles(packageFiles)
+
+			for i, packageFile := range packageFiles {
+				data := bytes.Repeat([]byte{byte(i)}, 64*1024)
+				md5sum := md5.Sum(data)
+				sha1sum := sha1.Sum(data)
+				sha256sum := sha256.Sum256(data)
+				sha512sum := sha512.Sum512(data)
+				want := PackageFile{
+					Path:   packageFile.Path,
+					MD5:    hex.EncodeToString(md5sum[:]),
+					SHA1:   hex.EncodeToString(sha1sum[:]),
+					SHA256: hex.EncodeToString(sha256sum[:]),
+					SHA512: hex.EncodeToString(sha512sum[:]),
+				}
+				if !reflect.DeepEqual(packageFile, want) {
+					t.Errorf("got %+v, want %+v", packageFile, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseHashLines(t *testing.T) {
+	// The lines of the substituted processes can come in any order, and
+	// after the ones of the following file.
+	out := "1 sha512 bbbb\n" +
+		"0 sha256 aaaa\n" +
+		"1 md5 cccc\n" +
+		"3 md5 dddd\n" +
+		"garbage\n" +
+		"0 sha3 eeee\n"
+	packageFiles := make([]PackageFile, 3)
+	hashed := parseHashLines(out, packageFiles)
+	if !reflect.DeepEqual(hashed, []bool{true, true, false}) {
+		t.Errorf("got hashed %v", hashed)
+	}
+	if packageFiles[0].SHA256 != "aaaa" || packageFiles[1].SHA512 != "bbbb" || packageFiles[1].MD5 != "cccc" {
+		t.Errorf("got %+v", packageFiles)
+	}
+}
+
+// BenchmarkHashPackageFiles compares hashing the files of a package in a
+// single batch, with and without process substitution, to hashing each file
+// with its own commands.
+func BenchmarkHashPackageFiles(b *testing.B) {
+	const count, size = 5, 4 * 1024 * 1024
+
+	for _, singlePass := range []bool{true, false} {
+		b.Run(fmt.Sprintf("batch single pass %t", singlePass), func(b *testing.B) {
+			a := withProcessSubstitution(newFakeADB(b, fakeShell), singlePass)
+			packageFiles := writeHashFixtures(b, count, size)
+			b.SetBytes(count * size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				a.hashPackageFiles(packageFiles)
+			}
+		})
+	}
+
+	b.Run("per file", func(b *testing.B) {
+		a := withProcessSubstitution(newFakeADB(b, fakeShell), false)
+		packageFiles := writeHashFixtures(b, count, size)
+		b.SetBytes(count * size)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for j := range packageFiles {
+				packageFiles[j] = PackageFile{Path: packageFiles[j].Path}
+				a.hashPackageFile(&packageFiles[j])
+			}
+		}
+	})
+}
+
+// TestParsePackageLine parses `pm list packages --user 0 -f -U -u -i`
+// samples of Android 8 to 14, which all list com.example.app.
+func TestParsePackageLine(t *testing.T) {
+	tests := []struct {
+		fixture   string
+		count     int
+		path      string
+		installer string
+	}{
+		{"pm_list_packages_api26.txt", 5, "/data/app/com.example.app-1/base.apk", "com.google.android.packageinstaller"},
+		{"pm_list_packages_api28.txt", 5, "/data/app/com.example.app-Kd9sPq2WmX7yLc4RtBn0Ug==/base.apk", "com.google.android.packageinstaller"},
+		{"pm_list_packages_api29.txt", 4, "/data/app/com.example.app-Lr1tQm8WpZ3xKs6YvBn2Hg==/base.apk", "com.google.android.packageinstaller"},
+		{"pm_list_packages_api30.txt", 4, "/data/app/~~Rb9TqA3c0kX1yZ2wV4uS5g==/com.example.app-Fh7Kp0Lm2Nq4Rs6Tu8Vw0A==/base.apk", "com.google.android.packageinstaller"},
+		{"pm_list_packages_api31.txt", 4, "/data/app/~~Wm4Xn6Yo8Zp0Aq2Br4Cs6D==/com.example.app-Et8Fu0Gv2Hw4Ix6Jy8Kz0A==/base.apk", "com.google.android.packageinstaller"},
+		{"pm_list_packages_api33.txt", 4, "/data/app/~~Cd2Ef4Gh6Ij8Kl0Mn2Op4Q==/com.example.app-Rs6Tu8Vw0Xy2Za4Bc6De8F==/base.apk", "com.android.chrome"},
+		{"pm_list_packages_api34.txt", 5, "/data/app/~~w2Xy4Zb6Cd8Ef0Gh2Ij4Kl==/com.example.app-Mn6Op8Qr0St2Uv4Wx6Yz8A==/base.apk", "com.google.android.packageinstaller"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.fixture, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", test.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			count := 0
+			found := false
+			for _, line := range strings.Split(string(data), "\n") {
+				if strings.TrimSpace(line) == "" {
+					continue
+				}
+				name, packagePath, installer, uid, ok := parsePackageLine(line)
+				if !ok {
+					t.Errorf("failed to parse %q", line)
+					continue
+				}
+				count++
+				if uid < 1000 || !strings.HasSuffix(packagePath, ".apk") || installer == "" {
+					t.Errorf("got %q %q %q %d for %q", name, packagePath, installer, uid, line)
+				}
+				if name == "com.example.app" {
+					found = true
+					if packagePath != test.path || installer != test.installer || uid != 10112 {
+						t.Errorf("got %q %q %d", packagePath, installer, uid)
+					}
+				}
+			}
+			if count != test.count || !found {
+				t.Errorf("got %d packages, want %d with com.example.app", count, test.count)
+			}
+		})
+	}
+}
+
+func TestParsePackageLineMalformed(t *testing.T) {
+	tests := []struct {
+		line string
+		ok   bool
+		name string
+		uid  int
+	}{
+		{"", false, "", -1},
+		{"Error: java.lang.SecurityException", false, "", -1},
+		{"package:com.example.app", true, "com.example.app", -1},
+		{"uid:10112 installer=com.android.vending package:com.example.app", true, "com.example.app", 10112},
+		{"package:/data/app/x==/base.apk=com.example.app uid:abc", false, "", -1},
+		{"package:/data/app/base.apk= uid:10112", false, "", -1},
+	}
+
+	for _, test := range tests {
+		name, _, _, uid, ok := parsePackageLine(test.line)
+		if ok != test.ok || name != test.name || uid != test.uid {
+			t.Errorf("parsePackageLine(%q) = %q %d %v", test.line, name, uid, ok)
+		}
+	}
+}
+
+// TestGetUserPackagesWithoutInstaller covers devices which don't support
+// the -i option of `pm list packages`.
+func TestGetUserPackagesWithoutInstaller(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "pm_list_packages_api28.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	withoutInstaller := regexp.MustCompile(`  installer=\S+`).ReplaceAllString(string(data), "")
+
+	a, calls := newFakeDevice(t, []fakeCommand{
+		{pattern: "'pm list packages --user 0 -f -U -u -i'", out: "Error: Unknown option: -i\n", status: 1},
+		{pattern: "'pm list packages --user 0 -f -U -u'", out: withoutInstaller},
+		{pattern: "'pm list packages --user 0 -3'", out: "package:com.example.app\npackage:com.whatsapp\n"},
+		{pattern: "'pm list packages --user 0'*", out: ""},
+		{pattern: "'dumpsys package'", out: ""},
+	})
+	packages, err := a.GetUserPackages(0, true, nil, noopProgress{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(packages) != 5 {
+		t.Fatalf("got %d packages, want 5: %v", len(packages), calls())
+	}
+	for _, pkg := range packages {
+		if pkg.Installer != "" {
+			t.Errorf("got installer %q for %s", pkg.Installer, pkg.Name)
+		}
+		if pkg.Name == "com.example.app" && (pkg.UID != 10112 || !pkg.ThirdParty) {
+			t.Errorf("got %+v", pkg)
+		}
+	}
+}
+
+// FuzzParsePackageLine makes sure that no line can make the parser panic,
+// and that the package names returned are plausible.
+func FuzzParsePackageLine(f *testing.F) {
+	fixtures, _ := filepath.Glob(filepath.Join("testdata", "pm_list_packages_*.txt"))
+	for _, fixture := range fixtures {
+		data, err := os.ReadFile(fixture)
+		if err != nil {
+			f.Fatal(err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			f.Add(line)
+		}
+	}
+	f.Add("package:=")
+	f.Add("package: uid: installer=")
+
+	f.Fuzz(func(t *testing.T, line string) {
+		name, _, _, _, ok := parsePackageLine(line)
+		if ok && (name == "" || strings.ContainsAny(name, "= \t\n")) {
+			t.Errorf("parsePackageLine(%q) returned the package name %q", line, name)
+		}
+	})
+}
+
+// writePackageDirs creates the folders of count packages installed with a
+// base.apk and the given splits, and returns their base APK paths along with
+// the answers of a fake device to `pm path`.
+func writePackageDirs(tb testing.TB, count int, splits []string) (map[string]string, []fakeCommand) {
+	tb.Helper()
+	root := tb.TempDir()
+	basePaths := make(map[string]string)
+	commands := []fakeCommand{}
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("com.example.app%d", i)
+		dir := filepath.Join(root, name+"-1")
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			tb.Fatal(err)
+		}
+
+		var pmPath strings.Builder
+		for _, file := range append([]string{"base.apk"}, splits...) {
+			if err := os.WriteFile(filepath.Join(dir, file), nil, 0o644); err != nil {
+				tb.Fatal(err)
+			}
+			fmt.Fprintf(&pmPath, "package:%s\n", filepath.ToSlash(filepath.Join(dir, file)))
+		}
+		basePaths[name] = filepath.ToSlash(filepath.Join(dir, "base.apk"))
+		commands = append(commands, fakeCommand{
+			pattern: shellQuote("pm path --user 0 " + name),
+			out:     pmPath.String(),
+		})
+	}
+	return basePaths, commands
+}
+
+// TestResolvePackageFiles checks that the files found from the paths of
+// `pm list packages -f` are the same as with `pm path`, with fewer shell
+// commands.
+func TestResolvePackageFiles(t *testing.T) {
+	splits := []string{"split_config.arm64_v8a.apk", "split_config.en.apk", "split_config.xxhdpi.apk"}
+	basePaths, commands := writePackageDirs(t, 30, splits)
+	a, calls := newFakeDevice(t, commands)
+
+	files := a.resolvePackageFiles(0, basePaths, nil)
+	listCalls := len(calls())
+	for name := range basePaths {
+		want := a.getPackageFiles(name, 0)
+		if len(want) != 4 || !reflect.DeepEqual(files[name], want) {
+			t.Errorf("got %+v for %s, want %+v", files[name], name, want)
+		}
+	}
+	pmPathCalls := len(calls()) - listCalls
+
+	if listCalls != 2 || pmPathCalls != 30 {
+		t.Errorf("got %d shell commands with the listing and %d with `pm path`", listCalls, pmPathCalls)
+	}
+}
+
+// BenchmarkResolvePackageFiles compares finding the files of the packages
+// from the output of `pm list packages -f` to running `pm path` for each.
+func BenchmarkResolvePackageFiles(b *testing.B) {
+	splits := []string{"split_config.arm64_v8a.apk", "split_config.en.apk"}
+	basePaths, commands := writePackageDirs(b, 100, splits)
+
+	b.Run("pm list packages -f", func(b *testing.B) {
+		a, calls := newFakeDevice(b, commands)
+		for i := 0; i < b.N; i++ {
+			a.resolvePackageFiles(0, basePaths, nil)
+		}
+		b.ReportMetric(float64(len(calls()))/float64(b.N), "shells/op")
+	})
+
+	b.Run("pm path", func(b *testing.B) {
+		a, calls := newFakeDevice(b, commands)
+		for i := 0; i < b.N; i++ {
+			for name := range basePaths {
+				a.getPackageFiles(name, 0)
+			}
+		}
+		b.ReportMetric(float64(len(calls()))/float64(b.N), "shells/op")
+	})
+}
+
+// TestPullPackageSplits pulls two packages installed with five splits of the
+// same names, which must each be stored in the folder of their package.
+func TestPullPackageSplits(t *testing.T) {
+	splits := []string{
+		"split_config.arm64_v8a.apk",
+		"split_config.en.apk",
+		"split_config.fr.apk",
+		"split_config.xxhdpi.apk",
+		"split_feature_camera.apk",
+	}
+	basePaths, commands := writePackageDirs(t, 2, splits)
+	for name, basePath := range basePaths {
+		for _, file := range append([]string{"base.apk"}, splits...) {
+			filePath := filepath.Join(filepath.Dir(filepath.FromSlash(basePath)), file)
+			if err := os.WriteFile(filePath, []byte(name+"/"+file), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	a, _ := newFakeDevice(t, commands)
+	files := a.resolvePackageFiles(0, basePaths, nil)
+
+	rootDir := t.TempDir()
+	destDir := filepath.Join(rootDir, "apks")
+	for name := range basePaths {
+		packageFiles := files[name]
+		if len(packageFiles) != 6 {
+			t.Fatalf("got %d files for %s, want 6", len(packageFiles), name)
+		}
+		if packageFiles[0].Type != PackageFileBase || packageFiles[0].SplitName != "" {
+			t.Errorf("got %+v for the base APK", packageFiles[0])
+		}
+		for i, split := range splits {
+			packageFile := packageFiles[i+1]
+			splitName := strings.TrimSuffix(strings.TrimPrefix(split, "split_"), ".apk")
+			if packageFile.Type != PackageFileSplit || packageFile.SplitName != splitName {
+				t.Errorf("got type %q and split name %q for %s", packageFile.Type, packageFile.SplitName, packageFile.Path)
+			}
+		}
+
+		pkg := Package{Name: name, Files: packageFiles}
+		if err := a.PullPackageAPKWithProgress(pkg, rootDir, destDir, nil); err != nil {
+			t.Fatal(err)
+		}
+		for _, packageFile := range pkg.Files {
+			// The path is relative to the acquisition folder.
+			want := "apks/" + name + "/" + path.Base(packageFile.Path)
+			if packageFile.LocalName != want {
+				t.Errorf("got local name %q, want %q", packageFile.LocalName, want)
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join(rootDir, filepath.FromSlash(packageFile.LocalName)))
+			if err != nil || string(data) != name+"/"+path.Base(packageFile.Path) {
+				t.Errorf("got content %q for %s: %v", data, packageFile.LocalName, err)
+			}
+		}
+	}
+}
+
+// TestPackageTimes parses the install times and source from `dumpsys
+// package` samples of Android 9, 12 and 14.
+func TestPackageTimes(t *testing.T) {
+	tests := []struct {
+		fixture     string
+		installTime string
+		updateTime  string
+		installing  string
+		originating string
+	}{
+		{"pm_dump_api28.txt", "2019-11-04T18:21:12Z", "2019-11-04T18:21:12Z", "com.android.vending", ""},
+		{"pm_dump_api31.txt", "2022-08-30T16:45:04Z", "2022-09-12T07:03:19Z", "org.mozilla.firefox", "org.mozilla.firefox"},
+		// The install time moved to the state of each user.
+		{"pm_dump_api34.txt", "2024-05-22T08:44:19Z", "2024-05-22T08:44:19Z", "com.android.chrome", ""},
+	}
+
+	const packageName = "com.example.app"
+	for _, test := range tests {
+		t.Run(test.fixture, func(t *testing.T) {
+			dump, err := os.ReadFile(filepath.Join("testdata", test.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := &ADB{dumpCache: map[string]string{packageName: string(dump)}}
+			a.locationOnce.Do(func() {
+				a.location = time.UTC
+			})
+
+			installTime, updateTime := a.getPackageTimes(packageName)
+			if got := installTime.Format(time.RFC3339); got != test.installTime {
+				t.Errorf("got install time %s, want %s", got, test.installTime)
+			}
+			if got := updateTime.Format(time.RFC3339); got != test.updateTime {
+				t.Errorf("got update time %s, want %s", got, test.updateTime)
+			}
+			installing, originating := a.getPackageInstallSource(packageName)
+			if installing != test.installing || originating != test.originating {
+				t.Errorf("got install source %q %q, want %q %q", installing, originating, test.installing, test.originating)
+			}
+		})
+	}
+
+	// Missing or unexpected values are left empty.
+	a := &ADB{dumpCache: map[string]string{packageName: "    firstInstallTime=yesterday\n"}}
+	a.locationOnce.Do(func() {
+		a.location = time.UTC
+	})
+	installTime, updateTime := a.getPackageTimes(packageName)
+	installing, originating := a.getPackageInstallSource(packageName)
+	if !installTime.IsZero() || !updateTime.IsZero() || installing != "" || originating != "" {
+		t.Errorf("got %v %v %q %q", installTime, updateTime, installing, originating)
+	}
+}
@@ -0,0 +1,84 @@
+// androidqf - Android Quick Forensics
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this software is governed by the MVT License 1.1 that can be found at
+//   https://license.mvt.re/1.1/
+
+package adb
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mvt-project/androidqf/log"
+)
+
+const (
+	// DefaultMaxRetries is the default number of times a command is
+	// retried after the device reconnected.
+	DefaultMaxRetries = 3
+	// DefaultReconnectTimeout is the default time to wait for a
+	// disconnected device to come back.
+	DefaultReconnectTimeout = 2 * time.Minute
+	// DefaultRetryBackoff is the default time to wait before retrying a
+	// command after the device disconnected.
+	DefaultRetryBackoff = 2 * time.Second
+)
+
+// isDisconnected checks whether adb failed because the device went away.
+func isDisconnected(err error) bool {
+	return errors.Is(err, ErrNoDevice) ||
+		errors.Is(err, ErrDeviceOffline) ||
+		errors.Is(err, ErrDeviceUnauthorized)
+}
+
+// Reconnect asks adb to reconnect to the device and waits for it to come
+// back, up to ReconnectTimeout. It returns false if the device did not come
+// back in time.
+func (a *ADB) Reconnect() bool {
+	return a.waitForDevice(a.context(), a.RetryBackoff)
+}
+
+// waitForDevice waits for backoff, then blocks until the device is back, up
+// to ReconnectTimeout. It returns false if the device did not come back in
+// time.
+func (a *ADB) waitForDevice(ctx context.Context, backoff time.Duration) bool {
+	log.Warningf("Device disconnected at %s, waiting up to %s for it to reconnect...",
+		time.Now().UTC().Format(time.RFC3339), a.ReconnectTimeout)
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(backoff):
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, a.ReconnectTimeout)
+	defer cancel()
+
+	// adb does not reliably reconnect to TCP/IP devices on its own.
+	if a.TCPAddress != "" {
+		if !a.reconnectTCP(waitCtx) {
+			log.Errorf("Device did not reconnect by %s",
+				time.Now().UTC().Format(time.RFC3339))
+			return false
+		}
+		log.Infof("Device reconnected at %s", time.Now().UTC().Format(time.RFC3339))
+		return true
+	}
+
+	// Reset the USB transport, which brings back devices stuck offline.
+	_, err := a.execOnce(waitCtx, "reconnect")
+	if err != nil {
+		log.Debugf("Failed to run `adb reconnect`: %v", err)
+	}
+
+	_, err = a.execOnce(waitCtx, "wait-for-device")
+	if err != nil {
+		log.Errorf("Device did not reconnect by %s: %v",
+			time.Now().UTC().Format(time.RFC3339), err)
+		return false
+	}
+
+	log.Infof("Device reconnected at %s", time.Now().UTC().Format(time.RFC3339))
+	return true
+}
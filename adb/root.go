@@ -0,0 +1,139 @@
+// androidqf - Android Quick Forensics
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this software is governed by the MVT License 1.1 that can be found at
+//   https://license.mvt.re/1.1/
+
+package adb
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/mvt-project/androidqf/log"
+)
+
+// Methods used to run commands as root.
+const (
+	RootNone = ""
+	// RootAdbd means adbd itself runs as root, either because the device
+	// is a debug build or because `adb root` succeeded.
+	RootAdbd = "adbd"
+	// RootSu means commands are run through a working su binary.
+	RootSu = "su"
+)
+
+// ErrNoRoot is returned when a command requires root and the device does
+// not provide it.
+var ErrNoRoot = errors.New("root access is not available on the device")
+
+// isRootID checks whether the output of `id` is the one of the root user.
+func isRootID(out string) bool {
+	return strings.Contains(out, "uid=0(")
+}
+
+// shellQuote quotes a command so it can be passed as a single argument to
+// the device shell.
+func shellQuote(cmd string) string {
+	return "'" + strings.ReplaceAll(cmd, "'", `'\''`) + "'"
+}
+
+// RootMethod returns how root access can be obtained on the device, or
+// RootNone. The check is only done once. `adb root` is only attempted when
+// AdbRoot is enabled.
+func (a *ADB) RootMethod() string {
+	a.rootOnce.Do(func() {
+		out, _ := a.Shell("id")
+		if isRootID(out) {
+			a.rootMethod = RootAdbd
+			return
+		}
+
+		out, _ = a.Shell("su", "-c", "id")
+		if isRootID(out) {
+			a.rootMethod = RootSu
+			return
+		}
+
+		if a.AdbRoot && a.restartAdbdAsRoot() {
+			a.rootMethod = RootAdbd
+		}
+	})
+
+	return a.rootMethod
+}
+
+// restartAdbdAsRoot runs `adb root`, which only works on userdebug and eng
+// builds, waits for the device to come back and checks that adbd runs as
+// root.
+func (a *ADB) restartAdbdAsRoot() bool {
+	out, err := a.Exec("root")
+	// Production builds refuse without failing.
+	if err != nil || strings.Contains(string(out), "cannot run as root") {
+		log.Debugf("Failed to restart adbd as root: %v: %s", err, strings.TrimSpace(string(out)))
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(a.context(), a.ReconnectTimeout)
+	defer cancel()
+	// Restarting adbd drops the connection to devices over wireless
+	// debugging.
+	if a.TCPAddress != "" {
+		if !a.reconnectTCP(ctx) {
+			log.Errorf("Device did not reconnect after restarting adbd as root")
+			return false
+		}
+	} else if _, err := a.execOnce(ctx, "wait-for-device"); err != nil {
+		log.Errorf("Device did not reconnect after restarting adbd as root: %v", err)
+		return false
+	}
+
+	id, _ := a.Shell("id")
+	if !isRootID(id) {
+		log.Debugf("adbd does not run as root after `adb root`: %s", strings.TrimSpace(id))
+		return false
+	}
+	log.Info("Restarted adbd as root")
+	return true
+}
+
+// HasRoot checks whether commands can be run as root on the device.
+func (a *ADB) HasRoot() bool {
+	return a.RootMethod() != RootNone
+}
+
+// RootUsed tells whether any command was run as root.
+func (a *ADB) RootUsed() bool {
+	return a.rootUsed.Load()
+}
+
+// ShellAsRoot executes a shell command as root, using whichever method is
+// available on the device. It returns ErrNoRoot on stock devices.
+func (a *ADB) ShellAsRoot(cmd ...string) (string, error) {
+	switch a.RootMethod() {
+	case RootAdbd:
+		a.rootUsed.Store(true)
+		return a.Shell(cmd...)
+	case RootSu:
+		a.rootUsed.Store(true)
+		return a.Shell("su", "-c", shellQuote(strings.Join(cmd, " ")))
+	}
+
+	return "", ErrNoRoot
+}
+
+// ExecOutAsRoot runs a command as root like ExecOut, returning its raw
+// output. It returns ErrNoRoot on stock devices.
+func (a *ADB) ExecOutAsRoot(cmd string) ([]byte, error) {
+	switch a.RootMethod() {
+	case RootAdbd:
+		a.rootUsed.Store(true)
+		return a.ExecOut(cmd)
+	case RootSu:
+		a.rootUsed.Store(true)
+		log.Debugf("Running as root through su: %s", cmd)
+		return a.ExecOut("su -c " + shellQuote(cmd))
+	}
+
+	return nil, ErrNoRoot
+}
@@ -0,0 +1,147 @@
+// androidqf - Android Quick Forensics
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this software is governed by the MVT License 1.1 that can be found at
+//   https://license.mvt.re/1.1/
+
+package adb
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRootMethod(t *testing.T) {
+	const rootID = "uid=0(root) gid=0(root) groups=0(root) context=u:r:su:s0\n"
+	const shellID = "uid=2000(shell) gid=2000(shell) groups=2000(shell),1004(input) context=u:r:shell:s0\n"
+
+	tests := []struct {
+		name     string
+		commands []fakeCommand
+		want     string
+		calls    []string
+	}{
+		{
+			name:     "adbd",
+			commands: []fakeCommand{{pattern: "id", out: rootID}},
+			want:     RootAdbd,
+			calls:    []string{"id"},
+		},
+		{
+			name: "su",
+			commands: []fakeCommand{
+				{pattern: "id", out: shellID},
+				{pattern: "'su -c id'", out: rootID},
+			},
+			want:  RootSu,
+			calls: []string{"id", "su -c id"},
+		},
+		{
+			// adbd is not restarted with `adb root` unless AdbRoot is set.
+			name: "none",
+			commands: []fakeCommand{
+				{pattern: "id", out: shellID},
+				{pattern: "'su -c id'", out: "/system/bin/sh: su: inaccessible or not found\n", status: 127},
+			},
+			want:  RootNone,
+			calls: []string{"id", "su -c id"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, calls := newFakeDevice(t, test.commands)
+			if got := a.RootMethod(); got != test.want {
+				t.Errorf("got root method %q, want %q", got, test.want)
+			}
+			// The result is cached.
+			a.HasRoot()
+			if got := calls(); !reflect.DeepEqual(got, test.calls) {
+				t.Errorf("got commands %q, want %q", got, test.calls)
+			}
+		})
+	}
+}
+
+// fakeAdbRoot is a fake adb executable for a device without su, where `adb
+// root` restarts adbd as root unless the build is a production one.
+const fakeAdbRoot = `#!/bin/bash
+state="$(dirname "$0")/adbd_root"
+while [ $# -gt 0 ] && [ "$1" != "shell" ] && [ "$1" != "root" ] && [ "$1" != "wait-for-device" ]; do
+	shift
+done
+echo "$*" >> "$(dirname "$0")/commands.log"
+case "$*" in
+root)
+	if [ -n "$PRODUCTION" ]; then
+		echo "adbd cannot run as root in production builds"
+	else
+		touch "$state"
+		echo "restarting adbd as root"
+	fi;;
+wait-for-device) ;;
+"shell id")
+	if [ -f "$state" ]; then
+		echo "uid=0(root) gid=0(root) groups=0(root) context=u:r:su:s0"
+	else
+		echo "uid=2000(shell) gid=2000(shell) groups=2000(shell) context=u:r:shell:s0"
+	fi;;
+*) echo "/system/bin/sh: su: inaccessible or not found"; exit 127;;
+esac
+`
+
+func TestRootMethodAdbRoot(t *testing.T) {
+	tests := []struct {
+		name       string
+		adbRoot    bool
+		production bool
+		want       string
+		calls      []string
+	}{
+		{
+			name:    "restarted",
+			adbRoot: true,
+			want:    RootAdbd,
+			// The device is checked again once back.
+			calls: []string{"shell id", "shell su -c id", "root", "wait-for-device", "shell id"},
+		},
+		{
+			name:       "production",
+			adbRoot:    true,
+			production: true,
+			want:       RootNone,
+			calls:      []string{"shell id", "shell su -c id", "root"},
+		},
+		{
+			// Modules running concurrently.
+			name:  "disabled",
+			want:  RootNone,
+			calls: []string{"shell id", "shell su -c id"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.production {
+				t.Setenv("PRODUCTION", "1")
+			}
+			a := newFakeADB(t, fakeAdbRoot)
+			a.AdbRoot = test.adbRoot
+			a.ReconnectTimeout = DefaultReconnectTimeout
+			if got := a.RootMethod(); got != test.want {
+				t.Errorf("got root method %q, want %q", got, test.want)
+			}
+
+			data, err := os.ReadFile(filepath.Join(filepath.Dir(a.ExePath), "commands.log"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			calls := strings.Split(strings.TrimSpace(string(data)), "\n")
+			if !reflect.DeepEqual(calls, test.calls) {
+				t.Errorf("got commands %q, want %q", calls, test.calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+// androidqf - Android Quick Forensics
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this software is governed by the MVT License 1.1 that can be found at
+//   https://license.mvt.re/1.1/
+
+package adb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mvt-project/androidqf/log"
+)
+
+// User describes an Android user or profile, such as a work profile.
+type User struct {
+	ID             int    `json:"id"`
+	Name           string `json:"name"`
+	Running        bool   `json:"running"`
+	ManagedProfile bool   `json:"managed_profile"`
+}
+
+// userFlagManagedProfile is UserInfo.FLAG_MANAGED_PROFILE.
+const userFlagManagedProfile = 0x20
+
+// parseUsers parses the output of `pm list users`, with lines in the form
+// "UserInfo{0:Owner:c13} running".
+func parseUsers(out string) []User {
+	users := []User{}
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		start := strings.Index(line, "UserInfo{")
+		end := strings.LastIndex(line, "}")
+		if start == -1 || end < start {
+			continue
+		}
+
+		fields := strings.Split(line[start+len("UserInfo{"):end], ":")
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+
+		user := User{
+			ID:      id,
+			Running: strings.HasSuffix(line, "running"),
+		}
+		// The name is everything between the ID and the flags.
+		if len(fields) > 2 {
+			user.Name = strings.Join(fields[1:len(fields)-1], ":")
+			flags, err := strconv.ParseInt(fields[len(fields)-1], 16, 64)
+			if err == nil {
+				user.ManagedProfile = flags&userFlagManagedProfile != 0
+			}
+		}
+		users = append(users, user)
+	}
+
+	return users
+}
+
+// GetUsers returns the users and profiles existing on the device. If they
+// can't be listed, only the primary user is returned.
+func (a *ADB) GetUsers() ([]User, error) {
+	out, err := a.Shell("pm", "list", "users")
+	if err != nil && out == "" {
+		return []User{{ID: 0}}, fmt.Errorf("failed to run `pm list users`: %w", err)
+	}
+
+	users := parseUsers(out)
+	if len(users) == 0 {
+		log.Debugf("No users found in `pm list users` output: %s", out)
+		return []User{{ID: 0}}, nil
+	}
+
+	return users, nil
+}
@@ -0,0 +1,134 @@
+// androidqf - Android Quick Forensics
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this software is governed by the MVT License 1.1 that can be found at
+//   https://license.mvt.re/1.1/
+
+package adb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/mvt-project/androidqf/log"
+)
+
+// ErrConnectFailed is returned when adb could not pair or connect to a device
+// over TCP/IP.
+var ErrConnectFailed = errors.New("failed to connect to the device over TCP/IP")
+
+// NewTCP returns a new ADB instance acquiring the device reachable at the
+// given host:port through wireless debugging. If pairHostPort is set, it
+// first pairs with the device using the given pairing code.
+func NewTCP(hostPort, pairHostPort, pairCode string) (*ADB, error) {
+	adb, err := newADB()
+	if err != nil {
+		return nil, err
+	}
+
+	if pairHostPort != "" {
+		err = adb.Pair(pairHostPort, pairCode)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = adb.Connect(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	adb.Serial = hostPort
+	adb.TCPAddress = hostPort
+
+	return adb, nil
+}
+
+// execHost runs an adb command addressed to the adb server rather than to a
+// specific device.
+func (a *ADB) execHost(ctx context.Context, args ...string) (string, error) {
+	out, err := exec.CommandContext(ctx, a.ExePath, args...).Output()
+	return strings.TrimSpace(string(out)), parseError(err)
+}
+
+// Pair pairs with a device exposing wireless debugging at the given
+// host:port, using the pairing code displayed on the device. This is only
+// needed once per device, and only on Android 11 and newer.
+func (a *ADB) Pair(hostPort, code string) error {
+	log.Debugf("Pairing with %s", hostPort)
+	out, err := a.execHost(a.context(), "pair", hostPort, code)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrConnectFailed, err)
+	}
+	if !strings.Contains(out, "Successfully paired") {
+		return fmt.Errorf("%w: %s", ErrConnectFailed, out)
+	}
+
+	log.Debugf("Paired with %s", hostPort)
+	return nil
+}
+
+// Connect connects adb to a device listening at the given host:port.
+func (a *ADB) Connect(hostPort string) error {
+	log.Debugf("Connecting to %s", hostPort)
+	out, err := a.execHost(a.context(), "connect", hostPort)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrConnectFailed, err)
+	}
+	// adb returns 0 even when it failed to connect.
+	if !strings.HasPrefix(out, "connected to") && !strings.HasPrefix(out, "already connected to") {
+		return fmt.Errorf("%w: %s", ErrConnectFailed, out)
+	}
+
+	log.Debugf("Connected to %s", hostPort)
+	return nil
+}
+
+// Disconnect disconnects adb from a device connected over TCP/IP.
+func (a *ADB) Disconnect(hostPort string) error {
+	_, err := a.execHost(a.context(), "disconnect", hostPort)
+	return err
+}
+
+// MdnsServices returns the address of the devices advertising wireless
+// debugging over mDNS, as found by `adb mdns services`.
+func (a *ADB) MdnsServices() ([]string, error) {
+	out, err := a.execHost(a.context(), "mdns", "services")
+	if err != nil {
+		return nil, err
+	}
+
+	var addresses []string
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || !strings.HasPrefix(fields[1], "_adb-tls-connect._tcp") {
+			continue
+		}
+		addresses = append(addresses, fields[2])
+	}
+
+	return addresses, nil
+}
+
+// reconnectTCP tries to connect again to the device until it answers or the
+// context is done.
+func (a *ADB) reconnectTCP(ctx context.Context) bool {
+	for {
+		err := a.Connect(a.TCPAddress)
+		if err == nil {
+			_, err = a.execOnce(ctx, "get-state")
+			if err == nil {
+				return true
+			}
+		}
+		log.Debugf("Failed to reconnect to %s: %v", a.TCPAddress, err)
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
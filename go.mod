@@ -4,23 +4,42 @@ go 1.20
 
 require (
 	filippo.io/age v1.1.1
+	github.com/avast/apkparser v0.0.0-20230614091518-10cb8617da43
 	github.com/avast/apkverifier v0.0.0-20230614091700-49ed19602069
 	github.com/botherder/go-savetime v1.4.0
+	github.com/google/uuid v1.3.0
+	github.com/hillu/go-yara/v4 v4.3.2
 	github.com/i582/cfmt v1.4.0
 	github.com/manifoldco/promptui v0.9.0
 	github.com/satori/go.uuid v1.2.0
+	golang.org/x/crypto v0.4.0
+	gopkg.in/yaml.v3 v3.0.1
+	modernc.org/sqlite v1.21.2
 )
 
 require (
-	github.com/avast/apkparser v0.0.0-20230614091518-10cb8617da43 // indirect
+	filippo.io/edwards25519 v1.0.0 // indirect
 	github.com/chzyer/readline v0.0.0-20180603132655-2972be24d48e // indirect
+	github.com/dustin/go-humanize v1.0.1 // indirect
 	github.com/fatih/color v1.15.0 // indirect
-	github.com/google/uuid v1.3.0 // indirect
 	github.com/gookit/color v1.3.2 // indirect
+	github.com/kballard/go-shellquote v0.0.0-20180428030007-95032a82bc51 // indirect
 	github.com/klauspost/compress v1.16.6 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.17 // indirect
-	golang.org/x/crypto v0.4.0 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
+	golang.org/x/mod v0.3.0 // indirect
 	golang.org/x/sys v0.6.0 // indirect
+	golang.org/x/tools v0.0.0-20201124115921-2c860bdd6e78 // indirect
+	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
+	lukechampine.com/uint128 v1.2.0 // indirect
+	modernc.org/cc/v3 v3.40.0 // indirect
+	modernc.org/ccgo/v3 v3.16.13 // indirect
+	modernc.org/libc v1.22.4 // indirect
+	modernc.org/mathutil v1.5.0 // indirect
+	modernc.org/memory v1.5.0 // indirect
+	modernc.org/opt v0.1.3 // indirect
+	modernc.org/strutil v1.1.3 // indirect
+	modernc.org/token v1.0.1 // indirect
 )
@@ -6,6 +6,7 @@
 package log
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
@@ -33,6 +34,21 @@ type Logger struct {
 	fd           *os.File
 	fileName     string
 	Color        bool
+	// JSON prints newline-delimited JSON objects to the console instead of
+	// plain text.
+	JSON bool
+
+	module string
+	mutex  sync.Mutex
+}
+
+// entry is a log line printed when JSON output is enabled.
+type entry struct {
+	Level     string `json:"level"`
+	Timestamp string `json:"timestamp"`
+	Message   string `json:"message"`
+	Module    string `json:"module,omitempty"`
+	Error     string `json:"error,omitempty"`
 }
 
 var (
@@ -64,40 +80,44 @@ func Get() *Logger {
 	return log
 }
 
-func (log *Logger) out(level LEVEL, format string, v ...any) {
+func (log *Logger) out(level LEVEL, msg string, err error) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
 	// Start with printing in the console
-	if level >= log.LogLevel {
-		var msg string
-		if format == "" {
-			msg = fmt.Sprint(v...)
-		} else {
-			msg = fmt.Sprintf(format, v...)
+	if level >= log.LogLevel && log.JSON {
+		e := entry{
+			Level:     strings.ToLower(level.String()),
+			Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+			Message:   strings.TrimSpace(msg),
+			Module:    log.module,
 		}
+		if err != nil {
+			e.Error = err.Error()
+		}
+		data, _ := json.Marshal(&e)
+		fmt.Println(string(data))
+	} else if level >= log.LogLevel {
+		consoleMsg := msg
 		// for debug message,
 		if level == DEBUG {
-			msg = fmt.Sprintf("DEBUG: %s", msg)
+			consoleMsg = fmt.Sprintf("DEBUG: %s", consoleMsg)
 		}
 		// Make sure to trim end of line
-		msg = strings.TrimSuffix(msg, "\n")
+		consoleMsg = strings.TrimSuffix(consoleMsg, "\n")
 		if log.Color {
 			if level > INFO {
-				cfmt.Printf("{{%s}}::red|bold\n", msg)
+				cfmt.Printf("{{%s}}::red|bold\n", consoleMsg)
 			} else {
-				fmt.Println(msg)
+				fmt.Println(consoleMsg)
 			}
 		} else {
-			fmt.Println(msg)
+			fmt.Println(consoleMsg)
 		}
 	}
 	// Print in the file if any
 	if log.fd != nil {
-		var msg string
 		if level >= log.FileLogLevel {
-			if format == "" {
-				msg = fmt.Sprint(v...)
-			} else {
-				msg = fmt.Sprintf(format, v...)
-			}
 			fmt.Fprintf(log.fd, "%s [%s] %s\n", time.Now().Format(time.RFC3339), level.String(), msg)
 		}
 	}
@@ -121,6 +141,22 @@ func (l LEVEL) String() string {
 	return ""
 }
 
+// ParseLevel returns the level with the given name, one of debug, info,
+// warn or error.
+func ParseLevel(name string) (LEVEL, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return DEBUG, nil
+	case "info":
+		return INFO, nil
+	case "warn", "warning":
+		return WARNING, nil
+	case "error":
+		return ERROR, nil
+	}
+	return 0, fmt.Errorf("invalid log level %q, it should be one of debug, info, warn or error", name)
+}
+
 func SetLogLevel(level LEVEL) {
 	log.LogLevel = level
 }
@@ -129,6 +165,29 @@ func Coloring(enable bool) {
 	log.Color = enable
 }
 
+// JSONOutput enables printing log lines as JSON objects.
+func JSONOutput(enable bool) {
+	log.JSON = enable
+}
+
+// SetModule sets the name of the module running, added to the JSON log
+// lines. An empty name clears it.
+func SetModule(name string) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	log.module = name
+}
+
+// findError returns the first error among the arguments of a log call.
+func findError(v []any) error {
+	for _, arg := range v {
+		if err, ok := arg.(error); ok {
+			return err
+		}
+	}
+	return nil
+}
+
 func EnableFileLog(level LEVEL, filePath string) error {
 	if filePath == "" {
 		return errors.New("invalid file path")
@@ -138,72 +197,76 @@ func EnableFileLog(level LEVEL, filePath string) error {
 	if err != nil {
 		return err
 	}
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
 	log.fd = file
 	log.fileName = filePath
 	return nil
 }
 
 func DisableFileLog() {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
 	log.fd.Close()
 	log.fd = nil
 	log.fileName = ""
 }
 
 func Debug(v ...any) {
-	log.out(DEBUG, "", v...)
+	log.out(DEBUG, fmt.Sprint(v...), findError(v))
 }
 
 func Debugf(format string, v ...any) {
-	log.out(DEBUG, format, v...)
+	log.out(DEBUG, fmt.Sprintf(format, v...), findError(v))
 }
 
 func Info(v ...any) {
-	log.out(INFO, "", v...)
+	log.out(INFO, fmt.Sprint(v...), findError(v))
 }
 
 func Infof(format string, v ...any) {
-	log.out(INFO, format, v...)
+	log.out(INFO, fmt.Sprintf(format, v...), findError(v))
 }
 
 func Warning(v ...any) {
-	log.out(WARNING, "", v...)
+	log.out(WARNING, fmt.Sprint(v...), findError(v))
 }
 
 func Warningf(format string, v ...any) {
-	log.out(WARNING, format, v...)
+	log.out(WARNING, fmt.Sprintf(format, v...), findError(v))
 }
 
 func Error(v ...any) {
-	log.out(ERROR, "", v...)
+	log.out(ERROR, fmt.Sprint(v...), findError(v))
 }
 
 func Errorf(format string, v ...any) {
-	log.out(ERROR, format, v...)
+	log.out(ERROR, fmt.Sprintf(format, v...), findError(v))
 }
 
 func ErrorExc(desc string, err error) {
-	log.out(ERROR, "ERROR: %s: %s\n", desc, err.Error())
+	log.out(ERROR, fmt.Sprintf("ERROR: %s: %s\n", desc, err.Error()), err)
 }
 
 func Critical(v ...any) {
-	log.out(CRITICAL, "", v...)
+	log.out(CRITICAL, fmt.Sprint(v...), findError(v))
 }
 
 func Criticalf(format string, v ...any) {
-	log.out(CRITICAL, format, v...)
+	log.out(CRITICAL, fmt.Sprintf(format, v...), findError(v))
 }
 
 func Fatal(v ...any) {
-	log.out(FATAL, "", v...)
+	log.out(FATAL, fmt.Sprint(v...), findError(v))
 	os.Exit(1)
 }
 
 func Fatalf(format string, v ...any) {
-	log.out(FATAL, format, v...)
+	log.out(FATAL, fmt.Sprintf(format, v...), findError(v))
 	os.Exit(1)
 }
 
 func FatalExc(desc string, err error) {
-	log.out(FATAL, "FATAL: %s: %s\n", desc, err.Error())
+	log.out(FATAL, fmt.Sprintf("FATAL: %s: %s\n", desc, err.Error()), err)
 	os.Exit(1)
 }
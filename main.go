@@ -6,12 +6,21 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
 	"time"
 
+	rt "github.com/botherder/go-savetime/runtime"
+
 	"github.com/i582/cfmt/cmd/cfmt"
+	"github.com/manifoldco/promptui"
 	"github.com/mvt-project/androidqf/acquisition"
 	"github.com/mvt-project/androidqf/adb"
 	"github.com/mvt-project/androidqf/log"
@@ -19,7 +28,7 @@ import (
 	"github.com/mvt-project/androidqf/utils"
 )
 
-func init() {
+func printBanner() {
 	cfmt.Print(`
 	{{                    __           _     __      ____ }}::green
 	{{   ____  ____  ____/ /________  (_)___/ /___  / __/ }}::yellow
@@ -37,35 +46,175 @@ func systemPause() {
 	os.Stdin.Read(make([]byte, 1))
 }
 
+// adbErrorHint returns an actionable message for the known adb failures.
+func adbErrorHint(err error) string {
+	switch {
+	case errors.Is(err, adb.ErrAdbNotFound):
+		return "Unable to find the adb executable. Please make sure it is installed or placed next to androidqf."
+	case errors.Is(err, adb.ErrDeviceUnauthorized):
+		return "The device is not authorized. Please confirm the USB debugging prompt on the phone."
+	case errors.Is(err, adb.ErrDeviceOffline):
+		return "The device is offline. Please reconnect the USB cable and unlock the phone."
+	case errors.Is(err, adb.ErrConnectFailed):
+		return "Unable to connect to the device over wireless debugging. Please make sure it is on the same network and the address is correct."
+	case errors.Is(err, adb.ErrNoDevice):
+		return "No device found. Please make sure it is connected and USB debugging is enabled."
+	case errors.Is(err, adb.ErrTimeout):
+		return "The device did not answer in time. Please make sure it is unlocked and responsive."
+	}
+	return ""
+}
+
+// parseModuleNames splits a comma-separated list of module names, checking
+// that they all exist.
+func parseModuleNames(list string) ([]string, error) {
+	names := []string{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		found := false
+		for _, mod := range modules.List() {
+			if mod.Name() == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown module %q, use -list-modules to list the available ones", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
 func main() {
 	var err error
 	var verbose bool
+	var logFormat string
+	var logLevel string
 	var version_flag bool
 	var list_modules bool
 	var fast bool
+	var pullAPKs bool
+	var parseManifests bool
 	var module string
+	var selectedModules string
+	var excludedModules string
 	var output_folder string
 	var serial string
+	var tcp string
+	var pair string
+	var pairCode string
+	var reconnectTimeout time.Duration
+	var verifyPulls bool
+	var logcatLines int
+	var dropboxDays int
+	var maxDropboxSize int64
+	var parallel int
+	var parallelModules int
+	var trustedCerts string
+	var stores string
+	var iocs string
+	var yaraRules string
+	var downloadPolicy string
+	var resume bool
+	var baselinePath string
+	var maxCrashDumpsSize int64
+	var maxAPKSize int64
+	var includeCredentials bool
+	var redactContent bool
+	var redactEmails bool
+	var redactIdentifiers bool
+	var encryptOutput string
+	var zipOutput bool
+	var operatorNotes string
+	var signKey string
+	var allDevices bool
 
 	// Command line options
 	flag.BoolVar(&verbose, "verbose", false, "Verbose mode")
 	flag.BoolVar(&verbose, "v", false, "Verbose mode")
+	flag.StringVar(&logFormat, "log-format", "text", "Format of the console logs, text or json")
+	flag.StringVar(&logLevel, "log-level", "", "Minimum level of the console logs: debug, info, warn or error")
 	flag.BoolVar(&fast, "fast", false, "Fast mode")
-	flag.BoolVar(&verbose, "f", false, "Fast mode")
+	flag.BoolVar(&fast, "f", false, "Fast mode")
+	flag.BoolVar(&pullAPKs, "pull-apks", false, "Download copies of all apps without prompting")
+	flag.BoolVar(&parseManifests, "parse-manifests", false, "Decode the manifests of the downloaded apps")
+	flag.StringVar(&downloadPolicy, "download", "", "Download copies of apps without prompting: all, third-party, non-system or none")
+	flag.Int64Var(&maxAPKSize, "max-apk-size", 0, "Do not download apps whose files are larger than this size in MB, 0 for no limit")
 	flag.BoolVar(&list_modules, "list", false, "List modules and exit")
 	flag.BoolVar(&list_modules, "l", false, "List modules and exit")
+	flag.BoolVar(&list_modules, "list-modules", false, "List modules and exit")
 	flag.StringVar(&module, "module", "", "Only execute a specific module")
 	flag.StringVar(&module, "m", "", "Only execute a specific module")
+	flag.StringVar(&selectedModules, "modules", "", "Comma-separated list of modules to execute, skipping all others")
+	flag.StringVar(&excludedModules, "exclude-modules", "", "Comma-separated list of modules to skip")
 	flag.StringVar(&output_folder, "output", "", "Output folder")
 	flag.StringVar(&output_folder, "o", "", "Output folder")
+	flag.BoolVar(&resume, "resume", false, "Continue the most recent acquisition, or the one in the output folder, reusing the apps already downloaded")
 	flag.StringVar(&serial, "serial", "", "Phone serial number")
 	flag.StringVar(&serial, "s", "", "Phone serial number")
+	flag.BoolVar(&allDevices, "all-devices", false, "Acquire all the connected devices one after the other, each in a folder named after its serial")
+	flag.StringVar(&tcp, "tcp", "", "Acquire the device over wireless debugging at the given host:port")
+	flag.StringVar(&pair, "pair", "", "Pair with the device at the given host:port before connecting over wireless debugging")
+	flag.StringVar(&pairCode, "pair-code", "", "Wireless debugging pairing code displayed on the device")
+	flag.DurationVar(&reconnectTimeout, "reconnect-timeout", adb.DefaultReconnectTimeout, "How long to wait for a disconnected device to come back")
+	flag.BoolVar(&verifyPulls, "verify-pulls", true, "Check downloaded apps against the hashes computed on the device")
+	flag.IntVar(&logcatLines, "logcat-lines", 50000, "Maximum number of lines collected from each individual logcat buffer, 0 for no limit (logcat.txt is always complete)")
+	flag.IntVar(&dropboxDays, "dropbox-days", 7, "Number of days of dropbox entries to save, 0 for all")
+	flag.Int64Var(&maxDropboxSize, "max-dropbox-size", 100, "Total size in MB of the dropbox entries to save, 0 for no limit")
+	flag.IntVar(&parallel, "parallel", adb.DefaultPackageWorkers, "Number of apps hashed and downloaded concurrently")
+	flag.IntVar(&parallelModules, "parallel-modules", 1, "Number of modules run concurrently")
+	flag.StringVar(&trustedCerts, "trusted-certs", "", "Comma-separated list of JSON or PEM files of additional trusted app certificates")
+	flag.StringVar(&stores, "stores", "", "Comma-separated list of packages of additional app stores, whose installations are not considered sideloaded")
+	flag.StringVar(&iocs, "iocs", "", "Comma-separated list of STIX2 files or MVT YAML indexes of indicators to check the collected data against")
+	flag.StringVar(&iocs, "ioc-path", "", "Comma-separated list of STIX2 files or MVT YAML indexes of indicators to check the collected data against")
+	flag.StringVar(&yaraRules, "yara-rules", "", "Folder of YARA rules to scan the downloaded apps with")
+	flag.Int64Var(&maxCrashDumpsSize, "max-crash-dumps-size", 200, "Maximum total size in MB of the tombstones and ANR traces collected, 0 for no limit")
+	flag.StringVar(&baselinePath, "baseline-path", "", "apex_modules.json of a factory image acquisition to compare the APEX modules against")
+	flag.BoolVar(&redactContent, "redact-content", false, "Replace the content of messages with its SHA-256 hash")
+	flag.BoolVar(&redactEmails, "redact-emails", false, "Replace the local part of account email addresses with its SHA-256 hash")
+	flag.BoolVar(&redactIdentifiers, "redact-identifiers", false, "Replace the IMEI, IMSI and ICCID with their SHA-256 hash")
+	flag.BoolVar(&includeCredentials, "include-credentials", false, "Do not redact credentials, such as WiFi passwords")
+	flag.StringVar(&encryptOutput, "encrypt-output", "", "Encrypt the acquisition with the age, SSH or RSA public key at the given path and delete the unencrypted copy")
+	flag.BoolVar(&zipOutput, "zip-output", false, "Store the acquisition as a zip archive with a manifest of the files collected")
+	flag.StringVar(&operatorNotes, "operator-notes", "", "Free-text notes recorded in the acquisition metadata")
+	flag.StringVar(&signKey, "sign-key", "", "PEM private key to sign the manifest of the acquisition files with")
 	flag.BoolVar(&version_flag, "version", false, "Show version")
 
 	flag.Parse()
 	if verbose {
 		log.SetLogLevel(log.DEBUG)
 	}
+	if logLevel != "" {
+		level, err := log.ParseLevel(logLevel)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.SetLogLevel(level)
+	}
+	switch logFormat {
+	case "text":
+	case "json":
+		log.JSONOutput(true)
+	default:
+		log.Fatalf("Invalid log format %q, it should be text or json", logFormat)
+	}
+	if logFormat != "json" {
+		printBanner()
+	}
 
 	if version_flag {
 		log.Infof("AndroidQF version: %s", utils.Version)
@@ -81,69 +230,442 @@ func main() {
 		os.Exit(0)
 	}
 
+	include, err := parseModuleNames(selectedModules)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if module != "" {
+		include = append(include, module)
+	}
+	exclude, err := parseModuleNames(excludedModules)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if trustedCerts != "" {
+		for _, path := range strings.Split(trustedCerts, ",") {
+			count, err := utils.LoadTrustedCertificates(strings.TrimSpace(path))
+			if err != nil {
+				log.Warningf("Ignoring trusted certificates file %s: %v", path, err)
+				continue
+			}
+			log.Infof("Loaded %d trusted certificates from %s", count, path)
+		}
+	}
+
+	switch downloadPolicy {
+	case "", acquisition.DownloadAll, acquisition.DownloadThirdParty, acquisition.DownloadNotSystem, acquisition.DownloadNone:
+	default:
+		log.Fatalf("Invalid download policy %q, it should be one of all, third-party, non-system or none", downloadPolicy)
+	}
+
+	if encryptOutput != "" {
+		key, err := acquisition.LoadEncryptionKey(encryptOutput)
+		if err != nil {
+			log.Fatalf("Failed to load the encryption key from %s: %v", encryptOutput, err)
+		}
+		log.Infof("The acquisition will be encrypted with the %s key %s", key.Type, key.ID)
+	}
+
+	if signKey != "" {
+		_, err := acquisition.LoadSigningKey(signKey)
+		if err != nil {
+			log.Fatalf("Failed to load the signing key from %s: %v", signKey, err)
+		}
+	}
+
+	if iocs != "" {
+		for _, path := range strings.Split(iocs, ",") {
+			path = strings.TrimSpace(path)
+			count, err := utils.LoadIOCs(path)
+			if err != nil {
+				log.Fatalf("Failed to load indicators from %s: %v", path, err)
+			}
+			log.Infof("Loaded %d indicators from %s", count, path)
+		}
+	}
+
+	if yaraRules != "" {
+		count, err := utils.LoadYaraRules(yaraRules)
+		if err != nil {
+			log.Fatalf("Failed to load YARA rules from %s: %v", yaraRules, err)
+		}
+		log.Infof("Loaded %d YARA rules files from %s", count, yaraRules)
+	}
+
 	log.Debug("Starting androidqf")
-	adb.Client, err = adb.New(serial)
+	for _, store := range strings.Split(stores, ",") {
+		if store = strings.TrimSpace(store); store != "" {
+			adb.StoreInstallers = append(adb.StoreInstallers, store)
+		}
+	}
+
+	opts := &acquisitionOptions{
+		fast:               fast,
+		include:            include,
+		exclude:            exclude,
+		tcp:                tcp,
+		pair:               pair,
+		pairCode:           pairCode,
+		reconnectTimeout:   reconnectTimeout,
+		verifyPulls:        verifyPulls,
+		parallel:           parallel,
+		parallelModules:    parallelModules,
+		resume:             resume,
+		pullAPKs:           pullAPKs,
+		parseManifests:     parseManifests,
+		downloadPolicy:     downloadPolicy,
+		baselinePath:       baselinePath,
+		maxCrashDumpsSize:  maxCrashDumpsSize * 1024 * 1024,
+		maxAPKSize:         maxAPKSize * 1024 * 1024,
+		logcatLines:        logcatLines,
+		dropboxDays:        dropboxDays,
+		maxDropboxSize:     maxDropboxSize * 1024 * 1024,
+		includeCredentials: includeCredentials,
+		redactContent:      redactContent,
+		redactEmails:       redactEmails,
+		redactIdentifiers:  redactIdentifiers,
+		encryptOutput:      encryptOutput,
+		zipOutput:          zipOutput,
+		operatorNotes:      operatorNotes,
+		signKey:            signKey,
+	}
+
+	if tcp != "" && pair != "" && opts.pairCode == "" {
+		codePrompt := promptui.Prompt{
+			Label: "Pairing code",
+		}
+		opts.pairCode, err = codePrompt.Run()
+		if err != nil {
+			log.Fatal("Failed to read the pairing code: ", err)
+		}
+	}
+
+	// Cancel in-flight adb commands on Ctrl+C. A second Ctrl+C exits
+	// immediately.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if allDevices {
+		if tcp != "" || serial != "" {
+			log.Fatal("The -all-devices option can't be combined with -serial or -tcp")
+		}
+		acquireAllDevices(ctx, opts, output_folder)
+		systemPause()
+		return
+	}
+
+	acq, err := acquireDevice(ctx, opts, serial, output_folder)
 	if err != nil {
-		log.Fatal("Impossible to initialize adb: ", err)
+		log.Debug(err)
+		if hint := adbErrorHint(err); hint != "" {
+			log.Fatal(hint)
+		}
+		log.Fatal(err)
 	}
 
+	log.Info("Acquisition completed.")
+
+	if acq.IsModuleCompleted("root_binaries") {
+		log.Infof("Found %d root indicators", acq.RootIndicators)
+	}
+
+	if len(acq.Warnings) > 0 {
+		log.Warningf("The acquisition raised %d warnings:", len(acq.Warnings))
+		for _, warning := range acq.Warnings {
+			log.Warningf("- %s", warning)
+		}
+	}
+
+	systemPause()
+}
+
+// acquisitionOptions are the settings of the acquisition of each device.
+type acquisitionOptions struct {
+	fast               bool
+	include            []string
+	exclude            []string
+	tcp                string
+	pair               string
+	pairCode           string
+	reconnectTimeout   time.Duration
+	verifyPulls        bool
+	parallel           int
+	parallelModules    int
+	resume             bool
+	pullAPKs           bool
+	parseManifests     bool
+	downloadPolicy     string
+	baselinePath       string
+	maxCrashDumpsSize  int64
+	maxAPKSize         int64
+	logcatLines        int
+	dropboxDays        int
+	maxDropboxSize     int64
+	includeCredentials bool
+	redactContent      bool
+	redactEmails       bool
+	redactIdentifiers  bool
+	encryptOutput      string
+	zipOutput          bool
+	operatorNotes      string
+	signKey            string
+}
+
+// acquireDevice runs the selected modules on the device with the given
+// serial, storing the acquisition in outputFolder.
+func acquireDevice(ctx context.Context, opts *acquisitionOptions, serial, outputFolder string) (*acquisition.Acquisition, error) {
+	var err error
+	if opts.tcp != "" {
+		adb.Client, err = adb.NewTCP(opts.tcp, opts.pair, opts.pairCode)
+	} else {
+		adb.Client, err = adb.New(serial)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("impossible to initialize adb: %w", err)
+	}
+	adb.Client.ReconnectTimeout = opts.reconnectTimeout
+	adb.Client.VerifyPulls = opts.verifyPulls
+	adb.Client.PackageWorkers = opts.parallel
+	adb.Client.ResumePulls = opts.resume
+	adb.Client.SetContext(ctx)
+
 	// Initialization
 	for {
 		_, err = adb.Client.GetState()
 		if err == nil {
 			break
 		}
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("acquisition interrupted")
+		}
 		log.Debug(err)
-		log.Error("Unable to get device state. Please make sure it is connected and authorized. Trying again in 5 seconds...")
+		if errors.Is(err, adb.ErrAdbNotFound) {
+			return nil, err
+		}
+		hint := adbErrorHint(err)
+		if hint == "" {
+			hint = "Unable to get device state. Please make sure it is connected and authorized."
+		}
+		log.Errorf("%s Trying again in 5 seconds...", hint)
 		time.Sleep(5 * time.Second)
 	}
 
-	acq, err := acquisition.New(output_folder)
+	var acq *acquisition.Acquisition
+	if opts.resume {
+		acq, err = acquisition.Resume(outputFolder)
+	} else {
+		acq, err = acquisition.New(outputFolder)
+	}
 	if err != nil {
-		log.Debug(err)
-		log.FatalExc("Impossible to initialise the acquisition", err)
+		return nil, fmt.Errorf("impossible to initialise the acquisition: %w", err)
+	}
+	// Reuse the apps already downloaded when continuing from a checkpoint.
+	adb.Client.ResumePulls = opts.resume || acq.Resumed
+	acq.PullAPKs = opts.pullAPKs
+	acq.ParseManifests = opts.parseManifests
+	acq.DownloadPolicy = opts.downloadPolicy
+	acq.BaselinePath = opts.baselinePath
+	acq.MaxCrashDumpsSize = opts.maxCrashDumpsSize
+	acq.MaxAPKSize = opts.maxAPKSize
+	acq.LogcatLines = opts.logcatLines
+	acq.DropboxDays = opts.dropboxDays
+	acq.MaxDropboxSize = opts.maxDropboxSize
+	acq.IncludeCredentials = opts.includeCredentials
+	acq.RedactContent = opts.redactContent
+	acq.RedactEmails = opts.redactEmails
+	acq.RedactIdentifiers = opts.redactIdentifiers
+	acq.EncryptionKeyPath = opts.encryptOutput
+	acq.ZipOutput = opts.zipOutput
+
+	acq.OperatorNotes = opts.operatorNotes
+	acq.SignKeyPath = opts.signKey
+
+	err = acq.StoreMetadata()
+	if err != nil {
+		log.ErrorExc("Failed to store the acquisition metadata", err)
 	}
 
 	// Start acquisitions
 	log.Info(fmt.Sprintf("Started new acquisition in %s", acq.StoragePath))
 
-	mods := modules.List()
-	for _, mod := range mods {
-		if (module != "") && (module != mod.Name()) {
+	mods := []modules.Module{}
+	for _, mod := range modules.List() {
+		if (len(opts.include) > 0 && !containsString(opts.include, mod.Name())) || containsString(opts.exclude, mod.Name()) {
+			log.Infof("Skipping module %s, not selected", mod.Name())
+			acq.SkippedModules = append(acq.SkippedModules, mod.Name())
 			continue
 		}
-		err = mod.InitStorage(acq.StoragePath)
+		if acq.IsModuleCompleted(mod.Name()) {
+			restorable, ok := mod.(modules.RestorableModule)
+			if !ok {
+				log.Infof("Skipping module %s, already completed", mod.Name())
+				continue
+			}
+			err := restorable.Restore(acq)
+			if err == nil {
+				log.Infof("Skipping module %s, already completed", mod.Name())
+				continue
+			}
+			log.Infof("Running module %s again, failed to restore its output: %v", mod.Name(), err)
+			acq.ForgetModule(mod.Name())
+		}
+		mods = append(mods, mod)
+	}
+
+	runner, err := modules.NewModuleRunner(mods, opts.parallelModules)
+	if err != nil {
+		return acq, fmt.Errorf("impossible to schedule the modules: %w", err)
+	}
+	// The files written can't be attributed to a module when several run
+	// at the same time.
+	if runner.Workers > 1 {
+		log.Info("Running modules concurrently, the acquisition can't be resumed if interrupted")
+		acq.DisableCheckpoints()
+	}
+	// The progress bar can only show one module at a time.
+	if runner.Workers > 1 {
+		acq.Progress = acquisition.NoopProgress{}
+	}
+	// Restarting adbd as root would break the commands of modules running
+	// concurrently, so it is only tried in sequential runs, before the
+	// first module starts.
+	if runner.Workers == 1 {
+		adb.Client.AdbRoot = true
+		if adb.Client.HasRoot() {
+			log.Debugf("Root access is available through %s", adb.Client.RootMethod())
+		}
+	}
+
+	err = runner.Run(ctx, func(mod modules.Module) error {
+		err := mod.InitStorage(acq.StoragePath)
 		if err != nil {
 			log.Infof(
 				"ERROR: failed to initialize storage for module %s: %v",
 				mod.Name(),
 				err,
 			)
-			continue
+			return nil
 		}
 
-		err = mod.Run(acq, fast)
+		// Log lines can only be attributed to a module when they run one
+		// after the other.
+		if runner.Workers == 1 {
+			acq.Progress = acquisition.NewProgress()
+			acq.Progress.SetStatus(mod.Name())
+			log.SetModule(mod.Name())
+			defer log.SetModule("")
+		}
+		err = mod.Run(acq, opts.fast)
+		// Give the module another chance if the device went away for
+		// longer than the retries of a single command.
+		if (errors.Is(err, adb.ErrNoDevice) || errors.Is(err, adb.ErrDeviceOffline)) && adb.Client.Reconnect() {
+			log.Infof("Running module %s again after the device reconnected", mod.Name())
+			err = mod.Run(acq, opts.fast)
+		}
 		if err != nil {
+			// The device is gone and did not come back, there is no point
+			// in running the remaining modules.
+			if errors.Is(err, adb.ErrNoDevice) || errors.Is(err, adb.ErrAdbNotFound) {
+				log.Errorf("Module %s failed: %s", mod.Name(), adbErrorHint(err))
+				return err
+			}
+			if hint := adbErrorHint(err); hint != "" {
+				log.Infof("ERROR: failed to run module %s: %s", mod.Name(), hint)
+				log.Debug(err)
+				return nil
+			}
 			log.Infof("ERROR: failed to run module %s: %v", mod.Name(), err)
+			return nil
 		}
+		acq.ModuleCompleted(mod.Name())
+		return nil
+	})
+	if ctx.Err() != nil {
+		log.Warning("Acquisition interrupted, skipping remaining modules")
+	} else if err != nil {
+		log.Warning("Aborting the acquisition, skipping remaining modules")
 	}
 
-	err = acq.HashFiles()
+	err = acq.Finalize()
 	if err != nil {
-		log.ErrorExc("Failed to generate list of file hashes", err)
-		return
+		return acq, fmt.Errorf("failed to finalize the acquisition: %w", err)
 	}
 
-	acq.Complete()
-	acq.StoreInfo()
-
 	err = acq.StoreSecurely()
 	if err != nil {
 		log.ErrorExc("Something failed while encrypting the acquisition", err)
 		log.Warning("WARNING: The secure storage of the acquisition folder failed! The data is unencrypted!")
 	}
 
-	log.Info("Acquisition completed.")
+	err = acq.StoreArchive()
+	if err != nil {
+		log.ErrorExc("Failed to store the acquisition as a zip archive", err)
+	}
 
-	systemPause()
+	return acq, nil
+}
+
+// acquireAllDevices acquires every device attached to adb one after the
+// other, each in a folder named after its serial. A failure on a device does
+// not prevent the acquisition of the next ones.
+func acquireAllDevices(ctx context.Context, opts *acquisitionOptions, outputFolder string) {
+	devices, err := adb.ListAllDevices()
+	if err != nil {
+		log.Debug(err)
+		if hint := adbErrorHint(err); hint != "" {
+			log.Fatal(hint)
+		}
+		log.Fatal("Impossible to list the devices: ", err)
+	}
+	if len(devices) == 0 {
+		log.Fatal(adbErrorHint(adb.ErrNoDevice))
+	}
+
+	if outputFolder == "" {
+		outputFolder = rt.GetExecutableDirectory()
+	}
+	err = os.MkdirAll(outputFolder, 0o755)
+	if err != nil {
+		log.Fatalf("Failed to create the output folder %s: %v", outputFolder, err)
+	}
+
+	results := make([]string, len(devices))
+	for i, device := range devices {
+		if ctx.Err() != nil {
+			results[i] = "skipped: acquisition interrupted"
+			continue
+		}
+		if device.State != "device" {
+			log.Errorf("Skipping device %s, its state is %s", device.Serial, device.State)
+			results[i] = fmt.Sprintf("failed: device is %s", device.State)
+			continue
+		}
+
+		log.Infof("Acquiring device %s (%d of %d)", device.Serial, i+1, len(devices))
+		folder := filepath.Join(outputFolder, strings.NewReplacer(":", "_", "/", "_", "\\", "_").Replace(device.Serial))
+		acq, err := acquireDevice(ctx, opts, device.Serial, folder)
+		if err != nil {
+			log.Errorf("Failed to acquire device %s: %v", device.Serial, err)
+			results[i] = fmt.Sprintf("failed: %v", err)
+			continue
+		}
+		results[i] = fmt.Sprintf("completed with %d warnings", len(acq.Warnings))
+	}
+
+	log.Info("Summary of the acquisitions:")
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SERIAL\tMODEL\tRESULT")
+	for i, device := range devices {
+		model := device.Model
+		if model == "" {
+			model = "unknown"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", device.Serial, model, results[i])
+	}
+	w.Flush()
 }
@@ -0,0 +1,164 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mvt-project/androidqf/acquisition"
+	"github.com/mvt-project/androidqf/adb"
+	"github.com/mvt-project/androidqf/log"
+)
+
+var (
+	// "User state[attributes:{id=0, ..." or "User state[\n attributes:{id=0".
+	accessibilityUserRegexp = regexp.MustCompile(`attributes:\{id=(\d+)`)
+	// "Enabled services:{{com.example/.Service}, {...}}"
+	accessibilityEnabledRegexp   = regexp.MustCompile(`(?i)enabled services:\{(.*)\}\s*$`)
+	accessibilityComponentRegexp = regexp.MustCompile(`\{?([\w.]+/[\w.$]+)\}?`)
+)
+
+type AccessibilityService struct {
+	PackageName   string `json:"package_name"`
+	ComponentName string `json:"component_name"`
+	User          int    `json:"user"`
+	IsThirdParty  bool   `json:"is_third_party"`
+	IsSystem      bool   `json:"is_system"`
+	IsSideloaded  bool   `json:"is_sideloaded"`
+}
+
+type AccessibilityServices struct {
+	StoragePath string
+}
+
+func NewAccessibilityServices() *AccessibilityServices {
+	return &AccessibilityServices{}
+}
+
+func (a *AccessibilityServices) Name() string {
+	return "accessibility_services"
+}
+
+func (a *AccessibilityServices) Dependencies() []string {
+	return []string{"packages"}
+}
+
+func (a *AccessibilityServices) InitStorage(storagePath string) error {
+	a.StoragePath = storagePath
+	return nil
+}
+
+// parseComponents parses a colon-separated list of component names, such as
+// "com.example/.Service:com.other/com.other.Service".
+func parseComponents(out string) []string {
+	components := []string{}
+	out = strings.TrimSpace(out)
+	if out == "" || out == "null" {
+		return components
+	}
+
+	for _, component := range strings.Split(out, ":") {
+		component = strings.TrimSpace(component)
+		if component != "" {
+			components = append(components, component)
+		}
+	}
+
+	return components
+}
+
+// parseAccessibilityDump returns the services enabled for each user listed
+// by `dumpsys accessibility`.
+func parseAccessibilityDump(out string) map[int][]string {
+	enabled := make(map[int][]string)
+	user := 0
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if match := accessibilityUserRegexp.FindStringSubmatch(line); match != nil {
+			user, _ = strconv.Atoi(match[1])
+		}
+		match := accessibilityEnabledRegexp.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		for _, component := range accessibilityComponentRegexp.FindAllStringSubmatch(match[1], -1) {
+			enabled[user] = appendUniqueString(enabled[user], component[1])
+		}
+	}
+	return enabled
+}
+
+// packageIndex returns the collected packages keyed by user and name.
+func packageIndex(acq *acquisition.Acquisition) map[string]adb.Package {
+	index := make(map[string]adb.Package)
+	for _, pkg := range getPackages(acq) {
+		index[fmt.Sprintf("%d/%s", pkg.User, pkg.Name)] = pkg
+	}
+	return index
+}
+
+func (a *AccessibilityServices) Run(acq *acquisition.Acquisition, fast bool) error {
+	log.Info("Collecting enabled accessibility services...")
+
+	users, err := adb.Client.GetUsers()
+	if err != nil {
+		log.Debugf("Failed to list users, only looking at the primary one: %v", err)
+	}
+
+	out, err := adb.Client.ShellTimeout(dumpsysServiceTimeout, "dumpsys", "accessibility")
+	if err != nil {
+		log.Debugf("Failed to run `dumpsys accessibility`: %v", err)
+	} else {
+		err = saveCommandOutput(filepath.Join(a.StoragePath, "accessibility.txt"), out)
+		if err != nil {
+			log.Errorf("Impossible to save the accessibility dump: %v", err)
+		}
+	}
+	running := parseAccessibilityDump(out)
+
+	packages := packageIndex(acq)
+	services := []AccessibilityService{}
+	for _, user := range users {
+		out, err := adb.Client.Shell("settings", "--user", fmt.Sprint(user.ID), "get", "secure", "enabled_accessibility_services")
+		if err != nil {
+			log.Errorf("Failed to get enabled accessibility services of user %d: %v", user.ID, err)
+		}
+
+		// The setting and the services running in the system should match,
+		// unless a service is being enabled or crashed.
+		components := parseComponents(out)
+		for _, component := range running[user.ID] {
+			components = appendUniqueString(components, component)
+		}
+
+		for _, component := range components {
+			service := AccessibilityService{
+				PackageName:   strings.SplitN(component, "/", 2)[0],
+				ComponentName: component,
+				User:          user.ID,
+			}
+			if pkg, ok := packages[fmt.Sprintf("%d/%s", user.ID, service.PackageName)]; ok {
+				service.IsThirdParty = pkg.ThirdParty
+				service.IsSystem = pkg.System
+				service.IsSideloaded = pkg.Sideloaded
+			}
+
+			if service.IsSideloaded {
+				acq.AddWarning("Sideloaded app %s has an enabled accessibility service: %s",
+					service.PackageName, service.ComponentName)
+			} else if service.IsThirdParty {
+				log.Warningf("Third-party app %s has an enabled accessibility service: %s",
+					service.PackageName, service.ComponentName)
+			}
+			services = append(services, service)
+		}
+	}
+
+	return saveCommandOutputJson(filepath.Join(a.StoragePath, "accessibility.json"), &services)
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mvt-project/androidqf/acquisition"
+	"github.com/mvt-project/androidqf/adb"
+	"github.com/mvt-project/androidqf/log"
+)
+
+var (
+	// "User UserInfo{0:Owner:c13}:"
+	accountUserRegexp = regexp.MustCompile(`^\s*User UserInfo\{(\d+):`)
+	// "Accounts: 2" on recent versions, "Accounts:" on older ones.
+	accountsSectionRegexp = regexp.MustCompile(`^\s*Accounts:`)
+	// "Account {name=user@example.com, type=com.google}"
+	accountRegexp = regexp.MustCompile(`^\s*Account \{name=(.*), type=([^},]+)\}`)
+	// "ServiceInfo: AuthenticatorDescription {type=com.google}, ComponentInfo{com.google.android.gms/...}, uid 10123"
+	authenticatorRegexp = regexp.MustCompile(`AuthenticatorDescription \{type=([^},]+)\}, ComponentInfo\{([^/}]+)/`)
+	// emailRegexp matches whole email addresses, so that an address is never
+	// redacted inside a longer one.
+	emailRegexp = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(\.[A-Za-z0-9\-]+)+`)
+)
+
+type Account struct {
+	Name                 string `json:"name"`
+	Type                 string `json:"type"`
+	AuthenticatorPackage string `json:"authenticator_package"`
+	User                 int    `json:"user"`
+	IsThirdParty         bool   `json:"is_third_party"`
+}
+
+type Accounts struct {
+	StoragePath string
+}
+
+func NewAccounts() *Accounts {
+	return &Accounts{}
+}
+
+func (a *Accounts) Name() string {
+	return "accounts"
+}
+
+func (a *Accounts) Dependencies() []string {
+	return []string{"packages"}
+}
+
+func (a *Accounts) InitStorage(storagePath string) error {
+	a.StoragePath = storagePath
+	return nil
+}
+
+// parseAccounts parses the accounts registered for each user in the
+// "Accounts:" sections of `dumpsys account`, along with the package of their
+// authenticator. Accounts listed again in other sections are ignored.
+func parseAccounts(out string) []Account {
+	accounts := []Account{}
+	seen := make(map[string]bool)
+	authenticators := make(map[string]string)
+	user := 0
+	sectionIndent := -1
+	for _, line := range strings.Split(out, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if sectionIndent >= 0 && indentation(line) <= sectionIndent {
+			sectionIndent = -1
+		}
+
+		if match := accountUserRegexp.FindStringSubmatch(line); match != nil {
+			user, _ = strconv.Atoi(match[1])
+			continue
+		}
+		if accountsSectionRegexp.MatchString(line) {
+			sectionIndent = indentation(line)
+			continue
+		}
+		if match := accountRegexp.FindStringSubmatch(line); match != nil && sectionIndent >= 0 {
+			account := Account{
+				Name: strings.TrimSpace(match[1]),
+				Type: strings.TrimSpace(match[2]),
+				User: user,
+			}
+			key := fmt.Sprintf("%d/%s/%s", user, account.Type, account.Name)
+			if !seen[key] {
+				seen[key] = true
+				accounts = append(accounts, account)
+			}
+			continue
+		}
+		if match := authenticatorRegexp.FindStringSubmatch(line); match != nil {
+			authenticators[fmt.Sprintf("%d/%s", user, strings.TrimSpace(match[1]))] = match[2]
+		}
+	}
+
+	for i := range accounts {
+		accounts[i].AuthenticatorPackage = authenticators[fmt.Sprintf("%d/%s", accounts[i].User, accounts[i].Type)]
+	}
+
+	return accounts
+}
+
+// redactEmail replaces the local part of an email address with its SHA-256,
+// which still allows to correlate accounts between acquisitions. Names which
+// are not email addresses are returned as is.
+func redactEmail(name string) string {
+	at := strings.LastIndex(name, "@")
+	if at <= 0 {
+		return name
+	}
+	hash := sha256.Sum256([]byte(name[:at]))
+	return hex.EncodeToString(hash[:]) + name[at:]
+}
+
+// redactEmails redacts with redactEmail all the email addresses in the text.
+func redactEmails(text string) string {
+	return emailRegexp.ReplaceAllStringFunc(text, redactEmail)
+}
+
+func (a *Accounts) Run(acq *acquisition.Acquisition, fast bool) error {
+	log.Info("Collecting registered accounts...")
+
+	out, err := adb.Client.ShellTimeout(dumpsysServiceTimeout, "dumpsys", "account")
+	if err != nil && out == "" {
+		return fmt.Errorf("failed to run `adb shell dumpsys account`: %v", err)
+	}
+
+	accounts := parseAccounts(out)
+	if acq.RedactEmails {
+		out = redactEmails(out)
+		for i := range accounts {
+			accounts[i].Name = redactEmails(accounts[i].Name)
+		}
+	}
+	err = saveCommandOutput(filepath.Join(a.StoragePath, "accounts.txt"), out)
+	if err != nil {
+		log.Errorf("Impossible to save the accounts dump: %v", err)
+	}
+
+	packages := packageIndex(acq)
+	for i := range accounts {
+		account := &accounts[i]
+		if pkg, ok := packages[fmt.Sprintf("%d/%s", account.User, account.AuthenticatorPackage)]; ok {
+			account.IsThirdParty = pkg.ThirdParty
+		}
+
+		if account.IsThirdParty {
+			log.Warningf("Third-party app %s is the authenticator of accounts of type %s",
+				account.AuthenticatorPackage, account.Type)
+		}
+	}
+
+	return saveCommandOutputJson(filepath.Join(a.StoragePath, "accounts.json"), &accounts)
+}
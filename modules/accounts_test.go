@@ -0,0 +1,29 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactEmails(t *testing.T) {
+	out := "Accounts: 2\n" +
+		"    Account {name=bob@example.com, type=com.google}\n" +
+		"    Account {name=alice.bob@example.com, type=com.google}\n"
+
+	redacted := redactEmails(out)
+	for _, local := range []string{"bob", "alice.bob"} {
+		if strings.Contains(redacted, local+"@") {
+			t.Errorf("%s@example.com was not redacted in %q", local, redacted)
+		}
+		if want := redactEmail(local + "@example.com"); !strings.Contains(redacted, "name="+want+",") {
+			t.Errorf("missing %s in %q", want, redacted)
+		}
+	}
+	if !strings.Contains(redacted, "type=com.google}") {
+		t.Errorf("account types were changed in %q", redacted)
+	}
+}
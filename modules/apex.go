@@ -0,0 +1,253 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mvt-project/androidqf/acquisition"
+	"github.com/mvt-project/androidqf/adb"
+	"github.com/mvt-project/androidqf/log"
+)
+
+type APEXModule struct {
+	Name     string `json:"name"`
+	Version  int64  `json:"version"`
+	IsActive bool   `json:"is_active"`
+	// IsFactory is set for the modules preinstalled in the system image.
+	IsFactory bool   `json:"is_factory"`
+	Path      string `json:"path"`
+	// LocalName is the path of the local copy, relative to the folder of
+	// the acquisition.
+	LocalName string `json:"local_name,omitempty"`
+}
+
+type APEXModules struct {
+	StoragePath string
+}
+
+func NewAPEXModules() *APEXModules {
+	return &APEXModules{}
+}
+
+func (a *APEXModules) Name() string {
+	return "apex_modules"
+}
+
+func (a *APEXModules) Outputs() []string {
+	return []string{"apex"}
+}
+
+func (a *APEXModules) InitStorage(storagePath string) error {
+	a.StoragePath = storagePath
+	return nil
+}
+
+// parseAPEXDump parses the APEX packages listed by `dumpsys package apex`,
+// available since Android 10. Each section lists the packages along with
+// their details:
+//
+//	Active APEX packages:
+//	  com.android.tzdata
+//	    Version: 310000000
+//	    Path: /apex/com.android.tzdata@310000000
+//	    IsActive: true
+func parseAPEXDump(out string) []APEXModule {
+	modules := []APEXModule{}
+	seen := make(map[string]bool)
+	active := false
+	var current *APEXModule
+	flush := func() {
+		if current == nil {
+			return
+		}
+		key := fmt.Sprintf("%s/%d/%s", current.Name, current.Version, current.Path)
+		if !seen[key] {
+			seen[key] = true
+			modules = append(modules, *current)
+		}
+		current = nil
+	}
+
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			continue
+		}
+
+		if strings.HasSuffix(trimmed, "APEX packages:") {
+			flush()
+			active = strings.HasPrefix(trimmed, "Active")
+			continue
+		}
+
+		key, value, found := strings.Cut(trimmed, ":")
+		if !found && !strings.Contains(trimmed, " ") {
+			flush()
+			current = &APEXModule{Name: trimmed, IsActive: active}
+			continue
+		}
+		if current == nil {
+			continue
+		}
+
+		value = strings.TrimSpace(value)
+		switch key {
+		case "Version":
+			current.Version, _ = strconv.ParseInt(value, 10, 64)
+		case "Path":
+			current.Path = value
+		case "IsActive":
+			current.IsActive = value == "true"
+		case "IsFactory":
+			current.IsFactory = value == "true"
+		}
+	}
+	flush()
+
+	return modules
+}
+
+// parseAPEXList parses the output of
+// `pm list packages --apex-only --show-versioncode -f`, which only lists the
+// active APEX packages.
+func parseAPEXList(out string) []APEXModule {
+	modules := []APEXModule{}
+	for _, line := range strings.Split(out, "\n") {
+		// Older versions print an error instead.
+		line, found := strings.CutPrefix(strings.TrimSpace(line), "package:")
+		fields := strings.Fields(line)
+		if !found || len(fields) == 0 {
+			continue
+		}
+
+		module := APEXModule{IsActive: true}
+		// The path is separated from the name with the last "=".
+		if idx := strings.LastIndex(fields[0], "="); idx >= 0 {
+			module.Path = fields[0][:idx]
+			module.Name = fields[0][idx+1:]
+			// Updated modules are installed in /data/apex.
+			module.IsFactory = !strings.HasPrefix(module.Path, "/data/")
+		} else {
+			module.Name = fields[0]
+		}
+		for _, field := range fields[1:] {
+			if version, found := strings.CutPrefix(field, "versionCode:"); found {
+				module.Version, _ = strconv.ParseInt(version, 10, 64)
+			}
+		}
+		modules = append(modules, module)
+	}
+
+	return modules
+}
+
+// loadAPEXBaseline loads the apex_modules.json of a reference acquisition of
+// the factory image, and returns the versions of its active APEX modules.
+func loadAPEXBaseline(path string) (map[string]int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read APEX baseline: %v", err)
+	}
+
+	var modules []APEXModule
+	err = json.Unmarshal(data, &modules)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse APEX baseline: %v", err)
+	}
+
+	baseline := make(map[string]int64)
+	for _, module := range modules {
+		if module.IsActive {
+			baseline[module.Name] = module.Version
+		}
+	}
+
+	return baseline, nil
+}
+
+// pullAPEX downloads the .apex files of the modules into the apex folder.
+// Paths of mounted modules, such as /apex/com.android.tzdata@310000000, are
+// folders and are skipped.
+func (a *APEXModules) pullAPEX(modules []APEXModule) error {
+	apexPath := filepath.Join(a.StoragePath, "apex")
+	err := os.MkdirAll(apexPath, 0o755)
+	if err != nil {
+		return fmt.Errorf("failed to create apex folder: %v", err)
+	}
+
+	for i := range modules {
+		module := &modules[i]
+		if !strings.HasSuffix(module.Path, ".apex") && !strings.HasSuffix(module.Path, ".capex") {
+			continue
+		}
+
+		localPath := filepath.Join(apexPath, filepath.Base(module.Path))
+		out, err := adb.Client.Pull(module.Path, localPath)
+		if err != nil {
+			log.Debugf("Failed to pull %s: %v: %s", module.Path, err, strings.TrimSpace(out))
+			continue
+		}
+		module.LocalName = "apex/" + filepath.Base(module.Path)
+	}
+
+	return nil
+}
+
+func (a *APEXModules) Run(acq *acquisition.Acquisition, fast bool) error {
+	log.Info("Collecting APEX modules...")
+
+	// APEX modules only exist since Android 10, older devices get an empty
+	// list.
+	out, err := adb.Client.ShellTimeout(dumpsysServiceTimeout, "dumpsys", "package", "apex")
+	if err != nil {
+		log.Debugf("Failed to run `adb shell dumpsys package apex`: %v", err)
+	}
+	modules := parseAPEXDump(out)
+	if len(modules) == 0 {
+		out, err = adb.Client.Shell("pm", "list", "packages", "--apex-only", "--show-versioncode", "-f")
+		if err != nil {
+			log.Debugf("Failed to list APEX packages: %v", err)
+		}
+		modules = parseAPEXList(out)
+	}
+
+	// APEX modules are system components, so they are only downloaded along
+	// with all the packages.
+	if acq.DownloadPolicy == acquisition.DownloadAll {
+		err = a.pullAPEX(modules)
+		if err != nil {
+			log.Errorf("Failed to download APEX modules: %v", err)
+		}
+	}
+
+	if acq.BaselinePath != "" {
+		baseline, err := loadAPEXBaseline(acq.BaselinePath)
+		if err != nil {
+			return err
+		}
+
+		for _, module := range modules {
+			if !module.IsActive {
+				continue
+			}
+			version, ok := baseline[module.Name]
+			if !ok {
+				acq.AddWarning("APEX module %s is not part of the baseline", module.Name)
+			} else if version != module.Version {
+				acq.AddWarning("APEX module %s has version %d, while the baseline has version %d",
+					module.Name, module.Version, version)
+			}
+		}
+	}
+
+	return saveCommandOutputJson(filepath.Join(a.StoragePath, "apex_modules.json"), &modules)
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mvt-project/androidqf/acquisition"
+	"github.com/mvt-project/androidqf/adb"
+	"github.com/mvt-project/androidqf/log"
+)
+
+var (
+	appOpsUIDRegexp     = regexp.MustCompile(`^\s*Uid (u(\d+)\w*|\d+):`)
+	appOpsPackageRegexp = regexp.MustCompile(`^\s*Package (\S+):`)
+	// "CAMERA (allow):" or "CAMERA (allow / switch COARSE_LOCATION=allow):"
+	appOpsOpRegexp = regexp.MustCompile(`^\s*([A-Z][A-Z0-9_]+) \(([\w-]+)[^)]*\):\s*(.*)`)
+	// "Access: [top-s] 2023-05-01 10:00:00.123 (-1h2m3s4ms) duration=+10ms"
+	appOpsAccessRegexp = regexp.MustCompile(`^\s*(Access|Reject): (?:\[[^\]]*\] )?(.*?) \(([-+][^)]+)\)(?: duration=(\S+))?`)
+	// "time=+1h2m3s ago; rejectTime=+2d ago; duration=+5ms" on old versions.
+	appOpsTimeRegexp     = regexp.MustCompile(`(?:^|; )time=(\S+) ago`)
+	appOpsRejectRegexp   = regexp.MustCompile(`rejectTime=(\S+) ago`)
+	appOpsDurationRegexp = regexp.MustCompile(`duration=(\S+)`)
+	androidDaysRegexp    = regexp.MustCompile(`^(\d+)d`)
+)
+
+// sensitiveAppOps are the operations whose recent use by a third-party app
+// is a strong indicator of stalkerware. The location permission
+// ACCESS_FINE_LOCATION is tracked as the FINE_LOCATION op.
+var sensitiveAppOps = map[string]bool{
+	"FINE_LOCATION": true,
+	"RECORD_AUDIO":  true,
+	"CAMERA":        true,
+	"READ_SMS":      true,
+}
+
+type AppOp struct {
+	PackageName string `json:"package_name"`
+	User        int    `json:"user"`
+	Op          string `json:"op"`
+	Mode        string `json:"mode"`
+	AccessTime  string `json:"access_time"`
+	RejectTime  string `json:"reject_time"`
+	Duration    string `json:"duration"`
+	// accessAgo is how long before the acquisition the op was last used.
+	accessAgo time.Duration
+}
+
+type AppOps struct {
+	StoragePath string
+}
+
+func NewAppOps() *AppOps {
+	return &AppOps{}
+}
+
+func (a *AppOps) Name() string {
+	return "app_ops"
+}
+
+func (a *AppOps) Dependencies() []string {
+	return []string{"packages"}
+}
+
+func (a *AppOps) InitStorage(storagePath string) error {
+	a.StoragePath = storagePath
+	return nil
+}
+
+// parseAndroidDuration parses durations as printed by Android, such as
+// "+1d2h3m4s5ms" or "-5m0s".
+func parseAndroidDuration(value string) (time.Duration, error) {
+	value = strings.TrimLeft(strings.TrimSpace(value), "+-")
+
+	var days time.Duration
+	if match := androidDaysRegexp.FindStringSubmatch(value); match != nil {
+		count, _ := strconv.Atoi(match[1])
+		days = time.Duration(count) * 24 * time.Hour
+		value = strings.TrimPrefix(value, match[0])
+	}
+	if value == "" {
+		return days, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+
+	return days + duration, nil
+}
+
+// parseAppOps parses the output of `appops dump`. When an op was used
+// several times, for example by different attribution tags, the most recent
+// access is kept.
+func parseAppOps(out string) []AppOp {
+	ops := []AppOp{}
+	user := 0
+	packageName := ""
+	current := -1
+	for _, line := range strings.Split(out, "\n") {
+		if match := appOpsUIDRegexp.FindStringSubmatch(line); match != nil {
+			if match[2] != "" {
+				user, _ = strconv.Atoi(match[2])
+			} else {
+				uid, _ := strconv.Atoi(match[1])
+				user = uid / 100000
+			}
+			packageName = ""
+			current = -1
+			continue
+		}
+		if match := appOpsPackageRegexp.FindStringSubmatch(line); match != nil {
+			packageName = match[1]
+			current = -1
+			continue
+		}
+		if packageName == "" {
+			continue
+		}
+
+		if match := appOpsOpRegexp.FindStringSubmatch(line); match != nil {
+			ops = append(ops, AppOp{
+				PackageName: packageName,
+				User:        user,
+				Op:          match[1],
+				Mode:        match[2],
+				accessAgo:   -1,
+			})
+			current = len(ops) - 1
+
+			rest := match[3]
+			if timeMatch := appOpsTimeRegexp.FindStringSubmatch(rest); timeMatch != nil {
+				ops[current].AccessTime = timeMatch[1] + " ago"
+				if ago, err := parseAndroidDuration(timeMatch[1]); err == nil {
+					ops[current].accessAgo = ago
+				}
+			}
+			if rejectMatch := appOpsRejectRegexp.FindStringSubmatch(rest); rejectMatch != nil {
+				ops[current].RejectTime = rejectMatch[1] + " ago"
+			}
+			if durationMatch := appOpsDurationRegexp.FindStringSubmatch(rest); durationMatch != nil {
+				ops[current].Duration = durationMatch[1]
+			}
+			continue
+		}
+
+		if current < 0 {
+			continue
+		}
+		match := appOpsAccessRegexp.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		op := &ops[current]
+		ago, err := parseAndroidDuration(match[3])
+		if err != nil {
+			log.Debugf("Failed to parse app op time %q: %v", match[3], err)
+			continue
+		}
+
+		if match[1] == "Reject" {
+			op.RejectTime = match[2]
+			continue
+		}
+		if op.accessAgo < 0 || ago < op.accessAgo {
+			op.AccessTime = match[2]
+			op.Duration = match[4]
+			op.accessAgo = ago
+		}
+	}
+
+	return ops
+}
+
+func (a *AppOps) Run(acq *acquisition.Acquisition, fast bool) error {
+	log.Info("Collecting app ops...")
+
+	out, err := adb.Client.Shell("appops", "dump")
+	if err != nil && out == "" {
+		return fmt.Errorf("failed to run `adb shell appops dump`: %v", err)
+	}
+
+	err = saveCommandOutput(filepath.Join(a.StoragePath, "appops.txt"), out)
+	if err != nil {
+		return err
+	}
+
+	ops := parseAppOps(out)
+	packages := packageIndex(acq)
+	for _, op := range ops {
+		if !sensitiveAppOps[op.Op] || op.accessAgo < 0 || op.accessAgo > 24*time.Hour {
+			continue
+		}
+		pkg, ok := packages[fmt.Sprintf("%d/%s", op.User, op.PackageName)]
+		if !ok || !pkg.ThirdParty {
+			continue
+		}
+
+		acq.AddWarning("Third-party app %s used %s in the last 24 hours (%s)",
+			op.PackageName, op.Op, op.AccessTime)
+	}
+
+	return saveCommandOutputJson(filepath.Join(a.StoragePath, "app_ops.json"), &ops)
+}
@@ -67,13 +67,13 @@ func (b *Backup) Run(acq *acquisition.Acquisition, fast bool) error {
 
 	err = adb.Client.Backup(arg)
 	if err != nil {
-		log.Debugf("Impossible to get backup: %w", err)
+		log.Debugf("Impossible to get backup: %v", err)
 		return err
 	}
 
 	cwd, err := os.Getwd()
 	if err != nil {
-		log.Debugf("Impossible to get current directory: %w", err)
+		log.Debugf("Impossible to get current directory: %v", err)
 		return err
 	}
 
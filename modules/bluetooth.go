@@ -0,0 +1,272 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mvt-project/androidqf/acquisition"
+	"github.com/mvt-project/androidqf/adb"
+	"github.com/mvt-project/androidqf/log"
+	"github.com/mvt-project/androidqf/utils"
+)
+
+const btConfigPath = "/data/misc/bluedroid/bt_config.conf"
+
+var (
+	macAddressRegexp = regexp.MustCompile(`(?i)^([0-9a-f]{2}:){5}[0-9a-f]{2}$`)
+	// Recent versions mask the first bytes, as in "XX:XX:XX:XX:EE:FF".
+	maskedAddressRegexp = regexp.MustCompile(`(?i)^([0-9a-fx]{2}:){5}[0-9a-f]{2}$`)
+	// "enabled: true" in the BluetoothManagerService section.
+	bluetoothEnabledRegexp = regexp.MustCompile(`(?m)^\s*enabled: (true|false)`)
+	// "[ DUAL ]", "[BR/EDR]" or "[ 0x240404 ]" after the address.
+	bluetoothTagRegexp = regexp.MustCompile(`^\[\s*([^\]]*?)\s*\]`)
+)
+
+// bondedMarkers are the headers of the bonded devices section, which vary
+// between Android versions and manufacturers.
+var bondedMarkers = []string{
+	"bonded devices",
+	"paired devices",
+	"mbondeddevices",
+}
+
+type BluetoothDevice struct {
+	Name         string     `json:"name"`
+	Address      string     `json:"address"`
+	Type         string     `json:"type"`
+	Class        string     `json:"class"`
+	LastSeen     *time.Time `json:"last_seen"`
+	Surveillance string     `json:"surveillance,omitempty"`
+}
+
+type BluetoothResult struct {
+	Enabled *bool             `json:"enabled"`
+	Devices []BluetoothDevice `json:"devices"`
+}
+
+type BluetoothDevices struct {
+	StoragePath string
+}
+
+func NewBluetoothDevices() *BluetoothDevices {
+	return &BluetoothDevices{}
+}
+
+func (b *BluetoothDevices) Name() string {
+	return "bluetooth_devices"
+}
+
+func (b *BluetoothDevices) InitStorage(storagePath string) error {
+	b.StoragePath = storagePath
+	return nil
+}
+
+// parseBtConfig parses bt_config.conf, where each paired device has its own
+// section named after its address:
+//
+//	[aa:bb:cc:dd:ee:ff]
+//	Name = Headset
+//	DevClass = 2360324
+//	Timestamp = 1600000000
+func parseBtConfig(out string) []BluetoothDevice {
+	devices := []BluetoothDevice{}
+
+	var device *BluetoothDevice
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			if device != nil {
+				devices = append(devices, *device)
+				device = nil
+			}
+			address := strings.Trim(line, "[]")
+			if macAddressRegexp.MatchString(address) {
+				device = &BluetoothDevice{Address: strings.ToLower(address)}
+			}
+			continue
+		}
+		if device == nil {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+		switch strings.TrimSpace(parts[0]) {
+		case "Name":
+			device.Name = value
+		case "DevClass":
+			device.Class = value
+		case "Timestamp":
+			timestamp, err := strconv.ParseInt(value, 10, 64)
+			if err == nil {
+				lastSeen := time.Unix(timestamp, 0).UTC()
+				device.LastSeen = &lastSeen
+			}
+		}
+	}
+	if device != nil {
+		devices = append(devices, *device)
+	}
+
+	return devices
+}
+
+// isBondedMarker checks whether the line is the header of the bonded devices
+// section.
+func isBondedMarker(line string) bool {
+	line = strings.ToLower(strings.TrimSpace(line))
+	if !strings.Contains(line, ":") {
+		return false
+	}
+	for _, marker := range bondedMarkers {
+		if strings.HasPrefix(line, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseBluetoothManager parses the bonded devices listed by `dumpsys
+// bluetooth_manager`, as in "aa:bb:cc:dd:ee:ff [ DUAL ] Headset".
+func parseBluetoothManager(out string) []BluetoothDevice {
+	devices := []BluetoothDevice{}
+	seen := make(map[string]bool)
+	lines := strings.Split(out, "\n")
+	for i := 0; i < len(lines); i++ {
+		if !isBondedMarker(lines[i]) {
+			continue
+		}
+
+		indent := indentation(lines[i])
+		for i+1 < len(lines) && strings.TrimSpace(lines[i+1]) != "" && indentation(lines[i+1]) > indent {
+			i++
+			fields := strings.Fields(lines[i])
+			if len(fields) == 0 || !maskedAddressRegexp.MatchString(fields[0]) {
+				continue
+			}
+
+			device := BluetoothDevice{Address: strings.ToLower(fields[0])}
+			rest := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(lines[i]), fields[0]))
+			// The device type, and on some versions its class, are in
+			// brackets before the name.
+			for {
+				match := bluetoothTagRegexp.FindStringSubmatch(rest)
+				if match == nil {
+					break
+				}
+				if strings.HasPrefix(match[1], "0x") {
+					device.Class = match[1]
+				} else if device.Type == "" {
+					device.Type = match[1]
+				}
+				rest = strings.TrimSpace(rest[len(match[0]):])
+			}
+			device.Name = rest
+			if !seen[device.Address] {
+				seen[device.Address] = true
+				devices = append(devices, device)
+			}
+		}
+	}
+
+	return devices
+}
+
+// bluetoothEnabled tells whether Bluetooth is turned on, from `dumpsys
+// bluetooth_manager` or else from the global setting.
+func bluetoothEnabled(out string) *bool {
+	if match := bluetoothEnabledRegexp.FindStringSubmatch(out); match != nil {
+		enabled := match[1] == "true"
+		return &enabled
+	}
+
+	setting, err := adb.Client.Shell("settings", "get", "global", "bluetooth_on")
+	if err != nil {
+		return nil
+	}
+	switch strings.TrimSpace(setting) {
+	case "0":
+		enabled := false
+		return &enabled
+	case "1":
+		enabled := true
+		return &enabled
+	}
+	return nil
+}
+
+// flagSurveillanceDevices flags the devices whose address, or the OUI prefix
+// of their manufacturer, matches a MAC address indicator. The prefixes of
+// surveillance hardware are provided by the indicators, as in
+// "[mac-addr:value LIKE '00:11:22:%']".
+func flagSurveillanceDevices(acq *acquisition.Acquisition, devices []BluetoothDevice) {
+	for i := range devices {
+		device := &devices[i]
+		// Masked addresses can only match their last bytes.
+		if !macAddressRegexp.MatchString(device.Address) {
+			continue
+		}
+		ioc, ok := utils.MatchIOC(utils.IOCMACAddress, device.Address)
+		if !ok {
+			continue
+		}
+		device.Surveillance = ioc.Value
+		if ioc.Name != "" {
+			device.Surveillance = fmt.Sprintf("%s (%s)", ioc.Value, ioc.Name)
+		}
+		acq.AddWarning("Paired Bluetooth device %s (%s) matches the surveillance hardware indicator %s",
+			device.Name, device.Address, device.Surveillance)
+	}
+}
+
+func (b *BluetoothDevices) Run(acq *acquisition.Acquisition, fast bool) error {
+	log.Info("Collecting paired Bluetooth devices...")
+
+	out, err := adb.Client.ShellTimeout(dumpsysServiceTimeout, "dumpsys", "bluetooth_manager")
+	if err != nil && out == "" {
+		log.Debugf("Failed to run `adb shell dumpsys bluetooth_manager`: %v", err)
+	} else {
+		err = saveCommandOutput(filepath.Join(b.StoragePath, "bluetooth.txt"), out)
+		if err != nil {
+			log.Errorf("Impossible to save the Bluetooth dump: %v", err)
+		}
+	}
+
+	result := BluetoothResult{
+		Enabled: bluetoothEnabled(out),
+		Devices: parseBluetoothManager(out),
+	}
+
+	// The configuration readable by root has the full addresses and the
+	// last connection time.
+	if adb.Client.HasRoot() {
+		config, err := adb.Client.ShellAsRoot("cat", btConfigPath)
+		if err != nil {
+			log.Debugf("Unable to read %s: %v", btConfigPath, err)
+		} else if devices := parseBtConfig(config); len(devices) > 0 {
+			types := make(map[string]string)
+			for _, device := range result.Devices {
+				types[device.Address] = device.Type
+			}
+			for i := range devices {
+				devices[i].Type = types[devices[i].Address]
+			}
+			result.Devices = devices
+		}
+	}
+
+	flagSurveillanceDevices(acq, result.Devices)
+
+	return saveCommandOutputJson(filepath.Join(b.StoragePath, "bluetooth.json"), &result)
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/mvt-project/androidqf/acquisition"
+	"github.com/mvt-project/androidqf/utils"
+)
+
+func TestFlagSurveillanceDevices(t *testing.T) {
+	count, err := utils.LoadIOCs(filepath.Join("testdata", "surveillance_ouis.stix2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("got %d indicators, want 1", count)
+	}
+
+	devices := []BluetoothDevice{
+		{Name: "Tracker", Address: "a4:c1:38:12:34:56"},
+		{Name: "Headphones", Address: "00:1b:66:12:34:56"},
+		// The prefix of masked addresses is unknown.
+		{Name: "Watch", Address: "XX:XX:XX:XX:34:56"},
+	}
+	acq := &acquisition.Acquisition{}
+	flagSurveillanceDevices(acq, devices)
+
+	if want := "a4:c1:38 (Example Tracker)"; devices[0].Surveillance != want {
+		t.Errorf("got %q for %s, want %q", devices[0].Surveillance, devices[0].Address, want)
+	}
+	for _, device := range devices[1:] {
+		if device.Surveillance != "" {
+			t.Errorf("got %q for %s", device.Surveillance, device.Address)
+		}
+	}
+	if len(acq.Warnings) != 1 {
+		t.Errorf("got warnings %q, want one", acq.Warnings)
+	}
+}
+
+func TestFlagSurveillanceDevicesIndex(t *testing.T) {
+	// The STIX2 file next to the index is used instead of downloading it,
+	// and the entry without a file is skipped.
+	count, err := utils.LoadIOCs(filepath.Join("testdata", "indicators.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("got %d indicators, want 1", count)
+	}
+
+	devices := []BluetoothDevice{{Name: "Tracker", Address: "a4:c1:38:12:34:56"}}
+	flagSurveillanceDevices(&acquisition.Acquisition{}, devices)
+	if want := "a4:c1:38 (Example Tracker)"; devices[0].Surveillance != want {
+		t.Errorf("got %q, want %q", devices[0].Surveillance, want)
+	}
+}
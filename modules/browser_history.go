@@ -0,0 +1,209 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mvt-project/androidqf/acquisition"
+	"github.com/mvt-project/androidqf/adb"
+	"github.com/mvt-project/androidqf/log"
+	_ "modernc.org/sqlite"
+)
+
+// chromeEpochOffset is the number of microseconds between the origin of the
+// timestamps of Chrome, January 1st 1601, and the Unix epoch. A
+// time.Duration can't span the four centuries in between.
+const chromeEpochOffset = 11644473600 * 1000 * 1000
+
+// browserDatabase is the history database of a browser, along with the
+// query returning the URL, the title, the time of the last visit and the
+// number of visits.
+type browserDatabase struct {
+	browser   string
+	path      string
+	query     string
+	visitTime func(value int64) time.Time
+}
+
+var browserDatabases = []browserDatabase{
+	{
+		browser: "chrome",
+		path:    "/data/data/com.android.chrome/app_chrome/Default/History",
+		query:   "SELECT url, title, last_visit_time, visit_count FROM urls;",
+		visitTime: func(value int64) time.Time {
+			return time.UnixMicro(value - chromeEpochOffset).UTC()
+		},
+	},
+	{
+		browser: "aosp",
+		path:    "/data/data/com.android.browser/databases/browser.db",
+		query:   "SELECT url, title, date, visits FROM history;",
+		visitTime: func(value int64) time.Time {
+			return time.UnixMilli(value).UTC()
+		},
+	},
+}
+
+type BrowserHistoryEntry struct {
+	Browser    string    `json:"browser"`
+	URL        string    `json:"url"`
+	Title      string    `json:"title"`
+	VisitTime  time.Time `json:"visit_time"`
+	VisitCount int       `json:"visit_count"`
+}
+
+type BrowserHistory struct {
+	StoragePath string
+	HistoryPath string
+}
+
+func NewBrowserHistory() *BrowserHistory {
+	return &BrowserHistory{}
+}
+
+func (b *BrowserHistory) Name() string {
+	return "browser_history"
+}
+
+func (b *BrowserHistory) Outputs() []string {
+	return []string{"browser_history"}
+}
+
+func (b *BrowserHistory) InitStorage(storagePath string) error {
+	b.StoragePath = storagePath
+	b.HistoryPath = filepath.Join(storagePath, "browser_history")
+	return nil
+}
+
+// copyFile copies the file at src to dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// readBrowserHistory runs the query of the browser database on the local
+// copy at localPath. SQLite merges the write-ahead log into the database
+// when closing it, so both are copied to a temporary folder first to leave
+// the acquired files untouched.
+func readBrowserHistory(db browserDatabase, localPath string) ([]BrowserHistoryEntry, error) {
+	tempDir, err := os.MkdirTemp("", "androidqf-history-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	tempPath := filepath.Join(tempDir, "history.db")
+	if err := copyFile(localPath, tempPath); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(localPath + "-wal"); err == nil {
+		if err := copyFile(localPath+"-wal", tempPath+"-wal"); err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := sql.Open("sqlite", tempPath)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	rows, err := conn.Query(db.query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []BrowserHistoryEntry{}
+	for rows.Next() {
+		var url, title sql.NullString
+		var visitTime sql.NullInt64
+		var visitCount sql.NullInt64
+		if err := rows.Scan(&url, &title, &visitTime, &visitCount); err != nil {
+			return nil, err
+		}
+		entries = append(entries, BrowserHistoryEntry{
+			Browser:    db.browser,
+			URL:        url.String,
+			Title:      title.String,
+			VisitTime:  db.visitTime(visitTime.Int64),
+			VisitCount: int(visitCount.Int64),
+		})
+	}
+
+	return entries, rows.Err()
+}
+
+// Run copies the history databases, which requires root, and reads the
+// copies.
+func (b *BrowserHistory) Run(acq *acquisition.Acquisition, fast bool) error {
+	if !adb.Client.HasRoot() {
+		log.Warning("Root is not available, skipping collection of browser history")
+		return nil
+	}
+
+	log.Info("Collecting browser history...")
+
+	err := os.MkdirAll(b.HistoryPath, 0o755)
+	if err != nil {
+		return fmt.Errorf("failed to create browser_history folder: %v", err)
+	}
+
+	entries := []BrowserHistoryEntry{}
+	for _, db := range browserDatabases {
+		localPath := filepath.Join(b.HistoryPath, fmt.Sprintf("%s_%s", db.browser, filepath.Base(db.path)))
+
+		// The write-ahead log holds the most recent visits.
+		copied := false
+		for _, suffix := range []string{"", "-wal"} {
+			out, err := adb.Client.ExecOutAsRoot(fmt.Sprintf("cat '%s%s'", db.path, suffix))
+			if err != nil || strings.HasPrefix(string(out), "cat:") {
+				log.Debugf("Failed to read %s%s: %v", db.path, suffix, err)
+				continue
+			}
+
+			err = os.WriteFile(localPath+suffix, out, 0o644)
+			if err != nil {
+				log.Errorf("Failed to save %s: %v", db.path, err)
+				continue
+			}
+			if suffix == "" {
+				copied = true
+			}
+		}
+		if !copied {
+			continue
+		}
+
+		history, err := readBrowserHistory(db, localPath)
+		if err != nil {
+			log.Errorf("Failed to read the history of %s: %v", db.browser, err)
+			continue
+		}
+		entries = append(entries, history...)
+	}
+
+	return saveCommandOutputJson(filepath.Join(b.StoragePath, "browser_history.json"), &entries)
+}
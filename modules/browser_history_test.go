@@ -0,0 +1,79 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"bytes"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadBrowserHistory(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "History")
+	conn, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetMaxOpenConns(1)
+
+	// The last visit is only in the write-ahead log, as on the device.
+	for _, query := range []string{
+		"PRAGMA journal_mode=WAL;",
+		"PRAGMA wal_autocheckpoint=0;",
+		"CREATE TABLE urls (id INTEGER PRIMARY KEY, url LONGVARCHAR, title LONGVARCHAR, visit_count INTEGER, last_visit_time INTEGER);",
+		"INSERT INTO urls (url, title, visit_count, last_visit_time) VALUES ('https://example.com/', 'Example', 3, 13317033600000000);",
+		"INSERT INTO urls (url, title, visit_count, last_visit_time) VALUES ('https://example.org/login?id=1', NULL, 1, 13317037200000000);",
+	} {
+		if _, err := conn.Exec(query); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+
+	// Copy the files as pulled from the device, with the database open.
+	localPath := filepath.Join(dir, "chrome_History")
+	for _, suffix := range []string{"", "-wal"} {
+		if err := copyFile(dbPath+suffix, localPath+suffix); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before, err := os.ReadFile(localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := readBrowserHistory(browserDatabases[0], localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	want := BrowserHistoryEntry{
+		Browser:    "chrome",
+		URL:        "https://example.org/login?id=1",
+		VisitTime:  time.Date(2023, 1, 1, 9, 0, 0, 0, time.UTC),
+		VisitCount: 1,
+	}
+	if entries[1] != want {
+		t.Errorf("got %+v, want %+v", entries[1], want)
+	}
+
+	// The acquired copies are left untouched.
+	after, err := os.ReadFile(localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("the database was modified")
+	}
+	if _, err := os.Stat(localPath + "-wal"); err != nil {
+		t.Errorf("the write-ahead log was removed: %v", err)
+	}
+}
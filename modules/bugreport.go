@@ -8,12 +8,17 @@ package modules
 import (
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/mvt-project/androidqf/acquisition"
 	"github.com/mvt-project/androidqf/adb"
 	"github.com/mvt-project/androidqf/log"
 )
 
+// bugreportTimeout is the maximum time given to the device to generate
+// the bugreport.
+const bugreportTimeout = 10 * time.Minute
+
 type Bugreport struct {
 	StoragePath string
 }
@@ -36,15 +41,15 @@ func (b *Bugreport) Run(acq *acquisition.Acquisition, fast bool) error {
 		"Generating a bugreport for the device...",
 	)
 
-	err := adb.Client.Bugreport()
+	err := adb.Client.Bugreport(bugreportTimeout)
 	if err != nil {
-		log.Debugf("Impossible to generate bugreport: %w", err)
+		log.Debugf("Impossible to generate bugreport: %v", err)
 		return err
 	}
 
 	cwd, err := os.Getwd()
 	if err != nil {
-		log.Debugf("Impossible to get current directory: %w", err)
+		log.Debugf("Impossible to get current directory: %v", err)
 		return err
 	}
 
@@ -0,0 +1,68 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"github.com/mvt-project/androidqf/acquisition"
+	"github.com/mvt-project/androidqf/log"
+)
+
+type BuildProperties struct {
+	StoragePath string
+}
+
+func NewBuildProperties() *BuildProperties {
+	return &BuildProperties{}
+}
+
+func (b *BuildProperties) Name() string {
+	return "build_properties"
+}
+
+// Dependencies returns getprop, whose properties are checked instead of
+// running getprop again. They are saved in getprop.txt and getprop.json.
+func (b *BuildProperties) Dependencies() []string {
+	return []string{"getprop"}
+}
+
+func (b *BuildProperties) InitStorage(storagePath string) error {
+	b.StoragePath = storagePath
+	return nil
+}
+
+// buildInfo returns the build properties of forensic interest.
+func buildInfo(props map[string]string) *acquisition.BuildInfo {
+	return &acquisition.BuildInfo{
+		Fingerprint: props["ro.build.fingerprint"],
+		Release:     props["ro.build.version.release"],
+		Debuggable:  props["ro.debuggable"],
+		Secure:      props["ro.secure"],
+		USBConfig:   props["persist.sys.usb.config"],
+	}
+}
+
+// Restore sets the build properties from the properties restored by the
+// getprop module, as this module doesn't save any file.
+func (b *BuildProperties) Restore(acq *acquisition.Acquisition) error {
+	acq.BuildInfo = buildInfo(getProperties(acq))
+	return nil
+}
+
+func (b *BuildProperties) Run(acq *acquisition.Acquisition, fast bool) error {
+	log.Info("Checking build properties...")
+
+	acq.BuildInfo = buildInfo(getProperties(acq))
+
+	// Production builds are not debuggable and have adbd running
+	// unprivileged.
+	if acq.BuildInfo.Debuggable == "1" {
+		log.Warning("The device is running a debuggable build (ro.debuggable=1)")
+	}
+	if acq.BuildInfo.Secure == "0" {
+		log.Warning("The device is running an insecure build (ro.secure=0)")
+	}
+
+	return nil
+}
@@ -0,0 +1,344 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mvt-project/androidqf/acquisition"
+	"github.com/mvt-project/androidqf/adb"
+	"github.com/mvt-project/androidqf/log"
+)
+
+// Folders containing the system trust store. Since Android 14 it is shipped
+// in the Conscrypt APEX module.
+var systemCACertsPaths = []string{
+	"/apex/com.android.conscrypt/cacerts",
+	"/system/etc/security/cacerts",
+}
+
+// Certificates are stored as <subject hash>.<index>.
+var certFileRegexp = regexp.MustCompile(`^[0-9a-f]{8}\.[0-9]+$`)
+
+// maxCAValidity is the validity period above which a user CA is flagged.
+const maxCAValidity = 10 * 365 * 24 * time.Hour
+
+type CACertificate struct {
+	Path      string    `json:"path"`
+	User      int       `json:"user"`
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	SHA1      string    `json:"sha1"`
+	SHA256    string    `json:"sha256"`
+	Warnings  []string  `json:"warnings"`
+}
+
+// Status of the folders of the user trust store. A folder that does not
+// exist means that no certificate was ever added or removed, while one that
+// can't be read tells nothing.
+const (
+	certFolderAccessible = "accessible"
+	certFolderNotFound   = "not_found"
+	certFolderDenied     = "permission_denied"
+	certFolderError      = "error"
+)
+
+// UserCertificateStore describes the certificates added to and removed from
+// the trust store by a user.
+type UserCertificateStore struct {
+	User          int             `json:"user"`
+	AddedStatus   string          `json:"added_status"`
+	AddedError    string          `json:"added_error,omitempty"`
+	Added         []CACertificate `json:"added"`
+	RemovedStatus string          `json:"removed_status"`
+	RemovedError  string          `json:"removed_error,omitempty"`
+	Removed       []CACertificate `json:"removed"`
+}
+
+type CACertificatesResult struct {
+	User   []CACertificate `json:"user"`
+	System []CACertificate `json:"system"`
+}
+
+type CACertificates struct {
+	StoragePath string
+	CertsPath   string
+}
+
+func NewCACertificates() *CACertificates {
+	return &CACertificates{}
+}
+
+func (c *CACertificates) Name() string {
+	return "ca_certificates"
+}
+
+func (c *CACertificates) Outputs() []string {
+	return []string{"ca_certificates"}
+}
+
+func (c *CACertificates) InitStorage(storagePath string) error {
+	c.StoragePath = storagePath
+	c.CertsPath = filepath.Join(storagePath, "ca_certificates")
+	err := os.MkdirAll(c.CertsPath, 0o755)
+	if err != nil {
+		return fmt.Errorf("failed to create ca_certificates folder: %v", err)
+	}
+
+	return nil
+}
+
+// parseCertificate parses a certificate stored either in PEM, as in the
+// system trust store, or in DER, as in the user one.
+func parseCertificate(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block != nil {
+		data = block.Bytes
+	}
+	return x509.ParseCertificate(data)
+}
+
+func newCACertificate(remotePath string, user int, cert *x509.Certificate) CACertificate {
+	sha1Sum := sha1.Sum(cert.Raw)
+	sha256Sum := sha256.Sum256(cert.Raw)
+	return CACertificate{
+		Path:      remotePath,
+		User:      user,
+		Subject:   cert.Subject.String(),
+		Issuer:    cert.Issuer.String(),
+		NotBefore: cert.NotBefore.UTC(),
+		NotAfter:  cert.NotAfter.UTC(),
+		SHA1:      hex.EncodeToString(sha1Sum[:]),
+		SHA256:    hex.EncodeToString(sha256Sum[:]),
+		Warnings:  []string{},
+	}
+}
+
+// readFilePrivileged returns the raw content of a file on the device, reading
+// it as root if the shell user is not allowed to. Errors of cat are printed
+// in place of the content, as exec-out doesn't return its exit status.
+func readFilePrivileged(remotePath string) ([]byte, error) {
+	cmd := "cat " + shellQuote(remotePath)
+	data, err := adb.Client.ExecOut(cmd)
+	if err == nil {
+		err = commandError(cmd, data)
+	}
+	if err == nil {
+		return data, nil
+	}
+	if !adb.Client.HasRoot() {
+		return nil, err
+	}
+
+	data, err = adb.Client.ExecOutAsRoot(cmd)
+	if err == nil {
+		err = commandError(cmd, data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// listCertificateFiles returns the certificate files found in the folder.
+func listCertificateFiles(folder string) []string {
+	out, err := readPrivileged("ls", folder)
+	if err != nil {
+		log.Debugf("Unable to list %s: %v", folder, err)
+		return []string{}
+	}
+
+	files := []string{}
+	for _, name := range strings.Split(out, "\n") {
+		name = strings.TrimSpace(name)
+		if certFileRegexp.MatchString(name) {
+			files = append(files, path.Join(folder, name))
+		}
+	}
+
+	return files
+}
+
+// systemCertificates returns the certificates of the system trust store.
+// They are printed in a single command, as there usually are more than a
+// hundred of them.
+func systemCertificates(folder string) []CACertificate {
+	out, err := adb.Client.Shell(fmt.Sprintf("for f in %s/*; do echo \"==> $f\"; cat \"$f\"; done", folder))
+	if err != nil && out == "" {
+		log.Debugf("Unable to read system certificates from %s: %v", folder, err)
+		return nil
+	}
+
+	certs := []CACertificate{}
+	for _, section := range strings.Split(out, "==> ")[1:] {
+		lines := strings.SplitN(section, "\n", 2)
+		if len(lines) != 2 {
+			continue
+		}
+
+		cert, err := parseCertificate([]byte(lines[1]))
+		if err != nil {
+			log.Debugf("Failed to parse system certificate %s: %v", lines[0], err)
+			continue
+		}
+		certs = append(certs, newCACertificate(strings.TrimSpace(lines[0]), 0, cert))
+	}
+
+	return certs
+}
+
+// certFolderStatus returns the status of a folder of the user trust store
+// from the error listing it.
+func certFolderStatus(err error) string {
+	switch {
+	case err == nil:
+		return certFolderAccessible
+	case isPermissionDenied(err.Error()):
+		return certFolderDenied
+	case strings.Contains(err.Error(), "No such file"):
+		return certFolderNotFound
+	}
+	return certFolderError
+}
+
+// userCertificates pulls and parses the certificates in a folder of the user
+// trust store, adding its listing to listing. Certificates are saved with the
+// given prefix and the user ID.
+func (c *CACertificates) userCertificates(folder string, user int, prefix string, listing *strings.Builder) ([]CACertificate, string, error) {
+	certs := []CACertificate{}
+	out, err := readPrivileged("ls", "-la", folder)
+	if err != nil {
+		log.Debugf("Unable to list %s: %v", folder, err)
+		return certs, certFolderStatus(err), err
+	}
+	fmt.Fprintf(listing, "==> %s <==\n%s\n\n", folder, out)
+
+	for _, remotePath := range listCertificateFiles(folder) {
+		data, err := readFilePrivileged(remotePath)
+		if err != nil {
+			log.Errorf("Failed to read certificate %s: %v", remotePath, err)
+			continue
+		}
+
+		localPath := filepath.Join(c.CertsPath, fmt.Sprintf("%s%d_%s", prefix, user, path.Base(remotePath)))
+		err = os.WriteFile(localPath, data, 0o644)
+		if err != nil {
+			log.Errorf("Failed to save certificate %s: %v", remotePath, err)
+		}
+
+		cert, err := parseCertificate(data)
+		if err != nil {
+			log.Errorf("Failed to parse certificate %s: %v", remotePath, err)
+			continue
+		}
+		certs = append(certs, newCACertificate(remotePath, user, cert))
+	}
+
+	return certs, certFolderAccessible, nil
+}
+
+func (c *CACertificates) Run(acq *acquisition.Acquisition, fast bool) error {
+	log.Info("Collecting installed CA certificates...")
+
+	result := CACertificatesResult{
+		User:   []CACertificate{},
+		System: []CACertificate{},
+	}
+
+	for _, folder := range systemCACertsPaths {
+		certs := systemCertificates(folder)
+		if len(certs) > 0 {
+			result.System = certs
+			break
+		}
+	}
+	systemSubjects := make(map[string]bool)
+	for _, cert := range result.System {
+		systemSubjects[cert.Subject] = true
+	}
+
+	users, err := adb.Client.GetUsers()
+	if err != nil {
+		log.Debugf("Failed to list users, only looking at the primary one: %v", err)
+	}
+
+	var listing strings.Builder
+	stores := []UserCertificateStore{}
+	for _, user := range users {
+		store := UserCertificateStore{User: user.ID}
+
+		folder := fmt.Sprintf("/data/misc/user/%d/cacerts-added", user.ID)
+		store.Added, store.AddedStatus, err = c.userCertificates(folder, user.ID, "user", &listing)
+		if err != nil {
+			store.AddedError = err.Error()
+		}
+		for i := range store.Added {
+			caCert := &store.Added[i]
+			if len(systemSubjects) > 0 && !systemSubjects[caCert.Issuer] {
+				caCert.Warnings = append(caCert.Warnings, "issued by a root not in the system trust store")
+			}
+			if caCert.NotAfter.Sub(caCert.NotBefore) > maxCAValidity {
+				caCert.Warnings = append(caCert.Warnings, "valid for more than 10 years")
+			}
+
+			log.Warningf("Found user-installed CA certificate %s (%s)", caCert.Subject, caCert.Path)
+			for _, warning := range caCert.Warnings {
+				log.Warningf("CA certificate %s: %s", caCert.Subject, warning)
+			}
+			result.User = append(result.User, *caCert)
+		}
+
+		// Removing a system CA is less common, and can be used to break
+		// the connection to services not meant to be intercepted.
+		folder = fmt.Sprintf("/data/misc/user/%d/cacerts-removed", user.ID)
+		store.Removed, store.RemovedStatus, err = c.userCertificates(folder, user.ID, "removed", &listing)
+		if err != nil {
+			store.RemovedError = err.Error()
+		}
+		for _, caCert := range store.Removed {
+			log.Warningf("System CA certificate %s was disabled by user %d", caCert.Subject, user.ID)
+		}
+
+		if store.AddedStatus != certFolderAccessible && store.AddedStatus != certFolderNotFound {
+			log.Warningf("Unable to check the CA certificates added by user %d: %s", user.ID, store.AddedStatus)
+		}
+		stores = append(stores, store)
+	}
+
+	out, err := adb.Client.ShellTimeout(dumpsysServiceTimeout, "dumpsys", "trust")
+	if err != nil && out == "" {
+		log.Debugf("Failed to run `dumpsys trust`: %v", err)
+	} else {
+		err = saveCommandOutput(filepath.Join(c.StoragePath, "trust.txt"), out)
+		if err != nil {
+			log.Errorf("Impossible to save the trust dump: %v", err)
+		}
+	}
+
+	err = saveCommandOutputJson(filepath.Join(c.StoragePath, "user_certificates.json"), &stores)
+	if err != nil {
+		return err
+	}
+
+	err = saveCommandOutput(filepath.Join(c.StoragePath, "ca_certificates.txt"), listing.String())
+	if err != nil {
+		return err
+	}
+
+	return saveCommandOutputJson(filepath.Join(c.StoragePath, "ca_certificates.json"), &result)
+}
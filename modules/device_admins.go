@@ -0,0 +1,306 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mvt-project/androidqf/acquisition"
+	"github.com/mvt-project/androidqf/adb"
+	"github.com/mvt-project/androidqf/log"
+)
+
+var (
+	// "User  0: admin=com.example/.Receiver,DeviceOwner,Affiliated"
+	dpmOwnerRegexp = regexp.MustCompile(`User\s+(\d+):\s+admin=(\S+)`)
+	// "Enabled Device Admins (User 0, provisioningState: 0):"
+	enabledAdminsRegexp = regexp.MustCompile(`^\s*Enabled Device Admins \(User (\d+)`)
+	// "Device Owner:" or "Profile Owner (User 10):"
+	policyOwnerRegexp = regexp.MustCompile(`^\s*(Device|Profile) Owner(?: \(User (\d+)\))?:`)
+	// "admin=ComponentInfo{com.example/com.example.Receiver}"
+	policyOwnerAdminRegexp = regexp.MustCompile(`admin=ComponentInfo\{([^}]+)\}`)
+	// "User ID: 0"
+	policyOwnerUserRegexp = regexp.MustCompile(`^\s*User ID: (\d+)`)
+)
+
+type DeviceAdmin struct {
+	PackageName    string `json:"package_name"`
+	ComponentName  string `json:"component_name"`
+	User           int    `json:"user"`
+	IsOwner        bool   `json:"is_owner"`
+	IsProfileOwner bool   `json:"is_profile_owner"`
+	IsThirdParty   bool   `json:"is_third_party"`
+	IsSideloaded   bool   `json:"is_sideloaded"`
+}
+
+type DevicePolicy struct {
+	Admins         []DeviceAdmin `json:"admins"`
+	DeviceOwner    *DeviceAdmin  `json:"device_owner"`
+	ProfileOwners  []DeviceAdmin `json:"profile_owners"`
+	ManagedProfile bool          `json:"managed_profile"`
+}
+
+type DeviceAdmins struct {
+	StoragePath string
+}
+
+func NewDeviceAdmins() *DeviceAdmins {
+	return &DeviceAdmins{}
+}
+
+func (d *DeviceAdmins) Name() string {
+	return "device_admins"
+}
+
+func (d *DeviceAdmins) Dependencies() []string {
+	return []string{"packages"}
+}
+
+func (d *DeviceAdmins) InitStorage(storagePath string) error {
+	d.StoragePath = storagePath
+	return nil
+}
+
+// shortComponentName returns the component in the short form of
+// ComponentName.flattenToShortString(), as in "com.example/.Receiver", from
+// either form or from "ComponentInfo{com.example/com.example.Receiver}".
+func shortComponentName(component string) string {
+	component = strings.TrimSuffix(strings.TrimPrefix(component, "ComponentInfo{"), "}")
+	pkg, class, found := strings.Cut(component, "/")
+	if !found {
+		return component
+	}
+	if strings.HasPrefix(class, pkg+".") {
+		class = strings.TrimPrefix(class, pkg)
+	}
+	return pkg + "/" + class
+}
+
+// parseDeviceOwners parses the output of `dpm list-owners`, keyed by user
+// and component.
+func parseDeviceOwners(out string) map[string]DeviceAdmin {
+	owners := make(map[string]DeviceAdmin)
+	for _, line := range strings.Split(out, "\n") {
+		match := dpmOwnerRegexp.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+
+		user, _ := strconv.Atoi(match[1])
+		parts := strings.Split(match[2], ",")
+		admin := DeviceAdmin{
+			PackageName:   strings.SplitN(parts[0], "/", 2)[0],
+			ComponentName: shortComponentName(parts[0]),
+			User:          user,
+		}
+		for _, flag := range parts[1:] {
+			switch flag {
+			case "DeviceOwner":
+				admin.IsOwner = true
+			case "ProfileOwner":
+				admin.IsProfileOwner = true
+			}
+		}
+		owners[fmt.Sprintf("%d/%s", user, admin.ComponentName)] = admin
+	}
+
+	return owners
+}
+
+// parsePolicyOwners parses the device owner and the profile owners listed by
+// `dumpsys device_policy`, keyed by user and component. It is used on
+// devices where `dpm list-owners` isn't available.
+func parsePolicyOwners(out string) map[string]DeviceAdmin {
+	owners := make(map[string]DeviceAdmin)
+	lines := strings.Split(out, "\n")
+	for i := 0; i < len(lines); i++ {
+		match := policyOwnerRegexp.FindStringSubmatch(lines[i])
+		if match == nil {
+			continue
+		}
+
+		admin := DeviceAdmin{
+			IsOwner:        match[1] == "Device",
+			IsProfileOwner: match[1] == "Profile",
+		}
+		admin.User, _ = strconv.Atoi(match[2])
+		indent := indentation(lines[i])
+		for i+1 < len(lines) {
+			next := lines[i+1]
+			if strings.TrimSpace(next) == "" || indentation(next) <= indent {
+				break
+			}
+			i++
+
+			if m := policyOwnerAdminRegexp.FindStringSubmatch(next); m != nil {
+				admin.ComponentName = shortComponentName(m[1])
+				admin.PackageName = strings.SplitN(m[1], "/", 2)[0]
+			} else if m := policyOwnerUserRegexp.FindStringSubmatch(next); m != nil {
+				admin.User, _ = strconv.Atoi(m[1])
+			}
+		}
+		if admin.ComponentName == "" {
+			continue
+		}
+		owners[fmt.Sprintf("%d/%s", admin.User, admin.ComponentName)] = admin
+	}
+
+	return owners
+}
+
+// parseEnabledAdmins parses the active admin receivers listed by `dumpsys
+// device_policy` for each user.
+func parseEnabledAdmins(out string) []DeviceAdmin {
+	admins := []DeviceAdmin{}
+	lines := strings.Split(out, "\n")
+	for i := 0; i < len(lines); i++ {
+		match := enabledAdminsRegexp.FindStringSubmatch(lines[i])
+		if match == nil {
+			continue
+		}
+
+		user, _ := strconv.Atoi(match[1])
+		indent := indentation(lines[i])
+		adminIndent := -1
+		for i+1 < len(lines) {
+			next := lines[i+1]
+			if strings.TrimSpace(next) == "" || indentation(next) <= indent {
+				break
+			}
+			i++
+
+			// Admins are the first level of the section, followed by
+			// their details.
+			if adminIndent == -1 {
+				adminIndent = indentation(next)
+			}
+			component := strings.TrimSpace(next)
+			if indentation(next) != adminIndent || !strings.HasSuffix(component, ":") {
+				continue
+			}
+			component = strings.TrimSuffix(component, ":")
+			if !strings.Contains(component, "/") {
+				continue
+			}
+			admins = append(admins, DeviceAdmin{
+				PackageName:   strings.SplitN(component, "/", 2)[0],
+				ComponentName: shortComponentName(component),
+				User:          user,
+			})
+		}
+	}
+
+	return admins
+}
+
+// mergeOwners flags the enabled admins which are owners, sorted by user and
+// component.
+func mergeOwners(admins []DeviceAdmin, owners map[string]DeviceAdmin) []DeviceAdmin {
+	for i := range admins {
+		key := fmt.Sprintf("%d/%s", admins[i].User, admins[i].ComponentName)
+		if owner, ok := owners[key]; ok {
+			admins[i].IsOwner = owner.IsOwner
+			admins[i].IsProfileOwner = owner.IsProfileOwner
+			delete(owners, key)
+		}
+	}
+	// Owners are normally also enabled admins, but keep any which wasn't
+	// listed.
+	for _, owner := range owners {
+		admins = append(admins, owner)
+	}
+	sort.Slice(admins, func(i, j int) bool {
+		if admins[i].User != admins[j].User {
+			return admins[i].User < admins[j].User
+		}
+		return admins[i].ComponentName < admins[j].ComponentName
+	})
+	return admins
+}
+
+// indentation returns the number of leading whitespace characters of line.
+func indentation(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " \t"))
+}
+
+func (d *DeviceAdmins) Run(acq *acquisition.Acquisition, fast bool) error {
+	log.Info("Collecting device administrators...")
+
+	out, err := adb.Client.ShellTimeout(dumpsysServiceTimeout, "dumpsys", "device_policy")
+	if err != nil && out == "" {
+		return fmt.Errorf("failed to run `adb shell dumpsys device_policy`: %v", err)
+	}
+	err = saveCommandOutput(filepath.Join(d.StoragePath, "device_policy.txt"), out)
+	if err != nil {
+		log.Errorf("Impossible to save device policy: %v", err)
+	}
+	admins := parseEnabledAdmins(out)
+	owners := parsePolicyOwners(out)
+
+	out, err = adb.Client.Shell("dpm", "list-owners")
+	if err != nil && out == "" {
+		// Only available since Android 10.
+		log.Debugf("Failed to run `adb shell dpm list-owners`: %v", err)
+	} else {
+		err = saveCommandOutput(filepath.Join(d.StoragePath, "dpm_owners.txt"), out)
+		if err != nil {
+			log.Errorf("Impossible to save device owners: %v", err)
+		}
+		for key, owner := range parseDeviceOwners(out) {
+			owners[key] = owner
+		}
+	}
+
+	policy := DevicePolicy{
+		Admins:        mergeOwners(admins, owners),
+		ProfileOwners: []DeviceAdmin{},
+	}
+	users, err := adb.Client.GetUsers()
+	if err != nil {
+		log.Debugf("Failed to list users: %v", err)
+	}
+	for _, user := range users {
+		if user.ManagedProfile {
+			policy.ManagedProfile = true
+		}
+	}
+
+	packages := packageIndex(acq)
+	for i := range policy.Admins {
+		admin := &policy.Admins[i]
+		if pkg, ok := packages[fmt.Sprintf("%d/%s", admin.User, admin.PackageName)]; ok {
+			admin.IsThirdParty = pkg.ThirdParty
+			admin.IsSideloaded = pkg.Sideloaded
+		}
+
+		if admin.IsOwner {
+			owner := *admin
+			policy.DeviceOwner = &owner
+		}
+		if admin.IsProfileOwner {
+			policy.ProfileOwners = append(policy.ProfileOwners, *admin)
+			// A profile owner outside of the primary user manages a
+			// work profile.
+			if admin.User != 0 {
+				policy.ManagedProfile = true
+			}
+		}
+
+		if admin.IsSideloaded {
+			acq.AddWarning("Sideloaded app %s has device administrator privileges (%s)",
+				admin.PackageName, admin.ComponentName)
+		} else if admin.IsThirdParty {
+			log.Warningf("Third-party app %s has device administrator privileges (%s)",
+				admin.PackageName, admin.ComponentName)
+		}
+	}
+
+	return saveCommandOutputJson(filepath.Join(d.StoragePath, "device_policy.json"), &policy)
+}
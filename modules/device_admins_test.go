@@ -0,0 +1,49 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestShortComponentName(t *testing.T) {
+	tests := map[string]string{
+		"ComponentInfo{com.example/com.example.Receiver}": "com.example/.Receiver",
+		"com.example/com.example.Receiver":                "com.example/.Receiver",
+		"com.example/.Receiver":                           "com.example/.Receiver",
+		"com.example/com.other.Receiver":                  "com.example/com.other.Receiver",
+		// Only classes of the package itself are shortened.
+		"com.example/com.examples.Receiver": "com.example/com.examples.Receiver",
+	}
+	for component, want := range tests {
+		if got := shortComponentName(component); got != want {
+			t.Errorf("got %q for %q, want %q", got, component, want)
+		}
+	}
+}
+
+func TestMergeOwners(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "dumpsys_device_policy.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	owners := parsePolicyOwners(string(data))
+	// dpm list-owners prints the components in their short form.
+	for key, owner := range parseDeviceOwners("User 0: admin=com.example.mdm/.AdminReceiver,DeviceOwner,Affiliated\n") {
+		owners[key] = owner
+	}
+
+	want := []DeviceAdmin{
+		{PackageName: "com.example.mdm", ComponentName: "com.example.mdm/.AdminReceiver", User: 0, IsOwner: true},
+		{PackageName: "com.google.android.gms", ComponentName: "com.google.android.gms/.mdm.receivers.MdmDeviceAdminReceiver", User: 0},
+		{PackageName: "com.example.work", ComponentName: "com.example.work/com.other.WorkReceiver", User: 10, IsProfileOwner: true},
+	}
+	if got := mergeOwners(parseEnabledAdmins(string(data)), owners); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mvt-project/androidqf/acquisition"
+	"github.com/mvt-project/androidqf/adb"
+	"github.com/mvt-project/androidqf/log"
+)
+
+var (
+	// Android 10 and later print "DnsAddresses: [ /8.8.8.8,/1.1.1.1 ]",
+	// older versions "DnsAddresses: [8.8.8.8,1.1.1.1,]".
+	dnsAddressesRegexp  = regexp.MustCompile(`DnsAddresses: \[([^\]]*)\]`)
+	privateDNSRegexp    = regexp.MustCompile(`PrivateDnsServerName: (\S+)`)
+	usePrivateDNSRegexp = regexp.MustCompile(`UsePrivateDns: (true|false)`)
+	interfaceNameRegexp = regexp.MustCompile(`InterfaceName: (\S+)`)
+	networkIDRegexp     = regexp.MustCompile(`network\{(\d+)\}`)
+	// "ni{[type: WIFI[], ..." before Android 11, "ni{WIFI CONNECTED ..."
+	// since.
+	networkTypeRegexp = regexp.MustCompile(`ni\{(?:\[type: )?(\w+)`)
+	// "DnsManager:", "Private DNS configuration:" and similar headers.
+	dnsSectionRegexp = regexp.MustCompile(`(?i)^\s*(?:dnsmanager|private ?dns[\w ]*|dns[\w ]*):\s*$`)
+)
+
+type DNSNetwork struct {
+	Network       string   `json:"network"`
+	Type          string   `json:"type"`
+	Interface     string   `json:"interface"`
+	DNSServers    []string `json:"dns_servers"`
+	PrivateDNS    string   `json:"private_dns"`
+	UsePrivateDNS bool     `json:"use_private_dns"`
+}
+
+type DNSResult struct {
+	Mode      string       `json:"mode"`
+	Specifier string       `json:"specifier"`
+	Resolvers []string     `json:"resolvers"`
+	Networks  []DNSNetwork `json:"networks"`
+}
+
+type DNSConfig struct {
+	StoragePath string
+}
+
+func NewDNSConfig() *DNSConfig {
+	return &DNSConfig{}
+}
+
+func (d *DNSConfig) Name() string {
+	return "dns"
+}
+
+func (d *DNSConfig) InitStorage(storagePath string) error {
+	d.StoragePath = storagePath
+	return nil
+}
+
+// parseDNSAddresses returns the addresses of a DnsAddresses list, in either
+// format. InetAddress prints the addresses as "hostname/address".
+func parseDNSAddresses(list string) []string {
+	addresses := []string{}
+	for _, address := range strings.Split(list, ",") {
+		address = strings.TrimSpace(address)
+		if index := strings.LastIndex(address, "/"); index != -1 {
+			address = address[index+1:]
+		}
+		if address != "" {
+			addresses = appendUniqueString(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// parseDNSNetworks returns the DNS configuration of the networks listed by
+// `dumpsys connectivity`.
+func parseDNSNetworks(out string) []DNSNetwork {
+	networks := []DNSNetwork{}
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.Contains(line, "NetworkAgentInfo{") {
+			continue
+		}
+		match := dnsAddressesRegexp.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+
+		network := DNSNetwork{DNSServers: parseDNSAddresses(match[1])}
+		if match := networkIDRegexp.FindStringSubmatch(line); match != nil {
+			network.Network = match[1]
+		}
+		if match := networkTypeRegexp.FindStringSubmatch(line); match != nil {
+			network.Type = match[1]
+		}
+		if match := interfaceNameRegexp.FindStringSubmatch(line); match != nil {
+			network.Interface = match[1]
+		}
+		if match := privateDNSRegexp.FindStringSubmatch(line); match != nil && match[1] != "null" {
+			network.PrivateDNS = match[1]
+		}
+		if match := usePrivateDNSRegexp.FindStringSubmatch(line); match != nil {
+			network.UsePrivateDNS = match[1] == "true"
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// getGlobalSetting returns a global setting, or an empty string if unset.
+func getGlobalSetting(name string) string {
+	out, err := adb.Client.Shell("settings", "get", "global", name)
+	if err != nil {
+		log.Debugf("Failed to get global setting %s: %v", name, err)
+		return ""
+	}
+	out = strings.TrimSpace(out)
+	if out == "null" {
+		return ""
+	}
+	return out
+}
+
+// shellServices returns the services listed by `cmd -l`.
+func shellServices() map[string]bool {
+	services := make(map[string]bool)
+	out, err := adb.Client.Shell("cmd", "-l")
+	if err != nil {
+		log.Debugf("Failed to list services with `cmd -l`: %v", err)
+		return services
+	}
+	for _, line := range strings.Split(out, "\n") {
+		services[strings.TrimSpace(line)] = true
+	}
+	return services
+}
+
+func (d *DNSConfig) Run(acq *acquisition.Acquisition, fast bool) error {
+	log.Info("Collecting DNS configuration...")
+
+	result := DNSResult{
+		Mode:      getGlobalSetting("private_dns_mode"),
+		Specifier: getGlobalSetting("private_dns_specifier"),
+		Resolvers: []string{},
+		Networks:  []DNSNetwork{},
+	}
+
+	out, err := adb.Client.ShellTimeout(dumpsysServiceTimeout, "dumpsys", "connectivity")
+	if err != nil && out == "" {
+		log.Debugf("Failed to run `adb shell dumpsys connectivity`: %v", err)
+	} else {
+		result.Networks = parseDNSNetworks(out)
+		if sections := dumpSection(out, dnsSectionRegexp); len(sections) > 0 {
+			err = saveCommandOutput(filepath.Join(d.StoragePath, "dns_connectivity.txt"),
+				strings.Join(sections, "\n"))
+			if err != nil {
+				log.Errorf("Impossible to save the DNS sections of the connectivity dump: %v", err)
+			}
+		}
+	}
+
+	for _, network := range result.Networks {
+		for _, server := range network.DNSServers {
+			result.Resolvers = appendUniqueString(result.Resolvers, server)
+		}
+	}
+	// Before Android 8 the resolvers were also exposed as properties.
+	if len(result.Resolvers) == 0 {
+		props := getProperties(acq)
+		for _, key := range []string{"net.dns1", "net.dns2", "net.dns3", "net.dns4"} {
+			if props[key] != "" {
+				result.Resolvers = appendUniqueString(result.Resolvers, props[key])
+			}
+		}
+	}
+
+	// The resolver moved out of netd in Android 10.
+	services := shellServices()
+	for _, service := range []string{"dnsresolver", "netd"} {
+		if !services[service] {
+			continue
+		}
+		out, err := adb.Client.ShellTimeout(dumpsysServiceTimeout, "dumpsys", service)
+		if err != nil && out == "" {
+			log.Debugf("Failed to run `adb shell dumpsys %s`: %v", service, err)
+			continue
+		}
+		err = saveCommandOutput(filepath.Join(d.StoragePath, "dns_resolver.txt"), out)
+		if err != nil {
+			log.Errorf("Impossible to save the resolver information: %v", err)
+		}
+		break
+	}
+
+	if result.Mode == "hostname" && result.Specifier != "" {
+		log.Warningf("Private DNS is set to use the resolver %s", result.Specifier)
+	}
+
+	return saveCommandOutputJson(filepath.Join(d.StoragePath, "dns.json"), &result)
+}
@@ -0,0 +1,339 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mvt-project/androidqf/acquisition"
+	"github.com/mvt-project/androidqf/adb"
+	"github.com/mvt-project/androidqf/log"
+)
+
+// "2023-05-01 10:00:00 data_app_crash (text, 1234 bytes)"
+var dropboxEntryRegexp = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}) (\S+) \(([^)]*)\)`)
+
+// dropboxTags are the tags of the entries reporting crashes and other
+// anomalies. Others, such as the protobuf copies of tombstones, are noise.
+var dropboxTags = map[string]bool{
+	"data_app_anr":               true,
+	"data_app_crash":             true,
+	"data_app_native_crash":      true,
+	"data_app_wtf":               true,
+	"system_app_anr":             true,
+	"system_app_crash":           true,
+	"system_app_native_crash":    true,
+	"system_app_wtf":             true,
+	"system_server_anr":          true,
+	"system_server_crash":        true,
+	"system_server_native_crash": true,
+	"system_server_wtf":          true,
+	"SYSTEM_RESTART":             true,
+	"SYSTEM_TOMBSTONE":           true,
+	"SYSTEM_LAST_KMSG":           true,
+	"SYSTEM_RECOVERY_LOG":        true,
+}
+
+type DropboxEntry struct {
+	Tag   string    `json:"tag"`
+	Time  time.Time `json:"time"`
+	Flags string    `json:"flags"`
+	Data  string    `json:"data"`
+}
+
+// DropboxFile is a dropbox entry saved to its own file, listed in
+// dropbox.json.
+type DropboxFile struct {
+	Tag       string `json:"tag"`
+	Timestamp string `json:"timestamp"`
+	Flags     string `json:"flags"`
+	File      string `json:"file"`
+	Size      int64  `json:"size"`
+	// Compressed is set for the entries printed gzip-compressed, which are
+	// stored inflated.
+	Compressed bool `json:"compressed"`
+}
+
+type DropboxLogs struct {
+	StoragePath string
+	DropboxPath string
+}
+
+func NewDropboxLogs() *DropboxLogs {
+	return &DropboxLogs{}
+}
+
+func (d *DropboxLogs) Name() string {
+	return "dropbox_logs"
+}
+
+func (d *DropboxLogs) Outputs() []string {
+	return []string{"dropbox"}
+}
+
+func (d *DropboxLogs) InitStorage(storagePath string) error {
+	d.StoragePath = storagePath
+	d.DropboxPath = filepath.Join(storagePath, "dropbox")
+	err := os.MkdirAll(d.DropboxPath, 0o755)
+	if err != nil {
+		return fmt.Errorf("failed to create dropbox folder: %v", err)
+	}
+
+	return nil
+}
+
+// parseDropboxTags returns the tags of the entries listed by `dumpsys
+// dropbox`, in the order they first appear.
+func parseDropboxTags(out string) []string {
+	tags := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		if match := dropboxEntryRegexp.FindStringSubmatch(strings.TrimRight(line, "\r")); match != nil {
+			tags = appendUniqueString(tags, match[2])
+		}
+	}
+	return tags
+}
+
+// inflateIfCompressed replaces the content of the file with its
+// decompressed content if it is gzip-compressed.
+func inflateIfCompressed(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	magic := make([]byte, 2)
+	if _, err := io.ReadFull(file, magic); err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+		return false, nil
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return false, nil
+	}
+
+	inflatedPath := path + ".inflated"
+	inflated, err := os.Create(inflatedPath)
+	if err != nil {
+		return false, err
+	}
+	_, err = io.Copy(inflated, reader)
+	inflated.Close()
+	if err != nil {
+		os.Remove(inflatedPath)
+		return false, err
+	}
+	file.Close()
+
+	return true, os.Rename(inflatedPath, path)
+}
+
+// dropboxFilter selects the dropbox entries to pull: the ones since the time
+// in the location of the device, zero for all, as long as the total size
+// pulled doesn't exceed maxSize, 0 for no limit.
+type dropboxFilter struct {
+	since    time.Time
+	location *time.Location
+	maxSize  int64
+	pulled   int64
+}
+
+// pullDropboxEntries saves each dropbox entry with the tag to its own file in
+// localDir. The output of dumpsys is streamed to disk, as entries can be
+// large.
+func pullDropboxEntries(tag, localDir string, filter *dropboxFilter) ([]DropboxFile, error) {
+	tmpPath := filepath.Join(localDir, fmt.Sprintf(".dropbox_%s.tmp", tag))
+	defer os.Remove(tmpPath)
+
+	err := adb.Client.ShellToFile(tmpPath, "dumpsys", "dropbox", "--print", tag)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run `dumpsys dropbox --print %s`: %v", tag, err)
+	}
+
+	in, err := os.Open(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	return splitDropboxEntries(in, tag, localDir, filter), nil
+}
+
+// splitDropboxEntries splits the output of `dumpsys dropbox --print` line by
+// line, saving the entries with the tag selected by the filter.
+func splitDropboxEntries(in io.Reader, tag, localDir string, filter *dropboxFilter) []DropboxFile {
+	files := []DropboxFile{}
+	var out *os.File
+	var written int64
+	// skipEntry removes the last entry, once closed.
+	skipEntry := func() {
+		entry := files[len(files)-1]
+		os.Remove(filepath.Join(localDir, entry.File))
+		files = files[:len(files)-1]
+		log.Infof("Skipping dropbox entry %s of %s, it would exceed the size limit of dropbox entries", tag, entry.Timestamp)
+	}
+	closeEntry := func() {
+		if out == nil {
+			return
+		}
+		out.Close()
+		out = nil
+
+		entry := &files[len(files)-1]
+		entryPath := filepath.Join(localDir, entry.File)
+		compressed, err := inflateIfCompressed(entryPath)
+		if err != nil {
+			log.Debugf("Failed to inflate dropbox entry %s: %v", entry.File, err)
+		}
+		entry.Compressed = compressed
+		if info, err := os.Stat(entryPath); err == nil {
+			entry.Size = info.Size()
+		}
+		// Compressed entries can exceed the limit once inflated.
+		if filter.maxSize > 0 && filter.pulled+entry.Size > filter.maxSize {
+			skipEntry()
+			return
+		}
+		filter.pulled += entry.Size
+	}
+
+	reader := bufio.NewReader(in)
+	for {
+		line, readErr := reader.ReadString('\n')
+		if match := dropboxEntryRegexp.FindStringSubmatch(strings.TrimRight(line, "\r\n")); match != nil {
+			closeEntry()
+			if match[2] != tag {
+				continue
+			}
+			if !filter.since.IsZero() {
+				entryTime, err := time.ParseInLocation("2006-01-02 15:04:05", match[1], filter.location)
+				if err == nil && entryTime.Before(filter.since) {
+					continue
+				}
+			}
+			if filter.maxSize > 0 && filter.pulled >= filter.maxSize {
+				log.Infof("Skipping dropbox entry %s of %s, the size limit of dropbox entries is reached", tag, match[1])
+				continue
+			}
+
+			base := fmt.Sprintf("%s@%s", tag, strings.NewReplacer("-", "", ":", "", " ", "-").Replace(match[1]))
+			name := base + ".txt"
+			for i := 1; ; i++ {
+				if _, err := os.Stat(filepath.Join(localDir, name)); os.IsNotExist(err) {
+					break
+				}
+				name = fmt.Sprintf("%s_%d.txt", base, i)
+			}
+			file, err := os.Create(filepath.Join(localDir, name))
+			if err != nil {
+				log.Errorf("Failed to save dropbox entry %s of %s: %v", tag, match[1], err)
+			} else {
+				out = file
+				written = 0
+				files = append(files, DropboxFile{
+					Tag:       tag,
+					Timestamp: match[1],
+					Flags:     match[3],
+					File:      name,
+				})
+			}
+		} else if strings.HasPrefix(line, "=====") {
+			// Entries are separated by a line of "=".
+			closeEntry()
+		} else if out != nil {
+			written += int64(len(line))
+			if filter.maxSize > 0 && filter.pulled+written > filter.maxSize {
+				out.Close()
+				out = nil
+				skipEntry()
+			} else {
+				out.WriteString(line)
+			}
+		}
+
+		if readErr != nil {
+			break
+		}
+	}
+	closeEntry()
+
+	return files
+}
+
+func (d *DropboxLogs) Run(acq *acquisition.Acquisition, fast bool) error {
+	log.Info("Collecting dropbox logs...")
+
+	out, err := adb.Client.ShellTimeout(dumpsysServiceTimeout, "dumpsys", "dropbox")
+	if err != nil && out == "" {
+		return fmt.Errorf("failed to run `adb shell dumpsys dropbox`: %v", err)
+	}
+
+	err = saveCommandOutput(filepath.Join(d.StoragePath, "dropbox_logs.txt"), out)
+	if err != nil {
+		return err
+	}
+
+	filter := &dropboxFilter{
+		location: adb.Client.DeviceLocation(),
+		maxSize:  acq.MaxDropboxSize,
+	}
+	if acq.DropboxDays > 0 {
+		filter.since = time.Now().AddDate(0, 0, -acq.DropboxDays)
+	}
+
+	index := []DropboxFile{}
+	entries := []DropboxEntry{}
+	for _, tag := range parseDropboxTags(out) {
+		files, err := pullDropboxEntries(tag, d.DropboxPath, filter)
+		if err != nil {
+			log.Errorf("Failed to collect dropbox entries %s: %v", tag, err)
+			continue
+		}
+		for i := range files {
+			files[i].File = path.Join("dropbox", files[i].File)
+		}
+		index = append(index, files...)
+
+		if !dropboxTags[tag] {
+			continue
+		}
+		for _, file := range files {
+			entryTime, err := time.ParseInLocation("2006-01-02 15:04:05", file.Timestamp, filter.location)
+			if err != nil {
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join(d.StoragePath, filepath.FromSlash(file.File)))
+			if err != nil {
+				continue
+			}
+			entries = append(entries, DropboxEntry{
+				Tag:   tag,
+				Time:  entryTime,
+				Flags: file.Flags,
+				Data:  strings.TrimSpace(string(data)),
+			})
+		}
+	}
+	log.Debugf("Saved %d dropbox entries, %d reporting crashes", len(index), len(entries))
+
+	err = saveCommandOutputJson(filepath.Join(d.StoragePath, "dropbox.json"), &index)
+	if err != nil {
+		return err
+	}
+
+	return saveCommandOutputJson(filepath.Join(d.StoragePath, "dropbox_logs.json"), &entries)
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSplitDropboxEntries(t *testing.T) {
+	tests := []struct {
+		name    string
+		maxSize int64
+		want    []string
+	}{
+		{name: "no limit", want: []string{"2023-05-01 10:00:00", "2023-05-01 11:00:00"}},
+		// The second entry would exceed the limit, even though the size
+		// pulled so far is below it.
+		{name: "limit", maxSize: 100, want: []string{"2023-05-01 10:00:00"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			in, err := os.Open(filepath.Join("testdata", "dumpsys_dropbox_print.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer in.Close()
+
+			localDir := t.TempDir()
+			filter := &dropboxFilter{
+				since:    time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC),
+				location: time.UTC,
+				maxSize:  test.maxSize,
+			}
+			files := splitDropboxEntries(in, "data_app_crash", localDir, filter)
+
+			if len(files) != len(test.want) {
+				t.Fatalf("got %+v, want entries of %q", files, test.want)
+			}
+			var size int64
+			for i, file := range files {
+				if file.Timestamp != test.want[i] {
+					t.Errorf("got entry of %s, want %s", file.Timestamp, test.want[i])
+				}
+				size += file.Size
+			}
+			if filter.pulled != size {
+				t.Errorf("got %d bytes pulled, want %d", filter.pulled, size)
+			}
+
+			// Only the files of the entries kept are left.
+			saved, err := os.ReadDir(localDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(saved) != len(files) {
+				t.Errorf("got %d files saved, want %d", len(saved), len(files))
+			}
+		})
+	}
+}
@@ -6,15 +6,35 @@ package modules
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/mvt-project/androidqf/acquisition"
 	"github.com/mvt-project/androidqf/adb"
 	"github.com/mvt-project/androidqf/log"
 )
 
+const dumpsysTimeout = 10 * time.Minute
+
+// dumpsysServiceTimeout is how long a single service is given to dump its
+// state, so that a hanging one doesn't stall the acquisition.
+const dumpsysServiceTimeout = 2 * time.Minute
+
+// dumpsysSeparator precedes the output of each service in dumpsys.txt, as in
+// the output of dumpsys itself.
+const dumpsysSeparator = "-------------------------------------------------------------------------------"
+
+// serviceFileNameReplacer replaces the characters of service names, such as
+// "android.hardware.power.IPower/default", which can't be used in file names.
+var serviceFileNameReplacer = strings.NewReplacer(
+	"/", "_", "\\", "_", ":", "_", "*", "_", "?", "_", "\"", "_", "<", "_", ">", "_", "|", "_",
+)
+
 type Dumpsys struct {
-	StoragePath string
+	StoragePath  string
+	ServicesPath string
 }
 
 func NewDumpsys() *Dumpsys {
@@ -25,18 +45,79 @@ func (d *Dumpsys) Name() string {
 	return "dumpsys"
 }
 
+func (d *Dumpsys) Outputs() []string {
+	return []string{"dumpsys"}
+}
+
 func (d *Dumpsys) InitStorage(storagePath string) error {
 	d.StoragePath = storagePath
+	d.ServicesPath = filepath.Join(storagePath, "dumpsys")
+	err := os.MkdirAll(d.ServicesPath, 0o755)
+	if err != nil {
+		return fmt.Errorf("failed to create dumpsys folder: %v", err)
+	}
+
 	return nil
 }
 
+// parseDumpsysServices parses the services listed by `dumpsys -l`.
+func parseDumpsysServices(out string) []string {
+	services := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		// Services are indented below "Currently running services:".
+		if !strings.HasPrefix(line, " ") {
+			continue
+		}
+		service := strings.TrimSpace(line)
+		if service != "" {
+			services = append(services, service)
+		}
+	}
+
+	return services
+}
+
 func (d *Dumpsys) Run(acq *acquisition.Acquisition, fast bool) error {
 	log.Info("Collecting device diagnostic information. This might take a while...")
 
-	out, err := adb.Client.Shell("dumpsys")
+	out, err := adb.Client.ShellTimeout(dumpsysServiceTimeout, "dumpsys", "-l")
+	services := parseDumpsysServices(out)
+	if err != nil || len(services) == 0 {
+		log.Debugf("Failed to list dumpsys services, running a single dumpsys instead: %v", err)
+		out, err = adb.Client.ShellTimeout(dumpsysTimeout, "dumpsys")
+		if err != nil {
+			return fmt.Errorf("failed to run `adb shell dumpsys`: %v", err)
+		}
+
+		return saveCommandOutput(filepath.Join(d.StoragePath, "dumpsys.txt"), out)
+	}
+
+	// The combined dumpsys.txt is kept for tools expecting the single file.
+	combined, err := os.Create(filepath.Join(d.StoragePath, "dumpsys.txt"))
 	if err != nil {
-		return fmt.Errorf("failed to run `adb shell dumpsys`: %v", err)
+		return fmt.Errorf("failed to create dumpsys.txt: %v", err)
 	}
+	defer combined.Close()
 
-	return saveCommandOutput(filepath.Join(d.StoragePath, "dumpsys.txt"), out)
+	for _, service := range services {
+		log.Debugf("Running dumpsys %s", service)
+		out, err := adb.Client.ShellTimeout(dumpsysServiceTimeout, "dumpsys", fmt.Sprintf("'%s'", service))
+		if err != nil {
+			// The error explains why the output of the service is missing.
+			out = fmt.Sprintf("%s\nERROR: failed to run `dumpsys %s`: %v", out, service, err)
+			log.Debugf("Failed to run `adb shell dumpsys %s`: %v", service, err)
+		}
+
+		err = saveCommandOutput(filepath.Join(d.ServicesPath, serviceFileNameReplacer.Replace(service)+".txt"), out)
+		if err != nil {
+			log.Errorf("Failed to save output of dumpsys %s: %v", service, err)
+		}
+
+		_, err = fmt.Fprintf(combined, "%s\nDUMP OF SERVICE %s:\n%s\n", dumpsysSeparator, service, out)
+		if err != nil {
+			return fmt.Errorf("failed to write dumpsys.txt: %v", err)
+		}
+	}
+
+	return nil
 }
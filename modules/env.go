@@ -7,12 +7,15 @@ package modules
 import (
 	"fmt"
 	"path/filepath"
+	"time"
 
 	"github.com/mvt-project/androidqf/acquisition"
 	"github.com/mvt-project/androidqf/adb"
 	"github.com/mvt-project/androidqf/log"
 )
 
+const envTimeout = 30 * time.Second
+
 type Environment struct {
 	StoragePath string
 }
@@ -33,7 +36,7 @@ func (e *Environment) InitStorage(storagePath string) error {
 func (e *Environment) Run(acq *acquisition.Acquisition, fast bool) error {
 	log.Info("Collecting environment...")
 
-	out, err := adb.Client.Shell("env")
+	out, err := adb.Client.ShellTimeout(envTimeout, "env")
 	if err != nil {
 		return fmt.Errorf("failed to run `adb shell env`: %v", err)
 	}
@@ -5,14 +5,20 @@
 package modules
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/mvt-project/androidqf/acquisition"
 	"github.com/mvt-project/androidqf/adb"
 	"github.com/mvt-project/androidqf/log"
 )
 
+const getpropTimeout = 30 * time.Second
+
 type GetProp struct {
 	StoragePath string
 }
@@ -30,13 +36,104 @@ func (g *GetProp) InitStorage(storagePath string) error {
 	return nil
 }
 
+// parseGetprop parses the output of getprop, in the form "[key]: [value]".
+// Values spanning multiple lines are kept whole.
+func parseGetprop(out string) map[string]string {
+	props := make(map[string]string)
+
+	var key string
+	var value strings.Builder
+	inValue := false
+	for _, line := range strings.Split(strings.ReplaceAll(out, "\r\n", "\n"), "\n") {
+		if inValue {
+			value.WriteString("\n")
+		} else {
+			if !strings.HasPrefix(line, "[") {
+				continue
+			}
+			parts := strings.SplitN(line, "]: [", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			key = strings.TrimPrefix(parts[0], "[")
+			value.Reset()
+			line = parts[1]
+			inValue = true
+		}
+
+		if strings.HasSuffix(line, "]") {
+			value.WriteString(strings.TrimSuffix(line, "]"))
+			props[key] = value.String()
+			inValue = false
+		} else {
+			value.WriteString(line)
+		}
+	}
+
+	return props
+}
+
+// deviceInfo returns the summary of the device from its properties.
+func deviceInfo(props map[string]string) *acquisition.DeviceInfo {
+	device := &acquisition.DeviceInfo{
+		AndroidVersion: props["ro.build.version.release"],
+		SecurityPatch:  props["ro.build.version.security_patch"],
+		Fingerprint:    props["ro.build.fingerprint"],
+		Manufacturer:   props["ro.product.manufacturer"],
+		Model:          props["ro.product.model"],
+		Serial:         props["ro.serialno"],
+	}
+	// Some OEMs only set the vendor copies of the product properties.
+	if device.Manufacturer == "" {
+		device.Manufacturer = props["ro.product.vendor.manufacturer"]
+	}
+	if device.Model == "" {
+		device.Model = props["ro.product.vendor.model"]
+	}
+	return device
+}
+
+// Restore loads the properties collected by a previous run from its
+// getprop.json.
+func (g *GetProp) Restore(acq *acquisition.Acquisition) error {
+	data, err := os.ReadFile(filepath.Join(acq.StoragePath, "getprop.json"))
+	if err != nil {
+		return err
+	}
+	props := make(map[string]string)
+	if err := json.Unmarshal(data, &props); err != nil {
+		return fmt.Errorf("failed to parse getprop.json: %v", err)
+	}
+
+	propertiesMutex.Lock()
+	defer propertiesMutex.Unlock()
+	acq.Properties = props
+	acq.Device = deviceInfo(props)
+	return nil
+}
+
 func (g *GetProp) Run(acq *acquisition.Acquisition, fast bool) error {
 	log.Info("Collecting device properties...")
 
-	out, err := adb.Client.Shell("getprop")
+	out, err := adb.Client.ShellTimeout(getpropTimeout, "getprop")
 	if err != nil {
 		return fmt.Errorf("failed to run `adb shell getprop`: %v", err)
 	}
 
-	return saveCommandOutput(filepath.Join(g.StoragePath, "getprop.txt"), out)
+	err = saveCommandOutput(filepath.Join(g.StoragePath, "getprop.txt"), out)
+	if err != nil {
+		return err
+	}
+
+	props := parseGetprop(out)
+	propertiesMutex.Lock()
+	acq.Properties = props
+	propertiesMutex.Unlock()
+
+	acq.Device = deviceInfo(props)
+	log.Infof("Device is a %s %s running Android %s, security patch %s",
+		acq.Device.Manufacturer, acq.Device.Model, acq.Device.AndroidVersion,
+		acq.Device.SecurityPatch)
+
+	return saveCommandOutputJson(filepath.Join(g.StoragePath, "getprop.json"), &props)
 }
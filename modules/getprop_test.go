@@ -0,0 +1,99 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mvt-project/androidqf/acquisition"
+)
+
+func TestParseGetprop(t *testing.T) {
+	tests := []struct {
+		fixture   string
+		count     int
+		multiline [2]string
+		device    acquisition.DeviceInfo
+		build     acquisition.BuildInfo
+	}{
+		{
+			// Samsung only sets the vendor copies of the product properties.
+			fixture: "getprop_samsung.txt",
+			count:   22,
+			multiline: [2]string{"vendor.sec.rild.disclaimer", "This device is intended\n" +
+				"for use in accordance with local regulations.\n" +
+				"Do not remove the SIM while roaming."},
+			device: acquisition.DeviceInfo{
+				AndroidVersion: "13",
+				SecurityPatch:  "2023-01-01",
+				Fingerprint:    "samsung/a52qnsxx/a52q:13/TP1A.220624.014/A525FXXS6DWA1:user/release-keys",
+				Manufacturer:   "samsung",
+				Model:          "SM-A525F",
+				Serial:         "R58R12ABCDE",
+			},
+			build: acquisition.BuildInfo{
+				Fingerprint: "samsung/a52qnsxx/a52q:13/TP1A.220624.014/A525FXXS6DWA1:user/release-keys",
+				Release:     "13",
+				Debuggable:  "0",
+				Secure:      "1",
+				USBConfig:   "mtp,adb",
+			},
+		},
+		{
+			// A userdebug Pixel build, read with CRLF line endings.
+			fixture:   "getprop_pixel.txt",
+			count:     16,
+			multiline: [2]string{"ro.vendor.build.banner", "Welcome\n  to the userdebug build"},
+			device: acquisition.DeviceInfo{
+				AndroidVersion: "14",
+				SecurityPatch:  "2024-01-05",
+				Fingerprint:    "google/oriole/oriole:14/UQ1A.240105.004/11206848:userdebug/dev-keys",
+				Manufacturer:   "Google",
+				Model:          "Pixel 6",
+				Serial:         "1A2B3C4D5E6F",
+			},
+			build: acquisition.BuildInfo{
+				Fingerprint: "google/oriole/oriole:14/UQ1A.240105.004/11206848:userdebug/dev-keys",
+				Release:     "14",
+				Debuggable:  "1",
+				Secure:      "0",
+				USBConfig:   "adb",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.fixture, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", test.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			props := parseGetprop(string(data))
+			if len(props) != test.count {
+				t.Errorf("got %d properties, want %d", len(props), test.count)
+			}
+			if got := props[test.multiline[0]]; got != test.multiline[1] {
+				t.Errorf("got %q for %s, want %q", got, test.multiline[0], test.multiline[1])
+			}
+			if got := *deviceInfo(props); got != test.device {
+				t.Errorf("got device %+v, want %+v", got, test.device)
+			}
+			if got := *buildInfo(props); got != test.build {
+				t.Errorf("got build info %+v, want %+v", got, test.build)
+			}
+		})
+	}
+}
+
+func TestGetPropertiesShared(t *testing.T) {
+	acq := &acquisition.Acquisition{Properties: map[string]string{"ro.secure": "1"}}
+	// The properties of the getprop module are used without running getprop
+	// again.
+	if got := getProperties(acq)["ro.secure"]; got != "1" {
+		t.Errorf("got ro.secure %q, want 1", got)
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mvt-project/androidqf/acquisition"
+	"github.com/mvt-project/androidqf/adb"
+	"github.com/mvt-project/androidqf/log"
+)
+
+// fridaPort is the port frida-server listens on by default.
+const fridaPort = "27042"
+
+// xposedPaths are the files installed in the system by Xposed and its
+// successors.
+var xposedPaths = []string{
+	"/system/framework/XposedBridge.jar",
+	"/system/framework/edxp.jar",
+	"/data/adb/lspd",
+}
+
+// hookingPackages are the packages of the hooking frameworks managers.
+var hookingPackages = map[string]string{
+	"de.robv.android.xposed.installer": "Xposed",
+	"org.meowcat.edxposed.manager":     "EdXposed",
+	"com.solohsu.android.edxp.manager": "EdXposed",
+	"org.lsposed.manager":              "LSPosed",
+}
+
+// hookingLibraryRegexp matches the libraries injected by the frameworks in
+// the memory maps of the processes they hook.
+var hookingLibraryRegexp = regexp.MustCompile(`(?i)(frida-agent|frida-gadget|XposedBridge|libxposed|liblspd|libedxp|lspd)`)
+
+type HookingFramework struct {
+	Name      string `json:"name"`
+	Indicator string `json:"indicator"`
+	Evidence  string `json:"evidence"`
+}
+
+type HookingFrameworks struct {
+	StoragePath string
+}
+
+func NewHookingFrameworks() *HookingFrameworks {
+	return &HookingFrameworks{}
+}
+
+func (h *HookingFrameworks) Name() string {
+	return "hooking_frameworks"
+}
+
+func (h *HookingFrameworks) Dependencies() []string {
+	return []string{"packages"}
+}
+
+func (h *HookingFrameworks) InitStorage(storagePath string) error {
+	h.StoragePath = storagePath
+	return nil
+}
+
+// hookingFrameworkName returns the framework a library or file belongs to.
+func hookingFrameworkName(evidence string) string {
+	lower := strings.ToLower(evidence)
+	switch {
+	case strings.Contains(lower, "frida"):
+		return "Frida"
+	case strings.Contains(lower, "lspd"):
+		return "LSPosed"
+	case strings.Contains(lower, "edxp"):
+		return "EdXposed"
+	}
+	return "Xposed"
+}
+
+// parseHookedMaps parses the lines of /proc/<pid>/maps matching the hooking
+// libraries, as printed by grep with the file name, and returns the
+// libraries loaded by each process.
+func parseHookedMaps(out string) []HookingFramework {
+	frameworks := []HookingFramework{}
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "/proc/") {
+			continue
+		}
+		fields := strings.Fields(parts[1])
+		if len(fields) < 6 || !hookingLibraryRegexp.MatchString(fields[5]) {
+			continue
+		}
+
+		pid := strings.TrimSuffix(strings.TrimPrefix(parts[0], "/proc/"), "/maps")
+		evidence := fmt.Sprintf("%s loaded by process %s", fields[5], pid)
+		if seen[evidence] {
+			continue
+		}
+		seen[evidence] = true
+		frameworks = append(frameworks, HookingFramework{
+			Name:      hookingFrameworkName(fields[5]),
+			Indicator: "loaded_library",
+			Evidence:  evidence,
+		})
+	}
+	return frameworks
+}
+
+func (h *HookingFrameworks) Run(acq *acquisition.Acquisition, fast bool) error {
+	log.Info("Checking for hooking frameworks...")
+
+	frameworks := []HookingFramework{}
+
+	out, err := adb.Client.Shell("ls", "-a", "/data/local/tmp/")
+	if err != nil {
+		log.Debugf("Failed to list /data/local/tmp/: %v", err)
+	}
+	for _, name := range strings.Split(out, "\n") {
+		name = strings.TrimSpace(name)
+		if strings.Contains(strings.ToLower(name), "frida") {
+			frameworks = append(frameworks, HookingFramework{
+				Name:      "Frida",
+				Indicator: "file",
+				Evidence:  "/data/local/tmp/" + name,
+			})
+		}
+	}
+
+	for _, proto := range []string{"tcp", "tcp6"} {
+		out, err := readProcNet(acq, proto)
+		if err != nil {
+			log.Debugf("Failed to read /proc/net/%s: %v", proto, err)
+			continue
+		}
+		for _, conn := range parseProcNet(proto, out) {
+			_, port, err := net.SplitHostPort(conn.LocalAddr)
+			if err != nil || port != fridaPort || conn.State != "LISTEN" {
+				continue
+			}
+			frameworks = append(frameworks, HookingFramework{
+				Name:      "Frida",
+				Indicator: "listening_port",
+				Evidence:  fmt.Sprintf("%s %s", proto, conn.LocalAddr),
+			})
+		}
+	}
+
+	for _, path := range xposedPaths {
+		out, err := adb.Client.Shell("ls", "-d", path)
+		if err != nil || strings.Contains(out, "No such file") {
+			continue
+		}
+		frameworks = append(frameworks, HookingFramework{
+			Name:      hookingFrameworkName(path),
+			Indicator: "file",
+			Evidence:  path,
+		})
+	}
+
+	for _, pkg := range getPackages(acq) {
+		name, ok := hookingPackages[pkg.Name]
+		if !ok {
+			continue
+		}
+		frameworks = append(frameworks, HookingFramework{
+			Name:      name,
+			Indicator: "package",
+			Evidence:  fmt.Sprintf("%s installed for user %d", pkg.Name, pkg.User),
+		})
+	}
+
+	// Without root, only the maps of the processes of the shell user can
+	// be read.
+	cmd := "grep -E 'frida|XposedBridge|xposed|lspd|edxp' /proc/[0-9]*/maps 2>/dev/null"
+	if adb.Client.HasRoot() {
+		out, err = adb.Client.ShellAsRoot(cmd)
+	} else {
+		out, err = adb.Client.Shell(cmd)
+	}
+	// grep exits with 1 when nothing matched.
+	if err != nil && out != "" {
+		log.Debugf("Failed to scan the memory maps of the processes: %v", err)
+	}
+	frameworks = append(frameworks, parseHookedMaps(out)...)
+
+	for _, framework := range frameworks {
+		acq.AddWarning("Found traces of the %s hooking framework: %s", framework.Name, framework.Evidence)
+	}
+
+	return saveCommandOutputJson(filepath.Join(h.StoragePath, "hooking_frameworks.json"), &frameworks)
+}
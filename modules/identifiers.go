@@ -0,0 +1,151 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mvt-project/androidqf/acquisition"
+	"github.com/mvt-project/androidqf/adb"
+	"github.com/mvt-project/androidqf/log"
+)
+
+// Transaction codes of the IPhoneSubInfo service. They have been stable for
+// getDeviceId and getSubscriberId, but might differ on some vendor builds.
+const (
+	iphonesubinfoIMEI = "1"
+	iphonesubinfoIMSI = "7"
+)
+
+// errPhoneStateDenied is returned when an identifier can't be read by the
+// shell user.
+var errPhoneStateDenied = errors.New("not readable without root, the shell user lacks the privileged phone state permission")
+
+var (
+	parcelStringRegexp = regexp.MustCompile(`'([^']*)'`)
+	imeiRegexp         = regexp.MustCompile(`^[0-9]{14,16}$`)
+	imsiRegexp         = regexp.MustCompile(`^[0-9]{6,15}$`)
+)
+
+type Identifiers struct {
+	AndroidID string   `json:"android_id"`
+	Serial    string   `json:"serial"`
+	IMEI      string   `json:"imei"`
+	IMSI      string   `json:"imsi"`
+	Errors    []string `json:"errors"`
+}
+
+type DeviceIdentifiers struct {
+	StoragePath string
+}
+
+func NewDeviceIdentifiers() *DeviceIdentifiers {
+	return &DeviceIdentifiers{}
+}
+
+func (d *DeviceIdentifiers) Name() string {
+	return "device_identifiers"
+}
+
+func (d *DeviceIdentifiers) InitStorage(storagePath string) error {
+	d.StoragePath = storagePath
+	return nil
+}
+
+// parseParcelString extracts the string returned by `service call`, which
+// prints the parcel as an hex dump followed by its printable characters:
+//
+//	Result: Parcel(
+//	  0x00000000: 00000000 0000000f 00350033 00300034 '........3.5.4.0.'
+//	  ...
+func parseParcelString(out string) string {
+	var value strings.Builder
+	for _, match := range parcelStringRegexp.FindAllStringSubmatch(out, -1) {
+		value.WriteString(match[1])
+	}
+	// UTF-16 characters are printed with a dot for each null byte.
+	return strings.TrimSpace(strings.ReplaceAll(value.String(), ".", ""))
+}
+
+// callIphonesubinfo calls the IPhoneSubInfo service and validates the value
+// it returns, retrying as root if the shell user is not allowed to read it.
+func callIphonesubinfo(code string, valid *regexp.Regexp) (string, error) {
+	out, err := adb.Client.Shell("service", "call", "iphonesubinfo", code, "s16", "com.android.shell")
+	value := parseParcelString(out)
+	if err == nil && valid.MatchString(value) {
+		return value, nil
+	}
+
+	if !adb.Client.HasRoot() {
+		if strings.Contains(out, "Exception") || strings.Contains(out, "READ_PRIVILEGED_PHONE_STATE") {
+			return "", errPhoneStateDenied
+		}
+		return "", fmt.Errorf("unexpected response from `service call iphonesubinfo %s`: %q", code, value)
+	}
+
+	out, err = adb.Client.ShellAsRoot("service", "call", "iphonesubinfo", code, "s16", "com.android.shell")
+	if err != nil {
+		return "", fmt.Errorf("failed to run `service call iphonesubinfo %s` as root: %v", code, err)
+	}
+	value = parseParcelString(out)
+	if !valid.MatchString(value) {
+		return "", fmt.Errorf("unexpected response from `service call iphonesubinfo %s`: %q", code, value)
+	}
+
+	return value, nil
+}
+
+func (d *DeviceIdentifiers) Run(acq *acquisition.Acquisition, fast bool) error {
+	log.Info("Collecting device identifiers...")
+
+	identifiers := Identifiers{
+		Errors: []string{},
+	}
+
+	out, err := adb.Client.Shell("settings", "get", "secure", "android_id")
+	if err != nil {
+		identifiers.Errors = append(identifiers.Errors, fmt.Sprintf("android_id: %v", err))
+	} else if out == "null" || out == "" {
+		identifiers.Errors = append(identifiers.Errors, "android_id: not set on the device")
+	} else {
+		identifiers.AndroidID = out
+	}
+
+	out, err = adb.Client.Shell("getprop", "ro.serialno")
+	if err != nil {
+		identifiers.Errors = append(identifiers.Errors, fmt.Sprintf("serial: %v", err))
+	} else {
+		identifiers.Serial = out
+	}
+
+	// Devices without telephony don't have an IMEI nor an IMSI.
+	identifiers.IMEI, err = callIphonesubinfo(iphonesubinfoIMEI, imeiRegexp)
+	if err != nil {
+		identifiers.Errors = append(identifiers.Errors, fmt.Sprintf("imei: %v", err))
+	}
+	identifiers.IMSI, err = callIphonesubinfo(iphonesubinfoIMSI, imsiRegexp)
+	if err != nil {
+		identifiers.Errors = append(identifiers.Errors, fmt.Sprintf("imsi: %v", err))
+	}
+
+	if acq.RedactIdentifiers {
+		if identifiers.IMEI != "" {
+			identifiers.IMEI = hashIdentifier(identifiers.IMEI)
+		}
+		if identifiers.IMSI != "" {
+			identifiers.IMSI = hashIdentifier(identifiers.IMSI)
+		}
+	}
+
+	for _, msg := range identifiers.Errors {
+		log.Debugf("Device identifier not collected: %s", msg)
+	}
+
+	return saveCommandOutputJson(filepath.Join(d.StoragePath, "device_identifiers.json"), &identifiers)
+}
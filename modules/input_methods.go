@@ -0,0 +1,137 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mvt-project/androidqf/acquisition"
+	"github.com/mvt-project/androidqf/adb"
+	"github.com/mvt-project/androidqf/log"
+)
+
+// "com.example.keyboard/.KeyboardService:" at the start of each IME.
+var imeHeaderRegexp = regexp.MustCompile(`^([\w.]+)/([\w.$]+):$`)
+
+// imeSensitivePermissions are the permissions with which a keyboard can
+// exfiltrate what is typed.
+var imeSensitivePermissions = []string{
+	"android.permission.INTERNET",
+	"android.permission.READ_CONTACTS",
+}
+
+type InputMethod struct {
+	ID                   string   `json:"id"`
+	PackageName          string   `json:"package_name"`
+	ClassName            string   `json:"class_name"`
+	IsEnabled            bool     `json:"is_enabled"`
+	IsSelected           bool     `json:"is_selected"`
+	IsThirdParty         bool     `json:"is_third_party"`
+	SensitivePermissions []string `json:"sensitive_permissions"`
+}
+
+type InputMethods struct {
+	StoragePath string
+}
+
+func NewInputMethods() *InputMethods {
+	return &InputMethods{}
+}
+
+func (i *InputMethods) Name() string {
+	return "input_methods"
+}
+
+func (i *InputMethods) Dependencies() []string {
+	return []string{"packages"}
+}
+
+func (i *InputMethods) InitStorage(storagePath string) error {
+	i.StoragePath = storagePath
+	return nil
+}
+
+// parseInputMethods parses the IDs of the input methods listed by
+// `ime list -a`, ignoring their details.
+func parseInputMethods(out string) []InputMethod {
+	imes := []InputMethod{}
+	for _, line := range strings.Split(out, "\n") {
+		match := imeHeaderRegexp.FindStringSubmatch(strings.TrimRight(line, "\r"))
+		if match == nil {
+			continue
+		}
+
+		className := match[2]
+		if strings.HasPrefix(className, ".") {
+			className = match[1] + className
+		}
+		imes = append(imes, InputMethod{
+			ID:                   match[1] + "/" + match[2],
+			PackageName:          match[1],
+			ClassName:            className,
+			SensitivePermissions: []string{},
+		})
+	}
+
+	return imes
+}
+
+func (i *InputMethods) Run(acq *acquisition.Acquisition, fast bool) error {
+	log.Info("Collecting input methods...")
+
+	out, err := adb.Client.Shell("ime", "list", "-a")
+	if err != nil && out == "" {
+		return fmt.Errorf("failed to run `adb shell ime list -a`: %v", err)
+	}
+	imes := parseInputMethods(out)
+
+	enabled := make(map[string]bool)
+	out, err = adb.Client.Shell("ime", "list", "-s")
+	if err != nil {
+		log.Debugf("Failed to list enabled input methods: %v", err)
+	}
+	for _, line := range strings.Split(out, "\n") {
+		enabled[strings.TrimSpace(line)] = true
+	}
+
+	selected, err := adb.Client.Shell("settings", "get", "secure", "default_input_method")
+	if err != nil {
+		log.Debugf("Failed to get the selected input method: %v", err)
+	}
+
+	// Permissions come from the packages already collected.
+	packages := packageIndex(acq)
+	for idx := range imes {
+		ime := &imes[idx]
+		ime.IsEnabled = enabled[ime.ID]
+		ime.IsSelected = ime.ID == selected
+
+		pkg, ok := packages[fmt.Sprintf("0/%s", ime.PackageName)]
+		if !ok {
+			continue
+		}
+		ime.IsThirdParty = pkg.ThirdParty
+		for _, permission := range imeSensitivePermissions {
+			for _, requested := range pkg.Permissions {
+				if requested == permission {
+					ime.SensitivePermissions = append(ime.SensitivePermissions, permission)
+					break
+				}
+			}
+		}
+
+		if ime.IsThirdParty && ime.IsSelected {
+			log.Warningf("Third-party keyboard %s is selected as the input method", ime.ID)
+		}
+		if ime.IsThirdParty && len(ime.SensitivePermissions) > 0 {
+			log.Warningf("Third-party keyboard %s requests %s", ime.ID, strings.Join(ime.SensitivePermissions, ", "))
+		}
+	}
+
+	return saveCommandOutputJson(filepath.Join(i.StoragePath, "input_methods.json"), &imes)
+}
@@ -0,0 +1,192 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mvt-project/androidqf/acquisition"
+	"github.com/mvt-project/androidqf/adb"
+	"github.com/mvt-project/androidqf/log"
+)
+
+var (
+	// "JOB #u0a123/1001: 7f3e2a com.example/.SyncJob", or "JOB #1000/5: ..."
+	// for jobs of system uids.
+	jobHeaderRegexp = regexp.MustCompile(`^\s*JOB #(u(\d+)\w*|\d+)/(-?\d+): \S+ (\S+)`)
+	// "Source: uid=u0a123 user=0 pkg=com.example"
+	jobSourceRegexp = regexp.MustCompile(`Source: .*pkg=(\S+)`)
+	// "Periodic: interval=+15m0s0ms flex=+5m0s0ms"
+	jobIntervalRegexp = regexp.MustCompile(`(?i)periodic: interval=(\S+)`)
+	// "#u0a123/1001" in the list of active jobs.
+	activeJobRegexp = regexp.MustCompile(`#(u\d+\w*/-?\d+|\d+/-?\d+)`)
+)
+
+// Types of job triggers.
+const (
+	jobTriggerPeriodic = "periodic"
+	jobTriggerContent  = "content"
+	jobTriggerDelay    = "delay"
+	jobTriggerOneOff   = "one_off"
+)
+
+type ScheduledJob struct {
+	JobID         int      `json:"job_id"`
+	User          int      `json:"user"`
+	PackageName   string   `json:"package_name"`
+	ComponentName string   `json:"component_name"`
+	TriggerType   string   `json:"trigger_type"`
+	Interval      string   `json:"interval"`
+	IsRunning     bool     `json:"is_running"`
+	Constraints   []string `json:"constraints"`
+}
+
+type ScheduledJobs struct {
+	StoragePath string
+}
+
+func NewScheduledJobs() *ScheduledJobs {
+	return &ScheduledJobs{}
+}
+
+func (s *ScheduledJobs) Name() string {
+	return "scheduled_jobs"
+}
+
+func (s *ScheduledJobs) Dependencies() []string {
+	return []string{"packages"}
+}
+
+func (s *ScheduledJobs) InitStorage(storagePath string) error {
+	s.StoragePath = storagePath
+	return nil
+}
+
+// parseActiveJobs returns the jobs listed in the "Active jobs:" section of
+// `dumpsys jobscheduler`, keyed by their uid/id.
+func parseActiveJobs(lines []string) map[string]bool {
+	active := make(map[string]bool)
+	for i := 0; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) != "Active jobs:" {
+			continue
+		}
+
+		indent := indentation(lines[i])
+		for i+1 < len(lines) && (strings.TrimSpace(lines[i+1]) == "" || indentation(lines[i+1]) > indent) {
+			i++
+			// Idle slots are printed as "inactive since ...".
+			if strings.Contains(lines[i], "inactive") {
+				continue
+			}
+			for _, match := range activeJobRegexp.FindAllStringSubmatch(lines[i], -1) {
+				active[match[1]] = true
+			}
+		}
+	}
+
+	return active
+}
+
+// parseJobScheduler parses the jobs registered in `dumpsys jobscheduler`.
+func parseJobScheduler(out string) []ScheduledJob {
+	jobs := []ScheduledJob{}
+	lines := strings.Split(out, "\n")
+	active := parseActiveJobs(lines)
+
+	var job *ScheduledJob
+	indent := 0
+	for _, line := range lines {
+		if match := jobHeaderRegexp.FindStringSubmatch(line); match != nil {
+			if job != nil {
+				jobs = append(jobs, *job)
+			}
+			id, _ := strconv.Atoi(match[3])
+			user, _ := strconv.Atoi(match[2])
+			if match[2] == "" {
+				uid, _ := strconv.Atoi(match[1])
+				user = uid / 100000
+			}
+			job = &ScheduledJob{
+				JobID:         id,
+				User:          user,
+				PackageName:   strings.SplitN(match[4], "/", 2)[0],
+				ComponentName: match[4],
+				TriggerType:   jobTriggerOneOff,
+				IsRunning:     active[fmt.Sprintf("%s/%s", match[1], match[3])],
+				Constraints:   []string{},
+			}
+			indent = indentation(line)
+			continue
+		}
+		if job == nil {
+			continue
+		}
+		if strings.TrimSpace(line) != "" && indentation(line) <= indent {
+			jobs = append(jobs, *job)
+			job = nil
+			continue
+		}
+
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case jobSourceRegexp.MatchString(trimmed):
+			// Jobs can be scheduled on behalf of another package.
+			job.PackageName = jobSourceRegexp.FindStringSubmatch(trimmed)[1]
+		case jobIntervalRegexp.MatchString(trimmed):
+			job.TriggerType = jobTriggerPeriodic
+			job.Interval = jobIntervalRegexp.FindStringSubmatch(trimmed)[1]
+		case strings.HasPrefix(trimmed, "Trigger content URIs:"):
+			if job.TriggerType != jobTriggerPeriodic {
+				job.TriggerType = jobTriggerContent
+			}
+		case strings.HasPrefix(trimmed, "Required constraints:"):
+			for _, constraint := range strings.Fields(strings.TrimPrefix(trimmed, "Required constraints:")) {
+				if strings.HasPrefix(constraint, "[") {
+					continue
+				}
+				job.Constraints = append(job.Constraints, constraint)
+				if (constraint == "TIMING_DELAY" || constraint == "DEADLINE") && job.TriggerType == jobTriggerOneOff {
+					job.TriggerType = jobTriggerDelay
+				}
+			}
+		}
+	}
+	if job != nil {
+		jobs = append(jobs, *job)
+	}
+
+	return jobs
+}
+
+func (s *ScheduledJobs) Run(acq *acquisition.Acquisition, fast bool) error {
+	log.Info("Collecting scheduled jobs...")
+
+	out, err := adb.Client.ShellTimeout(dumpsysServiceTimeout, "dumpsys", "jobscheduler")
+	if err != nil && out == "" {
+		return fmt.Errorf("failed to run `adb shell dumpsys jobscheduler`: %v", err)
+	}
+
+	err = saveCommandOutput(filepath.Join(s.StoragePath, "jobscheduler.txt"), out)
+	if err != nil {
+		return err
+	}
+
+	jobs := parseJobScheduler(out)
+	packages := packageIndex(acq)
+	for _, job := range jobs {
+		pkg, ok := packages[fmt.Sprintf("%d/%s", job.User, job.PackageName)]
+		if !ok {
+			log.Warningf("Job %d is registered by %s, which is not an installed package", job.JobID, job.PackageName)
+		} else if pkg.Disabled {
+			log.Warningf("Job %d is registered by %s, which is disabled", job.JobID, job.PackageName)
+		}
+	}
+
+	return saveCommandOutputJson(filepath.Join(s.StoragePath, "scheduled_jobs.json"), &jobs)
+}
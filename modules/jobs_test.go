@@ -0,0 +1,92 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseJobScheduler(t *testing.T) {
+	tests := []struct {
+		fixture string
+		want    []ScheduledJob
+	}{
+		{
+			fixture: "dumpsys_jobscheduler_api28.txt",
+			want: []ScheduledJob{
+				{
+					JobID: 1001, User: 0, PackageName: "com.example.app",
+					ComponentName: "com.example.app/.sync.SyncJobService",
+					TriggerType:   jobTriggerPeriodic, Interval: "+15m0s0ms", IsRunning: true,
+					Constraints: []string{"TIMING_DELAY", "DEADLINE", "CONNECTIVITY"},
+				},
+				{
+					JobID: 5, User: 0, PackageName: "android",
+					ComponentName: "android/com.android.server.pm.BackgroundDexOptService",
+					TriggerType:   jobTriggerDelay,
+					Constraints:   []string{"CHARGING", "IDLE", "DEADLINE"},
+				},
+				{
+					// Scheduled by Play Services on behalf of the app.
+					JobID: 77, User: 10, PackageName: "com.example.app",
+					ComponentName: "com.google.android.gms/.gcm.GcmService",
+					TriggerType:   jobTriggerContent,
+					Constraints:   []string{"CONTENT_TRIGGER"},
+				},
+			},
+		},
+		{
+			fixture: "dumpsys_jobscheduler_api31.txt",
+			want: []ScheduledJob{
+				{
+					JobID: 3, User: 0, PackageName: "com.example.app",
+					ComponentName: "com.example.app/androidx.work.impl.background.systemjob.SystemJobService",
+					TriggerType:   jobTriggerDelay,
+					Constraints:   []string{"TIMING_DELAY"},
+				},
+				{
+					JobID: 42, User: 0, PackageName: "com.whatsapp",
+					ComponentName: "com.whatsapp/.messaging.MessageService",
+					TriggerType:   jobTriggerPeriodic, Interval: "+1h0m0s0ms",
+					Constraints: []string{"TIMING_DELAY", "DEADLINE", "CONNECTIVITY"},
+				},
+			},
+		},
+		{
+			fixture: "dumpsys_jobscheduler_api34.txt",
+			want: []ScheduledJob{
+				{
+					JobID: 42, User: 0, PackageName: "com.example.app",
+					ComponentName: "com.example.app/.PushJobService",
+					TriggerType:   jobTriggerPeriodic, Interval: "+15m0s0ms", IsRunning: true,
+					Constraints: []string{"TIMING_DELAY", "DEADLINE", "CONNECTIVITY"},
+				},
+				{
+					// Pending, but not running.
+					JobID: 7, User: 10, PackageName: "com.example.app",
+					ComponentName: "com.example.app/.UploadJobService",
+					TriggerType:   jobTriggerOneOff,
+					Constraints:   []string{"CHARGING"},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.fixture, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", test.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			jobs := parseJobScheduler(string(data))
+			if !reflect.DeepEqual(jobs, test.want) {
+				t.Errorf("got %+v, want %+v", jobs, test.want)
+			}
+		})
+	}
+}
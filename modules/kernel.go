@@ -0,0 +1,231 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mvt-project/androidqf/acquisition"
+	"github.com/mvt-project/androidqf/adb"
+	"github.com/mvt-project/androidqf/log"
+)
+
+// Locations of the kernel log from before the last reboot, besides the
+// console-ramoops files found in pstoreFolder.
+var lastKmsgPaths = []string{
+	"/proc/last_kmsg",
+	"/sys/fs/pstore/console-ramoops",
+	"/sys/fs/pstore/console-ramoops-0",
+}
+
+const pstoreFolder = "/sys/fs/pstore"
+
+var (
+	kernelVersionRegexp  = regexp.MustCompile(`^Linux version (\S+)`)
+	kernelCompilerRegexp = regexp.MustCompile(`((?:gcc|clang) version [^\s,)]+)`)
+)
+
+type KernelInfo struct {
+	StoragePath string
+}
+
+func NewKernelInfo() *KernelInfo {
+	return &KernelInfo{}
+}
+
+func (k *KernelInfo) Name() string {
+	return "kernel"
+}
+
+func (k *KernelInfo) InitStorage(storagePath string) error {
+	k.StoragePath = storagePath
+	return nil
+}
+
+// parseProcVersion parses the content of /proc/version, for example
+// "Linux version 4.14.186 (builder@host) (gcc version 4.9.x (GCC) ) #1 SMP
+// PREEMPT Wed Jun 2 12:00:00 CST 2021".
+func parseProcVersion(out string) *acquisition.KernelVersion {
+	out = strings.TrimSpace(out)
+	kernel := &acquisition.KernelVersion{}
+
+	if match := kernelVersionRegexp.FindStringSubmatch(out); match != nil {
+		kernel.Version = match[1]
+	}
+	if match := kernelCompilerRegexp.FindStringSubmatch(out); match != nil {
+		kernel.GCCVersion = match[1]
+	}
+
+	// The build date follows the build number and the configuration flags.
+	index := strings.LastIndex(out, " #")
+	if index != -1 {
+		fields := strings.Fields(out[index+2:])
+		if len(fields) > 0 {
+			fields = fields[1:]
+		}
+		for len(fields) > 0 && strings.ToUpper(fields[0]) == fields[0] {
+			fields = fields[1:]
+		}
+		kernel.BuildDate = strings.Join(fields, " ")
+	}
+
+	return kernel
+}
+
+// isPermissionDenied checks whether the command failed for lack of
+// privileges.
+func isPermissionDenied(out string) bool {
+	out = strings.ToLower(out)
+	return strings.Contains(out, "permission denied") ||
+		strings.Contains(out, "operation not permitted")
+}
+
+// readPrivileged runs the command, and runs it again as root if it was not
+// allowed and root is available.
+func readPrivileged(cmd ...string) (string, error) {
+	out, err := adb.Client.Shell(cmd...)
+	if err == nil && !isPermissionDenied(out) {
+		return out, nil
+	}
+	if !isPermissionDenied(out) {
+		return "", fmt.Errorf("%v: %s", err, out)
+	}
+	if !adb.Client.HasRoot() {
+		return "", fmt.Errorf("permission denied: %s", out)
+	}
+
+	out, err = adb.Client.ShellAsRoot(cmd...)
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, out)
+	}
+	if isPermissionDenied(out) {
+		return "", fmt.Errorf("permission denied: %s", out)
+	}
+	return out, nil
+}
+
+// errPermissionDenied is returned by readPrivilegedRaw when the command was
+// not allowed to read the source.
+var errPermissionDenied = errors.New("permission denied")
+
+// commandError returns the error the command printed in place of its output,
+// as exec-out doesn't return the exit status of the command. Errors start
+// with the name of the command, as in "cat: /proc/last_kmsg: No such file or
+// directory".
+func commandError(cmd string, out []byte) error {
+	line := firstLine(out)
+	if len(out) == 0 {
+		return errors.New("empty output")
+	}
+	if isPermissionDenied(line) {
+		return fmt.Errorf("%w: %s", errPermissionDenied, line)
+	}
+	if name, _, _ := strings.Cut(cmd, " "); strings.HasPrefix(line, name+":") {
+		return errors.New(line)
+	}
+	return nil
+}
+
+// readPrivilegedRaw runs the command through exec-out, to keep binary
+// content intact, and runs it again as root if it was not allowed and root is
+// available.
+func readPrivilegedRaw(cmd string) ([]byte, error) {
+	out, err := adb.Client.ExecOut(cmd)
+	if err == nil {
+		err = commandError(cmd, out)
+	}
+	if err == nil {
+		return out, nil
+	}
+	// Root doesn't help with sources which don't exist.
+	if !adb.Client.HasRoot() || strings.Contains(err.Error(), "No such file") {
+		return nil, err
+	}
+
+	out, err = adb.Client.ExecOutAsRoot(cmd)
+	if err == nil {
+		err = commandError(cmd, out)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// firstLine returns the first line of the output, where commands print
+// their errors.
+func firstLine(out []byte) string {
+	line, _, _ := strings.Cut(string(out), "\n")
+	return strings.TrimSpace(line)
+}
+
+func (k *KernelInfo) Run(acq *acquisition.Acquisition, fast bool) error {
+	log.Info("Collecting kernel information...")
+
+	out, err := adb.Client.Shell("cat", "/proc/version")
+	if err != nil {
+		return fmt.Errorf("failed to read /proc/version: %v", err)
+	}
+	err = saveCommandOutput(filepath.Join(k.StoragePath, "proc_version.txt"), out)
+	if err != nil {
+		return err
+	}
+	acq.KernelVersion = parseProcVersion(out)
+
+	// Record which sources were collected or are missing, since most of
+	// them only exist on some devices.
+	var sources strings.Builder
+	saveRaw := func(source, fileName string) {
+		data, err := readPrivilegedRaw(source)
+		if err != nil {
+			// Logs that exist but can't be read without root are worth
+			// reporting, most of the others don't exist on the device.
+			if errors.Is(err, errPermissionDenied) && !adb.Client.HasRoot() {
+				log.Warningf("Unable to collect %s, root is required: %v", source, err)
+			} else {
+				log.Debugf("Unable to collect %s: %v", source, err)
+			}
+			fmt.Fprintf(&sources, "%s: missing (%v)\n", source, err)
+			return
+		}
+		err = os.WriteFile(filepath.Join(k.StoragePath, fileName), data, 0o644)
+		if err != nil {
+			log.Errorf("Impossible to save %s: %v", source, err)
+			fmt.Fprintf(&sources, "%s: failed to save (%v)\n", source, err)
+			return
+		}
+		fmt.Fprintf(&sources, "%s: saved to %s (%d bytes)\n", source, fileName, len(data))
+	}
+
+	// Unprivileged access to dmesg is blocked on newer kernels.
+	saveRaw("dmesg", "dmesg.txt")
+
+	paths := append([]string{}, lastKmsgPaths...)
+	out, err = readPrivileged("ls", pstoreFolder)
+	if err != nil {
+		log.Debugf("Unable to list %s: %v", pstoreFolder, err)
+	} else {
+		for _, name := range strings.Fields(out) {
+			if strings.HasPrefix(name, "console-ramoops") {
+				paths = appendUniqueString(paths, pstoreFolder+"/"+name)
+			}
+		}
+	}
+	for _, path := range paths {
+		saveRaw(fmt.Sprintf("cat %s", path), fmt.Sprintf("%s.txt", filepath.Base(path)))
+	}
+
+	err = saveCommandOutput(filepath.Join(k.StoragePath, "kernel_logs.txt"), sources.String())
+	if err != nil {
+		log.Errorf("Impossible to save the list of kernel logs: %v", err)
+	}
+
+	return nil
+}
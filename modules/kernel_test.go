@@ -0,0 +1,37 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCommandError(t *testing.T) {
+	tests := []struct {
+		cmd    string
+		out    string
+		failed bool
+		denied bool
+	}{
+		{cmd: "dmesg", out: "[    0.000000] Booting Linux on physical CPU 0x0\n"},
+		{cmd: "dmesg", out: "dmesg: klogctl: Permission denied\n", failed: true, denied: true},
+		{cmd: "dmesg", out: "", failed: true},
+		{cmd: "cat /proc/last_kmsg", out: "cat: /proc/last_kmsg: No such file or directory\n", failed: true},
+		{cmd: "cat /sys/fs/pstore/console-ramoops-0", out: "cat: /sys/fs/pstore/console-ramoops-0: Permission denied\n", failed: true, denied: true},
+		// Kernel logs can mention cat, as long as it's not at the start.
+		{cmd: "cat /sys/fs/pstore/console-ramoops", out: "[  12.345678] init: starting service 'cat:'\n"},
+	}
+
+	for _, test := range tests {
+		err := commandError(test.cmd, []byte(test.out))
+		if (err != nil) != test.failed {
+			t.Errorf("got error %v for %q", err, test.out)
+		}
+		if errors.Is(err, errPermissionDenied) != test.denied {
+			t.Errorf("got error %v for %q, permission denied %v", err, test.out, test.denied)
+		}
+	}
+}
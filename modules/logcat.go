@@ -6,7 +6,10 @@ package modules
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/mvt-project/androidqf/acquisition"
 	"github.com/mvt-project/androidqf/adb"
@@ -30,26 +33,84 @@ func (l *Logcat) InitStorage(storagePath string) error {
 	return nil
 }
 
+// logcatOptions are the format and buffer arguments supported by the device.
+type logcatOptions struct {
+	format string
+	// buffers selects all the buffers.
+	buffers []string
+}
+
+// logcatSupports runs logcat with the arguments, discarding the logs. An
+// unsupported option makes logcat exit with an error, printed on stderr. Log
+// lines can't be mistaken for such errors, as they are not printed.
+func logcatSupports(args ...string) bool {
+	cmd := append([]string{"logcat", "-d", "-t", "1"}, args...)
+	out, err := adb.Client.Shell(append(cmd, ">/dev/null")...)
+	return err == nil && strings.TrimSpace(out) == ""
+}
+
+// probeLogcat checks which logcat options the device supports. Formats with
+// modifiers were added in Android 7, and "-b all" in Android 5.
+func probeLogcat() logcatOptions {
+	options := logcatOptions{
+		format:  "threadtime,usec,UTC",
+		buffers: []string{"-b", "all"},
+	}
+
+	if !logcatSupports("-v", options.format) {
+		log.Debugf("logcat does not support the %s format, falling back to threadtime", options.format)
+		options.format = "threadtime"
+	}
+
+	if !logcatSupports(options.buffers...) {
+		log.Debug("logcat does not support `-b all`, selecting the buffers individually")
+		options.buffers = []string{"-b", "main", "-b", "system", "-b", "events", "-b", "radio"}
+	}
+
+	return options
+}
+
+// logcatArgs returns the logcat arguments limiting the output to the most
+// recent lines, unless lines is 0.
+func logcatArgs(options logcatOptions, lines int, args ...string) []string {
+	args = append([]string{"logcat", "-v", options.format}, args...)
+	if lines > 0 {
+		args = append(args, "-t", strconv.Itoa(lines))
+	}
+	return append(args, "\"*:V\"")
+}
+
+// Run streams the output of logcat to disk, as it can be tens of MB. The
+// capture of all the buffers in logcat.txt is always complete, the line limit
+// only applies to the individual buffers and to the logs before reboot.
 func (l *Logcat) Run(acq *acquisition.Acquisition, fast bool) error {
 	log.Info("Collecting logcat...")
 
-	out, err := adb.Client.Shell("logcat", "-d", "-b", "all", "\"*:V\"")
+	options := probeLogcat()
+	args := append([]string{"-d"}, options.buffers...)
+	err := adb.Client.ShellToFile(filepath.Join(l.StoragePath, "logcat.txt"), logcatArgs(options, 0, args...)...)
 	if err != nil {
 		return fmt.Errorf("failed to run `adb shell logcat`: %v", err)
 	}
 
-	err = saveCommandOutput(filepath.Join(l.StoragePath, "logcat.txt"), out)
-	if err != nil {
-		return err
+	// Individual buffers. Not all devices have all of them.
+	for _, buffer := range []string{"main", "system", "crash", "kernel"} {
+		localPath := filepath.Join(l.StoragePath, fmt.Sprintf("logcat_%s.txt", buffer))
+		err = adb.Client.ShellToFile(localPath, logcatArgs(options, acq.LogcatLines, "-d", "-b", buffer)...)
+		if err != nil {
+			log.Debugf("failed to run `adb shell logcat -b %s`: %v", buffer, err)
+			os.Remove(localPath)
+		}
 	}
 
 	// logcat from before reboot
-	out, err = adb.Client.Shell("logcat", "-L", "-b", "all", "\"*:V\"")
+	localPath := filepath.Join(l.StoragePath, "logcat_old.txt")
+	err = adb.Client.ShellToFile(localPath, logcatArgs(options, acq.LogcatLines, append([]string{"-L"}, options.buffers...)...)...)
 	if err != nil {
 		// Often fails, totally normal
 		log.Debugf("failed to run `adb shell logcat -L`: %v", err)
-		return nil
+		os.Remove(localPath)
 	}
 
-	return saveCommandOutput(filepath.Join(l.StoragePath, "logcat_old.txt"), out)
+	return nil
 }
@@ -29,10 +29,14 @@ func (l *Logs) Name() string {
 	return "logs"
 }
 
+func (l *Logs) Outputs() []string {
+	return []string{"logs"}
+}
+
 func (l *Logs) InitStorage(storagePath string) error {
 	l.StoragePath = storagePath
 	l.LogsPath = filepath.Join(storagePath, "logs")
-	err := os.Mkdir(l.LogsPath, 0o755)
+	err := os.MkdirAll(l.LogsPath, 0o755)
 	if err != nil {
 		return fmt.Errorf("failed to create logs folder: %v", err)
 	}
@@ -46,6 +50,10 @@ func (l *Logs) Run(acq *acquisition.Acquisition, fast bool) error {
 	logFiles := []string{
 		"/data/system/uiderrors.txt",
 		"/proc/kmsg",
+	}
+	// Pseudo-files which adb pull can't reliably copy, and which might
+	// contain binary data.
+	rawLogFiles := []string{
 		"/proc/last_kmsg",
 		"/sys/fs/pstore/console-ramoops",
 	}
@@ -54,7 +62,7 @@ func (l *Logs) Run(acq *acquisition.Acquisition, fast bool) error {
 	for _, logFolder := range []string{"/data/anr/", "/data/log/", "/sdcard/log/"} {
 		files, err := adb.Client.ListFiles(logFolder, true)
 		if err != nil {
-			log.Debugf("Impossible to get files from %", logFolder)
+			log.Debugf("Impossible to get files from %s", logFolder)
 			continue
 		}
 		if len(files) == 0 {
@@ -86,5 +94,31 @@ func (l *Logs) Run(acq *acquisition.Acquisition, fast bool) error {
 		}
 	}
 
+	for _, logFile := range rawLogFiles {
+		localPath := filepath.Join(l.LogsPath, logFile)
+		localDir, _ := filepath.Split(localPath)
+
+		cmd := fmt.Sprintf("cat %s", logFile)
+		out, err := adb.Client.ExecOut(cmd)
+		if (err != nil || len(out) == 0) && adb.Client.HasRoot() {
+			out, err = adb.Client.ExecOutAsRoot(cmd)
+		}
+		if err != nil || len(out) == 0 {
+			log.Debugf("Failed to read log file %s: %v", logFile, err)
+			continue
+		}
+
+		err = os.MkdirAll(localDir, 0o755)
+		if err != nil {
+			log.Errorf("Failed to create folders for logs %s: %v\n", localDir, err)
+			continue
+		}
+
+		err = os.WriteFile(localPath, out, 0o644)
+		if err != nil {
+			log.Errorf("Failed to save log file %s: %v\n", logFile, err)
+		}
+	}
+
 	return nil
 }
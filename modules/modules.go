@@ -8,8 +8,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
+	"sync"
 
 	"github.com/mvt-project/androidqf/acquisition"
+	"github.com/mvt-project/androidqf/adb"
+	"github.com/mvt-project/androidqf/log"
 )
 
 type Module interface {
@@ -22,22 +26,126 @@ func List() []Module {
 	return []Module{
 		NewBackup(),
 		NewPackages(),
+		NewNetworkSecurityConfig(),
 		NewGetProp(),
+		NewBuildProperties(),
+		NewKernelInfo(),
+		NewDeviceIdentifiers(),
+		NewTelephony(),
+		NewCACertificates(),
+		NewAccessibilityServices(),
+		NewDeviceAdmins(),
+		NewNotificationListeners(),
 		NewDumpsys(),
 		NewProcesses(),
+		NewNetworkConnections(),
 		NewServices(),
 		NewBugreport(),
 		NewFiles(),
 		NewSettings(),
-		NewSELinux(),
+		NewSELinuxStatus(),
+		NewFilesystemMounts(),
+		NewVPNConfig(),
+		NewDNSConfig(),
+		NewWiFiNetworks(),
+		NewBluetoothDevices(),
+		NewScheduledJobs(),
+		NewAppOps(),
+		NewRuntimePermissions(),
+		NewAccounts(),
+		NewInputMethods(),
+		NewAPEXModules(),
+		NewTombstones(),
+		NewDropboxLogs(),
+		NewBrowserHistory(),
+		NewSMS(),
 		NewEnvironment(),
 		NewRootBinaries(),
+		NewHookingFrameworks(),
 		NewLogcat(),
 		NewLogs(),
 		NewTemp(),
 	}
 }
 
+// packagesMutex prevents modules running concurrently from retrieving the
+// list of packages more than once.
+var packagesMutex sync.Mutex
+
+// getPackages returns the packages collected by the packages module. If it
+// did not run, a quick list of packages is retrieved instead.
+func getPackages(acq *acquisition.Acquisition) []adb.Package {
+	packagesMutex.Lock()
+	defer packagesMutex.Unlock()
+	if acq.Packages != nil {
+		return acq.Packages
+	}
+
+	packages, err := adb.Client.GetPackages(true, acq.Progress)
+	if err != nil {
+		log.Debugf("Failed to retrieve list of installed packages: %v", err)
+		return []adb.Package{}
+	}
+	acq.Packages = packages
+
+	return packages
+}
+
+// propertiesMutex prevents modules running concurrently from running getprop
+// more than once.
+var propertiesMutex sync.Mutex
+
+// getProperties returns the system properties collected by the getprop
+// module. If it did not run, they are retrieved instead.
+func getProperties(acq *acquisition.Acquisition) map[string]string {
+	propertiesMutex.Lock()
+	defer propertiesMutex.Unlock()
+	if acq.Properties != nil {
+		return acq.Properties
+	}
+
+	out, err := adb.Client.ShellTimeout(getpropTimeout, "getprop")
+	if err != nil && out == "" {
+		log.Debugf("Failed to run `adb shell getprop`: %v", err)
+		return map[string]string{}
+	}
+	acq.Properties = parseGetprop(out)
+
+	return acq.Properties
+}
+
+// packagesByUID returns the names of the packages running with each UID.
+func packagesByUID(acq *acquisition.Acquisition) map[int][]string {
+	uids := make(map[int][]string)
+	for _, pkg := range getPackages(acq) {
+		uids[pkg.UID] = append(uids[pkg.UID], pkg.Name)
+	}
+	return uids
+}
+
+// shellQuote quotes an argument so the device shell passes it unchanged.
+func shellQuote(arg string) string {
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// hasDeviceSQLite checks whether the sqlite3 binary is available as root on
+// the device.
+func hasDeviceSQLite() bool {
+	out, err := adb.Client.ShellAsRoot("which", "sqlite3")
+	return err == nil && strings.TrimSpace(out) != ""
+}
+
+// queryDeviceSQLite runs the query on the database as root with the sqlite3
+// binary of the device. Rows are returned one per line, with "|" separated
+// columns.
+func queryDeviceSQLite(dbPath, query string) (string, error) {
+	out, err := adb.Client.ShellAsRoot("sqlite3", shellQuote(dbPath), shellQuote(query))
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, out)
+	}
+	return out, nil
+}
+
 func saveCommandOutputJson(filePath string, data any) error {
 	jsonData, err := json.MarshalIndent(&data, "", "    ")
 	if err != nil {
@@ -0,0 +1,253 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/mvt-project/androidqf/acquisition"
+	"github.com/mvt-project/androidqf/adb"
+	"github.com/mvt-project/androidqf/log"
+)
+
+// Partitions which are mounted read-only on stock devices.
+var readOnlyMountPoints = []string{"/system", "/vendor", "/product"}
+
+// Locations from which nothing should be mounted.
+var suspiciousMountSources = []string{"/data/local", "/sdcard"}
+
+// systemMountPoints are the system partitions, over which overlays and
+// tmpfs mounts are used to hide modifications, as Magisk does.
+var systemMountPoints = []string{"/system", "/system_ext", "/vendor", "/product", "/odm", "/sbin"}
+
+// Contexts the mounts were read from. Each process can have its own mount
+// namespace, so the shell and root might not see the same mounts.
+const (
+	mountContextShell = "shell"
+	mountContextRoot  = "root"
+)
+
+type MountEntry struct {
+	Device     string   `json:"device"`
+	MountPoint string   `json:"mount_point"`
+	FSType     string   `json:"fs_type"`
+	Options    []string `json:"options"`
+	Suspicious bool     `json:"suspicious"`
+	Reason     string   `json:"reason,omitempty"`
+}
+
+type MountsResult struct {
+	Context     string       `json:"context"`
+	Filesystems []string     `json:"filesystems"`
+	Mounts      []MountEntry `json:"mounts"`
+}
+
+type FilesystemMounts struct {
+	StoragePath string
+}
+
+func NewFilesystemMounts() *FilesystemMounts {
+	return &FilesystemMounts{}
+}
+
+func (f *FilesystemMounts) Name() string {
+	return "filesystem_mounts"
+}
+
+func (f *FilesystemMounts) InitStorage(storagePath string) error {
+	f.StoragePath = storagePath
+	return nil
+}
+
+// unescapeMountField decodes the octal escapes used in /proc/mounts for
+// spaces, tabs, newlines and backslashes.
+func unescapeMountField(field string) string {
+	return strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(field)
+}
+
+// parseProcMounts parses the content of /proc/mounts, with lines in the form
+// "device mountpoint fstype options 0 0".
+func parseProcMounts(out string) []MountEntry {
+	mounts := []MountEntry{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+
+		mounts = append(mounts, MountEntry{
+			Device:     unescapeMountField(fields[0]),
+			MountPoint: unescapeMountField(fields[1]),
+			FSType:     fields[2],
+			Options:    strings.Split(fields[3], ","),
+		})
+	}
+
+	return mounts
+}
+
+// parseMount parses the output of the mount command, with lines in the form
+// "device on mountpoint type fstype (options)".
+func parseMount(out string) []MountEntry {
+	mounts := []MountEntry{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 6 || fields[1] != "on" || fields[3] != "type" {
+			continue
+		}
+
+		mounts = append(mounts, MountEntry{
+			Device:     fields[0],
+			MountPoint: fields[2],
+			FSType:     fields[4],
+			Options:    strings.Split(strings.Trim(fields[5], "()"), ","),
+		})
+	}
+
+	return mounts
+}
+
+// parseFilesystems returns the filesystems listed in /proc/filesystems, with
+// lines in the form "nodev	tmpfs" or "	ext4".
+func parseFilesystems(out string) []string {
+	filesystems := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 {
+			filesystems = append(filesystems, fields[len(fields)-1])
+		}
+	}
+	return filesystems
+}
+
+// isSystemMountPoint checks whether the mount point is one of the
+// systemMountPoints or inside one of them.
+func isSystemMountPoint(mountPoint string) bool {
+	for _, system := range systemMountPoints {
+		if mountPoint == system || strings.HasPrefix(mountPoint, system+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkMount flags mounts which are indicators of a rooted or tampered
+// device.
+func checkMount(mount *MountEntry) {
+	if strings.Contains(strings.ToLower(mount.Device), "magisk") {
+		mount.Suspicious = true
+		mount.Reason = fmt.Sprintf("%s is mounted from %s", mount.MountPoint, mount.Device)
+		return
+	}
+	if (mount.FSType == "overlay" || mount.FSType == "tmpfs") && isSystemMountPoint(mount.MountPoint) {
+		mount.Suspicious = true
+		mount.Reason = fmt.Sprintf("%s is mounted over the system partition %s", mount.FSType, mount.MountPoint)
+		return
+	}
+	// APEX modules are the only images expected to be loop mounted.
+	if strings.HasPrefix(mount.Device, "/dev/block/loop") && !strings.HasPrefix(mount.MountPoint, "/apex/") {
+		mount.Suspicious = true
+		mount.Reason = fmt.Sprintf("%s is loop mounted on %s", mount.Device, mount.MountPoint)
+		return
+	}
+
+	for _, mountPoint := range readOnlyMountPoints {
+		if mount.MountPoint != mountPoint {
+			continue
+		}
+		for _, option := range mount.Options {
+			if option == "rw" {
+				mount.Suspicious = true
+				mount.Reason = fmt.Sprintf("%s is mounted read-write", mountPoint)
+				return
+			}
+		}
+	}
+
+	for _, source := range suspiciousMountSources {
+		if strings.HasPrefix(mount.Device, source) {
+			mount.Suspicious = true
+			mount.Reason = fmt.Sprintf("%s is mounted from %s", mount.MountPoint, mount.Device)
+			return
+		}
+	}
+}
+
+// mountsShell runs the command as root if available, as the mounts seen
+// depend on the namespace of the process.
+func mountsShell(cmd ...string) (string, error) {
+	if adb.Client.HasRoot() {
+		return adb.Client.ShellAsRoot(cmd...)
+	}
+	return adb.Client.Shell(cmd...)
+}
+
+func (f *FilesystemMounts) Run(acq *acquisition.Acquisition, fast bool) error {
+	log.Info("Collecting mounted filesystems...")
+
+	result := MountsResult{
+		Context: mountContextShell,
+		Mounts:  []MountEntry{},
+	}
+	if adb.Client.HasRoot() {
+		result.Context = mountContextRoot
+	}
+
+	procMounts, err := mountsShell("cat", "/proc/mounts")
+	if err != nil {
+		log.Debugf("Failed to read /proc/mounts: %v", err)
+	}
+	mountOut, err := mountsShell("mount")
+	if err != nil {
+		log.Debugf("Failed to run `adb shell mount`: %v", err)
+	}
+	if procMounts == "" && mountOut == "" {
+		return fmt.Errorf("failed to list mounted filesystems")
+	}
+
+	// Deduplicate the entries found by both commands.
+	seen := make(map[string]bool)
+	for _, mount := range append(parseProcMounts(procMounts), parseMount(mountOut)...) {
+		key := fmt.Sprintf("%s %s %s %s", mount.Device, mount.MountPoint, mount.FSType, strings.Join(mount.Options, ","))
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		checkMount(&mount)
+		if mount.Suspicious {
+			acq.AddWarning("Suspicious mount: %s", mount.Reason)
+		}
+		result.Mounts = append(result.Mounts, mount)
+	}
+
+	filesystems, err := adb.Client.Shell("cat", "/proc/filesystems")
+	if err != nil {
+		log.Debugf("Failed to read /proc/filesystems: %v", err)
+	}
+	result.Filesystems = parseFilesystems(filesystems)
+
+	output := fmt.Sprintf("Context: %s\n\n==> /proc/mounts <==\n%s\n\n==> mount <==\n%s\n\n==> /proc/filesystems <==\n%s\n",
+		result.Context, procMounts, mountOut, filesystems)
+	// The block devices are only readable by root on recent versions, the
+	// errors are kept in the output.
+	for _, cmd := range []string{"df -h", "ls -l /dev/block/dm-*", "ls -l /dev/block/loop*", "losetup -a"} {
+		out, err := mountsShell(cmd)
+		if err != nil && out == "" {
+			log.Debugf("Failed to run `%s`: %v", cmd, err)
+			continue
+		}
+		output += fmt.Sprintf("\n==> %s <==\n%s\n", cmd, out)
+	}
+
+	err = saveCommandOutput(filepath.Join(f.StoragePath, "mounts.txt"), output)
+	if err != nil {
+		return err
+	}
+
+	return saveCommandOutputJson(filepath.Join(f.StoragePath, "mounts.json"), &result)
+}
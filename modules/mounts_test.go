@@ -0,0 +1,86 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCheckMounts(t *testing.T) {
+	tests := []struct {
+		fixture string
+		count   int
+		// suspicious maps the mount points flagged to the reason.
+		suspicious map[string]string
+	}{
+		{
+			fixture:    "proc_mounts_stock.txt",
+			count:      19,
+			suspicious: map[string]string{},
+		},
+		{
+			fixture: "proc_mounts_rooted.txt",
+			count:   16,
+			suspicious: map[string]string{
+				"/vendor":           "/vendor is mounted read-write",
+				"/debug_ramdisk":    "/debug_ramdisk is mounted from magisk",
+				"/data/adb/modules": "/dev/block/loop15 is loop mounted on /data/adb/modules",
+				"/system/bin":       "tmpfs is mounted over the system partition /system/bin",
+				"/system/etc/hosts": "overlay is mounted over the system partition /system/etc/hosts",
+				"/mnt/secret":       "/mnt/secret is mounted from /data/local/tmp/payload.img",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.fixture, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", test.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			mounts := parseProcMounts(string(data))
+			if len(mounts) != test.count {
+				t.Errorf("got %d mounts, want %d", len(mounts), test.count)
+			}
+			suspicious := map[string]string{}
+			for _, mount := range mounts {
+				checkMount(&mount)
+				if mount.Suspicious {
+					suspicious[mount.MountPoint] = mount.Reason
+				}
+			}
+			if !reflect.DeepEqual(suspicious, test.suspicious) {
+				t.Errorf("got suspicious mounts %v, want %v", suspicious, test.suspicious)
+			}
+		})
+	}
+}
+
+func TestParseMounts(t *testing.T) {
+	procMounts := parseProcMounts(`/dev/block/vold/public:179,1 /mnt/media_rw/My\040Card vfat rw,dirsync 0 0`)
+	if len(procMounts) != 1 || procMounts[0].MountPoint != "/mnt/media_rw/My Card" {
+		t.Errorf("got %+v", procMounts)
+	}
+
+	mounts := parseMount("/dev/block/dm-8 on /vendor type ext4 (ro,seclabel,relatime)\n" +
+		"garbage\n" +
+		"tmpfs on /system/bin type tmpfs (rw,seclabel,relatime)\n")
+	want := []MountEntry{
+		{Device: "/dev/block/dm-8", MountPoint: "/vendor", FSType: "ext4", Options: []string{"ro", "seclabel", "relatime"}},
+		{Device: "tmpfs", MountPoint: "/system/bin", FSType: "tmpfs", Options: []string{"rw", "seclabel", "relatime"}},
+	}
+	if !reflect.DeepEqual(mounts, want) {
+		t.Errorf("got %+v, want %+v", mounts, want)
+	}
+
+	filesystems := parseFilesystems("nodev\tsysfs\nnodev\ttmpfs\n\text4\n\tf2fs\n")
+	if !reflect.DeepEqual(filesystems, []string{"sysfs", "tmpfs", "ext4", "f2fs"}) {
+		t.Errorf("got filesystems %v", filesystems)
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mvt-project/androidqf/acquisition"
+	"github.com/mvt-project/androidqf/adb"
+	"github.com/mvt-project/androidqf/log"
+)
+
+// Socket states as found in /proc/net/tcp.
+var tcpStates = map[string]string{
+	"01": "ESTABLISHED",
+	"02": "SYN_SENT",
+	"03": "SYN_RECV",
+	"04": "FIN_WAIT1",
+	"05": "FIN_WAIT2",
+	"06": "TIME_WAIT",
+	"07": "CLOSE",
+	"08": "CLOSE_WAIT",
+	"09": "LAST_ACK",
+	"0A": "LISTEN",
+	"0B": "CLOSING",
+}
+
+type NetworkConnection struct {
+	Proto      string   `json:"proto"`
+	LocalAddr  string   `json:"local_address"`
+	RemoteAddr string   `json:"remote_address"`
+	State      string   `json:"state"`
+	UID        int      `json:"uid"`
+	PID        int      `json:"pid"`
+	Packages   []string `json:"packages"`
+}
+
+type NetworkConnections struct {
+	StoragePath string
+}
+
+func NewNetworkConnections() *NetworkConnections {
+	return &NetworkConnections{}
+}
+
+func (n *NetworkConnections) Name() string {
+	return "network_connections"
+}
+
+func (n *NetworkConnections) Dependencies() []string {
+	return []string{"packages"}
+}
+
+func (n *NetworkConnections) InitStorage(storagePath string) error {
+	n.StoragePath = storagePath
+	return nil
+}
+
+// decodeProcNetAddress converts an address from /proc/net/* in the form
+// 0100007F:0035 into 127.0.0.1:53.
+func decodeProcNetAddress(address string) (string, error) {
+	parts := strings.SplitN(address, ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("invalid address %s", address)
+	}
+
+	ipBytes, err := hex.DecodeString(parts[0])
+	if err != nil || (len(ipBytes) != 4 && len(ipBytes) != 16) {
+		return "", fmt.Errorf("invalid IP address %s", parts[0])
+	}
+	// The kernel prints the address as 32-bit words in host byte order.
+	for i := 0; i < len(ipBytes); i += 4 {
+		ipBytes[i], ipBytes[i+1], ipBytes[i+2], ipBytes[i+3] = ipBytes[i+3], ipBytes[i+2], ipBytes[i+1], ipBytes[i]
+	}
+
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return "", fmt.Errorf("invalid port %s", parts[1])
+	}
+
+	return net.JoinHostPort(net.IP(ipBytes).String(), strconv.FormatUint(port, 10)), nil
+}
+
+// parseProcNet parses the content of one of the /proc/net/{tcp,udp}[6] files.
+func parseProcNet(proto, content string) []NetworkConnection {
+	connections := []NetworkConnection{}
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 10 || fields[0] == "sl" {
+			continue
+		}
+
+		localAddr, err := decodeProcNetAddress(fields[1])
+		if err != nil {
+			continue
+		}
+		remoteAddr, err := decodeProcNetAddress(fields[2])
+		if err != nil {
+			continue
+		}
+		uid, _ := strconv.Atoi(fields[7])
+
+		state, ok := tcpStates[strings.ToUpper(fields[3])]
+		if !ok {
+			state = fields[3]
+		}
+
+		connections = append(connections, NetworkConnection{
+			Proto:      proto,
+			LocalAddr:  localAddr,
+			RemoteAddr: remoteAddr,
+			State:      state,
+			UID:        uid,
+		})
+	}
+
+	return connections
+}
+
+// parseNetstatPIDs maps each connection listed by `netstat -anp` to the PID
+// owning it, keyed by protocol, local and remote address.
+func parseNetstatPIDs(out string) map[string]int {
+	pids := make(map[string]int)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 6 || !strings.HasPrefix(fields[0], "tcp") && !strings.HasPrefix(fields[0], "udp") {
+			continue
+		}
+
+		// The PID/Program name column is the last one.
+		program := fields[len(fields)-1]
+		pid, err := strconv.Atoi(strings.SplitN(program, "/", 2)[0])
+		if err != nil {
+			continue
+		}
+		pids[connectionKey(fields[0], normalizeNetstatAddress(fields[3]), normalizeNetstatAddress(fields[4]))] = pid
+	}
+
+	return pids
+}
+
+// normalizeNetstatAddress converts an address printed by netstat to the same
+// form as those decoded from /proc/net.
+func normalizeNetstatAddress(address string) string {
+	index := strings.LastIndex(address, ":")
+	if index == -1 {
+		return address
+	}
+
+	host := strings.TrimPrefix(address[:index], "::ffff:")
+	port := address[index+1:]
+	if port == "*" {
+		port = "0"
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+
+	return net.JoinHostPort(host, port)
+}
+
+func connectionKey(proto, localAddr, remoteAddr string) string {
+	return fmt.Sprintf("%s %s %s", proto, localAddr, remoteAddr)
+}
+
+// procNetMutex protects the /proc/net files cached in the acquisition.
+var procNetMutex sync.Mutex
+
+// readProcNet returns the content of a /proc/net file from the device. It is
+// read only once per acquisition, as several modules look at the sockets.
+func readProcNet(acq *acquisition.Acquisition, proto string) (string, error) {
+	procNetMutex.Lock()
+	defer procNetMutex.Unlock()
+	if out, ok := acq.ProcNet[proto]; ok {
+		return out, nil
+	}
+
+	out, err := adb.Client.Shell("cat", fmt.Sprintf("/proc/net/%s", proto))
+	if err != nil {
+		return out, err
+	}
+	if acq.ProcNet == nil {
+		acq.ProcNet = make(map[string]string)
+	}
+	acq.ProcNet[proto] = out
+	return out, nil
+}
+
+// procNetHeaderRegexp matches the header preceding the content of each
+// /proc/net file in network_connections.txt.
+var procNetHeaderRegexp = regexp.MustCompile(`^==> /proc/net/(\w+) <==$`)
+
+// Restore loads the /proc/net files read by a previous run from its
+// network_connections.txt, so that the other modules see the same sockets.
+func (n *NetworkConnections) Restore(acq *acquisition.Acquisition) error {
+	data, err := os.ReadFile(filepath.Join(acq.StoragePath, "network_connections.txt"))
+	if err != nil {
+		return err
+	}
+
+	procNet := make(map[string]string)
+	proto := ""
+	var content []string
+	flush := func() {
+		if proto != "" {
+			procNet[proto] = strings.TrimSpace(strings.Join(content, "\n"))
+		}
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if match := procNetHeaderRegexp.FindStringSubmatch(line); match != nil {
+			flush()
+			proto = match[1]
+			content = nil
+			continue
+		}
+		content = append(content, line)
+	}
+	flush()
+
+	procNetMutex.Lock()
+	defer procNetMutex.Unlock()
+	acq.ProcNet = procNet
+	return nil
+}
+
+func (n *NetworkConnections) Run(acq *acquisition.Acquisition, fast bool) error {
+	log.Info("Collecting active network connections...")
+
+	var raw strings.Builder
+	connections := []NetworkConnection{}
+	for _, proto := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		out, err := readProcNet(acq, proto)
+		if err != nil {
+			log.Debugf("Failed to read /proc/net/%s: %v", proto, err)
+			continue
+		}
+
+		fmt.Fprintf(&raw, "==> /proc/net/%s <==\n%s\n\n", proto, out)
+		connections = append(connections, parseProcNet(proto, out)...)
+	}
+
+	err := saveCommandOutput(filepath.Join(n.StoragePath, "network_connections.txt"), raw.String())
+	if err != nil {
+		return err
+	}
+
+	pids := map[string]int{}
+	out, err := adb.Client.Shell("netstat", "-anp")
+	if err != nil && out == "" {
+		log.Debugf("Failed to run `adb shell netstat -anp`: %v", err)
+	} else {
+		err = saveCommandOutput(filepath.Join(n.StoragePath, "netstat.txt"), out)
+		if err != nil {
+			log.Errorf("Impossible to save netstat output: %v", err)
+		}
+		pids = parseNetstatPIDs(out)
+	}
+
+	uids := packagesByUID(acq)
+	for i := range connections {
+		conn := &connections[i]
+		conn.Packages = uids[conn.UID]
+		conn.PID = pids[connectionKey(conn.Proto, conn.LocalAddr, conn.RemoteAddr)]
+	}
+
+	return saveCommandOutputJson(filepath.Join(n.StoragePath, "network_connections.json"), &connections)
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"path/filepath"
+
+	"github.com/mvt-project/androidqf/acquisition"
+	"github.com/mvt-project/androidqf/adb"
+	"github.com/mvt-project/androidqf/log"
+	"github.com/mvt-project/androidqf/utils"
+)
+
+type PackageNetworkSecurity struct {
+	utils.NetworkSecurityConfig
+	PackageName string `json:"package_name"`
+	Error       string `json:"error,omitempty"`
+}
+
+type NetworkSecurityConfig struct {
+	StoragePath string
+}
+
+func NewNetworkSecurityConfig() *NetworkSecurityConfig {
+	return &NetworkSecurityConfig{}
+}
+
+func (n *NetworkSecurityConfig) Name() string {
+	return "network_security_config"
+}
+
+func (n *NetworkSecurityConfig) Dependencies() []string {
+	return []string{"packages"}
+}
+
+func (n *NetworkSecurityConfig) InitStorage(storagePath string) error {
+	n.StoragePath = storagePath
+	return nil
+}
+
+// baseAPK returns the local copy of the base APK of the package, which
+// holds the manifest, or an empty string if it wasn't downloaded.
+func baseAPK(acq *acquisition.Acquisition, pkg adb.Package) string {
+	for _, packageFile := range pkg.Files {
+		if packageFile.Type == adb.PackageFileBase && packageFile.LocalName != "" {
+			return filepath.Join(acq.StoragePath, filepath.FromSlash(packageFile.LocalName))
+		}
+	}
+	return ""
+}
+
+func (n *NetworkSecurityConfig) Run(acq *acquisition.Acquisition, fast bool) error {
+	log.Info("Extracting the Network Security Config of third-party apps...")
+
+	configs := []PackageNetworkSecurity{}
+	seen := make(map[string]bool)
+	skipped := 0
+	for _, pkg := range getPackages(acq) {
+		if !pkg.ThirdParty || seen[pkg.Name] {
+			continue
+		}
+		seen[pkg.Name] = true
+
+		// The APKs are only available if they were downloaded, and kept.
+		apkPath := baseAPK(acq, pkg)
+		if apkPath == "" {
+			skipped++
+			continue
+		}
+
+		config := PackageNetworkSecurity{PackageName: pkg.Name}
+		nsc, err := utils.ParseNetworkSecurityConfig(apkPath)
+		config.NetworkSecurityConfig = nsc
+		if err != nil {
+			log.Debugf("Failed to parse the Network Security Config of %s: %v", pkg.Name, err)
+			config.Error = err.Error()
+		}
+
+		if config.TrustUserCAs {
+			log.Warningf("WARNING: package %s trusts user-installed CA certificates", pkg.Name)
+		}
+		if config.PinsDisabled {
+			log.Warningf("WARNING: package %s disables certificate pinning for all domains", pkg.Name)
+		}
+		configs = append(configs, config)
+	}
+	if skipped > 0 {
+		log.Infof("Skipped %d third-party packages whose APK wasn't downloaded", skipped)
+	}
+
+	return saveCommandOutputJson(filepath.Join(n.StoragePath, "network_security_configs.json"), &configs)
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mvt-project/androidqf/acquisition"
+	"github.com/mvt-project/androidqf/adb"
+	"github.com/mvt-project/androidqf/log"
+)
+
+var (
+	// "Notification listeners:", "Listeners:" and similar section headers,
+	// which changed across Android versions.
+	listenersSectionRegexp = regexp.MustCompile(`(?i)^\s*(?:notification )?listeners(?: \(\d+\))?:`)
+	// "user:0", "user 0", "userId=0" or "UserHandle{0}".
+	listenerUserRegexp = regexp.MustCompile(`(?i)user(?:id=|:|\s|handle\{)\s*(\d+)`)
+	// Components are printed either flattened or as ComponentInfo{...}.
+	listenerComponentRegexp = regexp.MustCompile(`([\w.]+/[\w.$]+)`)
+	// "Archive (50 notifications):" or "Notification History:"
+	historySectionRegexp = regexp.MustCompile(`(?i)^\s*(?:archive \(|notification history)`)
+)
+
+type NotificationListener struct {
+	PackageName   string `json:"package_name"`
+	ComponentName string `json:"component_name"`
+	User          int    `json:"user"`
+	IsThirdParty  bool   `json:"is_third_party"`
+	IsSystem      bool   `json:"is_system"`
+	IsSideloaded  bool   `json:"is_sideloaded"`
+}
+
+type NotificationListeners struct {
+	StoragePath string
+}
+
+func NewNotificationListeners() *NotificationListeners {
+	return &NotificationListeners{}
+}
+
+func (n *NotificationListeners) Name() string {
+	return "notification_listeners"
+}
+
+func (n *NotificationListeners) Dependencies() []string {
+	return []string{"packages"}
+}
+
+func (n *NotificationListeners) InitStorage(storagePath string) error {
+	n.StoragePath = storagePath
+	return nil
+}
+
+// dumpSection returns the lines of the sections of the dump with a header
+// matching re, up to the next line indented as much as the header.
+func dumpSection(out string, re *regexp.Regexp) []string {
+	section := []string{}
+	lines := strings.Split(out, "\n")
+	for i := 0; i < len(lines); i++ {
+		if !re.MatchString(lines[i]) {
+			continue
+		}
+
+		section = append(section, lines[i])
+		indent := indentation(lines[i])
+		for i+1 < len(lines) {
+			next := lines[i+1]
+			if strings.TrimSpace(next) != "" && indentation(next) <= indent {
+				break
+			}
+			i++
+			section = append(section, next)
+		}
+	}
+	return section
+}
+
+// parseNotificationListeners returns the listeners for each user in the
+// listeners sections of `dumpsys notification`. Components which are
+// redacted on some Android versions are skipped.
+func parseNotificationListeners(out string) map[int][]string {
+	listeners := make(map[int][]string)
+	user := 0
+	for _, line := range dumpSection(out, listenersSectionRegexp) {
+		if match := listenerUserRegexp.FindStringSubmatch(line); match != nil {
+			user, _ = strconv.Atoi(match[1])
+		}
+		for _, match := range listenerComponentRegexp.FindAllStringSubmatch(line, -1) {
+			listeners[user] = appendUniqueString(listeners[user], match[1])
+		}
+	}
+	return listeners
+}
+
+func (n *NotificationListeners) Run(acq *acquisition.Acquisition, fast bool) error {
+	log.Info("Collecting notification listeners...")
+
+	users, err := adb.Client.GetUsers()
+	if err != nil {
+		log.Debugf("Failed to list users, only looking at the primary one: %v", err)
+	}
+
+	// The unredacted dump includes the content of the notifications, which
+	// is left out when messages have to be redacted.
+	out := ""
+	if !acq.RedactContent {
+		out, err = adb.Client.ShellTimeout(dumpsysServiceTimeout, "dumpsys", "notification", "--noredact")
+		if err != nil || strings.TrimSpace(out) == "" {
+			log.Debugf("Failed to run `dumpsys notification --noredact`, trying without: %v", err)
+			out = ""
+		}
+	}
+	if out == "" {
+		out, err = adb.Client.ShellTimeout(dumpsysServiceTimeout, "dumpsys", "notification")
+		if err != nil {
+			log.Debugf("Failed to run `dumpsys notification`: %v", err)
+		}
+	}
+	if out != "" {
+		err = saveCommandOutput(filepath.Join(n.StoragePath, "notification.txt"), out)
+		if err != nil {
+			log.Errorf("Impossible to save the notification dump: %v", err)
+		}
+	}
+	running := parseNotificationListeners(out)
+
+	packages := packageIndex(acq)
+	listeners := []NotificationListener{}
+	history := false
+	for _, user := range users {
+		setting, err := adb.Client.Shell("settings", "--user", fmt.Sprint(user.ID), "get", "secure", "enabled_notification_listeners")
+		if err != nil {
+			log.Errorf("Failed to get enabled notification listeners of user %d: %v", user.ID, err)
+		}
+
+		components := parseComponents(setting)
+		for _, component := range running[user.ID] {
+			components = appendUniqueString(components, component)
+		}
+
+		for _, component := range components {
+			listener := NotificationListener{
+				PackageName:   strings.SplitN(component, "/", 2)[0],
+				ComponentName: component,
+				User:          user.ID,
+			}
+			if pkg, ok := packages[fmt.Sprintf("%d/%s", user.ID, listener.PackageName)]; ok {
+				listener.IsThirdParty = pkg.ThirdParty
+				listener.IsSystem = pkg.System
+				listener.IsSideloaded = pkg.Sideloaded
+			}
+
+			if listener.IsSideloaded {
+				acq.AddWarning("Sideloaded app %s has access to notifications: %s",
+					listener.PackageName, listener.ComponentName)
+			} else if listener.IsThirdParty {
+				log.Warningf("Third-party app %s has access to notifications: %s",
+					listener.PackageName, listener.ComponentName)
+			}
+			listeners = append(listeners, listener)
+		}
+
+		enabled, _ := adb.Client.Shell("settings", "--user", fmt.Sprint(user.ID), "get", "secure", "notification_history_enabled")
+		if strings.TrimSpace(enabled) == "1" {
+			history = true
+		}
+	}
+
+	if history {
+		records := dumpSection(out, historySectionRegexp)
+		if len(records) > 0 {
+			err = saveCommandOutput(filepath.Join(n.StoragePath, "notification_history.txt"),
+				strings.Join(records, "\n"))
+			if err != nil {
+				log.Errorf("Impossible to save the notification history: %v", err)
+			}
+		}
+	}
+
+	return saveCommandOutputJson(filepath.Join(n.StoragePath, "notification_listeners.json"), &listeners)
+}
@@ -5,10 +5,16 @@
 package modules
 
 import (
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/manifoldco/promptui"
 	"github.com/mvt-project/androidqf/acquisition"
@@ -19,15 +25,30 @@ import (
 
 const (
 	apkAll           = "All"
+	apkThirdParty    = "Only third-party packages"
 	apkNotSystem     = "Only non-system packages"
 	apkNone          = "Do not download any"
 	apkRemoveTrusted = "Yes"
 	apkKeepAll       = "No"
 )
 
+// downloadPolicies maps the choices of the download prompt to the policies.
+var downloadPolicies = map[string]string{
+	apkAll:        acquisition.DownloadAll,
+	apkThirdParty: acquisition.DownloadThirdParty,
+	apkNotSystem:  acquisition.DownloadNotSystem,
+	apkNone:       acquisition.DownloadNone,
+}
+
 type Packages struct {
 	StoragePath string
 	ApksPath    string
+	// ManifestsPath is set when the manifests of the downloaded packages
+	// are decoded.
+	ManifestsPath string
+
+	manifestsMutex sync.Mutex
+	manifests      []utils.Manifest
 }
 
 func NewPackages() *Packages {
@@ -38,10 +59,20 @@ func (p *Packages) Name() string {
 	return "packages"
 }
 
+// Dependencies makes the backup prompt come first, as both modules ask the
+// user to make a choice.
+func (p *Packages) Dependencies() []string {
+	return []string{"backup"}
+}
+
+func (p *Packages) Outputs() []string {
+	return []string{"apks", "manifests"}
+}
+
 func (p *Packages) InitStorage(storagePath string) error {
 	p.StoragePath = storagePath
 	p.ApksPath = filepath.Join(storagePath, "apks")
-	err := os.Mkdir(p.ApksPath, 0o755)
+	err := os.MkdirAll(p.ApksPath, 0o755)
 	if err != nil {
 		return fmt.Errorf("failed to create apks folder: %v", err)
 	}
@@ -49,36 +80,388 @@ func (p *Packages) InitStorage(storagePath string) error {
 	return nil
 }
 
-func (p *Packages) getPathToLocalCopy(packageName, filePath string) string {
-	fileName := ""
-	if strings.Contains(filePath, "==/") {
-		fileName = fmt.Sprintf(
-			"_%s",
-			strings.Replace(strings.Split(filePath, "==/")[1], ".apk", "", 1),
-		)
+// shouldDownload checks whether the files of the package are downloaded
+// with the given policy.
+func shouldDownload(pkg *adb.Package, policy string) bool {
+	switch policy {
+	case acquisition.DownloadAll:
+		return true
+	case acquisition.DownloadThirdParty:
+		return pkg.ThirdParty
+	case acquisition.DownloadNotSystem:
+		return !pkg.System
+	default:
+		return false
+	}
+}
+
+// packageSize returns the total size in bytes of the files of the package.
+// Files whose size can't be determined are not counted.
+func packageSize(pkg *adb.Package) int64 {
+	var size int64
+	for _, packageFile := range pkg.Files {
+		fileSize, err := adb.Client.RemoteFileSize(packageFile.Path)
+		if err != nil {
+			log.Debugf("Failed to get size of %s: %v", packageFile.Path, err)
+			continue
+		}
+		size += fileSize
+	}
+	return size
+}
+
+// printPullProgress renders the download progress of a package file on a
+// single console line.
+func printPullProgress(current, count int, fileName string, done, total int64) {
+	line := fmt.Sprintf("[%d/%d packages] %s", current, count, fileName)
+	if total > 0 {
+		const width = 30
+		percent := done * 100 / total
+		if percent > 100 {
+			percent = 100
+		}
+		filled := int(width * percent / 100)
+		line = fmt.Sprintf("%s [%s%s] %3d%%", line,
+			strings.Repeat("#", filled), strings.Repeat(" ", width-filled), percent)
+	} else {
+		line = fmt.Sprintf("%s %d bytes", line, done)
+	}
+
+	fmt.Printf("\r%-100s", line)
+}
+
+// downloadPackage pulls the files of the package and verifies their
+// certificate. A failure is only logged, so that other packages can still be
+// downloaded.
+func (p *Packages) downloadPackage(pkg *adb.Package, keepOption string, progress func(file adb.PackageFile, done, total int64)) {
+	log.Debugf("Found Android package: %s", pkg.Name)
+
+	err := adb.Client.PullPackageAPKWithProgress(*pkg, p.StoragePath, p.ApksPath, progress)
+	if err != nil {
+		log.Debugf("ERROR: failed to download package %s: %v", pkg.Name, err)
+	}
+	for _, packageFile := range pkg.Files {
+		if packageFile.LocalName != "" {
+			pkg.Downloaded = true
+		}
+	}
+
+	for ipf := 0; ipf < len(pkg.Files); ipf++ {
+		packageFile := &pkg.Files[ipf]
+		if packageFile.LocalName == "" {
+			continue
+		}
+		localPath := filepath.Join(p.StoragePath, filepath.FromSlash(packageFile.LocalName))
+
+		log.Debugf("Downloaded %s to %s", packageFile.Path, localPath)
+
+		if p.ManifestsPath != "" && packageFile.Type == adb.PackageFileBase {
+			p.saveManifest(pkg.Name, localPath)
+		}
+
+		if utils.YaraEnabled() {
+			matches, err := utils.YaraScan(localPath)
+			if err != nil {
+				log.Errorf("Failed to scan %s with YARA: %v", localPath, err)
+			}
+			packageFile.YaraMatches = matches
+			if len(matches) > 0 {
+				log.Warningf("WARNING: %s of package %s matches YARA rules: %s",
+					filepath.Base(packageFile.Path), pkg.Name, strings.Join(matches, ", "))
+			}
+		}
+
+		// Check the certificate
+		verified, cert, signatures, err := utils.VerifyAPK(localPath)
+		packageFile.Signatures = signatures
+		schemes, schemesErr := utils.SignatureSchemes(localPath)
+		if schemesErr != nil {
+			log.Debugf("Failed to find the signature schemes of %s: %v", localPath, schemesErr)
+		}
+		packageFile.SignatureSchemeVersions = schemes
+		if cert == nil {
+			// Couldn't extract certificate
+			log.Debugf("Couldn't parse certificate for app %s", localPath)
+			packageFile.CertificateError = err.Error()
+			packageFile.VerifiedCertificate = false
+		} else {
+			packageFile.Certificate = *cert
+			packageFile.VerifiedCertificate = false
+			if err != nil {
+				// Extracted certificate but couldn't verify it
+				packageFile.CertificateError = err.Error()
+			} else {
+				packageFile.CertificateError = ""
+				packageFile.VerifiedCertificate = verified
+				if anchor := utils.TrustAnchor(*cert); anchor != "" {
+					packageFile.TrustedCertificate = true
+					packageFile.MatchedTrustAnchor = anchor
+					if keepOption == apkRemoveTrusted {
+						log.Debugf("Trusted APK removed: %s - %s",
+							localPath, packageFile.SHA256)
+						os.Remove(localPath)
+						// The package folder is only removed once empty.
+						os.Remove(filepath.Dir(localPath))
+						packageFile.LocalName = ""
+					}
+				}
+			}
+		}
+	}
+
+	checkSignatures(pkg)
+}
+
+// saveManifest decodes the manifest of the base APK of the package to
+// <package>_manifest.xml, and keeps its main fields for manifests.json.
+func (p *Packages) saveManifest(packageName, apkPath string) {
+	decoded, manifest, err := utils.DecodeManifest(apkPath)
+	if err != nil {
+		log.Debugf("Failed to decode the manifest of %s: %v", packageName, err)
+		return
+	}
+
+	err = saveCommandOutput(filepath.Join(p.ManifestsPath, packageName+"_manifest.xml"), string(decoded))
+	if err != nil {
+		log.Errorf("Failed to save the manifest of %s: %v", packageName, err)
+	}
+
+	p.manifestsMutex.Lock()
+	p.manifests = append(p.manifests, manifest)
+	p.manifestsMutex.Unlock()
+}
+
+// checkSignatures flags packages signed with test or debug keys, and those
+// whose split APKs are not signed with the same certificates.
+func checkSignatures(pkg *adb.Package) {
+	signers := ""
+	schemes := []int{}
+	for i, packageFile := range pkg.Files {
+		for _, scheme := range packageFile.SignatureSchemeVersions {
+			if !containsInt(schemes, scheme) {
+				schemes = append(schemes, scheme)
+			}
+		}
+
+		fingerprints := []string{}
+		for _, signature := range packageFile.Signatures {
+			if signature.TestKey || signature.DebugKey {
+				pkg.TestKeySigned = true
+			}
+			fingerprints = append(fingerprints, signature.SHA256)
+		}
+		if len(fingerprints) == 0 {
+			continue
+		}
+
+		sort.Strings(fingerprints)
+		current := strings.Join(fingerprints, ",")
+		if signers == "" {
+			signers = current
+		} else if signers != current {
+			pkg.SplitSignatureMismatch = true
+			log.Warningf("WARNING: %s of package %s is not signed with the same certificates as the other files",
+				filepath.Base(pkg.Files[i].Path), pkg.Name)
+		}
+	}
+
+	if pkg.TestKeySigned {
+		log.Warningf("WARNING: package %s is signed with a test or debug key", pkg.Name)
+	}
+
+	pkg.V1SignatureOnly = len(schemes) == 1 && schemes[0] == 1
+	if pkg.V1SignatureOnly && pkg.ThirdParty {
+		log.Warningf("WARNING: third-party package %s is only signed with the v1 signature scheme", pkg.Name)
+	}
+}
+
+// containsInt checks whether value is in values.
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// isDevelopmentInstall checks whether the package was installed with
+// `adb install`, as apps under development are expected to be debuggable.
+func isDevelopmentInstall(pkg *adb.Package) bool {
+	return pkg.Installer == "com.android.shell" || pkg.InstallingPackage == "com.android.shell"
+}
+
+// checkDebuggable flags non-system packages which are debuggable, and thus
+// expose a JDWP port, or test only, unless they were installed from adb.
+func checkDebuggable(pkg *adb.Package) {
+	if pkg.System || isDevelopmentInstall(pkg) {
+		return
+	}
+	if pkg.Debuggable {
+		log.Warningf("WARNING: package %s (user %d) is debuggable", pkg.Name, pkg.User)
+	}
+	if pkg.TestOnly {
+		log.Warningf("WARNING: package %s (user %d) is test only", pkg.Name, pkg.User)
+	}
+}
+
+// Detection is a package matching an indicator of compromise.
+type Detection struct {
+	utils.IOC
+	PackageName string `json:"package_name"`
+	User        int    `json:"user"`
+	Path        string `json:"path,omitempty"`
+}
+
+// YaraMatch lists the YARA rules matching a downloaded package file.
+type YaraMatch struct {
+	PackageName string   `json:"package_name"`
+	Path        string   `json:"path"`
+	LocalName   string   `json:"local_name"`
+	SHA256      string   `json:"sha256"`
+	Matches     []string `json:"matches"`
+}
+
+// saveYaraMatches consolidates the YARA matches of all packages in yara.json.
+func (p *Packages) saveYaraMatches(packages []adb.Package) error {
+	matches := []YaraMatch{}
+	seen := make(map[string]bool)
+	for _, pkg := range packages {
+		for _, packageFile := range pkg.Files {
+			if len(packageFile.YaraMatches) == 0 || seen[packageFile.Path] {
+				continue
+			}
+			seen[packageFile.Path] = true
+			matches = append(matches, YaraMatch{
+				PackageName: pkg.Name,
+				Path:        packageFile.Path,
+				LocalName:   packageFile.LocalName,
+				SHA256:      packageFile.SHA256,
+				Matches:     packageFile.YaraMatches,
+			})
+		}
+	}
+
+	return saveCommandOutputJson(filepath.Join(p.StoragePath, "yara.json"), &matches)
+}
+
+// checkIOCs matches the names and file hashes of the packages against the
+// loaded indicators, and saves the matches to detected.json. Failures are
+// only logged, so that the rest of the acquisition continues.
+func checkIOCs(acq *acquisition.Acquisition, packages []adb.Package) []Detection {
+	detections := []Detection{}
+	for _, pkg := range packages {
+		if ioc, ok := utils.MatchIOC(utils.IOCAppID, pkg.Name); ok {
+			detections = append(detections, Detection{IOC: ioc, PackageName: pkg.Name, User: pkg.User})
+		}
+		for _, packageFile := range pkg.Files {
+			if packageFile.SHA256 == "" {
+				continue
+			}
+			if ioc, ok := utils.MatchIOC(utils.IOCSHA256, packageFile.SHA256); ok {
+				detections = append(detections, Detection{IOC: ioc, PackageName: pkg.Name, User: pkg.User, Path: packageFile.Path})
+			}
+		}
+	}
+	if len(detections) == 0 {
+		return detections
+	}
+
+	for _, detection := range detections {
+		acq.AddWarning("DETECTED: package %s (user %d) matches indicator %s %q of %s from %s",
+			detection.PackageName, detection.User, detection.Type, detection.Value, detection.Name, detection.File)
+	}
+
+	err := saveCommandOutputJson(filepath.Join(acq.StoragePath, "detected.json"), &detections)
+	if err != nil {
+		log.Errorf("Failed to save detections: %v", err)
 	}
 
-	localPath := filepath.Join(p.ApksPath, fmt.Sprintf("%s%s.apk", packageName, fileName))
-	counter := 0
-	for {
-		if _, err := os.Stat(localPath); os.IsNotExist(err) {
-			break
+	return detections
+}
+
+// savePackagesCSV writes a row for each file of the packages to
+// packages.csv, as a convenience for triaging in a spreadsheet. Packages
+// without files get a single row.
+func (p *Packages) savePackagesCSV(packages []adb.Package, detections []Detection) error {
+	file, err := os.Create(filepath.Join(p.StoragePath, "packages.csv"))
+	if err != nil {
+		return fmt.Errorf("failed to create packages.csv: %v", err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	err = writer.Write([]string{
+		"package_name", "user", "path", "sha256", "installer", "system",
+		"third_party", "disabled", "certificate_subject", "trusted", "detections",
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, pkg := range packages {
+		files := pkg.Files
+		if len(files) == 0 {
+			files = []adb.PackageFile{{}}
+		}
+
+		for _, packageFile := range files {
+			hits := []string{}
+			for _, detection := range detections {
+				if detection.PackageName == pkg.Name && detection.User == pkg.User &&
+					(detection.Path == "" || detection.Path == packageFile.Path) {
+					hits = append(hits, fmt.Sprintf("ioc:%s:%s", detection.Type, detection.Name))
+				}
+			}
+			for _, match := range packageFile.YaraMatches {
+				hits = append(hits, "yara:"+match)
+			}
+
+			err = writer.Write([]string{
+				pkg.Name,
+				strconv.Itoa(pkg.User),
+				packageFile.Path,
+				packageFile.SHA256,
+				pkg.Installer,
+				strconv.FormatBool(pkg.System),
+				strconv.FormatBool(pkg.ThirdParty),
+				strconv.FormatBool(pkg.Disabled),
+				packageFile.Certificate.Subject,
+				strconv.FormatBool(packageFile.TrustedCertificate),
+				strings.Join(hits, "; "),
+			})
+			if err != nil {
+				return err
+			}
 		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
 
-		counter++
-		localPath = filepath.Join(
-			p.ApksPath,
-			fmt.Sprintf("%s%s_%d.apk", packageName, fileName, counter),
-		)
+// Restore loads the packages collected by a previous run from its
+// packages.json.
+func (p *Packages) Restore(acq *acquisition.Acquisition) error {
+	data, err := os.ReadFile(filepath.Join(acq.StoragePath, "packages.json"))
+	if err != nil {
+		return err
+	}
+	packages := []adb.Package{}
+	if err := json.Unmarshal(data, &packages); err != nil {
+		return fmt.Errorf("failed to parse packages.json: %v", err)
 	}
 
-	return localPath
+	packagesMutex.Lock()
+	defer packagesMutex.Unlock()
+	acq.Packages = packages
+	return nil
 }
 
 func (p *Packages) Run(acq *acquisition.Acquisition, fast bool) error {
 	log.Info("Collecting information on installed apps. This might take a while...")
 
-	packages, err := adb.Client.GetPackages(fast)
+	packages, err := adb.Client.GetPackages(fast, acq.Progress)
 	if err != nil {
 		return fmt.Errorf("failed to retrieve list of installed packages: %v", err)
 	}
@@ -87,83 +470,170 @@ func (p *Packages) Run(acq *acquisition.Acquisition, fast bool) error {
 		"Found a total of %d installed packages",
 		len(packages),
 	)
+	acq.Packages = packages
 
-	fmt.Println("Would you like to download copies of all apps or only non-system ones?")
-	downloadPrompt := promptui.Select{
-		Label: "Download",
-		Items: []string{apkAll, apkNotSystem, apkNone},
+	download := acq.DownloadPolicy
+	if download == "" && acq.PullAPKs {
+		download = acquisition.DownloadAll
 	}
-	_, download, err := downloadPrompt.Run()
-	if err != nil {
-		return fmt.Errorf("failed to make selection for download option: %v", err)
+	fromFlags := download != ""
+	if download == "" && fast {
+		log.Info("Fast mode enabled, skipping download of copies of apps")
+		download = acquisition.DownloadNone
+	} else if download == "" {
+		fmt.Println("Would you like to download copies of all apps, only third-party or non-system ones?")
+		downloadPrompt := promptui.Select{
+			Label: "Download",
+			Items: []string{apkAll, apkThirdParty, apkNotSystem, apkNone},
+		}
+		_, selected, err := downloadPrompt.Run()
+		if err != nil {
+			return fmt.Errorf("failed to make selection for download option: %v", err)
+		}
+		download = downloadPolicies[selected]
 	}
+	// Other modules follow the same policy.
+	acq.DownloadPolicy = download
 
 	// If the user decides to not download any APK, then we skip this.
 	// Otherwise we walk through the list of package, pull the files, and hash them.
-	if download != apkNone {
-
-		// Ask if the user want to remove trusted packages
-		fmt.Println("Would you like to remove copies of apps signed with a trusted certificate to limit the size of the output folder?")
-		promptAll := promptui.Select{
-			Label: "Remove",
-			Items: []string{apkRemoveTrusted, apkKeepAll},
+	if download != acquisition.DownloadNone {
+		if acq.ParseManifests {
+			p.ManifestsPath = filepath.Join(p.StoragePath, "manifests")
+			p.manifests = []utils.Manifest{}
+			err = os.MkdirAll(p.ManifestsPath, 0o755)
+			if err != nil {
+				return fmt.Errorf("failed to create manifests folder: %v", err)
+			}
 		}
-		_, keepOption, err := promptAll.Run()
-		if err != nil {
-			return fmt.Errorf("failed to make selection for download option: %v",
-				err)
+
+		// Ask if the user want to remove trusted packages, unless the
+		// download was requested from the command line.
+		keepOption := apkKeepAll
+		if !fromFlags {
+			fmt.Println("Would you like to remove copies of apps signed with a trusted certificate to limit the size of the output folder?")
+			promptAll := promptui.Select{
+				Label: "Remove",
+				Items: []string{apkRemoveTrusted, apkKeepAll},
+			}
+			_, keepOption, err = promptAll.Run()
+			if err != nil {
+				return fmt.Errorf("failed to make selection for download option: %v",
+					err)
+			}
 		}
 
-		for ip := 0; ip < len(packages); ip++ {
-			// If we the user did not request to download all packages and if
-			// the package is marked as system, we skip it.
-			if download != apkAll && packages[ip].System {
+		// Packages installed for several users share the same files, so
+		// they are only downloaded once.
+		toDownload := []int{}
+		first := make(map[string]int)
+		for ip := range packages {
+			if !shouldDownload(&packages[ip], download) {
+				continue
+			}
+			if _, ok := first[packages[ip].Name]; ok {
 				continue
 			}
+			first[packages[ip].Name] = ip
+			toDownload = append(toDownload, ip)
+		}
 
-			log.Debugf("Found Android package: %s", packages[ip].Name)
+		workers := adb.Client.PackageWorkers
+		if workers <= 0 {
+			workers = 1
+		}
 
-			for ipf := 0; ipf < len(packages[ip].Files); ipf++ {
-				packageFile := &packages[ip].Files[ipf]
-				localPath := p.getPathToLocalCopy(packages[ip].Name, packageFile.Path)
+		// Progress bars of concurrent downloads would overwrite each other,
+		// and would be mixed with the lines of the JSON log.
+		progressBar := workers == 1 && !log.Get().JSON
 
-				out, err := adb.Client.Pull(packageFile.Path, localPath)
-				if err != nil {
-					packageFile.Error = out
-					log.Debugf("ERROR: failed to download %s: %s", packageFile.Path, out)
-					continue
-				}
+		var completed int32
+		indexes := make(chan int)
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for ip := range indexes {
+					var progress func(file adb.PackageFile, done, total int64)
+					if progressBar {
+						current := int(atomic.LoadInt32(&completed)) + 1
+						progress = func(file adb.PackageFile, done, total int64) {
+							printPullProgress(current, len(toDownload), filepath.Base(file.Path), done, total)
+						}
+					}
 
-				log.Debugf("Downloaded %s to %s", packageFile.Path, localPath)
-
-				// Check the certificate
-				verified, cert, err := utils.VerifyCertificate(localPath)
-				if cert == nil {
-					// Couldn't extract certificate
-					log.Debugf("Couldn't parse certificate for app %s", localPath)
-					packageFile.CertificateError = err.Error()
-					packageFile.VerifiedCertificate = false
-				} else {
-					packageFile.Certificate = *cert
-					packageFile.VerifiedCertificate = false
-					if err != nil {
-						// Extracted certificate but couldn't verify it
-						packageFile.CertificateError = err.Error()
+					size := int64(0)
+					if acq.MaxAPKSize > 0 {
+						size = packageSize(&packages[ip])
+					}
+					if size > acq.MaxAPKSize {
+						log.Infof("Skipping download of package %s, its files are %d bytes", packages[ip].Name, size)
 					} else {
-						packageFile.CertificateError = ""
-						packageFile.VerifiedCertificate = verified
-						if utils.IsTrusted(*cert) {
-							packageFile.TrustedCertificate = true
-							if keepOption == apkRemoveTrusted {
-								log.Debugf("Trusted APK removed: %s - %s",
-									localPath, packageFile.SHA256)
-								os.Remove(localPath)
-							}
-						}
+						p.downloadPackage(&packages[ip], keepOption, progress)
+					}
+
+					current := atomic.AddInt32(&completed, 1)
+					if progressBar {
+						fmt.Println()
+					} else {
+						log.Infof("[%d/%d packages] %s", current, len(toDownload), packages[ip].Name)
 					}
 				}
+			}()
+		}
+		for _, ip := range toDownload {
+			indexes <- ip
+		}
+		close(indexes)
+		wg.Wait()
+
+		for ip := range packages {
+			if firstIndex, ok := first[packages[ip].Name]; ok && firstIndex != ip {
+				packages[ip].Files = append([]adb.PackageFile{}, packages[firstIndex].Files...)
+				packages[ip].Downloaded = packages[firstIndex].Downloaded
+			}
+		}
+
+		if utils.YaraEnabled() {
+			err = p.saveYaraMatches(packages)
+			if err != nil {
+				log.Errorf("Failed to save YARA matches: %v", err)
+			}
+		}
+
+		if p.ManifestsPath != "" {
+			sort.Slice(p.manifests, func(i, j int) bool {
+				return p.manifests[i].PackageName < p.manifests[j].PackageName
+			})
+			err = saveCommandOutputJson(filepath.Join(p.StoragePath, "manifests.json"), &p.manifests)
+			if err != nil {
+				log.Errorf("Failed to save manifests: %v", err)
 			}
 		}
+	} else if acq.ParseManifests {
+		log.Info("No apps were downloaded, skipping the parsing of their manifests")
+	}
+
+	sideloaded, uninstalled := 0, 0
+	for _, pkg := range packages {
+		checkDebuggable(&pkg)
+		if pkg.ThirdParty && pkg.Sideloaded {
+			sideloaded++
+		}
+		if pkg.UninstalledWithData {
+			uninstalled++
+		}
+	}
+	log.Infof("Found %d sideloaded third-party packages", sideloaded)
+	log.Infof("Found %d packages uninstalled with their data kept", uninstalled)
+
+	detections := checkIOCs(acq, packages)
+
+	// packages.json remains the complete output, the CSV is only a view.
+	err = p.savePackagesCSV(packages, detections)
+	if err != nil {
+		log.Errorf("Failed to save packages.csv: %v", err)
 	}
 
 	return saveCommandOutputJson(filepath.Join(p.StoragePath, "packages.json"), &packages)
@@ -0,0 +1,127 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mvt-project/androidqf/acquisition"
+	"github.com/mvt-project/androidqf/log"
+)
+
+// maxDangerousPermissions is the number of dangerous permissions above which
+// a third-party app is considered to hold a suspicious combination.
+const maxDangerousPermissions = 3
+
+// dangerousPermissions are the runtime permissions giving access to private
+// data or to the sensors of the device.
+var dangerousPermissions = map[string]bool{
+	"android.permission.ACCESS_BACKGROUND_LOCATION": true,
+	"android.permission.ACCESS_COARSE_LOCATION":     true,
+	"android.permission.ACCESS_FINE_LOCATION":       true,
+	"android.permission.ACCESS_MEDIA_LOCATION":      true,
+	"android.permission.ACTIVITY_RECOGNITION":       true,
+	"android.permission.ADD_VOICEMAIL":              true,
+	"android.permission.ANSWER_PHONE_CALLS":         true,
+	"android.permission.BODY_SENSORS":               true,
+	"android.permission.BODY_SENSORS_BACKGROUND":    true,
+	"android.permission.CALL_PHONE":                 true,
+	"android.permission.CAMERA":                     true,
+	"android.permission.GET_ACCOUNTS":               true,
+	"android.permission.PROCESS_OUTGOING_CALLS":     true,
+	"android.permission.READ_CALENDAR":              true,
+	"android.permission.READ_CALL_LOG":              true,
+	"android.permission.READ_CONTACTS":              true,
+	"android.permission.READ_EXTERNAL_STORAGE":      true,
+	"android.permission.READ_MEDIA_AUDIO":           true,
+	"android.permission.READ_MEDIA_IMAGES":          true,
+	"android.permission.READ_MEDIA_VIDEO":           true,
+	"android.permission.READ_PHONE_NUMBERS":         true,
+	"android.permission.READ_PHONE_STATE":           true,
+	"android.permission.READ_SMS":                   true,
+	"android.permission.RECEIVE_MMS":                true,
+	"android.permission.RECEIVE_SMS":                true,
+	"android.permission.RECEIVE_WAP_PUSH":           true,
+	"android.permission.RECORD_AUDIO":               true,
+	"android.permission.SEND_SMS":                   true,
+	"android.permission.USE_SIP":                    true,
+	"android.permission.WRITE_CALENDAR":             true,
+	"android.permission.WRITE_CALL_LOG":             true,
+	"android.permission.WRITE_CONTACTS":             true,
+	"android.permission.WRITE_EXTERNAL_STORAGE":     true,
+}
+
+type RuntimePermissions struct {
+	StoragePath string
+}
+
+func NewRuntimePermissions() *RuntimePermissions {
+	return &RuntimePermissions{}
+}
+
+func (r *RuntimePermissions) Name() string {
+	return "runtime_permissions"
+}
+
+func (r *RuntimePermissions) Dependencies() []string {
+	return []string{"packages"}
+}
+
+func (r *RuntimePermissions) InitStorage(storagePath string) error {
+	r.StoragePath = storagePath
+	return nil
+}
+
+// Run reuses the runtime permissions parsed from `dumpsys package` by the
+// packages module, instead of dumping every package again. Permissions granted
+// to a package for any user are all listed under its name.
+func (r *RuntimePermissions) Run(acq *acquisition.Acquisition, fast bool) error {
+	log.Info("Collecting granted runtime permissions...")
+
+	granted := make(map[string][]string)
+	thirdParty := make(map[string]bool)
+	for _, pkg := range getPackages(acq) {
+		if _, ok := granted[pkg.Name]; !ok {
+			granted[pkg.Name] = []string{}
+		}
+		if pkg.ThirdParty {
+			thirdParty[pkg.Name] = true
+		}
+
+		// Entries are in the form "android.permission.CAMERA: granted=true, flags=[ ... ]".
+		for _, item := range pkg.RuntimePermissions {
+			permission := strings.TrimSpace(strings.SplitN(item, ":", 2)[0])
+			granted[pkg.Name] = appendUniqueString(granted[pkg.Name], permission)
+		}
+	}
+
+	names := make([]string, 0, len(granted))
+	for name := range granted {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		// System apps, such as the dialer, legitimately hold many of them.
+		if !thirdParty[name] {
+			continue
+		}
+
+		dangerous := []string{}
+		for _, permission := range granted[name] {
+			if dangerousPermissions[permission] {
+				dangerous = append(dangerous, strings.TrimPrefix(permission, "android.permission."))
+			}
+		}
+		if len(dangerous) > maxDangerousPermissions {
+			log.Warningf("Third-party app %s was granted %d dangerous permissions: %s",
+				name, len(dangerous), strings.Join(dangerous, ", "))
+		}
+	}
+
+	return saveCommandOutputJson(filepath.Join(r.StoragePath, "runtime_permissions.json"), &granted)
+}
@@ -7,12 +7,69 @@ package modules
 import (
 	"fmt"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/mvt-project/androidqf/acquisition"
 	"github.com/mvt-project/androidqf/adb"
 	"github.com/mvt-project/androidqf/log"
 )
 
+// Locations from which a legitimate process is not expected to run.
+var suspiciousProcessPaths = []string{
+	"/data/local/tmp/",
+	"/sdcard/",
+}
+
+// Names of the Android system users, as found in the legacy ps output.
+var androidUsers = map[string]int{
+	"root":      0,
+	"system":    1000,
+	"radio":     1001,
+	"bluetooth": 1002,
+	"graphics":  1003,
+	"input":     1004,
+	"audio":     1005,
+	"camera":    1006,
+	"log":       1007,
+	"compass":   1008,
+	"mount":     1009,
+	"wifi":      1010,
+	"adb":       1011,
+	"install":   1012,
+	"media":     1013,
+	"dhcp":      1014,
+	"drm":       1019,
+	"mdnsr":     1020,
+	"gps":       1021,
+	"nfc":       1027,
+	"keystore":  1017,
+	"shell":     2000,
+	"nobody":    9999,
+}
+
+// psColumns are the columns collected with `ps -o`. NAME is last because
+// it might contain spaces.
+const psColumns = "USER,UID,PID,PPID,VSZ,RSS,WCHAN,ADDR,S,LABEL,NAME"
+
+type Process struct {
+	PID         int      `json:"pid"`
+	PPID        int      `json:"ppid"`
+	UID         int      `json:"uid"`
+	User        string   `json:"user"`
+	Name        string   `json:"name"`
+	CommandLine string   `json:"command_line"`
+	Executable  string   `json:"executable"`
+	VSZ         int64    `json:"vsz"`
+	RSS         int64    `json:"rss"`
+	WChan       string   `json:"wchan"`
+	Address     string   `json:"address"`
+	State       string   `json:"state"`
+	Label       string   `json:"label"`
+	Packages    []string `json:"packages"`
+	Suspicious  bool     `json:"suspicious"`
+}
+
 type Processes struct {
 	StoragePath string
 }
@@ -25,26 +82,239 @@ func (p *Processes) Name() string {
 	return "processes"
 }
 
+func (p *Processes) Dependencies() []string {
+	return []string{"packages"}
+}
+
 func (p *Processes) InitStorage(storagePath string) error {
 	p.StoragePath = storagePath
 	return nil
 }
 
+// userToUID converts an Android user name, such as u0_a123, to its UID.
+func userToUID(user string) (int, bool) {
+	if uid, ok := androidUsers[user]; ok {
+		return uid, true
+	}
+
+	var userID, appID int
+	if _, err := fmt.Sscanf(user, "u%d_a%d", &userID, &appID); err == nil {
+		return userID*100000 + 10000 + appID, true
+	}
+	if _, err := fmt.Sscanf(user, "u%d_i%d", &userID, &appID); err == nil {
+		return userID*100000 + 99000 + appID, true
+	}
+
+	return 0, false
+}
+
+// parsePs parses the output of ps, mapping the values to the columns named
+// in the header since their order and presence differ between the Android
+// releases. The last column, NAME, takes the rest of the line.
+func parsePs(out string) []Process {
+	processes := []Process{}
+	lines := strings.Split(strings.ReplaceAll(out, "\r\n", "\n"), "\n")
+	if len(lines) == 0 {
+		return processes
+	}
+
+	header := strings.Fields(lines[0])
+	// The legacy toolbox ps of Android 6 and older prints the state after
+	// PC without naming it in the header.
+	for i, column := range header {
+		if column == "PC" && i+1 < len(header) && header[i+1] != "S" {
+			header = append(header[:i+1], append([]string{"S"}, header[i+1:]...)...)
+			break
+		}
+	}
+	if len(header) == 0 {
+		return processes
+	}
+
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < len(header) {
+			continue
+		}
+
+		values := make(map[string]string)
+		for i, column := range header[:len(header)-1] {
+			values[column] = fields[i]
+		}
+		values[header[len(header)-1]] = strings.Join(fields[len(header)-1:], " ")
+
+		var proc Process
+		var err error
+		proc.PID, err = strconv.Atoi(values["PID"])
+		if err != nil {
+			continue
+		}
+		proc.PPID, _ = strconv.Atoi(values["PPID"])
+		proc.User = values["USER"]
+		if uid, ok := values["UID"]; ok {
+			proc.UID, _ = strconv.Atoi(uid)
+		} else {
+			proc.UID, _ = userToUID(proc.User)
+		}
+		proc.Name = values["NAME"]
+		proc.CommandLine = proc.Name
+		if vsz, ok := values["VSZ"]; ok {
+			proc.VSZ, _ = strconv.ParseInt(vsz, 10, 64)
+		} else {
+			proc.VSZ, _ = strconv.ParseInt(values["VSIZE"], 10, 64)
+		}
+		proc.RSS, _ = strconv.ParseInt(values["RSS"], 10, 64)
+		proc.WChan = values["WCHAN"]
+		if addr, ok := values["ADDR"]; ok {
+			proc.Address = addr
+		} else {
+			proc.Address = values["PC"]
+		}
+		proc.State = values["S"]
+		proc.Label = values["LABEL"]
+
+		processes = append(processes, proc)
+	}
+
+	return processes
+}
+
+// parseProcDetails parses the output of procDetailsScript, in the form
+// "pid|exe|cmdline".
+func parseProcDetails(out string) map[int][2]string {
+	details := make(map[int][2]string)
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(strings.TrimRight(line, "\r"), "|", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		pid, err := strconv.Atoi(parts[0])
+		if err != nil {
+			continue
+		}
+		details[pid] = [2]string{parts[1], strings.TrimSpace(parts[2])}
+	}
+	return details
+}
+
+// procDetailsScript prints the executable and the full command line of every
+// process, which are only readable as root.
+const procDetailsScript = `for p in /proc/[0-9]*; do echo "${p#/proc/}|$(readlink $p/exe)|$(tr '\0' ' ' < $p/cmdline 2>/dev/null)"; done`
+
+// isSuspiciousProcess checks whether the process runs from a location from
+// which a legitimate process is not expected to.
+func isSuspiciousProcess(proc *Process) bool {
+	for _, path := range suspiciousProcessPaths {
+		if strings.HasPrefix(proc.Name, path) || strings.HasPrefix(proc.CommandLine, path) ||
+			strings.HasPrefix(proc.Executable, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// collectorProcesses converts the processes listed by the collector, which
+// already include the full command line and executable.
+func collectorProcesses(infos []adb.ProcessInfo) []Process {
+	processes := []Process{}
+	for _, info := range infos {
+		proc := Process{
+			PID:         int(info.Pid),
+			PPID:        int(info.Ppid),
+			UID:         int(info.Uid),
+			Name:        info.Filename,
+			CommandLine: strings.TrimSpace(strings.Join(info.CommandLine, " ")),
+			Executable:  info.Path,
+			State:       info.State,
+			Label:       info.Context,
+		}
+		if proc.CommandLine == "" {
+			proc.CommandLine = proc.Name
+		}
+		processes = append(processes, proc)
+	}
+	return processes
+}
+
+// psProcesses lists the processes with ps, saving its output to
+// processes.txt.
+func (p *Processes) psProcesses() ([]Process, error) {
+	out, err := adb.Client.Shell("ps", "-A", "-o", psColumns)
+	if err != nil || !strings.HasPrefix(out, "USER") || !strings.Contains(strings.SplitN(out, "\n", 2)[0], "LABEL") {
+		// Older versions of Android only support the plain ps.
+		log.Debugf("Failed to run `adb shell ps -A -o`, falling back to `ps`: %v", err)
+		out, err = adb.Client.Shell("ps")
+		if err != nil {
+			return nil, fmt.Errorf("failed to run `adb shell ps`: %v", err)
+		}
+	}
+
+	err = saveCommandOutput(filepath.Join(p.StoragePath, "processes.txt"), out)
+	if err != nil {
+		return nil, err
+	}
+
+	processes := parsePs(out)
+
+	// The name is truncated by ps, the full command line and the executable
+	// can be resolved as root.
+	if adb.Client.HasRoot() {
+		detailsOut, err := adb.Client.ShellAsRoot(procDetailsScript)
+		if err != nil {
+			log.Debugf("Failed to read the command lines of the processes: %v", err)
+			return processes, nil
+		}
+		details := parseProcDetails(detailsOut)
+		for i := range processes {
+			if detail, ok := details[processes[i].PID]; ok {
+				processes[i].Executable = detail[0]
+				if detail[1] != "" {
+					processes[i].CommandLine = detail[1]
+				}
+			}
+		}
+	}
+
+	return processes, nil
+}
+
 func (p *Processes) Run(acq *acquisition.Acquisition, fast bool) error {
 	log.Info("Collecting list of running processes...")
 
-	if acq.Collector == nil {
-		out, err := adb.Client.Shell("ps -A")
+	// The raw output of ps is always kept, the collector provides more
+	// details when it is available.
+	processes, err := p.psProcesses()
+	if err != nil && acq.Collector == nil {
+		return err
+	} else if err != nil {
+		log.Debugf("Failed to list processes with ps: %v", err)
+	}
+
+	if acq.Collector != nil {
+		infos, err := acq.Collector.Processes()
 		if err != nil {
-			return fmt.Errorf("failed to run `adb shell ps -A`: %v", err)
+			log.Debugf("Failed to list processes with the collector: %v", err)
+		} else {
+			err = saveCommandOutputJson(filepath.Join(p.StoragePath, "processes_collector.json"), &infos)
+			if err != nil {
+				log.Errorf("Impossible to save the processes listed by the collector: %v", err)
+			}
+			processes = collectorProcesses(infos)
 		}
+	}
+	if processes == nil {
+		return fmt.Errorf("failed to list running processes")
+	}
 
-		return saveCommandOutput(filepath.Join(p.StoragePath, "processes.txt"), out)
-	} else {
-		out, err := acq.Collector.Processes()
-		if err != nil {
-			return err
+	uids := packagesByUID(acq)
+	for i := range processes {
+		processes[i].Packages = uids[processes[i].UID]
+		processes[i].Suspicious = isSuspiciousProcess(&processes[i])
+		if processes[i].Suspicious {
+			log.Warningf("Found process %s (PID %d) running from a suspicious location",
+				processes[i].Name, processes[i].PID)
 		}
-		return saveCommandOutputJson(filepath.Join(p.StoragePath, "processes.txt"), &out)
 	}
+
+	return saveCommandOutputJson(filepath.Join(p.StoragePath, "processes.json"), &processes)
 }
@@ -0,0 +1,124 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"testing"
+
+	"github.com/mvt-project/androidqf/adb"
+)
+
+// Toolbox ps of Android 6, which doesn't name the state column.
+const legacyPs = `USER      PID   PPID  VSIZE  RSS   WCHAN              PC  NAME
+root      1     0     8904   784   SyS_epoll_ 00000000 S /init
+system    812   300   1634040 95432 SyS_epoll_ 00000000 S system_server
+u0_a12    4242  300   1520000 60000 SyS_epoll_ 00000000 S com.example.app
+shell     5555  5000  12345  2000  0          00000000 R /data/local/tmp/frida-server
+`
+
+// Toybox ps of Android 8 and later, with the columns requested by the
+// module.
+const modernPs = `USER            UID   PID  PPID      VSZ    RSS WCHAN            ADDR S LABEL                          NAME
+root              0     1     0 10782796  11240 0                   0 S u:r:init:s0                    init
+system         1000   812   300 16340400  95432 do_epoll_wait       0 S u:r:system_server:s0           system_server
+u0_a150       10150  4321   800 14829580 102400 0                   0 S u:r:untrusted_app:s0:c150,c256 com.example.app
+shell          2000  5555  5000    12345   2000 0                   0 R u:r:shell:s0                   /data/local/tmp/frida-server --listen 0.0.0.0
+`
+
+func TestParsePs(t *testing.T) {
+	tests := []struct {
+		name  string
+		out   string
+		count int
+		want  Process
+	}{
+		{
+			name:  "legacy",
+			out:   legacyPs,
+			count: 4,
+			want: Process{
+				PID: 4242, PPID: 300, UID: 10012, User: "u0_a12", Name: "com.example.app",
+				CommandLine: "com.example.app", VSZ: 1520000, RSS: 60000, WChan: "SyS_epoll_",
+				Address: "00000000", State: "S",
+			},
+		},
+		{
+			name:  "modern",
+			out:   modernPs,
+			count: 4,
+			want: Process{
+				PID: 4321, PPID: 800, UID: 10150, User: "u0_a150", Name: "com.example.app",
+				CommandLine: "com.example.app", VSZ: 14829580, RSS: 102400, WChan: "0",
+				Address: "0", State: "S", Label: "u:r:untrusted_app:s0:c150,c256",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			processes := parsePs(test.out)
+			if len(processes) != test.count {
+				t.Fatalf("got %d processes, want %d", len(processes), test.count)
+			}
+			got := processes[2]
+			if got.PID != test.want.PID || got.PPID != test.want.PPID || got.UID != test.want.UID ||
+				got.User != test.want.User || got.Name != test.want.Name ||
+				got.CommandLine != test.want.CommandLine || got.VSZ != test.want.VSZ ||
+				got.RSS != test.want.RSS || got.WChan != test.want.WChan ||
+				got.Address != test.want.Address || got.State != test.want.State ||
+				got.Label != test.want.Label {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+
+			// The name keeps its arguments, and the process runs from a
+			// suspicious location.
+			last := processes[3]
+			if !isSuspiciousProcess(&last) {
+				t.Errorf("process %q not flagged as suspicious", last.Name)
+			}
+			if isSuspiciousProcess(&got) {
+				t.Errorf("process %q flagged as suspicious", got.Name)
+			}
+		})
+	}
+
+	if got := parsePs(modernPs)[3].Name; got != "/data/local/tmp/frida-server --listen 0.0.0.0" {
+		t.Errorf("got name %q with its arguments", got)
+	}
+}
+
+func TestParseProcDetails(t *testing.T) {
+	details := parseProcDetails("1|/system/bin/init|/system/bin/init second_stage \n" +
+		"4321|/system/bin/app_process64|com.example.app\n" +
+		"garbage\n")
+	if len(details) != 2 {
+		t.Fatalf("got %d entries, want 2", len(details))
+	}
+	if details[1] != [2]string{"/system/bin/init", "/system/bin/init second_stage"} {
+		t.Errorf("got %v for PID 1", details[1])
+	}
+}
+
+func TestCollectorProcesses(t *testing.T) {
+	processes := collectorProcesses([]adb.ProcessInfo{{
+		Pid:         5555,
+		Ppid:        5000,
+		Uid:         2000,
+		Filename:    "frida-server",
+		Path:        "/data/local/tmp/frida-server",
+		CommandLine: []string{"/data/local/tmp/frida-server", "-l", "0.0.0.0"},
+		Context:     "u:r:shell:s0",
+	}})
+	if len(processes) != 1 {
+		t.Fatalf("got %d processes, want 1", len(processes))
+	}
+	proc := processes[0]
+	if proc.CommandLine != "/data/local/tmp/frida-server -l 0.0.0.0" || proc.Label != "u:r:shell:s0" {
+		t.Errorf("got %+v", proc)
+	}
+	if !isSuspiciousProcess(&proc) {
+		t.Errorf("collector process not flagged as suspicious")
+	}
+}
@@ -7,6 +7,7 @@ package modules
 
 import (
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/mvt-project/androidqf/acquisition"
@@ -14,6 +15,92 @@ import (
 	"github.com/mvt-project/androidqf/log"
 )
 
+// rootBinaryPaths are the locations where su, Magisk and busybox are
+// installed by the common rooting tools.
+var rootBinaryPaths = []string{
+	"/system/bin/su",
+	"/system/xbin/su",
+	"/sbin/su",
+	"/su/bin/su",
+	"/system/sbin/su",
+	"/vendor/bin/su",
+	"/data/local/su",
+	"/data/local/bin/su",
+	"/data/local/xbin/su",
+	"/data/local/tmp/su",
+	"/system/bin/magisk",
+	"/sbin/magisk",
+	"/debug_ramdisk/magisk",
+	"/data/adb/magisk",
+	"/sbin/.magisk",
+	"/system/xbin/busybox",
+	"/system/bin/busybox",
+	"/sbin/busybox",
+	"/data/local/busybox",
+	"/system/xbin/daemonsu",
+	"/system/app/Superuser.apk",
+	"/system/app/SuperSU.apk",
+}
+
+// rootManagers are the packages of the apps managing root access.
+var rootManagers = map[string]string{
+	"com.topjohnwu.magisk":       "Magisk",
+	"io.github.huskydg.magisk":   "Magisk Delta",
+	"me.weishu.kernelsu":         "KernelSU",
+	"eu.chainfire.supersu":       "SuperSU",
+	"com.koushikdutta.superuser": "Superuser",
+	"com.noshufou.android.su":    "Superuser",
+	"com.thirdparty.superuser":   "Superuser",
+	"com.kingroot.kinguser":      "KingRoot",
+	"com.kingo.root":             "KingoRoot",
+	"com.kingouser.com":          "KingoRoot",
+	"com.zhiqupk.root.global":    "One Click Root",
+	"com.alephzain.framaroot":    "Framaroot",
+}
+
+// Status of a probed path.
+const (
+	rootBinaryFound            = "found"
+	rootBinaryNotFound         = "not_found"
+	rootBinaryPermissionDenied = "permission_denied"
+)
+
+// Severity of the root indicators. Binaries and mounts show that root is
+// available, while an installed manager app or busybox alone do not.
+const (
+	rootSeverityHigh   = "high"
+	rootSeverityMedium = "medium"
+	rootSeverityLow    = "low"
+)
+
+type RootIndicator struct {
+	Type     string `json:"type"`
+	Path     string `json:"path"`
+	Severity string `json:"severity"`
+}
+
+type RootBinary struct {
+	Path        string `json:"path"`
+	Status      string `json:"status"`
+	Size        int64  `json:"size,omitempty"`
+	Permissions string `json:"permissions,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+type RootManager struct {
+	PackageName string `json:"package_name"`
+	Name        string `json:"name"`
+	User        int    `json:"user"`
+}
+
+type RootBinariesResult struct {
+	// InPath are the root binaries found in the PATH by `command -v`.
+	InPath   []string      `json:"in_path"`
+	Binaries []RootBinary  `json:"binaries"`
+	Managers []RootManager `json:"managers"`
+}
+
 type RootBinaries struct {
 	StoragePath string
 }
@@ -26,11 +113,93 @@ func (r *RootBinaries) Name() string {
 	return "root_binaries"
 }
 
+func (r *RootBinaries) Dependencies() []string {
+	return []string{"packages"}
+}
+
 func (r *RootBinaries) InitStorage(storagePath string) error {
 	r.StoragePath = storagePath
 	return nil
 }
 
+// probeStatus returns the status of a path from the error printed by stat,
+// ls or sha256sum.
+func probeStatus(out string) string {
+	switch {
+	case strings.Contains(out, "No such file"):
+		return rootBinaryNotFound
+	case strings.Contains(out, "Permission denied"):
+		return rootBinaryPermissionDenied
+	}
+	return ""
+}
+
+// probeRootBinary checks whether the file exists, and collects its size,
+// permissions and SHA-256 if it does.
+func probeRootBinary(path string) RootBinary {
+	binary := RootBinary{Path: path}
+
+	out, err := adb.Client.Shell("stat", "-c", "'%s %A'", path)
+	if err != nil && strings.Contains(out, "not found") {
+		// Old versions of Android lack stat.
+		out, err = adb.Client.Shell("ls", "-l", path)
+	}
+	if status := probeStatus(out); status != "" {
+		binary.Status = status
+		return binary
+	}
+	if err != nil {
+		binary.Status = rootBinaryFound
+		binary.Error = strings.TrimSpace(out)
+		return binary
+	}
+
+	binary.Status = rootBinaryFound
+	fields := strings.Fields(out)
+	if len(fields) == 2 {
+		binary.Size, _ = strconv.ParseInt(fields[0], 10, 64)
+		binary.Permissions = fields[1]
+	} else if len(fields) > 0 {
+		binary.Permissions = fields[0]
+	}
+
+	out, err = adb.Client.Shell("sha256sum", path)
+	if err != nil {
+		binary.Error = strings.TrimSpace(out)
+	} else if fields := strings.Fields(out); len(fields) > 0 {
+		binary.SHA256 = fields[0]
+	}
+
+	return binary
+}
+
+// binarySeverity returns the severity of finding the binary at the path.
+func binarySeverity(path string) string {
+	if strings.Contains(path, "busybox") {
+		return rootSeverityLow
+	}
+	return rootSeverityHigh
+}
+
+// magiskMounts returns the mount points in /proc/mounts set up by Magisk,
+// such as its tmpfs on /sbin or /debug_ramdisk.
+func magiskMounts() []string {
+	out, err := adb.Client.Shell("cat", "/proc/mounts")
+	if err != nil {
+		log.Debugf("Failed to read /proc/mounts: %v", err)
+		return []string{}
+	}
+
+	mounts := []string{}
+	for _, mount := range parseProcMounts(out) {
+		if strings.Contains(strings.ToLower(mount.Device), "magisk") ||
+			strings.Contains(mount.MountPoint, ".magisk") {
+			mounts = appendUniqueString(mounts, mount.MountPoint)
+		}
+	}
+	return mounts
+}
+
 func (r *RootBinaries) Run(acq *acquisition.Acquisition, fast bool) error {
 	log.Info("Checking for traces of rooting")
 	root_binaries := []string{
@@ -45,22 +214,79 @@ func (r *RootBinaries) Run(acq *acquisition.Acquisition, fast bool) error {
 		"magiskinit",
 		"magiskpolicy",
 	}
-	found_root_binaries := []string{}
+
+	result := RootBinariesResult{
+		InPath:   []string{},
+		Binaries: []RootBinary{},
+		Managers: []RootManager{},
+	}
+	indicators := []RootIndicator{}
 	for _, binary := range root_binaries {
-		out, err := adb.Client.Shell("which -a ", binary)
+		out, err := adb.Client.Shell("command", "-v", binary)
 		if err != nil {
 			// returns 1 if file not found, ignore
 			continue
 		}
-		if out == "" {
+		if out == "" || strings.Contains(out, "not found") {
 			continue
 		}
-		if strings.Contains(out, "which: not found") {
+		log.Warningf("Found root binary: %s", out)
+		result.InPath = append(result.InPath, out)
+		indicators = append(indicators, RootIndicator{
+			Type:     "binary_in_path",
+			Path:     out,
+			Severity: binarySeverity(out),
+		})
+	}
+
+	for _, path := range rootBinaryPaths {
+		binary := probeRootBinary(path)
+		switch binary.Status {
+		case rootBinaryFound:
+			log.Warningf("Found root binary: %s", path)
+			indicators = append(indicators, RootIndicator{
+				Type:     "binary",
+				Path:     path,
+				Severity: binarySeverity(path),
+			})
+		case rootBinaryPermissionDenied:
+			log.Debugf("Permission denied checking for root binary %s", path)
+		}
+		result.Binaries = append(result.Binaries, binary)
+	}
+
+	for _, pkg := range getPackages(acq) {
+		name, ok := rootManagers[pkg.Name]
+		if !ok {
 			continue
 		}
-		log.Debugf("Found root binary: %s", out)
-		found_root_binaries = append(found_root_binaries, out)
+		log.Warningf("Found root manager app %s (%s) installed for user %d", name, pkg.Name, pkg.User)
+		result.Managers = append(result.Managers, RootManager{
+			PackageName: pkg.Name,
+			Name:        name,
+			User:        pkg.User,
+		})
+		indicators = append(indicators, RootIndicator{
+			Type:     "package",
+			Path:     pkg.Name,
+			Severity: rootSeverityMedium,
+		})
+	}
+
+	for _, mount := range magiskMounts() {
+		log.Warningf("Found Magisk mount on %s", mount)
+		indicators = append(indicators, RootIndicator{
+			Type:     "mount",
+			Path:     mount,
+			Severity: rootSeverityHigh,
+		})
+	}
+
+	acq.RootIndicators = len(indicators)
+	err := saveCommandOutputJson(filepath.Join(r.StoragePath, "root_indicators.json"), &indicators)
+	if err != nil {
+		return err
 	}
 
-	return saveCommandOutputJson(filepath.Join(r.StoragePath, "root_binaries.json"), &found_root_binaries)
+	return saveCommandOutputJson(filepath.Join(r.StoragePath, "root_binaries.json"), &result)
 }
@@ -0,0 +1,250 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/mvt-project/androidqf/acquisition"
+)
+
+// DependentModule is implemented by modules which need other modules to
+// complete before they start, for example to reuse the packages collected.
+type DependentModule interface {
+	Dependencies() []string
+}
+
+// OutputModule is implemented by modules which store their files in folders
+// of their own, relative to the acquisition folder.
+type OutputModule interface {
+	Outputs() []string
+}
+
+// RestorableModule is implemented by modules sharing what they collected
+// with the other modules through the acquisition. When the module completed
+// in a previous run, Restore loads it back from the output of the module.
+type RestorableModule interface {
+	Restore(acq *acquisition.Acquisition) error
+}
+
+// ModuleRunner runs modules on a pool of workers, starting each module once
+// the modules it depends on are done. Modules which are ready at the same
+// time are started in the order they were given.
+type ModuleRunner struct {
+	Workers int
+
+	modules    []Module
+	dependents map[string][]int
+	pending    []int
+}
+
+// NewModuleRunner checks the dependencies and the outputs of the modules,
+// and returns a runner for them. Dependencies on modules which aren't part
+// of mods are ignored, so that modules can still be run on their own.
+func NewModuleRunner(mods []Module, workers int) (*ModuleRunner, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	r := &ModuleRunner{
+		Workers:    workers,
+		modules:    mods,
+		dependents: make(map[string][]int),
+		pending:    make([]int, len(mods)),
+	}
+
+	known := make(map[string]bool)
+	for _, mod := range List() {
+		known[mod.Name()] = true
+	}
+	selected := make(map[string]bool)
+	for _, mod := range mods {
+		selected[mod.Name()] = true
+	}
+
+	deps := make(map[string][]string)
+	for i, mod := range mods {
+		dependent, ok := mod.(DependentModule)
+		if !ok {
+			continue
+		}
+		for _, dep := range dependent.Dependencies() {
+			if !known[dep] {
+				return nil, fmt.Errorf("module %s depends on unknown module %s", mod.Name(), dep)
+			}
+			if !selected[dep] {
+				continue
+			}
+			deps[mod.Name()] = append(deps[mod.Name()], dep)
+			r.dependents[dep] = append(r.dependents[dep], i)
+			r.pending[i]++
+		}
+	}
+
+	if err := r.checkCycles(); err != nil {
+		return nil, err
+	}
+	if err := r.checkOutputs(deps); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// checkCycles makes sure that every module can eventually be started.
+func (r *ModuleRunner) checkCycles() error {
+	pending := append([]int{}, r.pending...)
+	queue := []int{}
+	for i := range r.modules {
+		if pending[i] == 0 {
+			queue = append(queue, i)
+		}
+	}
+	for len(queue) > 0 {
+		mod := r.modules[queue[0]]
+		queue = queue[1:]
+		for _, i := range r.dependents[mod.Name()] {
+			pending[i]--
+			if pending[i] == 0 {
+				queue = append(queue, i)
+			}
+		}
+	}
+
+	cycle := []string{}
+	for i, mod := range r.modules {
+		if pending[i] > 0 {
+			cycle = append(cycle, mod.Name())
+		}
+	}
+	if len(cycle) > 0 {
+		return fmt.Errorf("circular dependency between modules %s", strings.Join(cycle, ", "))
+	}
+	return nil
+}
+
+// checkOutputs makes sure that modules storing files in the same folder
+// can't run at the same time, which is only the case when one of them
+// depends on the other.
+func (r *ModuleRunner) checkOutputs(deps map[string][]string) error {
+	// dependsOn tells whether a depends, directly or not, on b.
+	var dependsOn func(a, b string) bool
+	dependsOn = func(a, b string) bool {
+		for _, dep := range deps[a] {
+			if dep == b || dependsOn(dep, b) {
+				return true
+			}
+		}
+		return false
+	}
+
+	owners := make(map[string]string)
+	for _, mod := range r.modules {
+		output, ok := mod.(OutputModule)
+		if !ok {
+			continue
+		}
+		for _, path := range output.Outputs() {
+			path = filepath.Clean(path)
+			for other, owner := range owners {
+				if owner == mod.Name() || !overlaps(path, other) {
+					continue
+				}
+				if dependsOn(mod.Name(), owner) || dependsOn(owner, mod.Name()) {
+					continue
+				}
+				return fmt.Errorf("modules %s and %s both store files in %s and can't run concurrently",
+					owner, mod.Name(), path)
+			}
+			owners[path] = mod.Name()
+		}
+	}
+	return nil
+}
+
+// overlaps tells whether one of the paths is the same as, or inside, the
+// other.
+func overlaps(a, b string) bool {
+	sep := string(filepath.Separator)
+	return a == b || strings.HasPrefix(a, b+sep) || strings.HasPrefix(b, a+sep)
+}
+
+type moduleResult struct {
+	index int
+	err   error
+}
+
+// Run runs the modules with run, which is called concurrently from the
+// workers. If run returns an error, or the context is cancelled, no other
+// module is started and Run returns the error once the modules already
+// running are done.
+func (r *ModuleRunner) Run(ctx context.Context, run func(mod Module) error) error {
+	ready := make(chan int)
+	done := make(chan moduleResult, len(r.modules))
+	for w := 0; w < r.Workers; w++ {
+		go func() {
+			for i := range ready {
+				done <- moduleResult{index: i, err: run(r.modules[i])}
+			}
+		}()
+	}
+	defer close(ready)
+
+	pending := append([]int{}, r.pending...)
+	queue := []int{}
+	for i := range r.modules {
+		if pending[i] == 0 {
+			queue = append(queue, i)
+		}
+	}
+
+	var stopErr error
+	running := 0
+	for {
+		for stopErr == nil && running < r.Workers && len(queue) > 0 {
+			if ctx.Err() != nil {
+				stopErr = ctx.Err()
+				break
+			}
+			ready <- queue[0]
+			queue = queue[1:]
+			running++
+		}
+		if running == 0 {
+			return stopErr
+		}
+
+		result := <-done
+		running--
+		if result.err != nil && stopErr == nil {
+			stopErr = result.err
+		}
+		// Dependents still run if the module failed, as they fall back to
+		// collecting what they need themselves.
+		for _, i := range r.dependents[r.modules[result.index].Name()] {
+			pending[i]--
+			if pending[i] == 0 {
+				queue = insertSorted(queue, i)
+			}
+		}
+	}
+}
+
+// insertSorted inserts value in the sorted list.
+func insertSorted(list []int, value int) []int {
+	pos := len(list)
+	for i, v := range list {
+		if v > value {
+			pos = i
+			break
+		}
+	}
+	list = append(list, 0)
+	copy(list[pos+1:], list[pos:])
+	list[pos] = value
+	return list
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mvt-project/androidqf/acquisition"
+	"github.com/mvt-project/androidqf/adb"
+	"github.com/mvt-project/androidqf/log"
+)
+
+const selinuxTimeout = 30 * time.Second
+
+// Files recording the version and the build-time hash of the platform
+// policy. They are not exposed through properties.
+const (
+	sepolicyVersionPath = "/vendor/etc/selinux/plat_sepolicy_vers.txt"
+	sepolicyHashPath    = "/system/etc/selinux/plat_sepolicy_and_mapping.sha256"
+)
+
+// selinuxAccessDenied is recorded for the values the device did not allow to
+// read.
+const selinuxAccessDenied = "access denied"
+
+// Properties describing the verified boot state of the device.
+var verifiedBootProperties = []string{
+	"ro.boot.veritymode",
+	"ro.boot.verifiedbootstate",
+	"ro.boot.flash.locked",
+}
+
+type SELinuxStatus struct {
+	StoragePath string
+}
+
+func NewSELinuxStatus() *SELinuxStatus {
+	return &SELinuxStatus{}
+}
+
+func (s *SELinuxStatus) Name() string {
+	return "selinux_status"
+}
+
+func (s *SELinuxStatus) InitStorage(storagePath string) error {
+	s.StoragePath = storagePath
+	return nil
+}
+
+// readSELinuxValue runs the command, returning selinuxAccessDenied if it was
+// not allowed.
+func readSELinuxValue(cmd ...string) string {
+	out, err := readPrivileged(cmd...)
+	if err != nil {
+		if isPermissionDenied(err.Error()) {
+			return selinuxAccessDenied
+		}
+		log.Debugf("Failed to run `%s`: %v", strings.Join(cmd, " "), err)
+		return fmt.Sprintf("error: %v", err)
+	}
+	return out
+}
+
+func (s *SELinuxStatus) Run(acq *acquisition.Acquisition, fast bool) error {
+	log.Info("Collecting SELinux status...")
+
+	status := &acquisition.SELinuxStatus{
+		VerifiedBoot: make(map[string]string),
+	}
+	var raw strings.Builder
+
+	out, err := adb.Client.ShellTimeout(selinuxTimeout, "getenforce")
+	if err != nil {
+		return fmt.Errorf("failed to run `adb shell getenforce`: %v", err)
+	}
+	status.Mode = out
+	fmt.Fprintf(&raw, "getenforce: %s\n", out)
+
+	out, err = adb.Client.Shell("cat", "/proc/self/attr/current")
+	if err != nil {
+		log.Debugf("Failed to read the SELinux context of the shell: %v", err)
+	} else {
+		// The context is terminated by a null byte.
+		status.Context = strings.TrimRight(out, "\x00")
+		fmt.Fprintf(&raw, "context: %s\n", status.Context)
+	}
+
+	out, err = adb.Client.Shell("cat", sepolicyVersionPath)
+	if err == nil {
+		status.PolicyVersion = out
+		fmt.Fprintf(&raw, "policy version: %s\n", out)
+	}
+	out, err = adb.Client.Shell("cat", sepolicyHashPath)
+	if err == nil {
+		status.PolicyHash = out
+		fmt.Fprintf(&raw, "policy hash: %s\n", out)
+	}
+
+	status.Enforce = readSELinuxValue("cat", "/sys/fs/selinux/enforce")
+	fmt.Fprintf(&raw, "enforce: %s\n", status.Enforce)
+	status.KernelPolicyVersion = readSELinuxValue("cat", "/sys/fs/selinux/policyvers")
+	fmt.Fprintf(&raw, "kernel policy version: %s\n", status.KernelPolicyVersion)
+
+	status.LoadedPolicySHA256 = selinuxAccessDenied
+	if adb.Client.HasRoot() {
+		out, err = adb.Client.ShellAsRoot("sha256sum", "/sys/fs/selinux/policy")
+		if err != nil && !isPermissionDenied(out) {
+			status.LoadedPolicySHA256 = fmt.Sprintf("error: %v", err)
+		} else if fields := strings.Fields(out); err == nil && len(fields) > 0 {
+			status.LoadedPolicySHA256 = fields[0]
+		}
+	}
+	fmt.Fprintf(&raw, "loaded policy sha256: %s\n", status.LoadedPolicySHA256)
+
+	props := getProperties(acq)
+	for _, property := range verifiedBootProperties {
+		status.VerifiedBoot[property] = props[property]
+		fmt.Fprintf(&raw, "%s: %s\n", property, props[property])
+	}
+
+	acq.SELinux = status
+	switch strings.ToLower(status.Mode) {
+	case "enforcing":
+	case "permissive":
+		acq.AddWarning("SELinux is in permissive mode, which is a strong indicator of a rooted or compromised device")
+	default:
+		acq.AddWarning("SELinux is in an unexpected mode: %s", status.Mode)
+	}
+
+	if state := status.VerifiedBoot["ro.boot.verifiedbootstate"]; state != "" && state != "green" {
+		log.Warningf("The verified boot state of the device is %s", state)
+	}
+	if status.VerifiedBoot["ro.boot.flash.locked"] == "0" {
+		log.Warning("The bootloader of the device is unlocked")
+	}
+
+	err = saveCommandOutput(filepath.Join(s.StoragePath, "selinux.txt"), raw.String())
+	if err != nil {
+		return err
+	}
+
+	return saveCommandOutputJson(filepath.Join(s.StoragePath, "selinux.json"), status)
+}
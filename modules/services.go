@@ -7,12 +7,15 @@ package modules
 import (
 	"fmt"
 	"path/filepath"
+	"time"
 
 	"github.com/mvt-project/androidqf/acquisition"
 	"github.com/mvt-project/androidqf/adb"
 	"github.com/mvt-project/androidqf/log"
 )
 
+const servicesTimeout = 30 * time.Second
+
 type Services struct {
 	StoragePath string
 }
@@ -33,7 +36,7 @@ func (s *Services) InitStorage(storagePath string) error {
 func (s *Services) Run(acq *acquisition.Acquisition, fast bool) error {
 	log.Info("Collecting list of services...")
 
-	out, err := adb.Client.Shell("service list")
+	out, err := adb.Client.ShellTimeout(servicesTimeout, "service list")
 	if err != nil {
 		return fmt.Errorf("failed to run `adb shell service list`: %v", err)
 	}
@@ -7,12 +7,58 @@ package modules
 import (
 	"fmt"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/mvt-project/androidqf/acquisition"
 	"github.com/mvt-project/androidqf/adb"
 	"github.com/mvt-project/androidqf/log"
 )
 
+// maxLockTimeout is the delay in milliseconds after the screen turns off
+// above which the device is considered to stay unlocked for too long.
+const maxLockTimeout = 10 * 60 * 1000
+
+// riskySettings are the settings which are modified to ease the surveillance
+// of the device, with a check of whether their value is risky.
+var riskySettings = map[string]func(value string) bool{
+	"adb_enabled":                  func(value string) bool { return value == "1" },
+	"development_settings_enabled": func(value string) bool { return value == "1" },
+	"install_non_market_apps":      func(value string) bool { return value == "1" },
+	"lock_screen_lock_after_timeout": func(value string) bool {
+		timeout, err := strconv.Atoi(value)
+		return err == nil && timeout > maxLockTimeout
+	},
+}
+
+// RiskySetting is a setting whose value eases the surveillance of the
+// device.
+type RiskySetting struct {
+	Namespace string `json:"namespace"`
+	User      int    `json:"user"`
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+}
+
+// SettingEntry is a setting of a user in one of the namespaces.
+type SettingEntry struct {
+	Namespace string `json:"namespace"`
+	User      int    `json:"user"`
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+}
+
+type SettingsResult struct {
+	// Settings are indexed by namespace, and then by key. Namespaces of
+	// secondary users are named as in "secure_user10".
+	Settings map[string]map[string]string `json:"settings"`
+	// Entries are all the settings collected, tagged with their namespace
+	// and user.
+	Entries []SettingEntry `json:"entries"`
+	Risky   []RiskySetting `json:"risky"`
+}
+
 type Settings struct {
 	StoragePath string
 }
@@ -22,7 +68,7 @@ func NewSettings() *Settings {
 }
 
 func (s *Settings) Name() string {
-	return "logcat"
+	return "settings"
 }
 
 func (s *Settings) InitStorage(storagePath string) error {
@@ -30,23 +76,115 @@ func (s *Settings) InitStorage(storagePath string) error {
 	return nil
 }
 
+// parseSettings parses the output of `settings list`, in the form
+// "key=value".
+func parseSettings(out string) map[string]string {
+	settings := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		key, value, ok := strings.Cut(strings.TrimRight(line, "\r"), "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			continue
+		}
+		settings[strings.TrimSpace(key)] = value
+	}
+	return settings
+}
+
+// listSettings returns the settings of a user in the namespace. The settings
+// command is used on devices older than Android 7, which lack cmd.
+func listSettings(user int, namespace string) (string, error) {
+	out, err := adb.Client.Shell(fmt.Sprintf("cmd settings --user %d list %s", user, namespace))
+	if err == nil && !strings.Contains(out, "not found") && !strings.Contains(out, "Can't find service") {
+		return out, nil
+	}
+	log.Debugf("Failed to run `cmd settings`, falling back to `settings`: %v", err)
+
+	return adb.Client.Shell(fmt.Sprintf("settings --user %d list %s", user, namespace))
+}
+
 func (s *Settings) Run(acq *acquisition.Acquisition, fast bool) error {
 	log.Info("Collecting device settings...")
 
+	users, err := adb.Client.GetUsers()
+	if err != nil {
+		log.Debugf("Failed to list users, only looking at the primary one: %v", err)
+	}
+
+	result := SettingsResult{
+		Settings: make(map[string]map[string]string),
+		Entries:  []SettingEntry{},
+		Risky:    []RiskySetting{},
+	}
 	for _, namespace := range []string{"system", "secure", "global"} {
-		out, err := adb.Client.Shell(fmt.Sprintf("cmd settings list %s", namespace))
-		if err != nil {
-			return fmt.Errorf("failed to run `cmd settings %s`: %v", namespace, err)
-		}
+		for _, user := range users {
+			// Global settings are shared by all users.
+			if namespace == "global" && user.ID != 0 {
+				continue
+			}
+
+			// Some namespaces are missing on old Android versions.
+			out, err := listSettings(user.ID, namespace)
+			if err != nil {
+				log.Errorf("Failed to get %s settings of user %d: %v", namespace, user.ID, err)
+				continue
+			}
+
+			// Keep the original file names for the primary user.
+			name := namespace
+			if user.ID != 0 {
+				name = fmt.Sprintf("%s_user%d", namespace, user.ID)
+			}
+			err = saveCommandOutput(filepath.Join(s.StoragePath, fmt.Sprintf("settings_%s.txt", name)), out)
+			if err != nil {
+				log.Errorf("Impossible to save settings: %v", err)
+			}
+
+			settings := parseSettings(out)
+			result.Settings[name] = settings
+			for key, value := range settings {
+				result.Entries = append(result.Entries, SettingEntry{
+					Namespace: namespace,
+					User:      user.ID,
+					Key:       key,
+					Value:     value,
+				})
+			}
+			for key, isRisky := range riskySettings {
+				value, ok := settings[key]
+				if !ok || !isRisky(value) {
+					continue
+				}
 
-		err = saveCommandOutput(
-			filepath.Join(s.StoragePath, fmt.Sprintf("settings_%s.txt", namespace)),
-			out,
-		)
-		if err != nil {
-			log.Errorf("Impossible to save settings: %v", err)
+				log.Warningf("Setting %s of user %d is %s", key, user.ID, value)
+				result.Risky = append(result.Risky, RiskySetting{
+					Namespace: namespace,
+					User:      user.ID,
+					Key:       key,
+					Value:     value,
+				})
+			}
 		}
 	}
 
-	return nil
+	if len(result.Settings) == 0 {
+		return fmt.Errorf("failed to get any settings")
+	}
+
+	sort.Slice(result.Entries, func(i, j int) bool {
+		if result.Entries[i].User != result.Entries[j].User {
+			return result.Entries[i].User < result.Entries[j].User
+		}
+		if result.Entries[i].Namespace != result.Entries[j].Namespace {
+			return result.Entries[i].Namespace < result.Entries[j].Namespace
+		}
+		return result.Entries[i].Key < result.Entries[j].Key
+	})
+	sort.Slice(result.Risky, func(i, j int) bool {
+		if result.Risky[i].User != result.Risky[j].User {
+			return result.Risky[i].User < result.Risky[j].User
+		}
+		return result.Risky[i].Key < result.Risky[j].Key
+	})
+
+	return saveCommandOutputJson(filepath.Join(s.StoragePath, "settings.json"), &result)
 }
@@ -0,0 +1,219 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mvt-project/androidqf/acquisition"
+	"github.com/mvt-project/androidqf/adb"
+	"github.com/mvt-project/androidqf/log"
+)
+
+const smsDatabasePath = "/data/data/com.android.providers.telephony/databases/mmssms.db"
+
+// smsColumns are the columns queried from the content provider, in order.
+var smsColumns = []string{"_id", "address", "body", "date", "type", "read", "thread_id"}
+
+// "Row: 0 _id=1, address=..." at the start of each row of `content query`.
+var contentRowRegexp = regexp.MustCompile(`^Row: \d+ `)
+
+// smsQueries return the same columns as smsColumns, with the text ones hex
+// encoded. MMS are read from the pdu table, without their address, and their
+// date is in seconds.
+var smsQueries = []struct {
+	query string
+	isMMS bool
+}{
+	{"SELECT _id, hex(address), hex(body), date, type, read, thread_id FROM sms;", false},
+	{"SELECT _id, NULL, hex(sub), date * 1000, msg_box, read, thread_id FROM pdu;", true},
+}
+
+type SMSMessage struct {
+	ID       int       `json:"id"`
+	Address  string    `json:"address"`
+	Body     string    `json:"body"`
+	Date     time.Time `json:"date"`
+	Type     int       `json:"type"`
+	Read     bool      `json:"read"`
+	ThreadID int       `json:"thread_id"`
+	IsMMS    bool      `json:"is_mms"`
+}
+
+type SMS struct {
+	StoragePath string
+}
+
+func NewSMS() *SMS {
+	return &SMS{}
+}
+
+func (s *SMS) Name() string {
+	return "sms"
+}
+
+func (s *SMS) InitStorage(storagePath string) error {
+	s.StoragePath = storagePath
+	return nil
+}
+
+// newSMSMessage builds a message from the values of smsColumns.
+func newSMSMessage(values []string, isMMS bool) SMSMessage {
+	message := SMSMessage{
+		Address: values[1],
+		Body:    values[2],
+		IsMMS:   isMMS,
+	}
+	message.ID, _ = strconv.Atoi(values[0])
+	if date, err := strconv.ParseInt(values[3], 10, 64); err == nil {
+		message.Date = time.UnixMilli(date).UTC()
+	}
+	message.Type, _ = strconv.Atoi(values[4])
+	message.Read = values[5] == "1"
+	message.ThreadID, _ = strconv.Atoi(values[6])
+
+	return message
+}
+
+// parseContentSMS parses the output of `content query --uri content://sms`
+// with smsColumns as projection. Values are not escaped, so each column is
+// found by looking for the next one, and bodies can span several lines.
+func parseContentSMS(out string) []SMSMessage {
+	rows := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if contentRowRegexp.MatchString(line) {
+			rows = append(rows, contentRowRegexp.ReplaceAllString(line, ""))
+		} else if len(rows) > 0 {
+			rows[len(rows)-1] += "\n" + line
+		}
+	}
+
+	messages := []SMSMessage{}
+	for _, row := range rows {
+		values := make([]string, len(smsColumns))
+		rest, ok := strings.CutPrefix(row, smsColumns[0]+"=")
+		if !ok {
+			continue
+		}
+		for i := 1; i < len(smsColumns); i++ {
+			value, next, found := strings.Cut(rest, ", "+smsColumns[i]+"=")
+			if !found {
+				ok = false
+				break
+			}
+			values[i-1] = value
+			rest = next
+		}
+		if !ok {
+			continue
+		}
+		values[len(smsColumns)-1] = strings.TrimSpace(rest)
+
+		// Missing values are printed as NULL.
+		for i, value := range values {
+			if value == "NULL" {
+				values[i] = ""
+			}
+		}
+		messages = append(messages, newSMSMessage(values, false))
+	}
+
+	return messages
+}
+
+// parseSQLiteSMS parses the rows returned by sqlite3 for smsQueries.
+func parseSQLiteSMS(out string, isMMS bool) []SMSMessage {
+	messages := []SMSMessage{}
+	for _, line := range strings.Split(out, "\n") {
+		values := strings.Split(strings.TrimSpace(line), "|")
+		if len(values) != len(smsColumns) {
+			continue
+		}
+		for _, i := range []int{1, 2} {
+			decoded, _ := hex.DecodeString(values[i])
+			values[i] = string(decoded)
+		}
+		messages = append(messages, newSMSMessage(values, isMMS))
+	}
+
+	return messages
+}
+
+// collectSQLite copies the messages database and queries it with the sqlite3
+// binary of the device. The copy is not kept when content is redacted.
+func (s *SMS) collectSQLite(acq *acquisition.Acquisition) ([]SMSMessage, error) {
+	if !acq.RedactContent {
+		out, err := adb.Client.ExecOutAsRoot(fmt.Sprintf("cat '%s'", smsDatabasePath))
+		if err == nil && !strings.HasPrefix(string(out), "cat:") {
+			err = os.WriteFile(filepath.Join(s.StoragePath, "mmssms.db"), out, 0o644)
+			if err != nil {
+				log.Errorf("Failed to save the messages database: %v", err)
+			}
+		} else {
+			log.Debugf("Failed to copy the messages database: %v", err)
+		}
+	}
+
+	if !hasDeviceSQLite() {
+		return nil, fmt.Errorf("sqlite3 is not available on the device")
+	}
+
+	messages := []SMSMessage{}
+	for _, query := range smsQueries {
+		out, err := queryDeviceSQLite(smsDatabasePath, query.query)
+		if err != nil {
+			// Some databases don't have a pdu table, the SMS are kept.
+			if query.isMMS {
+				log.Debugf("Failed to read the MMS from the messages database: %v", err)
+				continue
+			}
+			return nil, err
+		}
+		messages = append(messages, parseSQLiteSMS(out, query.isMMS)...)
+	}
+
+	return messages, nil
+}
+
+func (s *SMS) Run(acq *acquisition.Acquisition, fast bool) error {
+	log.Info("Collecting SMS messages...")
+
+	var messages []SMSMessage
+	var err error
+	if adb.Client.HasRoot() {
+		messages, err = s.collectSQLite(acq)
+		if err != nil {
+			log.Debugf("Failed to read the messages database, querying the content provider instead: %v", err)
+			messages = nil
+		}
+	}
+	if messages == nil {
+		out, err := adb.Client.Shell("content", "query", "--uri", "content://sms",
+			"--projection", strings.Join(smsColumns, ":"))
+		if err != nil {
+			return fmt.Errorf("failed to query SMS messages: %v: %s", err, out)
+		}
+		messages = parseContentSMS(out)
+	}
+
+	// Hashes still allow to correlate messages between acquisitions.
+	if acq.RedactContent {
+		for i := range messages {
+			hash := sha256.Sum256([]byte(messages[i].Body))
+			messages[i].Body = hex.EncodeToString(hash[:])
+		}
+	}
+
+	return saveCommandOutputJson(filepath.Join(s.StoragePath, "sms.json"), &messages)
+}
@@ -0,0 +1,197 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mvt-project/androidqf/acquisition"
+	"github.com/mvt-project/androidqf/adb"
+	"github.com/mvt-project/androidqf/log"
+)
+
+// Status of each telephony field.
+const (
+	telephonyCollected   = "collected"
+	telephonyBlocked     = "blocked"
+	telephonyUnavailable = "unavailable"
+)
+
+var (
+	// "iccId=8933...". Recent versions mask most of the digits.
+	iccidRegexp = regexp.MustCompile(`(?i)iccId=([0-9a-f]{18,22})\b`)
+	// "mServiceState=0 0 home Operator ..." for each phone.
+	serviceStateRegexp = regexp.MustCompile(`mServiceState=(.*)`)
+)
+
+// multisimConfigs maps persist.radio.multisim.config to the number of SIM
+// slots.
+var multisimConfigs = map[string]int{
+	"ssss": 1,
+	"dsds": 2,
+	"dsda": 2,
+	"tsts": 3,
+}
+
+type TelephonyField struct {
+	Value  string `json:"value,omitempty"`
+	Status string `json:"status"`
+	Hashed bool   `json:"hashed,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type SIMSlot struct {
+	Slot            int    `json:"slot"`
+	State           string `json:"state"`
+	SIMOperator     string `json:"sim_operator"`
+	SIMOperatorName string `json:"sim_operator_name"`
+	SIMCountry      string `json:"sim_country"`
+	NetworkOperator string `json:"network_operator"`
+	NetworkName     string `json:"network_name"`
+	ServiceState    string `json:"service_state"`
+}
+
+type TelephonyInfo struct {
+	SIMSlots  int            `json:"sim_slots"`
+	PhoneType string         `json:"phone_type"`
+	IMEI      TelephonyField `json:"imei"`
+	IMSI      TelephonyField `json:"imsi"`
+	ICCID     TelephonyField `json:"iccid"`
+	Slots     []SIMSlot      `json:"slots"`
+}
+
+type Telephony struct {
+	StoragePath string
+}
+
+func NewTelephony() *Telephony {
+	return &Telephony{}
+}
+
+func (t *Telephony) Name() string {
+	return "telephony"
+}
+
+func (t *Telephony) InitStorage(storagePath string) error {
+	t.StoragePath = storagePath
+	return nil
+}
+
+// hashIdentifier returns the SHA-256 of an identifier, which still allows to
+// correlate devices between acquisitions.
+func hashIdentifier(value string) string {
+	hash := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(hash[:])
+}
+
+// newTelephonyField returns the field for a value retrieved with
+// callIphonesubinfo, hashing it if identifiers are redacted.
+func newTelephonyField(value string, err error, redact bool) TelephonyField {
+	switch {
+	case errors.Is(err, errPhoneStateDenied):
+		return TelephonyField{Status: telephonyBlocked, Error: err.Error()}
+	case err != nil:
+		return TelephonyField{Status: telephonyUnavailable, Error: err.Error()}
+	case redact:
+		return TelephonyField{Value: hashIdentifier(value), Status: telephonyCollected, Hashed: true}
+	}
+	return TelephonyField{Value: value, Status: telephonyCollected}
+}
+
+// splitSlots splits a property holding a comma-separated value for each SIM
+// slot, such as gsm.sim.state.
+func splitSlots(value string) []string {
+	if value == "" {
+		return []string{}
+	}
+	return strings.Split(value, ",")
+}
+
+// parseSIMSlots returns the SIM slots described by the gsm.* properties.
+func parseSIMSlots(props map[string]string, count int) []SIMSlot {
+	values := map[string][]string{}
+	for _, key := range []string{
+		"gsm.sim.state", "gsm.sim.operator.numeric", "gsm.sim.operator.alpha",
+		"gsm.sim.operator.iso-country", "gsm.operator.numeric", "gsm.operator.alpha",
+	} {
+		values[key] = splitSlots(props[key])
+		if len(values[key]) > count {
+			count = len(values[key])
+		}
+	}
+	get := func(key string, slot int) string {
+		if slot < len(values[key]) {
+			return strings.TrimSpace(values[key][slot])
+		}
+		return ""
+	}
+
+	slots := []SIMSlot{}
+	for i := 0; i < count; i++ {
+		slots = append(slots, SIMSlot{
+			Slot:            i,
+			State:           get("gsm.sim.state", i),
+			SIMOperator:     get("gsm.sim.operator.numeric", i),
+			SIMOperatorName: get("gsm.sim.operator.alpha", i),
+			SIMCountry:      get("gsm.sim.operator.iso-country", i),
+			NetworkOperator: get("gsm.operator.numeric", i),
+			NetworkName:     get("gsm.operator.alpha", i),
+		})
+	}
+	return slots
+}
+
+func (t *Telephony) Run(acq *acquisition.Acquisition, fast bool) error {
+	log.Info("Collecting telephony and SIM information...")
+
+	props := getProperties(acq)
+
+	info := TelephonyInfo{
+		SIMSlots:  multisimConfigs[props["persist.radio.multisim.config"]],
+		PhoneType: props["gsm.current.phone-type"],
+	}
+	info.Slots = parseSIMSlots(props, info.SIMSlots)
+	if info.SIMSlots == 0 {
+		info.SIMSlots = len(info.Slots)
+	}
+
+	registry, err := adb.Client.ShellTimeout(dumpsysServiceTimeout, "dumpsys", "telephony.registry")
+	if err != nil && registry == "" {
+		log.Debugf("Failed to run `adb shell dumpsys telephony.registry`: %v", err)
+	} else {
+		err = saveCommandOutput(filepath.Join(t.StoragePath, "telephony_registry.txt"), registry)
+		if err != nil {
+			log.Errorf("Impossible to save the telephony registry: %v", err)
+		}
+	}
+	// The registry lists the service state of each phone in order.
+	for i, match := range serviceStateRegexp.FindAllStringSubmatch(registry, -1) {
+		if i < len(info.Slots) {
+			info.Slots[i].ServiceState = strings.TrimSpace(match[1])
+		}
+	}
+
+	value, err := callIphonesubinfo(iphonesubinfoIMEI, imeiRegexp)
+	info.IMEI = newTelephonyField(value, err, acq.RedactIdentifiers)
+	value, err = callIphonesubinfo(iphonesubinfoIMSI, imsiRegexp)
+	info.IMSI = newTelephonyField(value, err, acq.RedactIdentifiers)
+
+	// The subscriptions only show the full ICCID on some builds, the dump
+	// is not saved as it would defeat the redaction.
+	info.ICCID = TelephonyField{Status: telephonyBlocked}
+	isub, err := adb.Client.ShellTimeout(dumpsysServiceTimeout, "dumpsys", "isub")
+	if err != nil && isub == "" {
+		info.ICCID = TelephonyField{Status: telephonyUnavailable, Error: err.Error()}
+	} else if match := iccidRegexp.FindStringSubmatch(isub); match != nil {
+		info.ICCID = newTelephonyField(match[1], nil, acq.RedactIdentifiers)
+	}
+
+	return saveCommandOutputJson(filepath.Join(t.StoragePath, "telephony.json"), &info)
+}
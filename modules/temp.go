@@ -28,10 +28,14 @@ func (t *Temp) Name() string {
 	return "temp"
 }
 
+func (t *Temp) Outputs() []string {
+	return []string{"tmp"}
+}
+
 func (t *Temp) InitStorage(storagePath string) error {
 	t.StoragePath = storagePath
 	t.TempPath = filepath.Join(storagePath, "tmp")
-	err := os.Mkdir(t.TempPath, 0o755)
+	err := os.MkdirAll(t.TempPath, 0o755)
 	if err != nil {
 		return fmt.Errorf("failed to create tmp folder: %v", err)
 	}
@@ -0,0 +1,251 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mvt-project/androidqf/acquisition"
+	"github.com/mvt-project/androidqf/adb"
+	"github.com/mvt-project/androidqf/log"
+)
+
+var (
+	tombstoneProcessRegexp   = regexp.MustCompile(`>>> (.+) <<<`)
+	tombstoneSignalRegexp    = regexp.MustCompile(`signal \d+ \((\w+)\)`)
+	tombstoneFaultRegexp     = regexp.MustCompile(`fault addr (\S+)`)
+	tombstoneTimestampRegexp = regexp.MustCompile(`(?m)^Timestamp: (.+)$`)
+)
+
+// crashDumpFolders are the folders of the crash dumps on the device, along
+// with the local folder they are pulled to, and the dropbox tag of the copies
+// of the dumps used when the folder is not readable.
+var crashDumpFolders = []struct {
+	remote string
+	local  string
+	tag    string
+}{
+	{"/data/tombstones/", "tombstones", "SYSTEM_TOMBSTONE"},
+	{"/data/anr/", "anr", "data_app_anr"},
+}
+
+// CrashDump is a crash dump stored in tombstones/ or anr/, listed in the
+// index.json of the folder.
+type CrashDump struct {
+	File string `json:"file"`
+	// Source is the path on the device, or the dropbox tag of the entry.
+	Source   string `json:"source"`
+	Size     int64  `json:"size"`
+	Modified string `json:"modified"`
+}
+
+type Tombstone struct {
+	File         string `json:"file"`
+	ProcessName  string `json:"process_name"`
+	Signal       string `json:"signal"`
+	FaultAddress string `json:"fault_address"`
+	Timestamp    string `json:"timestamp"`
+}
+
+// crashDumpFile is a file listed with `ls -la`.
+type crashDumpFile struct {
+	name     string
+	size     int64
+	modified string
+}
+
+type Tombstones struct {
+	StoragePath string
+}
+
+func NewTombstones() *Tombstones {
+	return &Tombstones{}
+}
+
+func (t *Tombstones) Name() string {
+	return "tombstones"
+}
+
+func (t *Tombstones) Outputs() []string {
+	return []string{"tombstones", "anr"}
+}
+
+func (t *Tombstones) InitStorage(storagePath string) error {
+	t.StoragePath = storagePath
+	for _, folder := range crashDumpFolders {
+		err := os.MkdirAll(filepath.Join(storagePath, folder.local), 0o755)
+		if err != nil {
+			return fmt.Errorf("failed to create %s folder: %v", folder.local, err)
+		}
+	}
+
+	return nil
+}
+
+// parseLsFiles returns the regular files listed by `ls -la`, as in
+// "-rw-r----- 1 tombstoned system 123456 2023-05-01 10:00 tombstone_00".
+func parseLsFiles(out string) []crashDumpFile {
+	files := []crashDumpFile{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 8 || !strings.HasPrefix(fields[0], "-") {
+			continue
+		}
+
+		size, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			continue
+		}
+		files = append(files, crashDumpFile{
+			name:     strings.Join(fields[7:], " "),
+			size:     size,
+			modified: fields[5] + " " + fields[6],
+		})
+	}
+
+	return files
+}
+
+// parseTombstone extracts the details of the crash from a tombstone.
+func parseTombstone(name, content string) Tombstone {
+	tombstone := Tombstone{File: name}
+	if match := tombstoneProcessRegexp.FindStringSubmatch(content); match != nil {
+		tombstone.ProcessName = match[1]
+	}
+	if match := tombstoneSignalRegexp.FindStringSubmatch(content); match != nil {
+		tombstone.Signal = match[1]
+	}
+	if match := tombstoneFaultRegexp.FindStringSubmatch(content); match != nil {
+		tombstone.FaultAddress = match[1]
+	}
+	if match := tombstoneTimestampRegexp.FindStringSubmatch(content); match != nil {
+		tombstone.Timestamp = strings.TrimSpace(match[1])
+	}
+
+	return tombstone
+}
+
+// readCrashDump reads the file, as root if it is not readable otherwise.
+// Errors of cat are recognized by their prefix, as crash dumps might
+// themselves mention denied permissions.
+func readCrashDump(remotePath string) ([]byte, error) {
+	cmd := fmt.Sprintf("cat '%s'", remotePath)
+	out, err := adb.Client.ExecOut(cmd)
+	if (err != nil || strings.HasPrefix(string(out), "cat:")) && adb.Client.HasRoot() {
+		out, err = adb.Client.ExecOutAsRoot(cmd)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(string(out), "cat:") {
+		return nil, fmt.Errorf("%s", strings.TrimSpace(string(out)))
+	}
+
+	return out, nil
+}
+
+// readHead returns the beginning of the local file, where the details of a
+// crash are.
+func readHead(path string, size int) string {
+	file, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	buf := make([]byte, size)
+	n, _ := io.ReadFull(file, buf)
+	return string(buf[:n])
+}
+
+func (t *Tombstones) Run(acq *acquisition.Acquisition, fast bool) error {
+	log.Info("Collecting tombstones and ANR traces...")
+
+	tombstones := []Tombstone{}
+	var pulled int64
+	for _, folder := range crashDumpFolders {
+		localDir := filepath.Join(t.StoragePath, folder.local)
+		index := []CrashDump{}
+		read := 0
+		out, err := readPrivileged("ls", "-la", folder.remote)
+		if err != nil {
+			log.Debugf("Failed to list %s: %v", folder.remote, err)
+		}
+
+		for _, file := range parseLsFiles(out) {
+			// Core dumps can be huge, files are skipped once the cap is
+			// reached.
+			if acq.MaxCrashDumpsSize > 0 && pulled+file.size > acq.MaxCrashDumpsSize {
+				log.Infof("Skipping %s%s (%d bytes), the size limit of crash dumps is reached",
+					folder.remote, file.name, file.size)
+				continue
+			}
+
+			remotePath := path.Join(folder.remote, file.name)
+			content, err := readCrashDump(remotePath)
+			if err != nil {
+				log.Debugf("Failed to read %s: %v", remotePath, err)
+				continue
+			}
+			pulled += int64(len(content))
+			read++
+
+			localName := filepath.Base(file.name)
+			err = os.WriteFile(filepath.Join(localDir, localName), content, 0o644)
+			if err != nil {
+				log.Errorf("Failed to save %s: %v", remotePath, err)
+				continue
+			}
+			index = append(index, CrashDump{
+				File:     localName,
+				Source:   remotePath,
+				Size:     int64(len(content)),
+				Modified: file.modified,
+			})
+
+			// Android 12+ also keeps a protobuf copy of each tombstone.
+			if folder.local == "tombstones" && !strings.HasSuffix(file.name, ".pb") {
+				tombstones = append(tombstones, parseTombstone(file.name, string(content)))
+			}
+		}
+
+		// The folders are not readable on stock devices, but dropbox keeps
+		// copies of the most recent crash dumps.
+		if read == 0 {
+			log.Debugf("No file read from %s, falling back to dropbox entries %s", folder.remote, folder.tag)
+			filter := &dropboxFilter{maxSize: acq.MaxCrashDumpsSize, pulled: pulled}
+			files, err := pullDropboxEntries(folder.tag, localDir, filter)
+			pulled = filter.pulled
+			if err != nil {
+				log.Debugf("Failed to collect dropbox entries %s: %v", folder.tag, err)
+			}
+			for _, file := range files {
+				index = append(index, CrashDump{
+					File:     file.File,
+					Source:   "dropbox:" + file.Tag,
+					Size:     file.Size,
+					Modified: file.Timestamp,
+				})
+				if folder.local == "tombstones" {
+					tombstones = append(tombstones, parseTombstone(file.File, readHead(filepath.Join(localDir, file.File), 16*1024)))
+				}
+			}
+		}
+
+		err = saveCommandOutputJson(filepath.Join(localDir, "index.json"), &index)
+		if err != nil {
+			log.Errorf("Failed to save the index of %s: %v", folder.local, err)
+		}
+	}
+
+	return saveCommandOutputJson(filepath.Join(t.StoragePath, "tombstones.json"), &tombstones)
+}
@@ -0,0 +1,314 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mvt-project/androidqf/acquisition"
+	"github.com/mvt-project/androidqf/adb"
+	"github.com/mvt-project/androidqf/log"
+)
+
+var (
+	ownerUIDRegexp  = regexp.MustCompile(`OwnerUid: (\d+)`)
+	vpnServerRegexp = regexp.MustCompile(`(?i)server(?:Address)?[:=] ?([^\s,}]+)`)
+	componentRegexp = regexp.MustCompile(`\s([\w.]+/[\w.$]+)\s`)
+	// "Legacy VPN:", "VPNs:" and similar headers.
+	vpnSectionRegexp = regexp.MustCompile(`(?i)^\s*(?:legacy )?vpns?\b[\w ]*:\s*$`)
+)
+
+type VPNProfile struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Server      string `json:"server"`
+	IsConnected bool   `json:"is_connected"`
+}
+
+type VPNApp struct {
+	PackageName   string `json:"package_name"`
+	ComponentName string `json:"component_name"`
+	IsThirdParty  bool   `json:"is_third_party"`
+	IsSideloaded  bool   `json:"is_sideloaded"`
+}
+
+// AlwaysOnVPN is the VPN app a user set to be always connected. With
+// lockdown, traffic is blocked whenever the VPN is down.
+type AlwaysOnVPN struct {
+	User         int    `json:"user"`
+	PackageName  string `json:"package_name"`
+	Lockdown     bool   `json:"lockdown"`
+	IsThirdParty bool   `json:"is_third_party"`
+	IsSideloaded bool   `json:"is_sideloaded"`
+}
+
+// VPNConsent is a package the user allowed to establish a VPN.
+type VPNConsent struct {
+	User         int    `json:"user"`
+	PackageName  string `json:"package_name"`
+	IsThirdParty bool   `json:"is_third_party"`
+	IsSideloaded bool   `json:"is_sideloaded"`
+}
+
+type VPNResult struct {
+	Profiles []VPNProfile  `json:"profiles"`
+	Apps     []VPNApp      `json:"apps"`
+	AlwaysOn []AlwaysOnVPN `json:"always_on"`
+	Consents []VPNConsent  `json:"consents"`
+}
+
+type VPNConfig struct {
+	StoragePath string
+}
+
+func NewVPNConfig() *VPNConfig {
+	return &VPNConfig{}
+}
+
+func (v *VPNConfig) Name() string {
+	return "vpn_config"
+}
+
+func (v *VPNConfig) Dependencies() []string {
+	return []string{"packages"}
+}
+
+func (v *VPNConfig) InitStorage(storagePath string) error {
+	v.StoragePath = storagePath
+	return nil
+}
+
+// parseConnectivityVPNs extracts the VPN networks from the output of
+// `dumpsys connectivity`, naming them after the package owning them.
+func parseConnectivityVPNs(out string, uids map[int][]string) []VPNProfile {
+	profiles := []VPNProfile{}
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.Contains(line, "NetworkAgentInfo{") || !strings.Contains(line, "VPN") {
+			continue
+		}
+
+		profile := VPNProfile{
+			Type:        "VpnService",
+			IsConnected: strings.Contains(line, "CONNECTED") && !strings.Contains(line, "DISCONNECTED"),
+		}
+		if strings.Contains(line, "LegacyVpn") || strings.Contains(line, "legacy") {
+			profile.Type = "legacy"
+		}
+		if match := ownerUIDRegexp.FindStringSubmatch(line); match != nil {
+			uid, _ := strconv.Atoi(match[1])
+			profile.Name = strings.Join(uids[uid], ",")
+			if profile.Name == "" {
+				profile.Name = fmt.Sprintf("uid %d", uid)
+			}
+		}
+		if match := vpnServerRegexp.FindStringSubmatch(line); match != nil {
+			profile.Server = match[1]
+		}
+		profiles = append(profiles, profile)
+	}
+
+	return profiles
+}
+
+// parseVpnServices extracts the components handling the VpnService action
+// from the resolver table printed by `dumpsys package`.
+func parseVpnServices(out string) []string {
+	components := []string{}
+	lines := strings.Split(out, "\n")
+	for i := 0; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) != "android.net.VpnService:" {
+			continue
+		}
+
+		indent := indentation(lines[i])
+		for i+1 < len(lines) && indentation(lines[i+1]) > indent {
+			i++
+			if match := componentRegexp.FindStringSubmatch(lines[i] + " "); match != nil {
+				components = appendUniqueString(components, match[1])
+			}
+		}
+	}
+
+	return components
+}
+
+// parseQueryOp returns the packages listed by `cmd appops query-op`, which
+// prints "No operations." when there are none.
+func parseQueryOp(out string) []string {
+	packages := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.Contains(line, " ") {
+			continue
+		}
+		packages = appendUniqueString(packages, line)
+	}
+	return packages
+}
+
+// vpnConsents returns the packages of the user allowed to establish a VPN,
+// which hold the ACTIVATE_VPN app op once the user accepted the
+// BIND_VPN_SERVICE consent dialog.
+func vpnConsents(user int) []string {
+	out, err := adb.Client.Shell("cmd", "appops", "query-op", "--user", strconv.Itoa(user), "ACTIVATE_VPN", "allow")
+	if err != nil && out == "" {
+		log.Debugf("Failed to query the VPN consents of user %d: %v", user, err)
+		return []string{}
+	}
+	if strings.Contains(out, "Unknown command") || strings.Contains(out, "Error") {
+		log.Debugf("Failed to query the VPN consents of user %d: %s", user, strings.TrimSpace(out))
+		return []string{}
+	}
+	return parseQueryOp(out)
+}
+
+// appendUniqueString appends value to values unless it is already present.
+func appendUniqueString(values []string, value string) []string {
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
+
+func (v *VPNConfig) Run(acq *acquisition.Acquisition, fast bool) error {
+	log.Info("Collecting VPN configuration...")
+
+	// Devices without any VPN still get the file, with empty lists.
+	result := VPNResult{
+		Profiles: []VPNProfile{},
+		Apps:     []VPNApp{},
+		AlwaysOn: []AlwaysOnVPN{},
+		Consents: []VPNConsent{},
+	}
+	packages := packageIndex(acq)
+
+	if adb.Client.HasRoot() {
+		out, err := adb.Client.ShellAsRoot("ls", "-la", "/data/misc/vpn/")
+		if err != nil {
+			log.Debugf("Failed to list /data/misc/vpn/: %v", err)
+		} else {
+			err = saveCommandOutput(filepath.Join(v.StoragePath, "vpn_files.txt"), out)
+			if err != nil {
+				log.Errorf("Impossible to save the list of VPN files: %v", err)
+			}
+		}
+	}
+
+	out, err := adb.Client.ShellTimeout(dumpsysServiceTimeout, "dumpsys", "connectivity")
+	if err != nil && out == "" {
+		log.Debugf("Failed to run `adb shell dumpsys connectivity`: %v", err)
+	} else {
+		result.Profiles = parseConnectivityVPNs(out, packagesByUID(acq))
+
+		section := dumpSection(out, vpnSectionRegexp)
+		for _, line := range strings.Split(out, "\n") {
+			if strings.Contains(line, "NetworkAgentInfo{") && strings.Contains(line, "VPN") {
+				section = append(section, line)
+			}
+		}
+		if len(section) > 0 {
+			err = saveCommandOutput(filepath.Join(v.StoragePath, "vpn_connectivity.txt"),
+				strings.Join(section, "\n"))
+			if err != nil {
+				log.Errorf("Impossible to save the VPN section of the connectivity dump: %v", err)
+			}
+		}
+	}
+
+	// The VPN service was split from connectivity in Android 12.
+	for _, service := range []string{"vpn_management", "vpn"} {
+		out, err := adb.Client.ShellTimeout(dumpsysServiceTimeout, "dumpsys", service)
+		if (err != nil && out == "") || strings.Contains(out, "Can't find service") {
+			continue
+		}
+		err = saveCommandOutput(filepath.Join(v.StoragePath, "vpn.txt"), out)
+		if err != nil {
+			log.Errorf("Impossible to save the VPN dump: %v", err)
+		}
+		break
+	}
+
+	users, err := adb.Client.GetUsers()
+	if err != nil {
+		log.Debugf("Failed to list users, only looking at the primary one: %v", err)
+	}
+	for _, user := range users {
+		userArg := strconv.Itoa(user.ID)
+		app, err := adb.Client.Shell("settings", "--user", userArg, "get", "secure", "always_on_vpn_app")
+		app = strings.TrimSpace(app)
+		if err != nil || app == "" || app == "null" {
+			continue
+		}
+		lockdown, _ := adb.Client.Shell("settings", "--user", userArg, "get", "secure", "always_on_vpn_lockdown")
+
+		alwaysOn := AlwaysOnVPN{
+			User:        user.ID,
+			PackageName: app,
+			Lockdown:    strings.TrimSpace(lockdown) == "1",
+		}
+		if pkg, ok := packages[fmt.Sprintf("%d/%s", user.ID, app)]; ok {
+			alwaysOn.IsThirdParty = pkg.ThirdParty
+			alwaysOn.IsSideloaded = pkg.Sideloaded
+		}
+		if alwaysOn.IsSideloaded {
+			acq.AddWarning("Sideloaded app %s is set as always-on VPN for user %d (lockdown: %t)",
+				app, user.ID, alwaysOn.Lockdown)
+		} else if alwaysOn.IsThirdParty {
+			log.Warningf("Third-party app %s is set as always-on VPN for user %d (lockdown: %t)",
+				app, user.ID, alwaysOn.Lockdown)
+		}
+		result.AlwaysOn = append(result.AlwaysOn, alwaysOn)
+	}
+
+	for _, user := range users {
+		for _, packageName := range vpnConsents(user.ID) {
+			consent := VPNConsent{User: user.ID, PackageName: packageName}
+			if pkg, ok := packages[fmt.Sprintf("%d/%s", user.ID, packageName)]; ok {
+				consent.IsThirdParty = pkg.ThirdParty
+				consent.IsSideloaded = pkg.Sideloaded
+			}
+			if consent.IsSideloaded {
+				acq.AddWarning("Sideloaded app %s was allowed to establish a VPN for user %d", packageName, user.ID)
+			}
+			result.Consents = append(result.Consents, consent)
+		}
+	}
+
+	out, err = adb.Client.ShellTimeout(dumpsysServiceTimeout, "dumpsys", "package", "r")
+	if err != nil && out == "" {
+		log.Debugf("Failed to run `adb shell dumpsys package r`: %v", err)
+	}
+
+	for _, component := range parseVpnServices(out) {
+		app := VPNApp{
+			PackageName:   strings.SplitN(component, "/", 2)[0],
+			ComponentName: component,
+		}
+		if pkg, ok := packages[fmt.Sprintf("0/%s", app.PackageName)]; ok {
+			app.IsThirdParty = pkg.ThirdParty
+			app.IsSideloaded = pkg.Sideloaded
+		}
+		if app.IsSideloaded {
+			acq.AddWarning("Sideloaded app %s provides a VPN service: %s", app.PackageName, app.ComponentName)
+		} else if app.IsThirdParty {
+			log.Warningf("Third-party app %s provides a VPN service: %s", app.PackageName, app.ComponentName)
+		}
+		result.Apps = append(result.Apps, app)
+	}
+
+	for _, profile := range result.Profiles {
+		if profile.IsConnected {
+			log.Warningf("A VPN owned by %s is connected", profile.Name)
+		}
+	}
+
+	return saveCommandOutputJson(filepath.Join(v.StoragePath, "vpn.json"), &result)
+}
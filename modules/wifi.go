@@ -0,0 +1,310 @@
+// Copyright (c) 2021-2023 Claudio Guarnieri.
+// Use of this source code is governed by the MVT License 1.1
+// which can be found in the LICENSE file.
+
+package modules
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mvt-project/androidqf/acquisition"
+	"github.com/mvt-project/androidqf/adb"
+	"github.com/mvt-project/androidqf/log"
+)
+
+// Locations of the saved networks. Since Android 11 the file is in the WiFi
+// APEX data folder.
+var wifiConfigStorePaths = []string{
+	"/data/misc/apexdata/com.android.wifi/WifiConfigStore.xml",
+	"/data/misc/wifi/WifiConfigStore.xml",
+}
+
+const redacted = "[redacted]"
+
+// wifiDumpMaxSize caps the size of the saved `dumpsys wifi`, which can be
+// several MB because of the connection and scan history.
+const wifiDumpMaxSize = 5 * 1024 * 1024
+
+var (
+	dumpsysSSIDRegexp = regexp.MustCompile(`SSID: "([^"]*)"`)
+	// " ID: 0 SSID: "Home" PROVIDER-NAME: ..." starts a saved network.
+	dumpsysNetworkRegexp = regexp.MustCompile(`\bID: \d+ SSID: "([^"]*)"`)
+	// "macRandomizationSetting: 1"
+	macRandomizationRegexp = regexp.MustCompile(`(?i)macRandomizationSetting:? (\d)`)
+	// "0    "Home"    wpa2-psk" in `cmd wifi list-networks`.
+	listNetworksRegexp = regexp.MustCompile(`^\s*\d+\s+"?(.*?)"?\s+(\S+)\s*$`)
+	// "WifiInfo: SSID: "Home", BSSID: 00:11:22:33:44:55, MAC: ..."
+	wifiInfoRegexp = regexp.MustCompile(`SSID: "?([^",]*)"?, BSSID: ([^,]*), MAC: ([^,]*)`)
+)
+
+// macRandomizationSettings are the values of
+// WifiConfiguration.macRandomizationSetting.
+var macRandomizationSettings = map[string]string{
+	"0": "none",
+	"1": "persistent",
+	"2": "non_persistent",
+	"3": "auto",
+}
+
+type WiFiNetwork struct {
+	SSID             string `json:"ssid"`
+	BSSID            string `json:"bssid"`
+	Security         string `json:"security"`
+	MACRandomization string `json:"mac_randomization"`
+	LastConnectUID   int    `json:"last_connect_uid"`
+	PreSharedKey     string `json:"pre_shared_key,omitempty"`
+}
+
+type WiFiStatus struct {
+	Enabled   bool   `json:"enabled"`
+	Connected bool   `json:"connected"`
+	SSID      string `json:"ssid"`
+	BSSID     string `json:"bssid"`
+	MAC       string `json:"mac"`
+}
+
+type WiFiResult struct {
+	Networks []WiFiNetwork `json:"networks"`
+	Status   *WiFiStatus   `json:"status"`
+}
+
+type WiFiNetworks struct {
+	StoragePath string
+}
+
+func NewWiFiNetworks() *WiFiNetworks {
+	return &WiFiNetworks{}
+}
+
+func (w *WiFiNetworks) Name() string {
+	return "wifi_networks"
+}
+
+func (w *WiFiNetworks) InitStorage(storagePath string) error {
+	w.StoragePath = storagePath
+	return nil
+}
+
+// parseWifiConfigStore parses the networks saved in WifiConfigStore.xml,
+// where each network has a WifiConfiguration element with children such as
+// <string name="SSID">&quot;Home&quot;</string>.
+func parseWifiConfigStore(data string, includeCredentials bool) ([]WiFiNetwork, error) {
+	networks := []WiFiNetwork{}
+	decoder := xml.NewDecoder(strings.NewReader(data))
+
+	var network *WiFiNetwork
+	var name string
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return networks, err
+		}
+
+		switch element := token.(type) {
+		case xml.StartElement:
+			if element.Name.Local == "WifiConfiguration" {
+				network = &WiFiNetwork{LastConnectUID: -1}
+				continue
+			}
+			if network == nil {
+				continue
+			}
+
+			name = ""
+			for _, attr := range element.Attr {
+				if attr.Name.Local == "name" {
+					name = attr.Value
+				}
+			}
+			for _, attr := range element.Attr {
+				if attr.Name.Local != "value" {
+					continue
+				}
+				switch name {
+				case "LastConnectUid":
+					network.LastConnectUID, _ = strconv.Atoi(attr.Value)
+				case "MacRandomizationSetting":
+					network.MACRandomization = macRandomizationSettings[attr.Value]
+				}
+			}
+		case xml.CharData:
+			if network == nil || name == "" {
+				continue
+			}
+			value := strings.Trim(strings.TrimSpace(string(element)), `"`)
+			switch name {
+			case "SSID":
+				network.SSID = value
+			case "BSSID":
+				network.BSSID = value
+			case "ConfigKey":
+				// The key is the quoted SSID followed by the security type.
+				if index := strings.LastIndex(value, `"`); index != -1 {
+					network.Security = value[index+1:]
+				}
+			case "PreSharedKey":
+				network.PreSharedKey = value
+				if !includeCredentials && value != "" {
+					network.PreSharedKey = redacted
+				}
+			}
+		case xml.EndElement:
+			name = ""
+			if element.Name.Local == "WifiConfiguration" && network != nil {
+				networks = append(networks, *network)
+				network = nil
+			}
+		}
+	}
+
+	return networks, nil
+}
+
+// parseListNetworks parses the saved networks listed by `cmd wifi
+// list-networks`, available since Android 11.
+func parseListNetworks(out string) []WiFiNetwork {
+	networks := []WiFiNetwork{}
+	for _, line := range strings.Split(out, "\n") {
+		match := listNetworksRegexp.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		networks = append(networks, WiFiNetwork{
+			SSID:           match[1],
+			Security:       match[2],
+			LastConnectUID: -1,
+		})
+	}
+	return networks
+}
+
+// parseWifiStatus parses the output of `cmd wifi status`.
+func parseWifiStatus(out string) *WiFiStatus {
+	status := &WiFiStatus{
+		Enabled:   strings.Contains(out, "Wifi is enabled"),
+		Connected: strings.Contains(out, "Wifi is connected"),
+	}
+	if match := wifiInfoRegexp.FindStringSubmatch(out); match != nil {
+		status.SSID = match[1]
+		status.BSSID = strings.TrimSpace(match[2])
+		status.MAC = strings.TrimSpace(match[3])
+	}
+	return status
+}
+
+// parseMACRandomization returns the MAC randomization setting of the saved
+// networks printed by `dumpsys wifi`, keyed by SSID.
+func parseMACRandomization(out string) map[string]string {
+	settings := make(map[string]string)
+	ssid := ""
+	for _, line := range strings.Split(out, "\n") {
+		if match := dumpsysNetworkRegexp.FindStringSubmatch(line); match != nil {
+			ssid = match[1]
+		}
+		if match := macRandomizationRegexp.FindStringSubmatch(line); match != nil && ssid != "" {
+			if _, ok := settings[ssid]; !ok {
+				settings[ssid] = macRandomizationSettings[match[1]]
+			}
+		}
+	}
+	return settings
+}
+
+// saveCappedOutput saves at most maxSize bytes of the output, noting its
+// full size when it is truncated.
+func saveCappedOutput(filePath, output string, maxSize int) error {
+	if len(output) > maxSize {
+		output = fmt.Sprintf("%s\n[truncated, %d bytes in total]\n", output[:maxSize], len(output))
+	}
+	return saveCommandOutput(filePath, output)
+}
+
+// parseDumpsysWifi extracts the SSIDs mentioned by `dumpsys wifi`.
+func parseDumpsysWifi(out string) []WiFiNetwork {
+	networks := []WiFiNetwork{}
+	seen := make(map[string]bool)
+	for _, match := range dumpsysSSIDRegexp.FindAllStringSubmatch(out, -1) {
+		if match[1] == "" || seen[match[1]] {
+			continue
+		}
+		seen[match[1]] = true
+		networks = append(networks, WiFiNetwork{SSID: match[1], LastConnectUID: -1})
+	}
+	return networks
+}
+
+func (w *WiFiNetworks) Run(acq *acquisition.Acquisition, fast bool) error {
+	log.Info("Collecting saved WiFi networks...")
+
+	var result WiFiResult
+
+	// Only root can read the saved networks with their passphrases.
+	if adb.Client.HasRoot() {
+		for _, path := range wifiConfigStorePaths {
+			out, err := adb.Client.ShellAsRoot("cat", path)
+			if err != nil || !strings.Contains(out, "<WifiConfigStoreData>") {
+				log.Debugf("Unable to read %s: %v", path, err)
+				continue
+			}
+
+			networks, err := parseWifiConfigStore(out, acq.IncludeCredentials)
+			if err != nil {
+				log.Errorf("Failed to parse %s: %v", path, err)
+				continue
+			}
+			result.Networks = networks
+			break
+		}
+	}
+
+	if result.Networks == nil {
+		out, err := adb.Client.Shell("cmd", "wifi", "list-networks")
+		if err != nil {
+			log.Debugf("Failed to run `adb shell cmd wifi list-networks`: %v", err)
+		} else {
+			result.Networks = parseListNetworks(out)
+		}
+	}
+
+	out, err := adb.Client.ShellTimeout(dumpsysServiceTimeout, "dumpsys", "wifi")
+	if err != nil && out == "" {
+		log.Debugf("Failed to run `adb shell dumpsys wifi`: %v", err)
+	} else {
+		err = saveCappedOutput(filepath.Join(w.StoragePath, "wifi.txt"), out, wifiDumpMaxSize)
+		if err != nil {
+			log.Errorf("Impossible to save the WiFi dump: %v", err)
+		}
+	}
+	// Before Android 11, only the SSIDs can be listed without root.
+	if len(result.Networks) == 0 {
+		result.Networks = parseDumpsysWifi(out)
+	}
+	randomization := parseMACRandomization(out)
+	for i := range result.Networks {
+		if result.Networks[i].MACRandomization == "" {
+			result.Networks[i].MACRandomization = randomization[result.Networks[i].SSID]
+		}
+	}
+
+	status, err := adb.Client.Shell("cmd", "wifi", "status")
+	if err != nil {
+		log.Debugf("Failed to run `adb shell cmd wifi status`: %v", err)
+	} else {
+		result.Status = parseWifiStatus(status)
+		err = saveCommandOutput(filepath.Join(w.StoragePath, "wifi_status.txt"), status)
+		if err != nil {
+			log.Errorf("Impossible to save the WiFi status: %v", err)
+		}
+	}
+
+	return saveCommandOutputJson(filepath.Join(w.StoragePath, "wifi.json"), &result)
+}
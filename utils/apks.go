@@ -6,9 +6,24 @@
 package utils
 
 import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
 
 	"github.com/avast/apkverifier"
+	"github.com/mvt-project/androidqf/log"
 )
 
 func ValidCertificates() []string {
@@ -263,30 +278,285 @@ func ValidCertificates() []string {
 	return certs
 }
 
-func IsTrusted(cert apkverifier.CertInfo) bool {
+// userTrustedCertificates are the SHA-256 fingerprints of the certificates
+// trusted through LoadTrustedCertificates.
+var userTrustedCertificates = map[string]bool{}
+
+// normalizeFingerprint lowercases the fingerprint and removes separators.
+func normalizeFingerprint(fingerprint string) string {
+	fingerprint = strings.ToLower(strings.TrimSpace(fingerprint))
+	return strings.NewReplacer(":", "", " ", "").Replace(fingerprint)
+}
+
+// LoadTrustedCertificates adds the certificates found in the file to the
+// trusted ones. The file is either a JSON list of SHA-256 fingerprints, or
+// PEM encoded certificates. Invalid entries are skipped with a warning.
+func LoadTrustedCertificates(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read trusted certificates: %v", err)
+	}
+
+	count := 0
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "[") {
+		var fingerprints []string
+		err = json.Unmarshal(data, &fingerprints)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse trusted certificates: %v", err)
+		}
+		for _, fingerprint := range fingerprints {
+			fingerprint = normalizeFingerprint(fingerprint)
+			if _, err := hex.DecodeString(fingerprint); err != nil || len(fingerprint) != 64 {
+				log.Warningf("Skipping invalid SHA-256 fingerprint in %s: %s", path, fingerprint)
+				continue
+			}
+			userTrustedCertificates[fingerprint] = true
+			count++
+		}
+		return count, nil
+	}
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			log.Warningf("Skipping invalid certificate in %s: %v", path, err)
+			continue
+		}
+		fingerprint := sha256.Sum256(cert.Raw)
+		userTrustedCertificates[hex.EncodeToString(fingerprint[:])] = true
+		count++
+	}
+	if count == 0 {
+		return 0, fmt.Errorf("no certificate or fingerprint found in %s", path)
+	}
+
+	return count, nil
+}
+
+// TrustAnchor returns the fingerprint of the trusted certificate matching
+// cert, either built-in or loaded from a file, or an empty string.
+func TrustAnchor(cert apkverifier.CertInfo) string {
 	for _, c := range ValidCertificates() {
 		if c == cert.Sha1 {
-			return true
+			return c
 		}
 	}
-	return false
+	if userTrustedCertificates[cert.Sha256] {
+		return cert.Sha256
+	}
+	return ""
+}
+
+func IsTrusted(cert apkverifier.CertInfo) bool {
+	return TrustAnchor(cert) != ""
+}
+
+// Signature describes a signer of an APK.
+type Signature struct {
+	Scheme    string    `json:"scheme"`
+	SHA256    string    `json:"sha256"`
+	SHA1      string    `json:"sha1"`
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	ValidFrom time.Time `json:"valid_from"`
+	ValidTo   time.Time `json:"valid_to"`
+	// TestKey is set for the publicly known AOSP test keys.
+	TestKey bool `json:"test_key"`
+	// DebugKey is set for the debug key generated by the Android SDK.
+	DebugKey bool `json:"debug_key"`
+}
+
+// isTestKey checks whether the certificate is one of the AOSP test keys
+// (testkey, platform, shared, media...), which all share the same subject.
+func isTestKey(cert *apkverifier.CertInfo) bool {
+	return strings.Contains(cert.Subject, "android@android.com") &&
+		strings.Contains(cert.Subject, "O=Android") &&
+		strings.Contains(cert.Subject, "CN=Android")
+}
+
+// isDebugKey checks whether the certificate is a debug key generated by the
+// Android SDK.
+func isDebugKey(cert *apkverifier.CertInfo) bool {
+	return strings.Contains(cert.Subject, "CN=Android Debug")
+}
+
+// signingScheme returns the name of the signature scheme, as in v2 or v3.1.
+func signingScheme(id int) string {
+	if id == 31 {
+		return "v3.1"
+	}
+	return fmt.Sprintf("v%d", id)
 }
 
 // Extract certificate for an apk and return information about it
 func VerifyCertificate(path string) (bool, *apkverifier.CertInfo, error) {
-	res, err := apkverifier.ExtractCerts(path, nil)
+	verified, cert, _, err := VerifyAPK(path)
+	return verified, cert, err
+}
+
+// VerifyAPK verifies the signature of an apk, and returns its preferred
+// certificate along with the details of every signer.
+func VerifyAPK(path string) (bool, *apkverifier.CertInfo, []Signature, error) {
+	signatures := []Signature{}
+	chains, err := apkverifier.ExtractCerts(path, nil)
 	if err != nil {
-		return false, nil, err
+		return false, nil, signatures, err
 	}
 
-	cert, _ := apkverifier.PickBestApkCert(res)
+	cert, _ := apkverifier.PickBestApkCert(chains)
 	if cert == nil {
-		return false, nil, errors.New("no certificate found")
+		return false, nil, signatures, errors.New("no certificate found")
+	}
+
+	res, verifyErr := apkverifier.Verify(path, nil)
+	scheme := ""
+	if res.SigningSchemeId > 0 {
+		scheme = signingScheme(res.SigningSchemeId)
 	}
+	if len(res.SignerCerts) > 0 {
+		chains = res.SignerCerts
+	}
+	for _, chain := range chains {
+		if len(chain) == 0 {
+			continue
+		}
+		info := apkverifier.NewCertInfo(chain[0])
+		signatures = append(signatures, Signature{
+			Scheme:    scheme,
+			SHA256:    info.Sha256,
+			SHA1:      info.Sha1,
+			Subject:   info.Subject,
+			Issuer:    info.Issuer,
+			ValidFrom: info.ValidFrom.UTC(),
+			ValidTo:   info.ValidTo.UTC(),
+			TestKey:   isTestKey(info),
+			DebugKey:  isDebugKey(info),
+		})
+	}
+
+	if verifyErr != nil {
+		return false, cert, signatures, verifyErr
+	}
+	return true, cert, signatures, nil
+}
+
+// IDs of the signature schemes in the APK Signing Block.
+const (
+	signingBlockV2  = 0x7109871a
+	signingBlockV3  = 0xf05368c0
+	signingBlockV31 = 0x1b93ad61
+)
+
+// signingBlockMagic ends the APK Signing Block, which is stored right
+// before the central directory.
+var signingBlockMagic = []byte("APK Sig Block 42")
+
+// SignatureSchemes returns the versions of the signature schemes an APK is
+// signed with: 1 for JAR signing, 2, 3 and 31 for v3.1. The v4 signature
+// is stored in a separate .idsig file and isn't reported.
+func SignatureSchemes(apkPath string) ([]int, error) {
+	schemes := []int{}
 
-	_, err = apkverifier.Verify(path, nil)
+	reader, err := zip.OpenReader(apkPath)
 	if err != nil {
-		return false, cert, err
+		return schemes, err
+	}
+	for _, file := range reader.File {
+		dir, name := path.Split(file.Name)
+		if dir == "META-INF/" && strings.HasSuffix(strings.ToUpper(name), ".SF") {
+			schemes = append(schemes, 1)
+			break
+		}
+	}
+	reader.Close()
+
+	ids, err := signingBlockIDs(apkPath)
+	if err != nil {
+		return schemes, err
+	}
+	for _, id := range ids {
+		switch id {
+		case signingBlockV2:
+			schemes = append(schemes, 2)
+		case signingBlockV3:
+			schemes = append(schemes, 3)
+		case signingBlockV31:
+			schemes = append(schemes, 31)
+		}
+	}
+	return schemes, nil
+}
+
+// signingBlockIDs returns the IDs of the entries of the APK Signing Block,
+// or none if the APK doesn't have one.
+func signingBlockIDs(apkPath string) ([]uint32, error) {
+	file, err := os.Open(apkPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// The end of central directory record is at least 22 bytes long and
+	// followed by a comment of up to 65535 bytes.
+	tailSize := int64(22 + 65535)
+	if tailSize > info.Size() {
+		tailSize = info.Size()
+	}
+	tail := make([]byte, tailSize)
+	if _, err := file.ReadAt(tail, info.Size()-tailSize); err != nil {
+		return nil, err
+	}
+	eocd := bytes.LastIndex(tail, []byte{0x50, 0x4b, 0x05, 0x06})
+	if eocd == -1 || eocd+22 > len(tail) {
+		return nil, errors.New("end of central directory not found")
+	}
+	cdOffset := int64(binary.LittleEndian.Uint32(tail[eocd+16:]))
+
+	// The block ends with its size and the magic.
+	if cdOffset < 32 {
+		return nil, nil
+	}
+	footer := make([]byte, 24)
+	if _, err := file.ReadAt(footer, cdOffset-24); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(footer[8:], signingBlockMagic) {
+		return nil, nil
+	}
+	blockSize := int64(binary.LittleEndian.Uint64(footer))
+	start := cdOffset - blockSize - 8
+	if blockSize < 24 || start < 0 {
+		return nil, errors.New("invalid APK Signing Block size")
+	}
+
+	// The size is repeated at the start of the block, followed by
+	// length-prefixed ID-value pairs.
+	pairs := make([]byte, blockSize-24)
+	if _, err := file.ReadAt(pairs, start+8); err != nil && err != io.EOF {
+		return nil, err
+	}
+	ids := []uint32{}
+	for len(pairs) >= 12 {
+		length := binary.LittleEndian.Uint64(pairs)
+		if length < 4 || length > uint64(len(pairs)-8) {
+			return ids, errors.New("invalid APK Signing Block entry")
+		}
+		ids = append(ids, binary.LittleEndian.Uint32(pairs[8:]))
+		pairs = pairs[8+length:]
 	}
-	return true, cert, nil
+	return ids, nil
 }
@@ -0,0 +1,305 @@
+// androidqf - Android Quick Forensics
+// Copyright (c) 2021-2022 Claudio Guarnieri.
+// Use of this software is governed by the MVT License 1.1 that can be found at
+//   https://license.mvt.re/1.1/
+
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mvt-project/androidqf/log"
+	"gopkg.in/yaml.v3"
+)
+
+// Types of indicators matched during the acquisition.
+const (
+	IOCAppID  = "app_id"
+	IOCSHA256 = "sha256"
+	IOCDomain = "domain"
+	IOCIPv4   = "ipv4"
+	// IOCMACAddress matches a whole address, or the OUI prefix of the
+	// manufacturer (the first three bytes) with the LIKE operator.
+	IOCMACAddress = "mac_address"
+)
+
+// "[app:id = 'com.example']" or "[file:hashes.sha256 = '...']", as in the
+// STIX2 files used by MVT, or "[mac-addr:value LIKE '00:11:22:%']".
+var stixPatternRegexp = regexp.MustCompile(`^\[\s*([\w:.'-]+)\s*(=|(?i:LIKE))\s*'([^']*)'\s*\]$`)
+
+// ouiRegexp matches the OUI prefix of a MAC address.
+var ouiRegexp = regexp.MustCompile(`^([0-9a-f]{2}:){2}[0-9a-f]{2}$`)
+
+// IOC is an indicator of compromise loaded from a STIX2 file.
+type IOC struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+	// Name is the name of the malware the indicator is related to.
+	Name string `json:"name"`
+	File string `json:"file"`
+}
+
+type stixObject struct {
+	Type      string `json:"type"`
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Pattern   string `json:"pattern"`
+	SourceRef string `json:"source_ref"`
+	TargetRef string `json:"target_ref"`
+}
+
+type stixBundle struct {
+	Type    string       `json:"type"`
+	Objects []stixObject `json:"objects"`
+}
+
+// iocs are the indicators loaded with LoadIOCs, indexed by type and value.
+var iocs = map[string]IOC{}
+
+// iocIndex is an MVT YAML index of indicators, listing STIX2 files hosted
+// online.
+type iocIndex struct {
+	Indicators []struct {
+		Name     string `yaml:"name"`
+		Type     string `yaml:"type"`
+		Stix2URL string `yaml:"stix2_url"`
+		Github   struct {
+			Owner  string `yaml:"owner"`
+			Repo   string `yaml:"repo"`
+			Branch string `yaml:"branch"`
+			Path   string `yaml:"path"`
+		} `yaml:"github"`
+	} `yaml:"indicators"`
+}
+
+// iocDownloadTimeout is how long downloading a STIX2 file listed in an MVT
+// YAML index can take.
+const iocDownloadTimeout = 60 * time.Second
+
+// LoadIOCs adds the app id, SHA-256, domain, IPv4 and MAC address indicators
+// found in the STIX2 bundle, or in the STIX2 files listed by an MVT YAML
+// index, to the ones matched with MatchIOC.
+func LoadIOCs(path string) (int, error) {
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".yaml" || ext == ".yml" {
+		return loadIOCIndex(path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read indicators: %v", err)
+	}
+	return loadSTIX2(data, filepath.Base(path))
+}
+
+// loadIOCIndex loads the STIX2 files listed in an MVT YAML index. Copies of
+// the files in the folder of the index are used when present, so that
+// indicators can be checked offline, otherwise they are downloaded. Files
+// which can't be loaded are skipped, unless none could be.
+func loadIOCIndex(indexPath string) (int, error) {
+	data, err := os.ReadFile(indexPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read indicators: %v", err)
+	}
+	var index iocIndex
+	if err := yaml.Unmarshal(data, &index); err != nil {
+		return 0, fmt.Errorf("failed to parse the indicators index: %v", err)
+	}
+
+	count := 0
+	loaded := 0
+	var errs []error
+	client := &http.Client{Timeout: iocDownloadTimeout}
+	for _, entry := range index.Indicators {
+		stixURL := entry.Stix2URL
+		if stixURL == "" && entry.Type == "github" {
+			stixURL = fmt.Sprintf("https://raw.githubusercontent.com/%s/%s/%s/%s",
+				entry.Github.Owner, entry.Github.Repo, entry.Github.Branch, entry.Github.Path)
+		}
+		if stixURL == "" {
+			errs = append(errs, fmt.Errorf("no STIX2 file listed for %q", entry.Name))
+			continue
+		}
+
+		fileName := path.Base(stixURL)
+		stixData, err := os.ReadFile(filepath.Join(filepath.Dir(indexPath), fileName))
+		if err != nil {
+			stixData, err = downloadIOCs(client, stixURL)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to get %s: %v", stixURL, err))
+			continue
+		}
+		n, err := loadSTIX2(stixData, fileName)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", stixURL, err))
+			continue
+		}
+		count += n
+		loaded++
+	}
+
+	if loaded == 0 && len(errs) > 0 {
+		return 0, errors.Join(errs...)
+	}
+	for _, err := range errs {
+		log.Warningf("Skipped indicators: %v", err)
+	}
+	return count, nil
+}
+
+// downloadIOCs downloads a STIX2 file.
+func downloadIOCs(client *http.Client, stixURL string) ([]byte, error) {
+	resp, err := client.Get(stixURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// loadSTIX2 adds the indicators of a STIX2 bundle, read from the file named
+// fileName.
+func loadSTIX2(data []byte, fileName string) (int, error) {
+	var bundle stixBundle
+	err := json.Unmarshal(data, &bundle)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse indicators: %v", err)
+	}
+	if bundle.Type != "bundle" {
+		return 0, fmt.Errorf("failed to parse indicators: not a STIX2 bundle")
+	}
+
+	// Indicators are related to the malware through relationship objects.
+	names := make(map[string]string)
+	for _, object := range bundle.Objects {
+		if object.Type == "malware" {
+			names[object.ID] = object.Name
+		}
+	}
+	related := make(map[string]string)
+	for _, object := range bundle.Objects {
+		if object.Type == "relationship" {
+			related[object.SourceRef] = names[object.TargetRef]
+		}
+	}
+
+	count := 0
+	for _, object := range bundle.Objects {
+		if object.Type != "indicator" {
+			continue
+		}
+
+		match := stixPatternRegexp.FindStringSubmatch(strings.TrimSpace(object.Pattern))
+		if match == nil {
+			continue
+		}
+
+		ioc := IOC{
+			Name: related[object.ID],
+			File: fileName,
+		}
+		value := match[3]
+		// Only prefixes of MAC addresses are matched with LIKE.
+		if match[2] != "=" {
+			value = strings.TrimSuffix(strings.ToLower(value), ":%")
+			if strings.ToLower(match[1]) != "mac-addr:value" || !ouiRegexp.MatchString(value) {
+				continue
+			}
+		}
+		switch strings.ToLower(match[1]) {
+		case "app:id":
+			ioc.Type = IOCAppID
+			ioc.Value = value
+		case "file:hashes.sha256", "file:hashes.'sha-256'":
+			ioc.Type = IOCSHA256
+			ioc.Value = strings.ToLower(value)
+		case "domain-name:value":
+			ioc.Type = IOCDomain
+			ioc.Value = strings.ToLower(value)
+		case "url:value":
+			// URLs are matched on their domain.
+			ioc.Type = IOCDomain
+			ioc.Value = URLDomain(value)
+			if ioc.Value == "" {
+				continue
+			}
+		case "ipv4-addr:value":
+			ioc.Type = IOCIPv4
+			ioc.Value = value
+		case "mac-addr:value":
+			ioc.Type = IOCMACAddress
+			ioc.Value = strings.ToLower(value)
+		default:
+			continue
+		}
+
+		iocs[ioc.Type+":"+ioc.Value] = ioc
+		count++
+	}
+
+	return count, nil
+}
+
+// URLDomain returns the lowercase domain of the URL, or an empty string if
+// it has none.
+func URLDomain(rawURL string) string {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL
+	}
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(parsed.Hostname())
+}
+
+// HasIOCs checks whether any indicator was loaded.
+func HasIOCs() bool {
+	return len(iocs) > 0
+}
+
+// MatchIOC returns the indicator of the given type matching the value, if
+// any. Domains also match their subdomains, and MAC addresses the prefix of
+// their manufacturer.
+func MatchIOC(iocType, value string) (IOC, bool) {
+	switch iocType {
+	case IOCMACAddress:
+		value = strings.ToLower(value)
+		if ioc, ok := iocs[iocType+":"+value]; ok {
+			return ioc, true
+		}
+		if len(value) > 8 {
+			value = value[:8]
+		}
+	case IOCSHA256:
+		value = strings.ToLower(value)
+	case IOCDomain:
+		value = strings.ToLower(value)
+		for {
+			if ioc, ok := iocs[iocType+":"+value]; ok {
+				return ioc, true
+			}
+			_, parent, found := strings.Cut(value, ".")
+			if !found || !strings.Contains(parent, ".") {
+				return IOC{}, false
+			}
+			value = parent
+		}
+	}
+	ioc, ok := iocs[iocType+":"+value]
+	return ioc, ok
+}
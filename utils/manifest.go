@@ -0,0 +1,146 @@
+// androidqf - Android Quick Forensics
+// Copyright (c) 2022 Claudio Guarnieri.
+// Use of this software is governed by the MVT License 1.1 that can be found at
+//   https://license.mvt.re/1.1/
+
+package utils
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strconv"
+	"strings"
+
+	"github.com/avast/apkparser"
+)
+
+// ManifestComponent is an activity, service, receiver or provider which can
+// be started by other apps.
+type ManifestComponent struct {
+	Type       string `json:"type"`
+	Name       string `json:"name"`
+	Permission string `json:"permission,omitempty"`
+}
+
+// Manifest holds the main fields of an AndroidManifest.xml.
+type Manifest struct {
+	PackageName        string              `json:"package_name"`
+	VersionCode        string              `json:"version_code"`
+	VersionName        string              `json:"version_name"`
+	MinSDKVersion      int                 `json:"min_sdk_version"`
+	TargetSDKVersion   int                 `json:"target_sdk_version"`
+	UsesPermissions    []string            `json:"uses_permissions"`
+	ExportedComponents []ManifestComponent `json:"exported_components"`
+}
+
+// manifestComponents are the elements of the manifest declaring components.
+var manifestComponents = map[string]bool{
+	"activity":       true,
+	"activity-alias": true,
+	"service":        true,
+	"receiver":       true,
+	"provider":       true,
+}
+
+// componentName returns the fully qualified name of a component, which can
+// be relative to the package.
+func componentName(packageName, name string) string {
+	if strings.HasPrefix(name, ".") {
+		return packageName + name
+	}
+	if !strings.Contains(name, ".") && name != "" {
+		return packageName + "." + name
+	}
+	return name
+}
+
+// DecodeManifest decodes the binary AndroidManifest.xml of an APK, and
+// returns it as indented XML along with its main fields. Components without
+// the exported attribute are exported when they have an intent filter, and
+// providers when targeting Android 4.1 or lower.
+func DecodeManifest(apkPath string) ([]byte, Manifest, error) {
+	manifest := Manifest{
+		UsesPermissions:    []string{},
+		ExportedComponents: []ManifestComponent{},
+	}
+
+	recorder := &tokenRecorder{}
+	zipErr, _, manifestErr := apkparser.ParseApk(apkPath, recorder)
+	if zipErr != nil {
+		return nil, manifest, zipErr
+	}
+	if manifestErr != nil {
+		return nil, manifest, manifestErr
+	}
+
+	var buf bytes.Buffer
+	encoder := xml.NewEncoder(&buf)
+	encoder.Indent("", "    ")
+	for _, token := range recorder.tokens {
+		if err := encoder.EncodeToken(token); err != nil {
+			return nil, manifest, err
+		}
+	}
+	if err := encoder.Flush(); err != nil {
+		return nil, manifest, err
+	}
+
+	type pendingComponent struct {
+		component    ManifestComponent
+		exported     string
+		intentFilter bool
+	}
+	// Components don't nest, current is the index of the one being parsed.
+	current := -1
+	pending := []pendingComponent{}
+	for _, token := range recorder.tokens {
+		switch element := token.(type) {
+		case xml.StartElement:
+			switch name := element.Name.Local; {
+			case name == "manifest":
+				manifest.PackageName = xmlAttr(element, "package")
+				manifest.VersionCode = xmlAttr(element, "versionCode")
+				manifest.VersionName = xmlAttr(element, "versionName")
+			case name == "uses-sdk":
+				manifest.MinSDKVersion, _ = strconv.Atoi(xmlAttr(element, "minSdkVersion"))
+				manifest.TargetSDKVersion, _ = strconv.Atoi(xmlAttr(element, "targetSdkVersion"))
+			case name == "uses-permission" || name == "uses-permission-sdk-23":
+				if permission := xmlAttr(element, "name"); permission != "" {
+					manifest.UsesPermissions = append(manifest.UsesPermissions, permission)
+				}
+			case manifestComponents[name]:
+				pending = append(pending, pendingComponent{
+					component: ManifestComponent{
+						Type:       name,
+						Name:       xmlAttr(element, "name"),
+						Permission: xmlAttr(element, "permission"),
+					},
+					exported: xmlAttr(element, "exported"),
+				})
+				current = len(pending) - 1
+			case name == "intent-filter" && current != -1:
+				pending[current].intentFilter = true
+			}
+		case xml.EndElement:
+			if manifestComponents[element.Name.Local] {
+				current = -1
+			}
+		}
+	}
+
+	if manifest.TargetSDKVersion == 0 {
+		manifest.TargetSDKVersion = manifest.MinSDKVersion
+	}
+	for _, p := range pending {
+		exported := p.exported == "true"
+		if p.exported == "" {
+			exported = p.intentFilter || (p.component.Type == "provider" && manifest.TargetSDKVersion <= 16)
+		}
+		if exported {
+			p.component.Name = componentName(manifest.PackageName, p.component.Name)
+			manifest.ExportedComponents = append(manifest.ExportedComponents, p.component)
+		}
+	}
+
+	return buf.Bytes(), manifest, nil
+}
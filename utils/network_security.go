@@ -0,0 +1,173 @@
+// androidqf - Android Quick Forensics
+// Copyright (c) 2022 Claudio Guarnieri.
+// Use of this software is governed by the MVT License 1.1 that can be found at
+//   https://license.mvt.re/1.1/
+
+package utils
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/avast/apkparser"
+)
+
+// NetworkSecurityConfig summarizes the Network Security Config of an APK,
+// or the platform defaults when the APK doesn't declare one.
+type NetworkSecurityConfig struct {
+	// ConfigPath is the path of the config in the APK, as in
+	// res/xml/network_security_config.xml.
+	ConfigPath      string `json:"config_path"`
+	AllowsCleartext bool   `json:"allows_cleartext"`
+	// PinsDisabled is set when the default trust anchors override the
+	// certificate pins of every domain.
+	PinsDisabled   bool `json:"pins_disabled"`
+	TrustUserCAs   bool `json:"trust_user_cas"`
+	TrustSystemCAs bool `json:"trust_system_cas"`
+}
+
+// tokenRecorder is an apkparser.ManifestEncoder keeping the decoded tokens.
+type tokenRecorder struct {
+	tokens []xml.Token
+}
+
+func (r *tokenRecorder) EncodeToken(t xml.Token) error {
+	r.tokens = append(r.tokens, xml.CopyToken(t))
+	return nil
+}
+
+func (r *tokenRecorder) Flush() error {
+	return nil
+}
+
+// xmlAttr returns the value of the attribute of the element, ignoring its
+// namespace.
+func xmlAttr(element xml.StartElement, name string) string {
+	for _, attr := range element.Attr {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// ParseNetworkSecurityConfig decodes the manifest of an APK and the Network
+// Security Config it references. Without a config, the defaults of the
+// target SDK are returned: cleartext was allowed until Android 9, and user
+// CAs were trusted until Android 7.
+func ParseNetworkSecurityConfig(apkPath string) (NetworkSecurityConfig, error) {
+	config := NetworkSecurityConfig{}
+
+	zip, err := apkparser.OpenZip(apkPath)
+	if err != nil {
+		return config, err
+	}
+	defer zip.Close()
+
+	recorder := &tokenRecorder{}
+	parser, resourcesErr := apkparser.NewParser(zip, recorder)
+	if err := parser.ParseXml("AndroidManifest.xml"); err != nil {
+		return config, err
+	}
+
+	targetSDK := 1
+	usesCleartext := ""
+	for _, token := range recorder.tokens {
+		element, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch element.Name.Local {
+		case "uses-sdk":
+			if sdk, err := strconv.Atoi(xmlAttr(element, "targetSdkVersion")); err == nil {
+				targetSDK = sdk
+			} else if sdk, err := strconv.Atoi(xmlAttr(element, "minSdkVersion")); err == nil {
+				targetSDK = sdk
+			}
+		case "application":
+			usesCleartext = xmlAttr(element, "usesCleartextTraffic")
+			config.ConfigPath = xmlAttr(element, "networkSecurityConfig")
+		}
+	}
+
+	config.AllowsCleartext = targetSDK < 28
+	if usesCleartext != "" {
+		config.AllowsCleartext = usesCleartext == "true"
+	}
+	config.TrustSystemCAs = true
+	config.TrustUserCAs = targetSDK < 24
+	if config.ConfigPath == "" {
+		return config, nil
+	}
+	if strings.HasPrefix(config.ConfigPath, "@") {
+		return config, fmt.Errorf("failed to resolve the Network Security Config %s: %v",
+			config.ConfigPath, resourcesErr)
+	}
+
+	recorder.tokens = nil
+	if err := parser.ParseXml(config.ConfigPath); err != nil {
+		return config, err
+	}
+
+	// The config takes precedence over usesCleartextTraffic, and only the
+	// base-config sets the defaults for all domains. Domain configs can be
+	// nested, the debug overrides only apply to debuggable builds.
+	config.AllowsCleartext = targetSDK < 28
+	sections := []string{}
+	baseAnchors := false
+	for _, token := range recorder.tokens {
+		switch element := token.(type) {
+		case xml.StartElement:
+			name := element.Name.Local
+			section := ""
+			if len(sections) > 0 {
+				section = sections[len(sections)-1]
+			}
+			switch name {
+			case "base-config", "domain-config", "debug-overrides":
+				if section != "debug-overrides" {
+					section = name
+				}
+				value := xmlAttr(element, "cleartextTrafficPermitted")
+				if section == "base-config" && value != "" {
+					config.AllowsCleartext = value == "true"
+				} else if section == "domain-config" && value == "true" {
+					config.AllowsCleartext = true
+				}
+			case "trust-anchors":
+				if section == "base-config" && !baseAnchors {
+					baseAnchors = true
+					config.TrustSystemCAs = false
+					config.TrustUserCAs = false
+				}
+			case "certificates":
+				src := xmlAttr(element, "src")
+				switch section {
+				case "base-config":
+					if src == "system" {
+						config.TrustSystemCAs = true
+					}
+					if src == "user" {
+						config.TrustUserCAs = true
+					}
+					if xmlAttr(element, "overridePins") == "true" {
+						config.PinsDisabled = true
+					}
+				case "domain-config":
+					if src == "user" {
+						config.TrustUserCAs = true
+					}
+				}
+			}
+			sections = append(sections, section)
+		case xml.EndElement:
+			if len(sections) > 0 {
+				sections = sections[:len(sections)-1]
+			}
+		}
+	}
+
+	return config, nil
+}
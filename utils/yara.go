@@ -0,0 +1,142 @@
+// androidqf - Android Quick Forensics
+// Copyright (c) 2021-2022 Claudio Guarnieri.
+// Use of this software is governed by the MVT License 1.1 that can be found at
+//   https://license.mvt.re/1.1/
+
+//go:build yara
+
+package utils
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hillu/go-yara/v4"
+)
+
+const yaraTimeout = 60 * time.Second
+
+// yaraRules are the rules compiled with LoadYaraRules.
+var yaraRules *yara.Rules
+
+// YaraEnabled checks whether rules were loaded to scan the APKs with.
+func YaraEnabled() bool {
+	return yaraRules != nil
+}
+
+// LoadYaraRules compiles all the .yar and .yara files in the folder.
+func LoadYaraRules(dir string) (int, error) {
+	compiler, err := yara.NewCompiler()
+	if err != nil {
+		return 0, fmt.Errorf("failed to initialize YARA compiler: %v", err)
+	}
+	defer compiler.Destroy()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read YARA rules folder: %v", err)
+	}
+
+	count := 0
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if entry.IsDir() || (ext != ".yar" && ext != ".yara") {
+			continue
+		}
+
+		rulesPath := filepath.Join(dir, entry.Name())
+		file, err := os.Open(rulesPath)
+		if err != nil {
+			return 0, fmt.Errorf("failed to open YARA rules %s: %v", rulesPath, err)
+		}
+		err = compiler.AddFile(file, entry.Name())
+		file.Close()
+		if err != nil {
+			messages := []string{}
+			for _, compileErr := range compiler.Errors {
+				messages = append(messages, fmt.Sprintf("%s:%d: %s", compileErr.Filename, compileErr.Line, compileErr.Text))
+			}
+			return 0, fmt.Errorf("failed to compile YARA rules: %s", strings.Join(messages, "; "))
+		}
+		count++
+	}
+	if count == 0 {
+		return 0, fmt.Errorf("no .yar or .yara file found in %s", dir)
+	}
+
+	yaraRules, err = compiler.GetRules()
+	if err != nil {
+		return 0, fmt.Errorf("failed to compile YARA rules: %v", err)
+	}
+
+	return count, nil
+}
+
+// YaraScan scans the APK and the DEX files it contains, and returns the
+// names of the matching rules.
+func YaraScan(path string) ([]string, error) {
+	if yaraRules == nil {
+		return nil, nil
+	}
+
+	names := []string{}
+	addMatches := func(matches yara.MatchRules) {
+		for _, match := range matches {
+			name := match.Namespace + ":" + match.Rule
+			found := false
+			for _, existing := range names {
+				if existing == name {
+					found = true
+					break
+				}
+			}
+			if !found {
+				names = append(names, name)
+			}
+		}
+	}
+
+	var matches yara.MatchRules
+	err := yaraRules.ScanFile(path, 0, yaraTimeout, &matches)
+	if err != nil {
+		return names, fmt.Errorf("failed to scan %s: %v", path, err)
+	}
+	addMatches(matches)
+
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		// Not an APK, only the raw file is scanned.
+		return names, nil
+	}
+	defer archive.Close()
+
+	for _, file := range archive.File {
+		if !strings.HasSuffix(file.Name, ".dex") {
+			continue
+		}
+
+		reader, err := file.Open()
+		if err != nil {
+			return names, fmt.Errorf("failed to extract %s from %s: %v", file.Name, path, err)
+		}
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return names, fmt.Errorf("failed to extract %s from %s: %v", file.Name, path, err)
+		}
+
+		var dexMatches yara.MatchRules
+		err = yaraRules.ScanMem(data, 0, yaraTimeout, &dexMatches)
+		if err != nil {
+			return names, fmt.Errorf("failed to scan %s of %s: %v", file.Name, path, err)
+		}
+		addMatches(dexMatches)
+	}
+
+	return names, nil
+}
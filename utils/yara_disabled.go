@@ -0,0 +1,26 @@
+// androidqf - Android Quick Forensics
+// Copyright (c) 2021-2022 Claudio Guarnieri.
+// Use of this software is governed by the MVT License 1.1 that can be found at
+//   https://license.mvt.re/1.1/
+
+//go:build !yara
+
+package utils
+
+import "fmt"
+
+// YaraEnabled checks whether rules were loaded to scan the APKs with. YARA
+// support requires building with `-tags yara`, as it depends on cgo.
+func YaraEnabled() bool {
+	return false
+}
+
+// LoadYaraRules fails, as androidqf was built without YARA support.
+func LoadYaraRules(dir string) (int, error) {
+	return 0, fmt.Errorf("androidqf was built without YARA support, rebuild it with `-tags yara`")
+}
+
+// YaraScan does nothing, as androidqf was built without YARA support.
+func YaraScan(path string) ([]string, error) {
+	return nil, nil
+}